@@ -15,6 +15,7 @@ type Activity struct {
 	ResourceID  string                 `json:"resource_id"`
 	Details     map[string]interface{} `json:"details"`
 	IPAddress   string                 `json:"ip_address"`
+	RequestID   string                 `json:"request_id,omitempty"`
 	Timestamp   time.Time              `json:"timestamp"`
 	Status      string                 `json:"status"`
 }
@@ -26,7 +27,7 @@ var (
 )
 
 // logActivity logs a user activity
-func logActivity(userID, userEmail, action, resource, resourceID, ipAddress, status string, details map[string]interface{}) {
+func logActivity(userID, userEmail, action, resource, resourceID, ipAddress, requestID, status string, details map[string]interface{}) {
 	activityMux.Lock()
 	defer activityMux.Unlock()
 
@@ -42,6 +43,7 @@ func logActivity(userID, userEmail, action, resource, resourceID, ipAddress, sta
 		ResourceID: resourceID,
 		Details:    details,
 		IPAddress:  ipAddress,
+		RequestID:  requestID,
 		Timestamp:  time.Now(),
 		Status:     status,
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
@@ -39,6 +40,10 @@ func getAlertAnalytics(c *gin.Context) {
 
 // getThreatAnalytics returns threat analytics
 func getThreatAnalytics(c *gin.Context) {
+	country := c.Query("country")
+	asn := c.Query("asn")
+	ipClass := c.Query("ip_class")
+
 	dataMux.RLock()
 	defer dataMux.RUnlock()
 
@@ -50,24 +55,53 @@ func getThreatAnalytics(c *gin.Context) {
 	statusCounts := make(map[string]int)
 	// Top source IPs
 	sourceIPCounts := make(map[string]int)
+	// Count by source country, ASN and address class
+	countryCounts := make(map[string]int)
+	asnCounts := make(map[string]int)
+	ipClassCounts := make(map[string]int)
 	// Total detections
 	totalDetections := 0
+	total := 0
 
 	for _, threat := range threats {
+		enrichment := threat.Enrichment["source_ip"]
+		if !matchesEnrichmentFilter(enrichment, country, asn, ipClass) {
+			continue
+		}
+
+		total++
 		typeCounts[threat.Type]++
 		severityCounts[threat.Severity]++
 		statusCounts[threat.Status]++
 		sourceIPCounts[threat.SourceIP]++
 		totalDetections += threat.Detections
+
+		if enrichment != nil {
+			ipClassCounts[enrichment.Class]++
+			if enrichment.CountryCode != "" {
+				countryCounts[enrichment.CountryCode]++
+			}
+			if enrichment.ASN != 0 {
+				asnCounts[fmt.Sprintf("AS%d %s", enrichment.ASN, enrichment.Organization)]++
+			}
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"total":            len(threats),
+		"total":            total,
 		"total_detections": totalDetections,
 		"by_type":          typeCounts,
 		"by_severity":      severityCounts,
 		"by_status":        statusCounts,
 		"top_source_ips":   sourceIPCounts,
+		"by_country":       countryCounts,
+		"by_asn":           asnCounts,
+		"by_ip_class":      ipClassCounts,
+		"filters": gin.H{
+			"country":  country,
+			"asn":      asn,
+			"ip_class": ipClass,
+		},
 	})
 }
 
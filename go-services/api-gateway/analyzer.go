@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AnalyzerPacket mirrors the threat-detector NetworkPacket model
+type AnalyzerPacket struct {
+	SourceIP        string   `json:"source_ip"`
+	DestinationIP   string   `json:"destination_ip"`
+	SourcePort      int      `json:"source_port"`
+	DestinationPort int      `json:"destination_port"`
+	Protocol        string   `json:"protocol"`
+	PacketSize      int      `json:"packet_size"`
+	Timestamp       float64  `json:"timestamp"`
+	Flags           []string `json:"flags,omitempty"`
+}
+
+// AnalyzerLogEntry mirrors the threat-detector LogEntry model
+type AnalyzerLogEntry struct {
+	Timestamp float64                `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Source    string                 `json:"source"`
+	Message   string                 `json:"message"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// AnalysisRequest is the payload submitted to an analyzer backend
+type AnalysisRequest struct {
+	Type    string             `json:"type"`
+	Packets []AnalyzerPacket   `json:"packets,omitempty"`
+	Logs    []AnalyzerLogEntry `json:"logs,omitempty"`
+}
+
+// AnalysisVerdict is the analyzer's conclusion about a payload
+type AnalysisVerdict struct {
+	ThreatDetected  bool                   `json:"threat_detected"`
+	ThreatType      string                 `json:"threat_type,omitempty"`
+	Confidence      float64                `json:"confidence"`
+	Severity        string                 `json:"severity"`
+	Details         map[string]interface{} `json:"details,omitempty"`
+	Recommendations []string               `json:"recommendations,omitempty"`
+}
+
+// AnalysisJob tracks an asynchronous analysis
+type AnalysisJob struct {
+	ID          string           `json:"id"`
+	Status      string           `json:"status"`
+	Backend     string           `json:"backend"`
+	ThreatID    string           `json:"threat_id"`
+	Attempts    int              `json:"attempts"`
+	RequestID   string           `json:"request_id,omitempty"`
+	Verdict     *AnalysisVerdict `json:"verdict,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	CompletedAt *time.Time       `json:"completed_at,omitempty"`
+
+	request AnalysisRequest
+	origin  trace.SpanContext
+}
+
+// ThreatAnalyzer is a backend that turns a payload into a verdict
+type ThreatAnalyzer interface {
+	Name() string
+	Analyze(ctx context.Context, req AnalysisRequest) (*AnalysisVerdict, error)
+}
+
+// permanentError marks analyzer failures that retrying will not fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// httpAnalyzer forwards analyses to the Python threat-detector service
+type httpAnalyzer struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (a *httpAnalyzer) Name() string { return "http" }
+
+func (a *httpAnalyzer) Analyze(ctx context.Context, req AnalysisRequest) (*AnalysisVerdict, error) {
+	if len(req.Logs) > 0 {
+		var result struct {
+			TotalLogs         int   `json:"total_logs"`
+			AnomaliesDetected int   `json:"anomalies_detected"`
+			AnomalyIndices    []int `json:"anomaly_indices"`
+		}
+		if err := a.post(ctx, "/api/v1/analyze/logs", req.Logs, &result); err != nil {
+			return nil, err
+		}
+
+		verdict := &AnalysisVerdict{
+			ThreatDetected: result.AnomaliesDetected > 0,
+			Severity:       "none",
+			Details: map[string]interface{}{
+				"total_logs":      result.TotalLogs,
+				"anomalies":       result.AnomaliesDetected,
+				"anomaly_indices": result.AnomalyIndices,
+			},
+		}
+		if result.TotalLogs > 0 {
+			verdict.Confidence = float64(result.AnomaliesDetected) / float64(result.TotalLogs)
+		}
+		if verdict.ThreatDetected {
+			verdict.ThreatType = "Log Anomaly"
+			verdict.Severity = severityForConfidence(verdict.Confidence)
+		}
+		return verdict, nil
+	}
+
+	var verdict AnalysisVerdict
+	body := map[string]interface{}{"packets": req.Packets, "analysis_type": "realtime"}
+	if err := a.post(ctx, "/api/v1/analyze/packet", body, &verdict); err != nil {
+		return nil, err
+	}
+	return &verdict, nil
+}
+
+func (a *httpAnalyzer) post(ctx context.Context, path string, body, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(a.baseURL, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if requestID := requestIDFrom(ctx); requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("analyzer returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("invalid analyzer response: %w", err)
+	}
+	return nil
+}
+
+// Ping checks the analyzer's health endpoint. It bypasses the traced client
+// so health probes do not fill traces.
+func (a *httpAnalyzer) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(a.baseURL, "/")+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("analyzer health returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// fakeAnalyzer returns a canned verdict. It backs ANALYZER_BACKEND=fake for
+// local development and tests; Err and Delay simulate a failing or slow backend.
+type fakeAnalyzer struct {
+	Verdict AnalysisVerdict
+	Err     error
+	Delay   time.Duration
+	calls   atomic.Int64
+}
+
+func (a *fakeAnalyzer) Name() string { return "fake" }
+
+// Calls returns how many analyses the fake has received
+func (a *fakeAnalyzer) Calls() int64 { return a.calls.Load() }
+
+func (a *fakeAnalyzer) Analyze(ctx context.Context, req AnalysisRequest) (*AnalysisVerdict, error) {
+	a.calls.Add(1)
+
+	if a.Delay > 0 {
+		select {
+		case <-time.After(a.Delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if a.Err != nil {
+		return nil, a.Err
+	}
+
+	verdict := a.Verdict
+	if verdict.Details == nil {
+		verdict.Details = map[string]interface{}{
+			"analyzed_packets": len(req.Packets),
+			"analyzed_logs":    len(req.Logs),
+		}
+	}
+	return &verdict, nil
+}
+
+// severityForConfidence maps an analyzer confidence score to a severity with
+// the cutoffs of determine_severity in python-ml/threat-detector, so log
+// verdicts are graded like the detector grades packet verdicts
+func severityForConfidence(confidence float64) string {
+	switch {
+	case confidence >= 0.9:
+		return "critical"
+	case confidence >= 0.7:
+		return "high"
+	case confidence >= 0.5:
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+// AnalysisService runs analysis jobs against a backend with retries
+type AnalysisService struct {
+	backend    ThreatAnalyzer
+	jobs       map[string]*AnalysisJob
+	queue      chan *AnalysisJob
+	mu         sync.RWMutex
+	nextID     atomic.Int64
+	maxRetries int
+	backoff    time.Duration
+	timeout    time.Duration
+}
+
+var analysisService *AnalysisService
+
+// newAnalysisService creates a service and starts its workers
+func newAnalysisService(backend ThreatAnalyzer, workers, maxRetries int, backoff, timeout time.Duration) *AnalysisService {
+	s := &AnalysisService{
+		backend:    backend,
+		jobs:       make(map[string]*AnalysisJob),
+		queue:      make(chan *AnalysisJob, 1000),
+		maxRetries: maxRetries,
+		backoff:    backoff,
+		timeout:    timeout,
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range s.queue {
+				s.run(job)
+			}
+		}()
+	}
+
+	return s
+}
+
+// Submit queues a job for the given threat and returns a snapshot of it; the
+// job itself belongs to the workers from here on. The request ID and trace
+// of ctx are carried to the backend so its work can be matched to the
+// submitting request.
+func (s *AnalysisService) Submit(ctx context.Context, threatID string, req AnalysisRequest) (AnalysisJob, error) {
+	now := time.Now()
+	job := &AnalysisJob{
+		ID:        fmt.Sprintf("job_%d", s.nextID.Add(1)),
+		Status:    "queued",
+		Backend:   s.backend.Name(),
+		ThreatID:  threatID,
+		RequestID: requestIDFrom(ctx),
+		CreatedAt: now,
+		UpdatedAt: now,
+		request:   req,
+		origin:    trace.SpanContextFromContext(ctx),
+	}
+
+	s.mu.Lock()
+	s.jobs[job.ID] = job
+	snapshot := *job
+	s.mu.Unlock()
+
+	select {
+	case s.queue <- job:
+		return snapshot, nil
+	default:
+		// The caller gets no job ID, so there is nothing to keep
+		s.mu.Lock()
+		delete(s.jobs, job.ID)
+		s.mu.Unlock()
+		return AnalysisJob{}, errors.New("analysis queue is full")
+	}
+}
+
+// Get returns a snapshot of a job
+func (s *AnalysisService) Get(id string) (AnalysisJob, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, exists := s.jobs[id]
+	if !exists {
+		return AnalysisJob{}, false
+	}
+	return *job, true
+}
+
+// run executes a job, retrying transient failures with exponential backoff
+func (s *AnalysisService) run(job *AnalysisJob) {
+	delay := s.backoff
+
+	jobCtx, span := startLinkedSpan(withRequestID(context.Background(), job.RequestID), "threat.analyze", job.origin,
+		attribute.String("analysis.job_id", job.ID),
+		attribute.String("analysis.backend", s.backend.Name()),
+		attribute.String("threat.id", job.ThreatID),
+	)
+	defer span.End()
+
+	for attempt := 1; ; attempt++ {
+		s.mu.Lock()
+		job.Status = "running"
+		job.Attempts = attempt
+		job.UpdatedAt = time.Now()
+		s.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(jobCtx, s.timeout)
+		verdict, err := s.backend.Analyze(ctx, job.request)
+		cancel()
+
+		var permanent permanentError
+		if err == nil || errors.As(err, &permanent) || attempt > s.maxRetries {
+			span.SetAttributes(attribute.Int("analysis.attempts", attempt))
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			s.finish(job, verdict, err)
+			return
+		}
+
+		slog.Warn("Analysis attempt failed, retrying", "job_id", job.ID, "request_id", job.RequestID,
+			"attempt", attempt, "retry_in", delay.String(), "error", err)
+
+		s.mu.Lock()
+		job.Status = "retrying"
+		job.Error = err.Error()
+		job.UpdatedAt = time.Now()
+		s.mu.Unlock()
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// finish records the job outcome and applies the verdict to its threat
+func (s *AnalysisService) finish(job *AnalysisJob, verdict *AnalysisVerdict, err error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	job.UpdatedAt = now
+	job.CompletedAt = &now
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+	} else {
+		job.Status = "completed"
+		job.Error = ""
+		job.Verdict = verdict
+	}
+	s.mu.Unlock()
+
+	dataMux.Lock()
+	threat, exists := threats[job.ThreatID]
+	if !exists {
+		dataMux.Unlock()
+		return
+	}
+
+	threat.Timestamp = now
+	switch {
+	case err != nil:
+		threat.Status = "analysis_failed"
+	case verdict.ThreatDetected:
+		threat.Status = "detected"
+		if verdict.Severity != "" && verdict.Severity != "none" {
+			threat.Severity = verdict.Severity
+		} else {
+			threat.Severity = severityForConfidence(verdict.Confidence)
+		}
+		if verdict.ThreatType != "" {
+			threat.Type = verdict.ThreatType
+			threat.Name = "Analyzed." + strings.ReplaceAll(verdict.ThreatType, " ", ".")
+		}
+	default:
+		threat.Status = "benign"
+		threat.Severity = "low"
+	}
+	snapshot := *threat
+	dataMux.Unlock()
+
+	publishEvent(nil, EventThreatAnalyzed, "threat", job.ThreatID, &snapshot)
+	if snapshot.Status == "detected" {
+		publishEvent(nil, EventThreatDetected, "threat", job.ThreatID, &snapshot)
+	}
+}
+
+// checkHealth reports the job backlog and whether the backend answers
+func (s *AnalysisService) checkHealth(ctx context.Context) (gin.H, error) {
+	details := gin.H{
+		"backend":        s.backend.Name(),
+		"queued":         len(s.queue),
+		"queue_capacity": cap(s.queue),
+	}
+	if pinger, ok := s.backend.(interface{ Ping(context.Context) error }); ok {
+		if err := pinger.Ping(ctx); err != nil {
+			return details, err
+		}
+	}
+	if len(s.queue) == cap(s.queue) {
+		return details, healthWarning("analysis queue is full")
+	}
+	return details, nil
+}
+
+// prune drops finished jobs older than maxAge
+func (s *AnalysisService) prune(maxAge time.Duration) {
+	cutoff := time.Now().Add(-maxAge)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, job := range s.jobs {
+		if job.CompletedAt != nil && job.CompletedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// newThreatAnalyzer builds the analyzer backend selected by ANALYZER_BACKEND
+func newThreatAnalyzer() ThreatAnalyzer {
+	switch getEnv("ANALYZER_BACKEND", "http") {
+	case "fake":
+		return &fakeAnalyzer{Verdict: AnalysisVerdict{
+			ThreatDetected: true,
+			ThreatType:     "Suspicious Activity",
+			Confidence:     0.75,
+			Severity:       "high",
+		}}
+	default:
+		return &httpAnalyzer{
+			baseURL: getEnv("ANALYZER_URL", "http://localhost:8001"),
+			client:  &http.Client{Transport: tracedTransport(http.DefaultTransport)},
+		}
+	}
+}
+
+// startAnalysisService creates the analysis service from configuration
+func startAnalysisService() {
+	analysisService = newAnalysisService(
+		newThreatAnalyzer(),
+		getEnvInt("ANALYZER_WORKERS", 4),
+		getEnvInt("ANALYZER_MAX_RETRIES", 3),
+		getEnvDuration("ANALYZER_RETRY_BACKOFF", 2*time.Second),
+		getEnvDuration("ANALYZER_TIMEOUT", 30*time.Second),
+	)
+	log.Printf("Threat analyzer backend: %s", analysisService.backend.Name())
+
+	// Jobs wait in the queue and are retried while the analyzer is down, so
+	// it degrades the gateway rather than making it unready
+	registerHealthCheck(HealthCheck{
+		Name:      "analyzer",
+		Readiness: true,
+		Timeout:   3 * time.Second,
+		Interval:  15 * time.Second,
+		Check:     analysisService.checkHealth,
+	})
+
+	retention := getEnvDuration("ANALYZER_JOB_RETENTION", 24*time.Hour)
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			analysisService.prune(retention)
+		}
+	}()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testThreat stores a threat for analysis results to update
+func testThreat(t *testing.T) string {
+	t.Helper()
+
+	dataMux.Lock()
+	id := nextResourceID("THR", len(threats), func(id string) bool { _, ok := threats[id]; return ok })
+	threats[id] = &Threat{ID: id, Status: "analyzing", Severity: "unknown", Timestamp: time.Now()}
+	dataMux.Unlock()
+
+	t.Cleanup(func() {
+		dataMux.Lock()
+		delete(threats, id)
+		dataMux.Unlock()
+	})
+	return id
+}
+
+// waitForJob polls a job until it completes
+func waitForJob(t *testing.T, s *AnalysisService, id string) AnalysisJob {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, _ := s.Get(id); job.CompletedAt != nil {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not complete", id)
+	return AnalysisJob{}
+}
+
+func threatStatus(id string) string {
+	dataMux.RLock()
+	defer dataMux.RUnlock()
+	return threats[id].Status
+}
+
+var testPackets = AnalysisRequest{Packets: []AnalyzerPacket{{SourceIP: "192.0.2.1", DestinationIP: "10.0.0.1", DestinationPort: 22}}}
+
+func TestAnalysisRetriesTransientErrors(t *testing.T) {
+	backend := &fakeAnalyzer{Err: errors.New("analyzer unavailable")}
+	s := newAnalysisService(backend, 1, 2, time.Millisecond, time.Second)
+	threatID := testThreat(t)
+
+	submitted, err := s.Submit(context.Background(), threatID, testPackets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, s, submitted.ID)
+
+	if job.Status != "failed" || job.Attempts != 3 || backend.Calls() != 3 {
+		t.Errorf("job %s after %d attempts and %d calls, want failed after 3", job.Status, job.Attempts, backend.Calls())
+	}
+	if job.Error != "analyzer unavailable" {
+		t.Errorf("job error = %q", job.Error)
+	}
+	if status := threatStatus(threatID); status != "analysis_failed" {
+		t.Errorf("threat status = %q, want analysis_failed", status)
+	}
+}
+
+func TestAnalysisDoesNotRetryPermanentErrors(t *testing.T) {
+	backend := &fakeAnalyzer{Err: permanentError{errors.New("analyzer returned HTTP 422")}}
+	s := newAnalysisService(backend, 1, 3, time.Millisecond, time.Second)
+
+	submitted, _ := s.Submit(context.Background(), testThreat(t), testPackets)
+	job := waitForJob(t, s, submitted.ID)
+
+	if job.Status != "failed" || backend.Calls() != 1 {
+		t.Errorf("job %s after %d calls, want failed after 1", job.Status, backend.Calls())
+	}
+}
+
+func TestAnalysisTimesOut(t *testing.T) {
+	backend := &fakeAnalyzer{Delay: time.Minute}
+	s := newAnalysisService(backend, 1, 1, time.Millisecond, 20*time.Millisecond)
+
+	start := time.Now()
+	submitted, _ := s.Submit(context.Background(), testThreat(t), testPackets)
+	job := waitForJob(t, s, submitted.ID)
+
+	if job.Status != "failed" || job.Attempts != 2 {
+		t.Errorf("job %s after %d attempts, want failed after 2", job.Status, job.Attempts)
+	}
+	if job.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("job error = %q, want %q", job.Error, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timed out attempts took %s", elapsed)
+	}
+}
+
+func TestAnalysisAppliesVerdict(t *testing.T) {
+	backend := &fakeAnalyzer{Verdict: AnalysisVerdict{ThreatDetected: true, ThreatType: "Port Scan", Confidence: 0.95}}
+	s := newAnalysisService(backend, 1, 0, time.Millisecond, time.Second)
+	threatID := testThreat(t)
+
+	submitted, _ := s.Submit(context.Background(), threatID, testPackets)
+	if submitted.Status != "queued" {
+		t.Errorf("submitted job is %s, want queued", submitted.Status)
+	}
+	job := waitForJob(t, s, submitted.ID)
+	if job.Status != "completed" || job.Verdict == nil || job.Verdict.ThreatType != "Port Scan" {
+		t.Fatalf("job = %+v, want completed with the verdict", job)
+	}
+
+	dataMux.RLock()
+	threat := *threats[threatID]
+	dataMux.RUnlock()
+	if threat.Status != "detected" || threat.Severity != "critical" || threat.Name != "Analyzed.Port.Scan" {
+		t.Errorf("threat = %s %s %s, want detected critical Analyzed.Port.Scan", threat.Status, threat.Severity, threat.Name)
+	}
+}
+
+// TestAnalysisPollingWhileRunning polls a job through the API while the
+// worker retries it; run with -race to check the handlers only read
+// snapshots
+func TestAnalysisPollingWhileRunning(t *testing.T) {
+	backend := &fakeAnalyzer{Err: errors.New("analyzer unavailable"), Delay: time.Millisecond}
+	previous := analysisService
+	analysisService = newAnalysisService(backend, 2, 5, time.Millisecond, time.Second)
+	t.Cleanup(func() { analysisService = previous })
+
+	router := gin.New()
+	router.POST("/api/v1/threats/analyze", analyzeThreat)
+	router.GET("/api/v1/threats/analyze/:job_id", getAnalysisJob)
+
+	w := doRequest(t, router, http.MethodPost, "/api/v1/threats/analyze", map[string]interface{}{
+		"type":    "packets",
+		"packets": testPackets.Packets,
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("analyze = %d, want 202: %s", w.Code, w.Body)
+	}
+	body := decodeBody(t, w)
+	threatID := body["threat_id"].(string)
+	t.Cleanup(func() {
+		dataMux.Lock()
+		delete(threats, threatID)
+		dataMux.Unlock()
+	})
+
+	statusURL := body["status_url"].(string)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := doRequest(t, router, http.MethodGet, statusURL, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("poll = %d, want 200: %s", w.Code, w.Body)
+		}
+		job := decodeBody(t, w)["job"].(map[string]interface{})
+		if job["status"] == "failed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %v", job["status"])
+		}
+	}
+	if backend.Calls() != 6 {
+		t.Errorf("backend called %d times, want 6", backend.Calls())
+	}
+}
+
+func TestAnalyzeThreatQueueFull(t *testing.T) {
+	previous := analysisService
+	// No workers and no buffer: every submission finds the queue full
+	analysisService = &AnalysisService{backend: &fakeAnalyzer{}, jobs: make(map[string]*AnalysisJob), queue: make(chan *AnalysisJob)}
+	t.Cleanup(func() { analysisService = previous })
+
+	router := gin.New()
+	router.POST("/api/v1/threats/analyze", analyzeThreat)
+
+	dataMux.RLock()
+	before := len(threats)
+	dataMux.RUnlock()
+
+	w := doRequest(t, router, http.MethodPost, "/api/v1/threats/analyze", map[string]interface{}{
+		"type":    "packets",
+		"packets": testPackets.Packets,
+	})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("analyze = %d, want 503: %s", w.Code, w.Body)
+	}
+
+	dataMux.RLock()
+	after := len(threats)
+	dataMux.RUnlock()
+	if after != before {
+		t.Errorf("threats = %d after a rejected analysis, want %d", after, before)
+	}
+	if len(analysisService.jobs) != 0 {
+		t.Errorf("kept %d jobs nobody can poll", len(analysisService.jobs))
+	}
+}
+
+func TestSeverityForConfidence(t *testing.T) {
+	// Cutoffs of determine_severity in python-ml/threat-detector
+	tests := []struct {
+		confidence float64
+		want       string
+	}{
+		{0.95, "critical"},
+		{0.9, "critical"},
+		{0.7, "high"},
+		{0.5, "medium"},
+		{0.45, "low"},
+		{0, "low"},
+	}
+	for _, tt := range tests {
+		if got := severityForConfidence(tt.confidence); got != tt.want {
+			t.Errorf("severityForConfidence(%v) = %s, want %s", tt.confidence, got, tt.want)
+		}
+	}
+}
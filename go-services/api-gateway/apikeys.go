@@ -19,6 +19,7 @@ type APIKey struct {
 	UserID      string    `json:"user_id"`
 	Permissions []string  `json:"permissions"`
 	Enabled     bool      `json:"enabled"`
+	Plan        string    `json:"plan,omitempty"`
 	LastUsed    time.Time `json:"last_used"`
 	CreatedAt   time.Time `json:"created_at"`
 	ExpiresAt   time.Time `json:"expires_at"`
@@ -44,15 +45,20 @@ func createAPIKey(c *gin.Context) {
 		Name        string   `json:"name" binding:"required"`
 		Permissions []string `json:"permissions"`
 		ExpiresIn   int      `json:"expires_in"` // days
+		Plan        string   `json:"plan"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !validAPIKeyPlan(c, req.Plan) {
+		return
+	}
 
 	key := generateAPIKey()
-	id := fmt.Sprintf("key_%d", time.Now().Unix())
+	// Nanoseconds keep IDs unique, since keys are rate limited by ID
+	id := fmt.Sprintf("key_%d", time.Now().UnixNano())
 
 	expiresAt := time.Now().AddDate(0, 0, 365) // Default 1 year
 	if req.ExpiresIn > 0 {
@@ -66,18 +72,24 @@ func createAPIKey(c *gin.Context) {
 		UserID:      userID.(string),
 		Permissions: req.Permissions,
 		Enabled:     true,
+		Plan:        req.Plan,
 		CreatedAt:   time.Now(),
 		ExpiresAt:   expiresAt,
 	}
 
 	apiKeysMux.Lock()
 	apiKeys[key] = apiKey
+	// Authenticated requests update the stored key from here on
+	snapshot := *apiKey
 	apiKeysMux.Unlock()
 
+	publishEvent(c, EventAPIKeyCreated, "api_key", id, &snapshot)
+
 	c.JSON(http.StatusCreated, gin.H{
 		"id":         id,
 		"key":        key,
 		"name":       req.Name,
+		"plan":       req.Plan,
 		"expires_at": expiresAt,
 		"message":    "API key created successfully. Save this key securely, it won't be shown again.",
 	})
@@ -97,6 +109,7 @@ func listAPIKeys(c *gin.Context) {
 				"id":         key.ID,
 				"name":       key.Name,
 				"enabled":    key.Enabled,
+				"plan":       key.Plan,
 				"last_used":  key.LastUsed,
 				"created_at": key.CreatedAt,
 				"expires_at": key.ExpiresAt,
@@ -122,6 +135,7 @@ func revokeAPIKey(c *gin.Context) {
 	for key, apiKey := range apiKeys {
 		if apiKey.ID == keyID && apiKey.UserID == userID.(string) {
 			delete(apiKeys, key)
+			publishEvent(c, EventAPIKeyRevoked, "api_key", keyID, apiKey)
 			c.JSON(http.StatusOK, gin.H{
 				"message": "API key revoked successfully",
 				"id":      keyID,
@@ -139,14 +153,18 @@ func updateAPIKey(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 
 	var req struct {
-		Name    string `json:"name"`
-		Enabled *bool  `json:"enabled"`
+		Name    string  `json:"name"`
+		Enabled *bool   `json:"enabled"`
+		Plan    *string `json:"plan"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Plan != nil && !validAPIKeyPlan(c, *req.Plan) {
+		return
+	}
 
 	apiKeysMux.Lock()
 	defer apiKeysMux.Unlock()
@@ -159,6 +177,10 @@ func updateAPIKey(c *gin.Context) {
 			if req.Enabled != nil {
 				apiKey.Enabled = *req.Enabled
 			}
+			if req.Plan != nil {
+				apiKey.Plan = *req.Plan
+			}
+			publishEvent(c, EventAPIKeyUpdated, "api_key", keyID, apiKey)
 
 			c.JSON(http.StatusOK, gin.H{
 				"message": "API key updated successfully",
@@ -171,6 +193,19 @@ func updateAPIKey(c *gin.Context) {
 	c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
 }
 
+// validAPIKeyPlan checks a requested rate limit plan. Plans raise limits, so
+// only admins may assign them.
+func validAPIKeyPlan(c *gin.Context, plan string) bool {
+	if plan == "" {
+		return true
+	}
+	if !rateLimiter.HasPlan(plan) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown plan " + plan})
+		return false
+	}
+	return requireAdmin(c)
+}
+
 // validateAPIKey validates an API key
 func validateAPIKey(key string) (*APIKey, bool) {
 	apiKeysMux.RLock()
@@ -212,6 +247,7 @@ func apiKeyMiddleware() gin.HandlerFunc {
 
 		key, valid := validateAPIKey(apiKey)
 		if !valid {
+			authFailuresTotal.WithLabelValues("invalid_api_key").Inc()
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
 			c.Abort()
 			return
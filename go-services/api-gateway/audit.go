@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"sync"
 	"time"
@@ -29,6 +31,7 @@ type AuditLog struct {
 	Duration      int64                  `json:"duration_ms"`
 	Changes       map[string]interface{} `json:"changes,omitempty"`
 	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	RequestID     string                 `json:"request_id,omitempty"`
 }
 
 var (
@@ -48,7 +51,7 @@ func auditMiddleware() gin.HandlerFunc {
 			bodyBytes, _ := c.GetRawData()
 			requestBody = string(bodyBytes)
 			// Restore body for next handlers
-			c.Request.Body = http.MaxBytesReader(c.Writer, http.NoBody, 0)
+			c.Request.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 		}
 
 		// Process request
@@ -85,6 +88,7 @@ func auditMiddleware() gin.HandlerFunc {
 			StatusCode:   c.Writer.Status(),
 			RequestBody:  requestBody,
 			Duration:     duration,
+			RequestID:    c.GetString("request_id"),
 		}
 
 		auditLogs = append(auditLogs, log)
@@ -103,6 +107,7 @@ func getAuditLogs(c *gin.Context) {
 	userID := c.Query("user_id")
 	action := c.Query("action")
 	resource := c.Query("resource")
+	requestID := c.Query("request_id")
 	startDate := c.Query("start_date")
 	endDate := c.Query("end_date")
 
@@ -121,6 +126,9 @@ func getAuditLogs(c *gin.Context) {
 		if resource != "" && log.Resource != resource {
 			continue
 		}
+		if requestID != "" && log.RequestID != requestID {
+			continue
+		}
 		if startDate != "" {
 			start, _ := time.Parse(time.RFC3339, startDate)
 			if log.Timestamp.Before(start) {
@@ -3,7 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"fmt"
+	"encoding/hex"
 	"net/http"
 	"strings"
 	"sync"
@@ -32,6 +32,10 @@ type Session struct {
 	ExpiresAt    time.Time
 }
 
+// defaultUserRole is the role given to self-registered users. Only an admin
+// can grant another role, through updateUser.
+const defaultUserRole = "viewer"
+
 // In-memory storage (replace with real database in production)
 var (
 	users    = make(map[string]*User)
@@ -60,6 +64,15 @@ func generateToken() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
+// generateUserID creates a random user ID. Webhooks, deliveries, API keys
+// and notifications are scoped by user ID, so two sign-ups must never share
+// one.
+func generateUserID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "user_" + hex.EncodeToString(b)
+}
+
 // hashPassword hashes a password using bcrypt
 func hashPassword(password string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -72,65 +85,91 @@ func verifyPassword(hash, password string) bool {
 	return err == nil
 }
 
-// authMiddleware validates JWT token
-// authOrAPIKeyMiddleware accepts either JWT token or API key
-func authOrAPIKeyMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// Try API key first
-		apiKey := c.GetHeader("X-API-Key")
-		if apiKey != "" {
-			// Validate API key
-			apiKeysMux.RLock()
-			key, exists := apiKeys[apiKey]
-			apiKeysMux.RUnlock()
-
-			if exists && key.Enabled && time.Now().Before(key.ExpiresAt) {
-				// API key is valid, set user context
-				usersMux.RLock()
-				user, userExists := users[key.UserID]
-				usersMux.RUnlock()
-
-				if userExists {
-					c.Set("user", user)
-					c.Set("user_id", user.ID)
-					c.Set("auth_method", "api_key")
-					c.Next()
-					return
-				}
+// userByID finds a user by ID rather than by the email users is keyed by.
+// The caller must hold usersMux.
+func userByID(id string) (*User, bool) {
+	for _, user := range users {
+		if user.ID == id {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+// authenticateCredentials resolves an API key or session token to a user.
+// The API key is tried first; the returned method is "api_key" or "jwt".
+func authenticateCredentials(apiKey, token string) (*User, string, bool) {
+	if apiKey != "" {
+		// Validate API key
+		apiKeysMux.RLock()
+		key, exists := apiKeys[apiKey]
+		apiKeysMux.RUnlock()
+
+		if exists && key.Enabled && time.Now().Before(key.ExpiresAt) {
+			usersMux.RLock()
+			user, userExists := userByID(key.UserID)
+			usersMux.RUnlock()
+
+			if userExists {
+				return user, "api_key", true
 			}
 		}
+	}
 
-		// Try JWT token
-		authHeader := c.GetHeader("Authorization")
-		if authHeader != "" {
-			// Extract token from "Bearer <token>"
-			parts := strings.Split(authHeader, " ")
-			if len(parts) == 2 && parts[0] == "Bearer" {
-				token := parts[1]
-
-				// Validate token
-				usersMux.RLock()
-				session, exists := sessions[token]
-				usersMux.RUnlock()
-
-				if exists && time.Now().Before(session.ExpiresAt) {
-					// Get user
-					usersMux.RLock()
-					user, userExists := users[session.UserID]
-					usersMux.RUnlock()
-
-					if userExists {
-						c.Set("user", user)
-						c.Set("user_id", user.ID)
-						c.Set("auth_method", "jwt")
-						c.Next()
-						return
-					}
-				}
+	if token != "" {
+		// Validate token
+		usersMux.RLock()
+		session, exists := sessions[token]
+		usersMux.RUnlock()
+
+		if exists && time.Now().Before(session.ExpiresAt) {
+			usersMux.RLock()
+			user, userExists := users[session.UserID]
+			usersMux.RUnlock()
+
+			if userExists {
+				return user, "jwt", true
 			}
 		}
+	}
+
+	return nil, "", false
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(authHeader string) string {
+	parts := strings.Split(authHeader, " ")
+	if len(parts) == 2 && parts[0] == "Bearer" {
+		return parts[1]
+	}
+	return ""
+}
+
+// credentialFailure is the auth_failures_total reason for rejected
+// credentials
+func credentialFailure(apiKey, token string) string {
+	if apiKey == "" && token == "" {
+		return "missing_credentials"
+	}
+	return "invalid_credentials"
+}
+
+// authMiddleware validates JWT token
+// authOrAPIKeyMiddleware accepts either JWT token or API key
+func authOrAPIKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey, token := c.GetHeader("X-API-Key"), bearerToken(c.GetHeader("Authorization"))
+		user, method, ok := authenticateCredentials(apiKey, token)
+		if ok {
+			c.Set("user", user)
+			c.Set("user_id", user.ID)
+			c.Set("auth_method", method)
+			c.Next()
+			return
+		}
 
 		// Neither API key nor JWT token is valid
+		authFailuresTotal.WithLabelValues(credentialFailure(apiKey, token)).Inc()
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required. Provide valid JWT token or API key"})
 		c.Abort()
 	}
@@ -212,12 +251,14 @@ func login(c *gin.Context) {
 	usersMux.RUnlock()
 
 	if !exists {
+		recordAuthFailure(c, req.Email, "unknown_user")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
 
 	// Verify password
 	if !verifyPassword(user.PasswordHash, req.Password) {
+		recordAuthFailure(c, req.Email, "invalid_password")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
@@ -253,6 +294,19 @@ func login(c *gin.Context) {
 	})
 }
 
+// recordAuthFailure feeds a failed API login into the detection engine
+func recordAuthFailure(c *gin.Context, email, reason string) {
+	authFailuresTotal.WithLabelValues(reason).Inc()
+	detectionEngine.Ingest(SecurityEvent{
+		Type:     "auth_failure",
+		SourceIP: c.ClientIP(),
+		Service:  "api",
+		User:     email,
+		Sensor:   "api-gateway",
+		Fields:   map[string]string{"reason": reason},
+	})
+}
+
 // register handles user registration
 func register(c *gin.Context) {
 	var req struct {
@@ -260,7 +314,6 @@ func register(c *gin.Context) {
 		Password string `json:"password" binding:"required,min=8"`
 		Name     string `json:"name" binding:"required"`
 		Company  string `json:"company"`
-		Role     string `json:"role"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -287,12 +340,12 @@ func register(c *gin.Context) {
 
 	// Create user
 	user := &User{
-		ID:           fmt.Sprintf("user_%d", time.Now().Unix()),
+		ID:           generateUserID(),
 		Email:        req.Email,
 		Name:         req.Name,
 		PasswordHash: hash,
 		Company:      req.Company,
-		Role:         req.Role,
+		Role:         defaultUserRole,
 		CreatedAt:    time.Now(),
 	}
 
@@ -300,6 +353,8 @@ func register(c *gin.Context) {
 	users[req.Email] = user
 	usersMux.Unlock()
 
+	publishEvent(c, EventUserCreated, "user", user.ID, user)
+
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "User registered successfully",
 		"user_id": user.ID,
@@ -330,6 +385,7 @@ func refreshToken(c *gin.Context) {
 	usersMux.RUnlock()
 
 	if !exists {
+		authFailuresTotal.WithLabelValues("invalid_refresh_token").Inc()
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
 		return
 	}
@@ -368,3 +424,27 @@ func logout(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
+
+// isAdmin reports whether the authenticated caller has the admin role. It
+// reads the *User set by the auth middleware: users is keyed by email, not
+// by the ID in "user_id".
+func isAdmin(c *gin.Context) bool {
+	value, _ := c.Get("user")
+	user, ok := value.(*User)
+	if !ok {
+		return false
+	}
+
+	usersMux.RLock()
+	defer usersMux.RUnlock()
+	return user.Role == "admin"
+}
+
+// requireAdmin aborts the request with 403 unless the caller is an admin
+func requireAdmin(c *gin.Context) bool {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin role required"})
+		return false
+	}
+	return true
+}
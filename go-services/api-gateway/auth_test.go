@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	router := newRouter()
+	_, adminToken := testUser(t, "admin")
+	_, analystToken := testUser(t, "analyst")
+
+	paths := []string{"/api/v1/admin/rate-limits", "/api/v1/admin/webhook-policy"}
+	for _, path := range paths {
+		if w := doRequest(t, router, http.MethodGet, path, nil, bearer(adminToken)...); w.Code != http.StatusOK {
+			t.Errorf("admin GET %s = %d, want 200: %s", path, w.Code, w.Body)
+		}
+		if w := doRequest(t, router, http.MethodGet, path, nil, bearer(analystToken)...); w.Code != http.StatusForbidden {
+			t.Errorf("analyst GET %s = %d, want 403", path, w.Code)
+		}
+	}
+}
+
+func TestUpdateUserRoleRequiresAdmin(t *testing.T) {
+	router := newRouter()
+	analyst, analystToken := testUser(t, "analyst")
+	_, adminToken := testUser(t, "admin")
+	path := "/api/v1/users/" + analyst.ID
+
+	w := doRequest(t, router, http.MethodPut, path, map[string]string{"role": "admin"}, bearer(analystToken)...)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("analyst promoting themselves = %d, want 403", w.Code)
+	}
+	if analyst.Role != "analyst" {
+		t.Fatalf("role changed to %q by a non-admin", analyst.Role)
+	}
+
+	w = doRequest(t, router, http.MethodPut, path, map[string]string{"name": "Renamed"}, bearer(analystToken)...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("analyst renaming themselves = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	w = doRequest(t, router, http.MethodPut, path, map[string]string{"role": "viewer"}, bearer(adminToken)...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin changing role = %d, want 200: %s", w.Code, w.Body)
+	}
+	if analyst.Role != "viewer" {
+		t.Fatalf("role = %q after admin update, want viewer", analyst.Role)
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	router := newRouter()
+	analyst, token := testUser(t, "analyst")
+
+	w := doRequest(t, router, http.MethodPost, "/api/v1/api-keys", map[string]string{"name": "ci"}, bearer(token)...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating API key = %d, want 201: %s", w.Code, w.Body)
+	}
+	key := decodeBody(t, w)["key"].(string)
+	t.Cleanup(func() {
+		apiKeysMux.Lock()
+		delete(apiKeys, key)
+		apiKeysMux.Unlock()
+	})
+
+	w = doRequest(t, router, http.MethodGet, "/api/v1/me", nil, "X-API-Key", key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /me with API key = %d, want 200: %s", w.Code, w.Body)
+	}
+	user := decodeBody(t, w)["user"].(map[string]interface{})
+	if user["id"] != analyst.ID {
+		t.Errorf("GET /me with API key returned user %v, want %s", user["id"], analyst.ID)
+	}
+
+	w = doRequest(t, router, http.MethodGet, "/api/v1/me", nil, "X-API-Key", "sk_invalid")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /me with unknown API key = %d, want 401", w.Code)
+	}
+}
+
+func TestRegisterIgnoresRequestedRole(t *testing.T) {
+	router := newRouter()
+	email := generateToken()[:12] + "@example.com"
+	t.Cleanup(func() {
+		usersMux.Lock()
+		delete(users, email)
+		usersMux.Unlock()
+	})
+
+	register := map[string]string{"email": email, "password": "password123", "name": "Mallory", "role": "admin"}
+	w := doRequest(t, router, http.MethodPost, "/api/v1/auth/register", register)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register = %d, want 201: %s", w.Code, w.Body)
+	}
+	user := decodeBody(t, w)["user"].(map[string]interface{})
+	if user["role"] != defaultUserRole {
+		t.Errorf("registered role = %v, want %s", user["role"], defaultUserRole)
+	}
+
+	login := map[string]string{"email": email, "password": "password123"}
+	w = doRequest(t, router, http.MethodPost, "/api/v1/auth/login", login)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login = %d, want 200: %s", w.Code, w.Body)
+	}
+	token := decodeBody(t, w)["token"].(string)
+	t.Cleanup(func() {
+		usersMux.Lock()
+		for key, session := range sessions {
+			if session.UserID == email {
+				delete(sessions, key)
+			}
+		}
+		usersMux.Unlock()
+	})
+
+	policy := map[string]interface{}{"allowed_networks": []string{"10.0.0.0/8"}}
+	w = doRequest(t, router, http.MethodPut, "/api/v1/admin/webhook-policy", policy, bearer(token)...)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("self-registered admin PUT /admin/webhook-policy = %d, want 403", w.Code)
+	}
+}
+
+func TestRegisterAssignsDistinctIDs(t *testing.T) {
+	router := newRouter()
+	ids := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		email := generateToken()[:12] + "@example.com"
+		t.Cleanup(func() {
+			usersMux.Lock()
+			delete(users, email)
+			usersMux.Unlock()
+		})
+
+		body := map[string]string{"email": email, "password": "password123", "name": "Same Second"}
+		w := doRequest(t, router, http.MethodPost, "/api/v1/auth/register", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("register = %d, want 201: %s", w.Code, w.Body)
+		}
+		id := decodeBody(t, w)["user_id"].(string)
+		if ids[id] {
+			t.Fatalf("user ID %s assigned twice", id)
+		}
+		ids[id] = true
+	}
+}
@@ -88,7 +88,8 @@ func createBackup(c *gin.Context) {
 	backup.Size = len(jsonData)
 
 	// Log activity
-	logActivity(fmt.Sprintf("%v", userID), "", "CREATE_BACKUP", "system", backup.ID, c.ClientIP(), "success", nil)
+	logActivity(fmt.Sprintf("%v", userID), "", "CREATE_BACKUP", "system", backup.ID, c.ClientIP(), c.GetString("request_id"), "success", nil)
+	publishEvent(c, EventBackupCreated, "backup", backup.ID, gin.H{"size": backup.Size})
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Backup created successfully",
@@ -176,7 +177,13 @@ func restoreBackup(c *gin.Context) {
 	}
 
 	// Log activity
-	logActivity(fmt.Sprintf("%v", userID), "", "RESTORE_BACKUP", "system", backup.ID, c.ClientIP(), "success", nil)
+	logActivity(fmt.Sprintf("%v", userID), "", "RESTORE_BACKUP", "system", backup.ID, c.ClientIP(), c.GetString("request_id"), "success", nil)
+	publishEvent(c, EventBackupRestored, "backup", backup.ID, gin.H{
+		"alerts":         len(backup.Data.Alerts),
+		"threats":        len(backup.Data.Threats),
+		"firewall_rules": len(backup.Data.FirewallRules),
+		"users":          len(backup.Data.Users),
+	})
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Backup restored successfully",
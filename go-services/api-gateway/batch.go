@@ -18,18 +18,22 @@ func batchDeleteAlerts(c *gin.Context) {
 	}
 
 	dataMux.Lock()
-	deleted := 0
+	var deleted []Alert
 	for _, id := range req.IDs {
-		if _, exists := alerts[id]; exists {
+		if alert, exists := alerts[id]; exists {
 			delete(alerts, id)
-			deleted++
+			deleted = append(deleted, *alert)
 		}
 	}
 	dataMux.Unlock()
 
+	for i := range deleted {
+		publishEvent(c, EventAlertDeleted, "alert", deleted[i].ID, &deleted[i])
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Alerts deleted successfully",
-		"deleted": deleted,
+		"deleted": len(deleted),
 		"total":   len(req.IDs),
 	})
 }
@@ -47,18 +51,22 @@ func batchUpdateAlerts(c *gin.Context) {
 	}
 
 	dataMux.Lock()
-	updated := 0
+	var updated []Alert
 	for _, id := range req.IDs {
 		if alert, exists := alerts[id]; exists {
 			alert.Status = req.Status
-			updated++
+			updated = append(updated, *alert)
 		}
 	}
 	dataMux.Unlock()
 
+	for i := range updated {
+		publishEvent(c, EventAlertUpdated, "alert", updated[i].ID, &updated[i])
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Alerts updated successfully",
-		"updated": updated,
+		"updated": len(updated),
 		"total":   len(req.IDs),
 	})
 }
@@ -75,18 +83,22 @@ func batchDeleteThreats(c *gin.Context) {
 	}
 
 	dataMux.Lock()
-	deleted := 0
+	var deleted []Threat
 	for _, id := range req.IDs {
-		if _, exists := threats[id]; exists {
+		if threat, exists := threats[id]; exists {
 			delete(threats, id)
-			deleted++
+			deleted = append(deleted, *threat)
 		}
 	}
 	dataMux.Unlock()
 
+	for i := range deleted {
+		publishEvent(c, EventThreatDeleted, "threat", deleted[i].ID, &deleted[i])
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Threats deleted successfully",
-		"deleted": deleted,
+		"deleted": len(deleted),
 		"total":   len(req.IDs),
 	})
 }
@@ -103,18 +115,22 @@ func batchDeleteFirewallRules(c *gin.Context) {
 	}
 
 	dataMux.Lock()
-	deleted := 0
+	var deleted []FirewallRule
 	for _, id := range req.IDs {
-		if _, exists := firewallRules[id]; exists {
+		if rule, exists := firewallRules[id]; exists {
 			delete(firewallRules, id)
-			deleted++
+			deleted = append(deleted, *rule)
 		}
 	}
 	dataMux.Unlock()
 
+	for _, rule := range deleted {
+		publishEvent(c, EventFirewallRuleChanged, "firewall_rule", rule.ID, gin.H{"action": "deleted", "rule": rule})
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Firewall rules deleted successfully",
-		"deleted": deleted,
+		"deleted": len(deleted),
 		"total":   len(req.IDs),
 	})
 }
@@ -132,11 +148,11 @@ func batchEnableFirewallRules(c *gin.Context) {
 	}
 
 	dataMux.Lock()
-	updated := 0
+	var updated []FirewallRule
 	for _, id := range req.IDs {
 		if rule, exists := firewallRules[id]; exists {
 			rule.Enabled = req.Enabled
-			updated++
+			updated = append(updated, *rule)
 		}
 	}
 	dataMux.Unlock()
@@ -146,9 +162,13 @@ func batchEnableFirewallRules(c *gin.Context) {
 		action = "disabled"
 	}
 
+	for _, rule := range updated {
+		publishEvent(c, EventFirewallRuleChanged, "firewall_rule", rule.ID, gin.H{"action": action, "rule": rule})
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Firewall rules " + action + " successfully",
-		"updated": updated,
+		"updated": len(updated),
 		"total":   len(req.IDs),
 	})
 }
@@ -1,107 +1,250 @@
 package main
 
 import (
+	"container/list"
+	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// CacheBackend stores cache entries. The Redis backend shares them between
+// gateway replicas; the memory backend is local to this process.
+type CacheBackend interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+	DeletePrefix(prefix string) error
+	Cleanup()
+	Stats() map[string]interface{}
+}
+
 // CacheItem represents a cached item
 type CacheItem struct {
-	Value      interface{}
+	Value      []byte
 	Expiration time.Time
 }
 
-// Cache represents an in-memory cache
-type Cache struct {
-	items map[string]*CacheItem
-	mu    sync.RWMutex
+// memoryCache is the in-process cache backend. It holds at most maxItems
+// entries and evicts the least recently used one to make room.
+type memoryCache struct {
+	items     map[string]*list.Element
+	lru       *list.List // front is most recently used
+	maxItems  int
+	evictions int64
+	mu        sync.Mutex
+}
+
+// memoryEntry is the value of an element in memoryCache.lru
+type memoryEntry struct {
+	key  string
+	item CacheItem
 }
 
-var cache = &Cache{
-	items: make(map[string]*CacheItem),
+func newMemoryCache(maxItems int) *memoryCache {
+	return &memoryCache{
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+		maxItems: maxItems,
+	}
 }
 
 // Set stores a value in cache with expiration
-func (c *Cache) Set(key string, value interface{}, duration time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (m *memoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	expiration := time.Now().Add(duration)
-	c.items[key] = &CacheItem{
+	item := CacheItem{
 		Value:      value,
-		Expiration: expiration,
+		Expiration: time.Now().Add(ttl),
+	}
+	if elem, exists := m.items[key]; exists {
+		elem.Value.(*memoryEntry).item = item
+		m.lru.MoveToFront(elem)
+		return nil
+	}
+
+	m.items[key] = m.lru.PushFront(&memoryEntry{key: key, item: item})
+	for m.maxItems > 0 && m.lru.Len() > m.maxItems {
+		m.remove(m.lru.Back())
+		m.evictions++
 	}
+	return nil
 }
 
 // Get retrieves a value from cache
-func (c *Cache) Get(key string) (interface{}, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (m *memoryCache) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	item, exists := c.items[key]
+	elem, exists := m.items[key]
 	if !exists {
-		return nil, false
+		return nil, false, nil
 	}
-
-	// Check if expired
-	if time.Now().After(item.Expiration) {
-		return nil, false
+	entry := elem.Value.(*memoryEntry)
+	if time.Now().After(entry.item.Expiration) {
+		m.remove(elem)
+		return nil, false, nil
 	}
+	m.lru.MoveToFront(elem)
+	return entry.item.Value, true, nil
+}
 
-	return item.Value, true
+// remove unlinks an element; the caller holds m.mu
+func (m *memoryCache) remove(elem *list.Element) {
+	m.lru.Remove(elem)
+	delete(m.items, elem.Value.(*memoryEntry).key)
 }
 
 // Delete removes a value from cache
-func (c *Cache) Delete(key string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (m *memoryCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	delete(c.items, key)
+	if elem, exists := m.items[key]; exists {
+		m.remove(elem)
+	}
+	return nil
 }
 
-// Clear removes all items from cache
-func (c *Cache) Clear() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// DeletePrefix removes every key starting with prefix
+func (m *memoryCache) DeletePrefix(prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	c.items = make(map[string]*CacheItem)
+	for key, elem := range m.items {
+		if strings.HasPrefix(key, prefix) {
+			m.remove(elem)
+		}
+	}
+	return nil
 }
 
-// CleanExpired removes expired items
-func (c *Cache) CleanExpired() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// Cleanup removes expired items
+func (m *memoryCache) Cleanup() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	now := time.Now()
-	for key, item := range c.items {
-		if now.After(item.Expiration) {
-			delete(c.items, key)
+	for _, elem := range m.items {
+		if now.After(elem.Value.(*memoryEntry).item.Expiration) {
+			m.remove(elem)
 		}
 	}
 }
 
-// GetStats returns cache statistics
-func (c *Cache) GetStats() map[string]interface{} {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// Stats counts live and expired items
+func (m *memoryCache) Stats() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	expired := 0
 	now := time.Now()
-	for _, item := range c.items {
-		if now.After(item.Expiration) {
+	for _, elem := range m.items {
+		if now.After(elem.Value.(*memoryEntry).item.Expiration) {
 			expired++
 		}
 	}
 
 	return map[string]interface{}{
-		"total_items":   len(c.items),
+		"backend":       "memory",
+		"total_items":   len(m.items),
 		"expired_items": expired,
-		"active_items":  len(c.items) - expired,
+		"active_items":  len(m.items) - expired,
+		"max_items":     m.maxItems,
+		"evictions":     m.evictions,
+	}
+}
+
+// Cache fronts a backend. Backend errors are logged and treated as misses so
+// an unreachable Redis degrades to recomputing responses.
+type Cache struct {
+	backend CacheBackend
+	hits    atomic.Int64
+	misses  atomic.Int64
+	errors  atomic.Int64
+}
+
+var cache = &Cache{backend: newMemoryCache(getEnvInt("CACHE_MAX_ITEMS", 10000))}
+
+func (c *Cache) failed(op string, err error) {
+	if c.errors.Add(1)%100 == 1 {
+		log.Printf("Cache %s failed: %v", op, err)
+	}
+}
+
+// Set stores a value in cache with expiration
+func (c *Cache) Set(key string, value []byte, ttl time.Duration) {
+	if err := c.backend.Set(key, value, ttl); err != nil {
+		c.failed("set", err)
+	}
+}
+
+// Get retrieves a value from cache
+func (c *Cache) Get(key string) ([]byte, bool) {
+	value, ok, err := c.backend.Get(key)
+	if err != nil {
+		c.failed("get", err)
+		ok = false
+	}
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return value, ok
+}
+
+// Delete removes a value from cache
+func (c *Cache) Delete(key string) {
+	if err := c.backend.Delete(key); err != nil {
+		c.failed("delete", err)
+	}
+}
+
+// Clear removes all items from cache
+func (c *Cache) Clear() {
+	expireResponseGroups()
+	if err := c.backend.DeletePrefix(""); err != nil {
+		c.failed("clear", err)
+	}
+}
+
+// CleanExpired removes expired items
+func (c *Cache) CleanExpired() {
+	c.backend.Cleanup()
+}
+
+// GetStats returns cache statistics
+func (c *Cache) GetStats() map[string]interface{} {
+	stats := c.backend.Stats()
+	hits, misses := c.hits.Load(), c.misses.Load()
+	stats["hits"] = hits
+	stats["misses"] = misses
+	stats["hit_rate"] = 0.0
+	if hits+misses > 0 {
+		stats["hit_rate"] = float64(hits) / float64(hits+misses)
+	}
+	stats["errors"] = c.errors.Load()
+	return stats
+}
+
+// configureCache selects the cache backend from CACHE_BACKEND
+func configureCache() {
+	switch backend := getEnv("CACHE_BACKEND", "memory"); backend {
+	case "memory":
+	case "redis":
+		cache.backend = newRedisCache(sharedRedis())
+	default:
+		log.Fatalf("Unknown CACHE_BACKEND %q (memory or redis)", backend)
 	}
 }
 
 // Start cache cleanup routine
 func startCacheCleanup() {
+	configureCache()
+
 	ticker := time.NewTicker(5 * time.Minute)
 	go func() {
 		for range ticker.C {
@@ -112,12 +255,7 @@ func startCacheCleanup() {
 
 // Invalidate cache for specific resource
 func invalidateCache(pattern string) {
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
-
-	for key := range cache.items {
-		if len(key) >= len(pattern) && key[:len(pattern)] == pattern {
-			delete(cache.items, key)
-		}
+	if err := cache.backend.DeletePrefix(pattern); err != nil {
+		cache.failed("invalidate", err)
 	}
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireIfMatch makes If-Match mandatory on guarded PUT and DELETE requests
+// instead of only being checked when a client sends it
+var requireIfMatch = getEnvBool("REQUIRE_IF_MATCH", false)
+
+var (
+	// modifiedAt records when each resource ("alert/ALT-001") and each
+	// collection ("alert") last changed, fed by publishEvent
+	modifiedAt    = map[string]time.Time{}
+	modifiedAtMux sync.RWMutex
+	// restoredAt is when a backup last replaced all data
+	restoredAt time.Time
+)
+
+// markModified records a write to a resource for Last-Modified
+func markModified(eventType, resource, resourceID string, at time.Time) {
+	modifiedAtMux.Lock()
+	defer modifiedAtMux.Unlock()
+
+	if eventType == EventBackupRestored {
+		restoredAt = at
+		return
+	}
+	modifiedAt[resource] = at
+	if resourceID != "" {
+		modifiedAt[resource+"/"+resourceID] = at
+	}
+}
+
+// resourceModified returns when a single resource last changed. Data only
+// lives in memory, so nothing is older than the process.
+func resourceModified(resource, id string, created time.Time) time.Time {
+	modifiedAtMux.RLock()
+	defer modifiedAtMux.RUnlock()
+
+	return latest(created, startTime, restoredAt, modifiedAt[resource+"/"+id])
+}
+
+// collectionModified returns when a collection last changed: the newest of
+// its items and the last create or delete
+func collectionModified(resource string, newestItem time.Time) time.Time {
+	modifiedAtMux.RLock()
+	defer modifiedAtMux.RUnlock()
+
+	return latest(newestItem, startTime, restoredAt, modifiedAt[resource])
+}
+
+func latest(times ...time.Time) time.Time {
+	var newest time.Time
+	for _, t := range times {
+		if t.After(newest) {
+			newest = t
+		}
+	}
+	return newest
+}
+
+// resourceETag is a strong validator for a representation: the hash of its
+// JSON encoding, so two responses share an ETag only if they are byte equal
+func resourceETag(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return etagOf(data)
+}
+
+func etagOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagListMatches reports whether a comma separated If-Match or If-None-Match
+// value contains etag. Weak validators only match when weak is set.
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConditionalJSON sends body with an ETag and Last-Modified, or 304 Not
+// Modified when the client's copy is current. If-None-Match takes precedence
+// over If-Modified-Since as RFC 9110 requires.
+func writeConditionalJSON(c *gin.Context, body interface{}, modified time.Time) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+
+	etag := etagOf(data)
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", "private, no-cache")
+
+	if notModified(c.Request, etag, modified) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatches(inm, etag, true)
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !modified.Truncate(time.Second).After(ims)
+	}
+	return false
+}
+
+// ifMatch checks the If-Match precondition of a write against the current
+// representation of the resource, as returned by its GET endpoint. Callers
+// hold the lock guarding the resource so the check and the write are atomic.
+func ifMatch(c *gin.Context, current interface{}) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return !requireIfMatch
+	}
+	return etagListMatches(header, resourceETag(current), false)
+}
+
+// preconditionFailed rejects a write whose If-Match did not pass, sending the
+// current ETag so the client can refetch and retry
+func preconditionFailed(c *gin.Context, etag string) {
+	if c.GetHeader("If-Match") == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required"})
+		return
+	}
+	c.Header("ETag", etag)
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Resource has changed, fetch it again and retry"})
+}
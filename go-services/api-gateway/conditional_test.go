@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newAlert is the body of a POST /alerts request
+func newAlert(title string) map[string]string {
+	return map[string]string{"title": title, "description": "test", "severity": "low"}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+	path := "/api/v1/alerts/" + createResource(t, router, token, "/api/v1/alerts", newAlert("conditional"))
+
+	w := doRequest(t, router, http.MethodGet, path, nil, bearer(token)...)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET = %d with ETag %q, want 200 and an ETag", w.Code, etag)
+	}
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w := doRequest(t, router, http.MethodGet, path, nil, append(bearer(token), "If-None-Match", header)...)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("GET with If-None-Match %s = %d, want 304", header, w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("304 response has a body: %s", w.Body)
+		}
+	}
+
+	w = doRequest(t, router, http.MethodGet, path, nil, append(bearer(token), "If-None-Match", `"stale"`)...)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET with a stale If-None-Match = %d, want 200", w.Code)
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+	path := "/api/v1/alerts/" + createResource(t, router, token, "/api/v1/alerts", newAlert("conditional"))
+
+	w := doRequest(t, router, http.MethodGet, path, nil, bearer(token)...)
+	lastModified := w.Header().Get("Last-Modified")
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		t.Fatalf("Last-Modified %q: %v", lastModified, err)
+	}
+
+	w = doRequest(t, router, http.MethodGet, path, nil, append(bearer(token), "If-Modified-Since", lastModified)...)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("GET with If-Modified-Since = Last-Modified = %d, want 304", w.Code)
+	}
+
+	earlier := modified.Add(-time.Hour).Format(http.TimeFormat)
+	w = doRequest(t, router, http.MethodGet, path, nil, append(bearer(token), "If-Modified-Since", earlier)...)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET with an earlier If-Modified-Since = %d, want 200", w.Code)
+	}
+
+	// If-None-Match wins over If-Modified-Since
+	w = doRequest(t, router, http.MethodGet, path, nil, append(bearer(token), "If-None-Match", `"stale"`, "If-Modified-Since", lastModified)...)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET with a stale If-None-Match and a current If-Modified-Since = %d, want 200", w.Code)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+	path := "/api/v1/alerts/" + createResource(t, router, token, "/api/v1/alerts", newAlert("conditional"))
+
+	etag := doRequest(t, router, http.MethodGet, path, nil, bearer(token)...).Header().Get("ETag")
+	update := map[string]string{"status": "investigating"}
+
+	w := doRequest(t, router, http.MethodPut, path, update, append(bearer(token), "If-Match", `"stale"`)...)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with a stale If-Match = %d, want 412", w.Code)
+	}
+	if w.Header().Get("ETag") != etag {
+		t.Errorf("412 ETag = %s, want the current %s", w.Header().Get("ETag"), etag)
+	}
+	if w := doRequest(t, router, http.MethodDelete, path, nil, append(bearer(token), "If-Match", `"stale"`)...); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with a stale If-Match = %d, want 412", w.Code)
+	}
+
+	if w := doRequest(t, router, http.MethodPut, path, update, append(bearer(token), "If-Match", etag)...); w.Code != http.StatusOK {
+		t.Fatalf("PUT with the current If-Match = %d, want 200: %s", w.Code, w.Body)
+	}
+	// The update changed the representation, so the old ETag is stale now
+	if w := doRequest(t, router, http.MethodDelete, path, nil, append(bearer(token), "If-Match", etag)...); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with the pre-update ETag = %d, want 412", w.Code)
+	}
+
+	etag = doRequest(t, router, http.MethodGet, path, nil, bearer(token)...).Header().Get("ETag")
+	if w := doRequest(t, router, http.MethodDelete, path, nil, append(bearer(token), "If-Match", etag)...); w.Code != http.StatusOK {
+		t.Errorf("DELETE with the current If-Match = %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+	path := "/api/v1/alerts/" + createResource(t, router, token, "/api/v1/alerts", newAlert("conditional"))
+
+	requireIfMatch = true
+	t.Cleanup(func() { requireIfMatch = false })
+
+	w := doRequest(t, router, http.MethodPut, path, map[string]string{"status": "resolved"}, bearer(token)...)
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("PUT without If-Match = %d, want 428", w.Code)
+	}
+}
+
+func TestCollectionETagChangesAfterWrite(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+
+	w := doRequest(t, router, http.MethodGet, "/api/v1/alerts", nil, bearer(token)...)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET = %d with ETag %q, want 200 and an ETag", w.Code, etag)
+	}
+	if w := doRequest(t, router, http.MethodGet, "/api/v1/alerts", nil, append(bearer(token), "If-None-Match", etag)...); w.Code != http.StatusNotModified {
+		t.Fatalf("GET with the current collection ETag = %d, want 304", w.Code)
+	}
+
+	createResource(t, router, token, "/api/v1/alerts", newAlert("new member"))
+
+	w = doRequest(t, router, http.MethodGet, "/api/v1/alerts", nil, append(bearer(token), "If-None-Match", etag)...)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET with the pre-create collection ETag = %d, want 200", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("collection ETag unchanged after creating an alert")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getEnv returns the value of an environment variable or a fallback
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvInt returns an integer environment variable or a fallback
+func getEnvInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// getEnvBool returns a boolean environment variable or a fallback
+func getEnvBool(key string, fallback bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// getEnvDuration returns a duration environment variable (e.g. "5m") or a fallback
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// getEnvList returns a comma separated environment variable as a slice
+func getEnvList(key string, fallback []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvFloat returns a floating point environment variable or a fallback
+func getEnvFloat(key string, fallback float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return fallback
+}
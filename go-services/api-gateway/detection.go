@@ -0,0 +1,509 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	detectionQueueSize  = 10000
+	detectionMaxSamples = 10
+)
+
+// SecurityEvent is a normalised event evaluated by the detection engine.
+// Types produced by the gateway are auth_failure, auth_success, flow and
+// firewall_hit; external sensors may submit others via /events.
+type SecurityEvent struct {
+	Type       string            `json:"type"`
+	Timestamp  time.Time         `json:"timestamp"`
+	SourceIP   string            `json:"source_ip,omitempty"`
+	SourcePort int               `json:"source_port,omitempty"`
+	DestIP     string            `json:"dest_ip,omitempty"`
+	DestPort   int               `json:"dest_port,omitempty"`
+	Protocol   string            `json:"protocol,omitempty"`
+	Service    string            `json:"service,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Action     string            `json:"action,omitempty"`
+	Sensor     string            `json:"sensor,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// Field returns an event attribute by its rule field name
+func (e SecurityEvent) Field(name string) string {
+	switch name {
+	case "type":
+		return e.Type
+	case "source_ip":
+		return e.SourceIP
+	case "source_port":
+		return strconv.Itoa(e.SourcePort)
+	case "dest_ip":
+		return e.DestIP
+	case "dest_port":
+		return strconv.Itoa(e.DestPort)
+	case "protocol":
+		return e.Protocol
+	case "service":
+		return e.Service
+	case "user":
+		return e.User
+	case "action":
+		return e.Action
+	case "sensor":
+		return e.Sensor
+	}
+	return e.Fields[name]
+}
+
+// DetectionEvidence records why a threat or alert was raised
+type DetectionEvidence struct {
+	RuleID    string            `json:"rule_id"`
+	RuleTitle string            `json:"rule_title"`
+	Group     map[string]string `json:"group,omitempty"`
+	Count     int               `json:"count"`
+	Threshold int               `json:"threshold"`
+	Window    string            `json:"window"`
+	FirstSeen time.Time         `json:"first_seen"`
+	LastSeen  time.Time         `json:"last_seen"`
+	Events    []SecurityEvent   `json:"events"`
+}
+
+// Detection is the outcome of a rule firing, before it is stored
+type Detection struct {
+	Key         string
+	RuleID      string
+	Title       string
+	Description string
+	Severity    string
+	ThreatType  string
+	ThreatName  string
+	SourceIP    string
+	SourceIPs   []string // every source of a distributed attack, which has no single SourceIP
+	TargetIP    string
+	Port        int
+	Evidence    *DetectionEvidence
+}
+
+// ruleWindow holds the sliding window state of one rule and group key
+type ruleWindow struct {
+	group     map[string]string
+	times     []time.Time
+	distinct  map[string]time.Time
+	samples   []SecurityEvent
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// raisedThreat is the threat a rule or detector group last updated
+type raisedThreat struct {
+	id     string
+	raised time.Time
+}
+
+// DetectionEngine evaluates declarative rules against ingested events
+type DetectionEngine struct {
+	rules      []*DetectionRule
+	rulesPath  string
+	detectors  []StreamDetector
+	windows    map[string]*ruleWindow
+	lastFired  map[string]time.Time
+	threatIDs  map[string]raisedThreat
+	mu         sync.Mutex
+	events     chan SecurityEvent
+	ingested   atomic.Uint64
+	dropped    atomic.Uint64
+	detections atomic.Uint64
+}
+
+var detectionEngine = newDetectionEngine()
+
+func newDetectionEngine() *DetectionEngine {
+	return &DetectionEngine{
+		windows:   make(map[string]*ruleWindow),
+		lastFired: make(map[string]time.Time),
+		threatIDs: make(map[string]raisedThreat),
+		events:    make(chan SecurityEvent, detectionQueueSize),
+	}
+}
+
+// LoadRules replaces the active rule set and resets window state
+func (e *DetectionEngine) LoadRules(path string) error {
+	rules, err := loadDetectionRules(path)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = rules
+	e.rulesPath = path
+	e.windows = make(map[string]*ruleWindow)
+	return nil
+}
+
+// SetDetectors replaces the built-in streaming detectors
+func (e *DetectionEngine) SetDetectors(detectors []StreamDetector) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.detectors = detectors
+}
+
+// Detectors returns the configuration of the built-in detectors
+func (e *DetectionEngine) Detectors() []map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]map[string]interface{}, 0, len(e.detectors))
+	for _, detector := range e.detectors {
+		result = append(result, map[string]interface{}{
+			"name":   detector.Name(),
+			"config": detector.Config(),
+		})
+	}
+	return result
+}
+
+// Rules returns the active rule set
+func (e *DetectionEngine) Rules() []*DetectionRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules := make([]*DetectionRule, len(e.rules))
+	copy(rules, e.rules)
+	return rules
+}
+
+// Ingest queues an event for evaluation without blocking the caller
+func (e *DetectionEngine) Ingest(event SecurityEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	select {
+	case e.events <- event:
+		e.ingested.Add(1)
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Start runs the evaluation worker and the idle window cleanup
+func (e *DetectionEngine) Start() {
+	go func() {
+		for event := range e.events {
+			for _, detection := range e.Evaluate(event) {
+				e.raise(detection)
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.cleanup()
+		}
+	}()
+}
+
+// Evaluate runs an event through every enabled rule and built-in detector
+// and returns the detections that fired
+func (e *DetectionEngine) Evaluate(event SecurityEvent) []Detection {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var detections []Detection
+	for _, rule := range e.rules {
+		if !rule.IsEnabled() || !rule.Matches(event) {
+			continue
+		}
+
+		groupKey, group := rule.groupKey(event)
+		key := rule.ID + "\x00" + groupKey
+
+		w, exists := e.windows[key]
+		if !exists {
+			w = &ruleWindow{group: group, firstSeen: event.Timestamp}
+			if rule.Distinct != "" {
+				w.distinct = make(map[string]time.Time)
+			}
+			e.windows[key] = w
+		}
+
+		count := w.observe(rule, event)
+		if count <= rule.Threshold {
+			continue
+		}
+
+		if fired, ok := e.lastFired[key]; ok && event.Timestamp.Sub(fired) < rule.cooldown {
+			continue
+		}
+		e.lastFired[key] = event.Timestamp
+
+		detections = append(detections, Detection{
+			Key:         key,
+			RuleID:      rule.ID,
+			Title:       rule.Title,
+			Description: rule.Description,
+			Severity:    rule.Severity,
+			ThreatType:  rule.ThreatType,
+			ThreatName:  rule.ThreatName,
+			SourceIP:    event.SourceIP,
+			TargetIP:    event.DestIP,
+			Port:        event.DestPort,
+			Evidence: &DetectionEvidence{
+				RuleID:    rule.ID,
+				RuleTitle: rule.Title,
+				Group:     w.group,
+				Count:     count,
+				Threshold: rule.Threshold,
+				Window:    rule.window.String(),
+				FirstSeen: w.firstSeen,
+				LastSeen:  w.lastSeen,
+				Events:    append([]SecurityEvent(nil), w.samples...),
+			},
+		})
+
+		// Start a fresh window so the next detection needs new evidence
+		delete(e.windows, key)
+	}
+
+	for _, detector := range e.detectors {
+		detections = append(detections, detector.Process(event)...)
+	}
+
+	return detections
+}
+
+// observe adds an event to the window and returns the current count
+func (w *ruleWindow) observe(rule *DetectionRule, event SecurityEvent) int {
+	cutoff := event.Timestamp.Add(-rule.window)
+	w.lastSeen = event.Timestamp
+
+	w.samples = append(w.samples, event)
+	if len(w.samples) > detectionMaxSamples {
+		w.samples = w.samples[len(w.samples)-detectionMaxSamples:]
+	}
+
+	if w.distinct != nil {
+		w.distinct[event.Field(rule.Distinct)] = event.Timestamp
+		for value, seen := range w.distinct {
+			if seen.Before(cutoff) {
+				delete(w.distinct, value)
+			}
+		}
+		return len(w.distinct)
+	}
+
+	valid := w.times[:0]
+	for _, t := range w.times {
+		if !t.Before(cutoff) {
+			valid = append(valid, t)
+		}
+	}
+	w.times = append(valid, event.Timestamp)
+
+	// Only threshold+1 events are needed to decide whether the rule fires
+	if len(w.times) > rule.Threshold+1 {
+		w.times = w.times[len(w.times)-rule.Threshold-1:]
+	}
+	if len(w.times) > 0 && w.times[0].After(w.firstSeen) {
+		w.firstSeen = w.times[0]
+	}
+	return len(w.times)
+}
+
+// cleanup drops windows that have been idle for longer than their rule window
+// and forgets cooldowns and threats that have not fired for a day
+func (e *DetectionEngine) cleanup() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	windows := make(map[string]time.Duration, len(e.rules))
+	for _, rule := range e.rules {
+		windows[rule.ID] = rule.window
+	}
+
+	now := time.Now()
+	for key, w := range e.windows {
+		ruleID, _, _ := strings.Cut(key, "\x00")
+		if now.Sub(w.lastSeen) > windows[ruleID] {
+			delete(e.windows, key)
+		}
+	}
+	for key, fired := range e.lastFired {
+		if now.Sub(fired) > 24*time.Hour {
+			delete(e.lastFired, key)
+		}
+	}
+	for key, threat := range e.threatIDs {
+		if now.Sub(threat.raised) > 24*time.Hour {
+			delete(e.threatIDs, key)
+		}
+	}
+	for _, detector := range e.detectors {
+		detector.Prune(now)
+	}
+}
+
+// raise stores a detection as a threat and an alert. Repeated detections for
+// the same rule and group update the existing threat instead of adding one.
+// It returns copies of what was stored.
+func (e *DetectionEngine) raise(d Detection) (*Threat, *Alert) {
+	e.detections.Add(1)
+	now := time.Now()
+
+	e.mu.Lock()
+	threatID := e.threatIDs[d.Key].id
+	e.mu.Unlock()
+
+	dataMux.Lock()
+	threat, exists := threats[threatID]
+	if exists {
+		threat.Detections += d.Evidence.Count
+		threat.Timestamp = now
+		threat.Evidence = d.Evidence
+		threat.SourceIPs = d.SourceIPs
+	} else {
+		threatID = nextResourceID("THR", len(threats), func(id string) bool { _, ok := threats[id]; return ok })
+		threat = &Threat{
+			ID:         threatID,
+			Name:       d.ThreatName,
+			Type:       d.ThreatType,
+			Severity:   d.Severity,
+			Status:     "detected",
+			SourceIP:   d.SourceIP,
+			SourceIPs:  d.SourceIPs,
+			TargetIP:   d.TargetIP,
+			Port:       d.Port,
+			Timestamp:  now,
+			Detections: d.Evidence.Count,
+			RuleID:     d.RuleID,
+			Evidence:   d.Evidence,
+		}
+		threats[threatID] = threat
+	}
+	threat.Intel = threatIntelMatches(threat)
+
+	alertID := nextResourceID("ALT", len(alerts), func(id string) bool { _, ok := alerts[id]; return ok })
+	alert := &Alert{
+		ID:          alertID,
+		Title:       d.Title,
+		Description: d.Description,
+		Severity:    d.Severity,
+		Status:      "active",
+		Timestamp:   now,
+		Source:      "Detection Engine",
+		SourceIP:    d.SourceIP,
+		SourceIPs:   d.SourceIPs,
+		RuleID:      d.RuleID,
+		ThreatID:    threatID,
+		Evidence:    d.Evidence,
+	}
+	if alert.Description == "" {
+		alert.Description = fmt.Sprintf("Rule %s matched %d events from %s", d.RuleID, d.Evidence.Count, d.SourceIP)
+	}
+	alert.Intel = alertIntelMatches(alert)
+	alerts[alertID] = alert
+	threatSnapshot, alertSnapshot := *threat, *alert
+	dataMux.Unlock()
+
+	e.mu.Lock()
+	e.threatIDs[d.Key] = raisedThreat{id: threatID, raised: now}
+	e.mu.Unlock()
+
+	if exists {
+		publishEvent(nil, EventThreatUpdated, "threat", threatID, &threatSnapshot)
+	} else {
+		enricher.QueueThreat(threatID)
+		publishEvent(nil, EventThreatDetected, "threat", threatID, &threatSnapshot)
+	}
+	enricher.QueueAlert(alertID)
+	publishEvent(nil, EventAlertCreated, "alert", alertID, &alertSnapshot)
+
+	log.Printf("Detection %s fired for %s: threat %s, alert %s", d.RuleID, d.SourceIP, threatID, alertID)
+	return &threatSnapshot, &alertSnapshot
+}
+
+// Stats returns engine counters
+func (e *DetectionEngine) Stats() map[string]interface{} {
+	e.mu.Lock()
+	ruleCount := len(e.rules)
+	detectorCount := len(e.detectors)
+	windowCount := len(e.windows)
+	rulesPath := e.rulesPath
+	e.mu.Unlock()
+
+	if rulesPath == "" {
+		rulesPath = "builtin"
+	}
+
+	return map[string]interface{}{
+		"rules":           ruleCount,
+		"detectors":       detectorCount,
+		"rules_source":    rulesPath,
+		"open_windows":    windowCount,
+		"queued_events":   len(e.events),
+		"events_ingested": e.ingested.Load(),
+		"events_dropped":  e.dropped.Load(),
+		"detections":      e.detections.Load(),
+	}
+}
+
+// flowEvent converts a decoded flow into a detection event
+func flowEvent(rec FlowRecord) SecurityEvent {
+	protocol, ok := ipProtocolNames[rec.Protocol]
+	if !ok {
+		protocol = strconv.Itoa(rec.Protocol)
+	}
+
+	return SecurityEvent{
+		Type:       "flow",
+		Timestamp:  rec.End,
+		SourceIP:   rec.SrcIP,
+		SourcePort: rec.SrcPort,
+		DestIP:     rec.DstIP,
+		DestPort:   rec.DstPort,
+		Protocol:   protocol,
+		Service:    flowApplication(rec),
+		Sensor:     rec.Exporter,
+		Fields: map[string]string{
+			"bytes":     strconv.FormatUint(rec.Bytes, 10),
+			"packets":   strconv.FormatUint(rec.Packets, 10),
+			"tcp_flags": strconv.Itoa(rec.TCPFlags),
+		},
+	}
+}
+
+// startDetectionEngine loads detection rules and wires event sources
+func startDetectionEngine() {
+	path := getEnv("DETECTION_RULES_PATH", "")
+	if err := detectionEngine.LoadRules(path); err != nil {
+		log.Printf("Failed to load detection rules from %s, using built-in rules: %v", path, err)
+		if err := detectionEngine.LoadRules(""); err != nil {
+			log.Printf("Failed to load built-in detection rules: %v", err)
+		}
+	}
+
+	config := loadDetectorConfig()
+	var detectors []StreamDetector
+	if getEnvBool("ENABLE_BUILTIN_DETECTORS", true) {
+		detectors = newBuiltinDetectors(config)
+	}
+	detectors = append(detectors, newIntelDetector(threatIntel, config.Cooldown))
+	detectionEngine.SetDetectors(detectors)
+
+	detectionEngine.Start()
+
+	if flowCollector != nil {
+		flowCollector.OnFlow(func(rec FlowRecord) {
+			detectionEngine.Ingest(flowEvent(rec))
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ingestEvents accepts one event or a batch of events from external sensors
+// (firewalls, SSH log shippers, network monitors). Events raise threats and
+// alerts, so only admins may submit them.
+func ingestEvents(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var events []SecurityEvent
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &events)
+	} else {
+		// An object is either a single event or a batch under "events"
+		var payload struct {
+			SecurityEvent
+			Events []SecurityEvent `json:"events"`
+		}
+		err = json.Unmarshal(body, &payload)
+		events = payload.Events
+		if events == nil {
+			events = []SecurityEvent{payload.SecurityEvent}
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event payload: " + err.Error()})
+		return
+	}
+
+	for i, event := range events {
+		if event.Type == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Event type is required", "index": i})
+			return
+		}
+	}
+
+	for _, event := range events {
+		detectionEngine.Ingest(event)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Events accepted",
+		"accepted": len(events),
+	})
+}
+
+// listDetectionRules returns the active detection rules and built-in detectors
+func listDetectionRules(c *gin.Context) {
+	rules := detectionEngine.Rules()
+
+	c.JSON(http.StatusOK, gin.H{
+		"rules":     rules,
+		"total":     len(rules),
+		"detectors": detectionEngine.Detectors(),
+	})
+}
+
+// reloadDetectionRules reloads rules from DETECTION_RULES_PATH. Admin only.
+func reloadDetectionRules(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	path := getEnv("DETECTION_RULES_PATH", "")
+	if err := detectionEngine.LoadRules(path); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to load detection rules: " + err.Error()})
+		return
+	}
+
+	publishEvent(c, EventDetectionRulesReloaded, "detection_rules", "", gin.H{"total": len(detectionEngine.Rules())})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Detection rules reloaded",
+		"total":   len(detectionEngine.Rules()),
+	})
+}
+
+// getDetectionStats returns detection engine statistics
+func getDetectionStats(c *gin.Context) {
+	c.JSON(http.StatusOK, detectionEngine.Stats())
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DetectionRule is a declarative, Sigma-like detection rule. A rule selects
+// events of one type with `match`/`exclude` conditions and fires once more
+// than `threshold` matching events (or distinct values of `distinct`) are
+// seen for the same `group_by` key within `window`.
+type DetectionRule struct {
+	ID          string                 `json:"id" yaml:"id"`
+	Title       string                 `json:"title" yaml:"title"`
+	Description string                 `json:"description" yaml:"description"`
+	Severity    string                 `json:"severity" yaml:"severity"`
+	ThreatType  string                 `json:"threat_type" yaml:"threat_type"`
+	ThreatName  string                 `json:"threat_name" yaml:"threat_name"`
+	EventType   string                 `json:"event_type" yaml:"event_type"`
+	Match       map[string]interface{} `json:"match,omitempty" yaml:"match"`
+	Exclude     map[string]interface{} `json:"exclude,omitempty" yaml:"exclude"`
+	GroupBy     []string               `json:"group_by,omitempty" yaml:"group_by"`
+	Distinct    string                 `json:"distinct,omitempty" yaml:"distinct"`
+	Threshold   int                    `json:"threshold" yaml:"threshold"`
+	Window      string                 `json:"window" yaml:"window"`
+	Cooldown    string                 `json:"cooldown,omitempty" yaml:"cooldown"`
+	Enabled     *bool                  `json:"enabled,omitempty" yaml:"enabled"`
+	Source      string                 `json:"source" yaml:"-"`
+
+	window     time.Duration
+	cooldown   time.Duration
+	conditions []ruleCondition
+	exclusions []ruleCondition
+}
+
+// ruleCondition is a single `field|modifier: values` clause
+type ruleCondition struct {
+	field    string
+	modifier string
+	values   []string
+	networks []*net.IPNet
+	patterns []*regexp.Regexp
+}
+
+// defaultDetectionRules are used when DETECTION_RULES_PATH is not set
+const defaultDetectionRules = `
+rules:
+  - id: ssh-brute-force
+    title: SSH Brute Force
+    description: More than 20 failed SSH logins from one IP within 5 minutes
+    severity: high
+    threat_type: Brute Force
+    threat_name: Brute.Force.SSH
+    event_type: auth_failure
+    match:
+      service: ssh
+    group_by: [source_ip]
+    threshold: 20
+    window: 5m
+    cooldown: 15m
+
+  - id: api-login-brute-force
+    title: API Login Brute Force
+    description: More than 10 failed API logins from one IP within 5 minutes
+    severity: high
+    threat_type: Brute Force
+    threat_name: Brute.Force.API
+    event_type: auth_failure
+    match:
+      service: api
+    group_by: [source_ip]
+    threshold: 10
+    window: 5m
+    cooldown: 15m
+
+  - id: credential-stuffing
+    title: Credential Stuffing
+    description: Failed logins for more than 15 distinct accounts from one IP within 10 minutes
+    severity: critical
+    threat_type: Credential Stuffing
+    threat_name: Credential.Stuffing
+    event_type: auth_failure
+    group_by: [source_ip]
+    distinct: user
+    threshold: 15
+    window: 10m
+    cooldown: 30m
+
+  - id: firewall-repeated-denies
+    title: Repeated Firewall Denies
+    description: More than 50 denied connections from one IP within 1 minute
+    severity: medium
+    threat_type: Reconnaissance
+    threat_name: Firewall.Repeated.Deny
+    event_type: firewall_hit
+    match:
+      action: [deny, drop, reject]
+    group_by: [source_ip]
+    threshold: 50
+    window: 1m
+    cooldown: 10m
+
+  - id: outbound-smb
+    title: Outbound SMB Traffic
+    description: SMB sessions from an internal host to an external address
+    severity: high
+    threat_type: Data Exfiltration
+    threat_name: Outbound.SMB
+    event_type: flow
+    match:
+      dest_port: [139, 445]
+      source_ip|cidr: [10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16]
+    exclude:
+      dest_ip|cidr: [10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16]
+    group_by: [source_ip, dest_ip]
+    threshold: 0
+    window: 1m
+    cooldown: 1h
+`
+
+// IsEnabled reports whether the rule is active (rules are enabled by default)
+func (r *DetectionRule) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// compile validates the rule and prepares its conditions for evaluation
+func (r *DetectionRule) compile() error {
+	if r.ID == "" {
+		return fmt.Errorf("rule is missing an id")
+	}
+	if r.EventType == "" {
+		return fmt.Errorf("rule %s: event_type is required", r.ID)
+	}
+	if r.Title == "" {
+		r.Title = r.ID
+	}
+	if r.Severity == "" {
+		r.Severity = "medium"
+	}
+	if r.ThreatType == "" {
+		r.ThreatType = "Detection"
+	}
+	if r.ThreatName == "" {
+		r.ThreatName = r.Title
+	}
+	if r.Threshold < 0 {
+		return fmt.Errorf("rule %s: threshold must not be negative", r.ID)
+	}
+
+	var err error
+	if r.window, err = parseRuleDuration(r.Window, time.Minute); err != nil {
+		return fmt.Errorf("rule %s: invalid window: %w", r.ID, err)
+	}
+	if r.cooldown, err = parseRuleDuration(r.Cooldown, r.window); err != nil {
+		return fmt.Errorf("rule %s: invalid cooldown: %w", r.ID, err)
+	}
+	if r.conditions, err = compileConditions(r.Match); err != nil {
+		return fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+	if r.exclusions, err = compileConditions(r.Exclude); err != nil {
+		return fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+
+	return nil
+}
+
+func parseRuleDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// compileConditions turns a `match`/`exclude` block into conditions
+func compileConditions(block map[string]interface{}) ([]ruleCondition, error) {
+	var conditions []ruleCondition
+	for key, raw := range block {
+		cond := ruleCondition{field: key}
+		if i := strings.Index(key, "|"); i >= 0 {
+			cond.field, cond.modifier = key[:i], key[i+1:]
+		}
+
+		switch value := raw.(type) {
+		case []interface{}:
+			for _, v := range value {
+				cond.values = append(cond.values, fmt.Sprint(v))
+			}
+		default:
+			cond.values = []string{fmt.Sprint(value)}
+		}
+
+		switch cond.modifier {
+		case "", "contains", "startswith", "endswith":
+		case "cidr":
+			for _, v := range cond.values {
+				_, network, err := net.ParseCIDR(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid cidr %q for %s", v, key)
+				}
+				cond.networks = append(cond.networks, network)
+			}
+		case "re":
+			for _, v := range cond.values {
+				pattern, err := regexp.Compile(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regular expression %q for %s", v, key)
+				}
+				cond.patterns = append(cond.patterns, pattern)
+			}
+		default:
+			return nil, fmt.Errorf("unknown modifier %q on %s", cond.modifier, key)
+		}
+
+		conditions = append(conditions, cond)
+	}
+	return conditions, nil
+}
+
+// matches reports whether any of the condition values matches the event
+func (cond ruleCondition) matches(event SecurityEvent) bool {
+	value := event.Field(cond.field)
+
+	switch cond.modifier {
+	case "cidr":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return false
+		}
+		for _, network := range cond.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case "re":
+		for _, pattern := range cond.patterns {
+			if pattern.MatchString(value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	value = strings.ToLower(value)
+	for _, expected := range cond.values {
+		expected = strings.ToLower(expected)
+		switch cond.modifier {
+		case "contains":
+			if strings.Contains(value, expected) {
+				return true
+			}
+		case "startswith":
+			if strings.HasPrefix(value, expected) {
+				return true
+			}
+		case "endswith":
+			if strings.HasSuffix(value, expected) {
+				return true
+			}
+		default:
+			if value == expected || expected == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Matches reports whether an event is selected by the rule
+func (r *DetectionRule) Matches(event SecurityEvent) bool {
+	if r.EventType != "*" && r.EventType != event.Type {
+		return false
+	}
+	for _, cond := range r.conditions {
+		if !cond.matches(event) {
+			return false
+		}
+	}
+	for _, cond := range r.exclusions {
+		if cond.matches(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupKey returns the aggregation key for an event and its field values
+func (r *DetectionRule) groupKey(event SecurityEvent) (string, map[string]string) {
+	group := make(map[string]string, len(r.GroupBy))
+	parts := make([]string, 0, len(r.GroupBy))
+	for _, field := range r.GroupBy {
+		value := event.Field(field)
+		group[field] = value
+		parts = append(parts, value)
+	}
+	return strings.Join(parts, "|"), group
+}
+
+// parseDetectionRules parses a YAML document containing a `rules` list
+func parseDetectionRules(data []byte, source string) ([]*DetectionRule, error) {
+	var doc struct {
+		Rules []*DetectionRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+
+	for _, rule := range doc.Rules {
+		rule.Source = source
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+	}
+	return doc.Rules, nil
+}
+
+// loadDetectionRules loads rules from a YAML file or a directory of YAML
+// files, falling back to the built-in rules when path is empty
+func loadDetectionRules(path string) ([]*DetectionRule, error) {
+	if path == "" {
+		return parseDetectionRules([]byte(defaultDetectionRules), "builtin")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		for _, pattern := range []string{"*.yml", "*.yaml"} {
+			matches, _ := filepath.Glob(filepath.Join(path, pattern))
+			files = append(files, matches...)
+		}
+	}
+
+	var rules []*DetectionRule
+	seen := make(map[string]string)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseDetectionRules(data, file)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range parsed {
+			if other, exists := seen[rule.ID]; exists {
+				return nil, fmt.Errorf("duplicate rule id %s in %s and %s", rule.ID, other, file)
+			}
+			seen[rule.ID] = file
+		}
+		rules = append(rules, parsed...)
+	}
+
+	return rules, nil
+}
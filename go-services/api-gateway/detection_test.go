@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testDetectionEngine returns an engine with the built-in rules and no
+// stream detectors
+func testDetectionEngine(t *testing.T) *DetectionEngine {
+	t.Helper()
+
+	engine := newDetectionEngine()
+	if err := engine.LoadRules(""); err != nil {
+		t.Fatalf("loading built-in rules: %v", err)
+	}
+	return engine
+}
+
+func authFailure(at time.Duration, source, user string) SecurityEvent {
+	return SecurityEvent{
+		Type:      "auth_failure",
+		Timestamp: detectorEpoch.Add(at),
+		SourceIP:  source,
+		Service:   "api",
+		User:      user,
+	}
+}
+
+// evaluate runs events through the engine and returns the IDs of the rules
+// that fired, in order
+func evaluate(engine *DetectionEngine, events ...SecurityEvent) []string {
+	var fired []string
+	for _, event := range events {
+		for _, d := range engine.Evaluate(event) {
+			fired = append(fired, d.RuleID)
+		}
+	}
+	return fired
+}
+
+func TestRuleThresholdAndWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		step     time.Duration
+		want     int
+	}{
+		{"at threshold", 10, time.Second, 0},
+		{"over threshold", 11, time.Second, 1},
+		// Eleven failures, but never more than ten within five minutes
+		{"spread beyond window", 11, 31 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := testDetectionEngine(t)
+			var events []SecurityEvent
+			for i := 0; i < tt.failures; i++ {
+				events = append(events, authFailure(time.Duration(i)*tt.step, "192.0.2.1", "admin@example.com"))
+			}
+
+			fired := evaluate(engine, events...)
+			if len(fired) != tt.want {
+				t.Fatalf("got detections %v, want %d", fired, tt.want)
+			}
+			if tt.want > 0 && fired[0] != "api-login-brute-force" {
+				t.Errorf("rule = %s, want api-login-brute-force", fired[0])
+			}
+		})
+	}
+}
+
+func TestRuleEvidence(t *testing.T) {
+	engine := testDetectionEngine(t)
+
+	var detections []Detection
+	for i := 0; i < 11; i++ {
+		detections = append(detections, engine.Evaluate(authFailure(time.Duration(i)*time.Second, "192.0.2.1", "admin@example.com"))...)
+	}
+	if len(detections) != 1 {
+		t.Fatalf("got %d detections, want 1", len(detections))
+	}
+
+	evidence := detections[0].Evidence
+	if evidence.Count != 11 || evidence.Threshold != 10 {
+		t.Errorf("count/threshold = %d/%d, want 11/10", evidence.Count, evidence.Threshold)
+	}
+	if evidence.Group["source_ip"] != "192.0.2.1" {
+		t.Errorf("group = %v, want source_ip 192.0.2.1", evidence.Group)
+	}
+	if !evidence.FirstSeen.Equal(detectorEpoch) || !evidence.LastSeen.Equal(detectorEpoch.Add(10*time.Second)) {
+		t.Errorf("seen %v to %v, want the first and last failure", evidence.FirstSeen, evidence.LastSeen)
+	}
+	if len(evidence.Events) != detectionMaxSamples {
+		t.Errorf("got %d sample events, want %d", len(evidence.Events), detectionMaxSamples)
+	}
+}
+
+func TestRuleGroupsBySource(t *testing.T) {
+	engine := testDetectionEngine(t)
+
+	var events []SecurityEvent
+	for i := 0; i < 11; i++ {
+		source := "192.0.2.1"
+		if i%2 == 1 {
+			source = "192.0.2.2"
+		}
+		events = append(events, authFailure(time.Duration(i)*time.Second, source, "admin@example.com"))
+	}
+
+	if fired := evaluate(engine, events...); len(fired) != 0 {
+		t.Errorf("failures split across two sources fired %v", fired)
+	}
+}
+
+func TestRuleCooldown(t *testing.T) {
+	engine := testDetectionEngine(t)
+
+	burst := func(start time.Duration) []SecurityEvent {
+		var events []SecurityEvent
+		for i := 0; i < 11; i++ {
+			events = append(events, authFailure(start+time.Duration(i)*time.Second, "192.0.2.1", "admin@example.com"))
+		}
+		return events
+	}
+
+	if n := len(evaluate(engine, burst(0)...)); n != 1 {
+		t.Fatalf("first burst raised %d detections, want 1", n)
+	}
+	if n := len(evaluate(engine, burst(time.Minute)...)); n != 0 {
+		t.Fatalf("burst within the cooldown raised %d detections, want 0", n)
+	}
+	if n := len(evaluate(engine, burst(20*time.Minute)...)); n != 1 {
+		t.Fatalf("burst after the cooldown raised %d detections, want 1", n)
+	}
+}
+
+func TestRuleDistinct(t *testing.T) {
+	engine := testDetectionEngine(t)
+
+	// The same account over and over is brute force, not stuffing
+	var same []SecurityEvent
+	for i := 0; i < 16; i++ {
+		same = append(same, authFailure(time.Duration(i)*time.Minute, "192.0.2.1", "admin@example.com"))
+	}
+	for _, rule := range evaluate(engine, same...) {
+		if rule == "credential-stuffing" {
+			t.Fatal("credential-stuffing fired for a single account")
+		}
+	}
+
+	var fired []string
+	for i := 0; i < 16; i++ {
+		event := authFailure(time.Duration(i)*30*time.Second, "192.0.2.9", "user"+strconv.Itoa(i)+"@example.com")
+		fired = append(fired, evaluate(engine, event)...)
+	}
+	found := false
+	for _, rule := range fired {
+		found = found || rule == "credential-stuffing"
+	}
+	if !found {
+		t.Errorf("16 distinct accounts fired %v, want credential-stuffing", fired)
+	}
+}
+
+func TestRuleMatchAndExclude(t *testing.T) {
+	flow := func(source, dest string, port int) SecurityEvent {
+		return SecurityEvent{Type: "flow", Timestamp: detectorEpoch, SourceIP: source, DestIP: dest, DestPort: port}
+	}
+
+	tests := []struct {
+		name  string
+		event SecurityEvent
+		want  bool
+	}{
+		{"internal to external smb", flow("10.0.0.5", "203.0.113.7", 445), true},
+		{"internal to internal smb", flow("10.0.0.5", "192.168.1.20", 445), false},
+		{"external source", flow("198.51.100.3", "203.0.113.7", 445), false},
+		{"other port", flow("10.0.0.5", "203.0.113.7", 443), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fired := evaluate(testDetectionEngine(t), tt.event)
+			if got := len(fired) == 1 && fired[0] == "outbound-smb"; got != tt.want {
+				t.Errorf("fired %v, want outbound-smb %v", fired, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleListValues(t *testing.T) {
+	engine := testDetectionEngine(t)
+
+	deny := func(at time.Duration, action string) SecurityEvent {
+		return SecurityEvent{Type: "firewall_hit", Timestamp: detectorEpoch.Add(at), SourceIP: "198.51.100.3", Action: action}
+	}
+
+	var events []SecurityEvent
+	for i := 0; i < 60; i++ {
+		events = append(events, deny(time.Duration(i)*100*time.Millisecond, "ALLOW"))
+	}
+	if fired := evaluate(engine, events...); len(fired) != 0 {
+		t.Fatalf("allowed connections fired %v", fired)
+	}
+
+	events = nil
+	for i := 0; i < 51; i++ {
+		action := []string{"deny", "DROP", "reject"}[i%3]
+		events = append(events, deny(time.Duration(i)*100*time.Millisecond, action))
+	}
+	if fired := evaluate(engine, events...); len(fired) != 1 || fired[0] != "firewall-repeated-denies" {
+		t.Errorf("51 denies fired %v, want firewall-repeated-denies", fired)
+	}
+}
+
+func TestParseDetectionRulesErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing id":       "rules:\n  - event_type: flow\n",
+		"missing type":     "rules:\n  - id: r1\n",
+		"bad window":       "rules:\n  - id: r1\n    event_type: flow\n    window: soon\n",
+		"unknown modifier": "rules:\n  - id: r1\n    event_type: flow\n    match:\n      source_ip|near: 10.0.0.1\n",
+		"bad cidr":         "rules:\n  - id: r1\n    event_type: flow\n    match:\n      source_ip|cidr: 10.0.0.0/33\n",
+		"bad regexp":       "rules:\n  - id: r1\n    event_type: flow\n    match:\n      user|re: \"(\"\n",
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseDetectionRules([]byte(doc), "test"); err == nil {
+				t.Error("parseDetectionRules accepted an invalid rule")
+			}
+		})
+	}
+}
+
+func TestCleanupForgetsOldThreats(t *testing.T) {
+	engine := testDetectionEngine(t)
+	engine.threatIDs["recent"] = raisedThreat{id: "THR-1", raised: time.Now()}
+	engine.threatIDs["old"] = raisedThreat{id: "THR-2", raised: time.Now().Add(-25 * time.Hour)}
+
+	engine.cleanup()
+
+	if _, ok := engine.threatIDs["recent"]; !ok {
+		t.Error("cleanup removed a recently raised threat")
+	}
+	if _, ok := engine.threatIDs["old"]; ok {
+		t.Error("cleanup kept a threat last raised a day ago")
+	}
+}
+
+func TestIngestEvents(t *testing.T) {
+	_, token := testUser(t, "admin")
+	router := newRouter()
+
+	saved := detectionEngine
+	detectionEngine = newDetectionEngine()
+	t.Cleanup(func() { detectionEngine = saved })
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   int
+	}{
+		{"single event", `{"type":"auth_failure","source_ip":"192.0.2.1"}`, http.StatusAccepted, 1},
+		{"array", `[{"type":"flow"},{"type":"firewall_hit"}]`, http.StatusAccepted, 2},
+		{"batch object", `{"events":[{"type":"flow"},{"type":"flow"},{"type":"flow"}]}`, http.StatusAccepted, 3},
+		// A single event whose fields mention "events" is still one event
+		{"field named events", `{"type":"flow","fields":{"events":"12"}}`, http.StatusAccepted, 1},
+		{"missing type", `{"events":[{"type":"flow"},{"source_ip":"192.0.2.1"}]}`, http.StatusBadRequest, 0},
+		{"wrong field type", `{"type":5}`, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(detectionEngine.events)
+
+			w := doRequest(t, router, http.MethodPost, "/api/v1/events", json.RawMessage(tt.body), bearer(token)...)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if queued := len(detectionEngine.events) - before; queued != tt.want {
+				t.Errorf("queued %d events, want %d", queued, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectionWritesRequireAdmin(t *testing.T) {
+	_, token := testUser(t, "analyst")
+	router := newRouter()
+
+	saved := detectionEngine
+	detectionEngine = newDetectionEngine()
+	t.Cleanup(func() { detectionEngine = saved })
+
+	for _, path := range []string{"/api/v1/events", "/api/v1/detection/rules/reload"} {
+		w := doRequest(t, router, http.MethodPost, path, json.RawMessage(`{"type":"auth_failure","source_ip":"192.0.2.1"}`), bearer(token)...)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("analyst POST %s = %d, want 403", path, w.Code)
+		}
+	}
+	if queued := len(detectionEngine.events); queued != 0 {
+		t.Errorf("queued %d events from a non-admin", queued)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagACK = 0x10
+)
+
+// StreamDetector is a built-in detector evaluated next to the declarative
+// rules. Detectors are only called from the engine and hold no locks.
+type StreamDetector interface {
+	Name() string
+	Config() map[string]interface{}
+	Process(event SecurityEvent) []Detection
+	Prune(now time.Time)
+}
+
+// DetectorConfig holds the tunable thresholds of the built-in detectors
+type DetectorConfig struct {
+	VerticalScanPorts   int
+	HorizontalScanHosts int
+	PortScanWindow      time.Duration
+	BruteForceAttempts  int
+	BruteForceWindow    time.Duration
+	BruteForcePorts     map[int]string
+	SYNFloodPackets     uint64
+	SYNFloodWindow      time.Duration
+	Cooldown            time.Duration
+}
+
+// loadDetectorConfig reads detector thresholds from the environment
+func loadDetectorConfig() DetectorConfig {
+	config := DetectorConfig{
+		VerticalScanPorts:   getEnvInt("PORTSCAN_VERTICAL_PORTS", 50),
+		HorizontalScanHosts: getEnvInt("PORTSCAN_HORIZONTAL_HOSTS", 30),
+		PortScanWindow:      getEnvDuration("PORTSCAN_WINDOW", time.Minute),
+		BruteForceAttempts:  getEnvInt("BRUTEFORCE_ATTEMPTS", 30),
+		BruteForceWindow:    getEnvDuration("BRUTEFORCE_WINDOW", 5*time.Minute),
+		BruteForcePorts:     make(map[int]string),
+		SYNFloodPackets:     uint64(getEnvInt("SYNFLOOD_PACKETS", 5000)),
+		SYNFloodWindow:      getEnvDuration("SYNFLOOD_WINDOW", 10*time.Second),
+		Cooldown:            getEnvDuration("DETECTOR_COOLDOWN", 10*time.Minute),
+	}
+
+	// BRUTEFORCE_PORTS is a list of port:service pairs, e.g. "22:SSH,3389:RDP"
+	for _, entry := range getEnvList("BRUTEFORCE_PORTS", []string{"22:SSH", "3389:RDP"}) {
+		portText, service, _ := strings.Cut(entry, ":")
+		port, err := strconv.Atoi(portText)
+		if err != nil {
+			continue
+		}
+		if service == "" {
+			service = portText
+		}
+		config.BruteForcePorts[port] = strings.ToUpper(service)
+	}
+
+	return config
+}
+
+// newBuiltinDetectors creates the built-in detectors from a configuration
+func newBuiltinDetectors(config DetectorConfig) []StreamDetector {
+	return []StreamDetector{
+		&portScanDetector{config: config, vertical: newWindowCounter(config.PortScanWindow), horizontal: newWindowCounter(config.PortScanWindow), cooldown: newCooldowns(config.Cooldown)},
+		&bruteForceDetector{config: config, attempts: newWindowCounter(config.BruteForceWindow), cooldown: newCooldowns(config.Cooldown)},
+		&synFloodDetector{config: config, syns: newWindowCounter(config.SYNFloodWindow), cooldown: newCooldowns(config.Cooldown)},
+	}
+}
+
+// isConnectionEvent reports whether an event describes network traffic
+func isConnectionEvent(event SecurityEvent) bool {
+	return (event.Type == "flow" || event.Type == "connection") && event.SourceIP != "" && event.DestIP != ""
+}
+
+// eventPackets returns the packet count of a flow (connection events count as one)
+func eventPackets(event SecurityEvent) uint64 {
+	if packets, err := strconv.ParseUint(event.Fields["packets"], 10, 64); err == nil && packets > 0 {
+		return packets
+	}
+	return 1
+}
+
+// eventTCPFlags returns the cumulative TCP flags of a flow, or -1 if unknown
+func eventTCPFlags(event SecurityEvent) int {
+	if flags, err := strconv.Atoi(event.Fields["tcp_flags"]); err == nil {
+		return flags
+	}
+	return -1
+}
+
+// windowCounter tracks distinct values or summed amounts per key in a sliding window
+type windowCounter struct {
+	window  time.Duration
+	entries map[string]*windowEntry
+}
+
+type windowEntry struct {
+	distinct  map[string]time.Time
+	buckets   []amountBucket
+	samples   []SecurityEvent
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// amountBucket aggregates amounts per second so sums stay bounded in memory
+type amountBucket struct {
+	second int64
+	amount uint64
+}
+
+func newWindowCounter(window time.Duration) *windowCounter {
+	return &windowCounter{window: window, entries: make(map[string]*windowEntry)}
+}
+
+func (wc *windowCounter) entry(key string, event SecurityEvent) *windowEntry {
+	e, exists := wc.entries[key]
+	if !exists {
+		e = &windowEntry{distinct: make(map[string]time.Time), firstSeen: event.Timestamp}
+		wc.entries[key] = e
+	}
+	e.lastSeen = event.Timestamp
+	e.samples = append(e.samples, event)
+	if len(e.samples) > detectionMaxSamples {
+		e.samples = e.samples[len(e.samples)-detectionMaxSamples:]
+	}
+	return e
+}
+
+// addDistinct records a value for a key and returns the distinct count in the window
+func (wc *windowCounter) addDistinct(key, value string, event SecurityEvent) (int, *windowEntry) {
+	e := wc.entry(key, event)
+	e.distinct[value] = event.Timestamp
+
+	cutoff := event.Timestamp.Add(-wc.window)
+	for v, seen := range e.distinct {
+		if seen.Before(cutoff) {
+			delete(e.distinct, v)
+		}
+	}
+	return len(e.distinct), e
+}
+
+// addAmount adds an amount for a key and returns the sum in the window
+func (wc *windowCounter) addAmount(key string, amount uint64, event SecurityEvent) (uint64, *windowEntry) {
+	e := wc.entry(key, event)
+	second := event.Timestamp.Unix()
+	if n := len(e.buckets); n > 0 && e.buckets[n-1].second == second {
+		e.buckets[n-1].amount += amount
+	} else {
+		e.buckets = append(e.buckets, amountBucket{second: second, amount: amount})
+	}
+
+	cutoff := event.Timestamp.Add(-wc.window).Unix()
+	var total uint64
+	valid := e.buckets[:0]
+	for _, bucket := range e.buckets {
+		if bucket.second > cutoff {
+			valid = append(valid, bucket)
+			total += bucket.amount
+		}
+	}
+	e.buckets = valid
+	return total, e
+}
+
+func (wc *windowCounter) reset(key string) {
+	delete(wc.entries, key)
+}
+
+func (wc *windowCounter) prune(now time.Time) {
+	for key, e := range wc.entries {
+		if now.Sub(e.lastSeen) > wc.window {
+			delete(wc.entries, key)
+		}
+	}
+}
+
+// cooldowns suppresses repeated detections for the same key
+type cooldowns struct {
+	period time.Duration
+	fired  map[string]time.Time
+}
+
+func newCooldowns(period time.Duration) *cooldowns {
+	return &cooldowns{period: period, fired: make(map[string]time.Time)}
+}
+
+// allow reports whether a key may fire and records the firing if so
+func (cd *cooldowns) allow(key string, at time.Time) bool {
+	if last, ok := cd.fired[key]; ok && at.Sub(last) < cd.period {
+		return false
+	}
+	cd.fired[key] = at
+	return true
+}
+
+func (cd *cooldowns) prune(now time.Time) {
+	for key, last := range cd.fired {
+		if now.Sub(last) > cd.period {
+			delete(cd.fired, key)
+		}
+	}
+}
+
+// builtinDetection builds a detection with evidence from a window entry
+func builtinDetection(name, key, title, description, severity, threatType, threatName string, event SecurityEvent, group map[string]string, count, threshold int, window time.Duration, entry *windowEntry) Detection {
+	return Detection{
+		Key:         name + "\x00" + key,
+		RuleID:      name,
+		Title:       title,
+		Description: description,
+		Severity:    severity,
+		ThreatType:  threatType,
+		ThreatName:  threatName,
+		SourceIP:    event.SourceIP,
+		TargetIP:    event.DestIP,
+		Port:        event.DestPort,
+		Evidence: &DetectionEvidence{
+			RuleID:    name,
+			RuleTitle: title,
+			Group:     group,
+			Count:     count,
+			Threshold: threshold,
+			Window:    window.String(),
+			FirstSeen: entry.firstSeen,
+			LastSeen:  entry.lastSeen,
+			Events:    append([]SecurityEvent(nil), entry.samples...),
+		},
+	}
+}
+
+// portScanDetector detects vertical (many ports on one host) and horizontal
+// (one port on many hosts) scans from a single source
+type portScanDetector struct {
+	config     DetectorConfig
+	vertical   *windowCounter
+	horizontal *windowCounter
+	cooldown   *cooldowns
+}
+
+func (d *portScanDetector) Name() string { return "builtin:port-scan" }
+
+func (d *portScanDetector) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"vertical_ports":   d.config.VerticalScanPorts,
+		"horizontal_hosts": d.config.HorizontalScanHosts,
+		"window":           d.config.PortScanWindow.String(),
+		"cooldown":         d.config.Cooldown.String(),
+	}
+}
+
+func (d *portScanDetector) Process(event SecurityEvent) []Detection {
+	if !isConnectionEvent(event) || event.DestPort == 0 {
+		return nil
+	}
+
+	var detections []Detection
+
+	key := event.SourceIP + "|" + event.DestIP
+	ports, entry := d.vertical.addDistinct(key, strconv.Itoa(event.DestPort), event)
+	if ports > d.config.VerticalScanPorts {
+		d.vertical.reset(key)
+		if d.cooldown.allow("vertical|"+key, event.Timestamp) {
+			detections = append(detections, builtinDetection(
+				"builtin:port-scan-vertical", key,
+				"Port Scan Detected",
+				fmt.Sprintf("%s probed %d ports on %s within %s", event.SourceIP, ports, event.DestIP, d.config.PortScanWindow),
+				"high", "Port Scan", "Scan.Port.Vertical", event,
+				map[string]string{"source_ip": event.SourceIP, "dest_ip": event.DestIP},
+				ports, d.config.VerticalScanPorts, d.config.PortScanWindow, entry,
+			))
+		}
+	}
+
+	key = event.SourceIP + "|" + strconv.Itoa(event.DestPort)
+	hosts, entry := d.horizontal.addDistinct(key, event.DestIP, event)
+	if hosts > d.config.HorizontalScanHosts {
+		d.horizontal.reset(key)
+		if d.cooldown.allow("horizontal|"+key, event.Timestamp) {
+			detections = append(detections, builtinDetection(
+				"builtin:port-scan-horizontal", key,
+				"Port Scan Detected",
+				fmt.Sprintf("%s probed port %d on %d hosts within %s", event.SourceIP, event.DestPort, hosts, d.config.PortScanWindow),
+				"high", "Port Scan", "Scan.Port.Horizontal", event,
+				map[string]string{"source_ip": event.SourceIP, "dest_port": strconv.Itoa(event.DestPort)},
+				hosts, d.config.HorizontalScanHosts, d.config.PortScanWindow, entry,
+			))
+		}
+	}
+
+	return detections
+}
+
+func (d *portScanDetector) Prune(now time.Time) {
+	d.vertical.prune(now)
+	d.horizontal.prune(now)
+	d.cooldown.prune(now)
+}
+
+// bruteForceDetector detects repeated connections to login services such as
+// SSH and RDP from one source to one target
+type bruteForceDetector struct {
+	config   DetectorConfig
+	attempts *windowCounter
+	cooldown *cooldowns
+}
+
+func (d *bruteForceDetector) Name() string { return "builtin:brute-force" }
+
+func (d *bruteForceDetector) Config() map[string]interface{} {
+	ports := make(map[string]string, len(d.config.BruteForcePorts))
+	for port, service := range d.config.BruteForcePorts {
+		ports[strconv.Itoa(port)] = service
+	}
+	return map[string]interface{}{
+		"attempts": d.config.BruteForceAttempts,
+		"window":   d.config.BruteForceWindow.String(),
+		"ports":    ports,
+		"cooldown": d.config.Cooldown.String(),
+	}
+}
+
+func (d *bruteForceDetector) Process(event SecurityEvent) []Detection {
+	if !isConnectionEvent(event) {
+		return nil
+	}
+	service, watched := d.config.BruteForcePorts[event.DestPort]
+	if !watched || (event.Protocol != "" && !strings.EqualFold(event.Protocol, "TCP")) {
+		return nil
+	}
+
+	key := event.SourceIP + "|" + event.DestIP + "|" + strconv.Itoa(event.DestPort)
+	attempts, entry := d.attempts.addAmount(key, 1, event)
+	if attempts <= uint64(d.config.BruteForceAttempts) {
+		return nil
+	}
+
+	d.attempts.reset(key)
+	if !d.cooldown.allow(key, event.Timestamp) {
+		return nil
+	}
+
+	return []Detection{builtinDetection(
+		"builtin:brute-force-"+strings.ToLower(service), key,
+		fmt.Sprintf("%s Brute Force", service),
+		fmt.Sprintf("%d %s connection attempts from %s to %s within %s", attempts, service, event.SourceIP, event.DestIP, d.config.BruteForceWindow),
+		"high", "Brute Force", "Brute.Force."+service, event,
+		map[string]string{"source_ip": event.SourceIP, "dest_ip": event.DestIP, "dest_port": strconv.Itoa(event.DestPort)},
+		int(attempts), d.config.BruteForceAttempts, d.config.BruteForceWindow, entry,
+	)}
+}
+
+func (d *bruteForceDetector) Prune(now time.Time) {
+	d.attempts.prune(now)
+	d.cooldown.prune(now)
+}
+
+// synFloodDetector detects floods of half-open TCP connections against one target
+type synFloodDetector struct {
+	config   DetectorConfig
+	syns     *windowCounter
+	cooldown *cooldowns
+}
+
+func (d *synFloodDetector) Name() string { return "builtin:syn-flood" }
+
+func (d *synFloodDetector) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"packets":  d.config.SYNFloodPackets,
+		"window":   d.config.SYNFloodWindow.String(),
+		"cooldown": d.config.Cooldown.String(),
+	}
+}
+
+func (d *synFloodDetector) Process(event SecurityEvent) []Detection {
+	if !isConnectionEvent(event) {
+		return nil
+	}
+
+	// Only flows that carried a SYN but never an ACK are half-open
+	flags := eventTCPFlags(event)
+	if flags < 0 || flags&tcpFlagSYN == 0 || flags&tcpFlagACK != 0 {
+		return nil
+	}
+
+	key := event.DestIP + "|" + strconv.Itoa(event.DestPort)
+	packets, entry := d.syns.addAmount(key, eventPackets(event), event)
+	if packets <= d.config.SYNFloodPackets {
+		return nil
+	}
+
+	sources := make(map[string]bool)
+	for _, sample := range entry.samples {
+		sources[sample.SourceIP] = true
+	}
+
+	d.syns.reset(key)
+	if !d.cooldown.allow(key, event.Timestamp) {
+		return nil
+	}
+
+	detection := builtinDetection(
+		"builtin:syn-flood", key,
+		"SYN Flood Detected",
+		fmt.Sprintf("%d half-open SYN packets to %s:%d within %s", packets, event.DestIP, event.DestPort, d.config.SYNFloodWindow),
+		"critical", "DDoS Attack", "DoS.SYN.Flood", event,
+		map[string]string{"dest_ip": event.DestIP, "dest_port": strconv.Itoa(event.DestPort)},
+		int(packets), int(d.config.SYNFloodPackets), d.config.SYNFloodWindow, entry,
+	)
+	if len(sources) > 1 {
+		detection.SourceIP = ""
+		for source := range sources {
+			detection.SourceIPs = append(detection.SourceIPs, source)
+		}
+		sort.Strings(detection.SourceIPs)
+	}
+	return []Detection{detection}
+}
+
+func (d *synFloodDetector) Prune(now time.Time) {
+	d.syns.prune(now)
+	d.cooldown.prune(now)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var detectorEpoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// testDetectorConfig has small thresholds so tests stay short
+func testDetectorConfig() DetectorConfig {
+	return DetectorConfig{
+		VerticalScanPorts:   5,
+		HorizontalScanHosts: 4,
+		PortScanWindow:      time.Minute,
+		BruteForceAttempts:  3,
+		BruteForceWindow:    time.Minute,
+		BruteForcePorts:     map[int]string{22: "SSH"},
+		SYNFloodPackets:     100,
+		SYNFloodWindow:      10 * time.Second,
+		Cooldown:            10 * time.Minute,
+	}
+}
+
+func connection(at time.Duration, source, dest string, port int) SecurityEvent {
+	return SecurityEvent{
+		Type:      "connection",
+		Timestamp: detectorEpoch.Add(at),
+		SourceIP:  source,
+		DestIP:    dest,
+		DestPort:  port,
+		Protocol:  "TCP",
+	}
+}
+
+func synFlow(at time.Duration, source string, packets int, flags int) SecurityEvent {
+	event := connection(at, source, "10.0.0.1", 80)
+	event.Type = "flow"
+	event.Fields = map[string]string{"packets": strconv.Itoa(packets), "tcp_flags": strconv.Itoa(flags)}
+	return event
+}
+
+// feed processes events in order and returns the detections they raised
+func feed(detector StreamDetector, events ...SecurityEvent) []Detection {
+	var detections []Detection
+	for _, event := range events {
+		detections = append(detections, detector.Process(event)...)
+	}
+	return detections
+}
+
+func TestPortScanVertical(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports int
+		step  time.Duration
+		want  int
+	}{
+		{"at threshold", 5, time.Second, 0},
+		{"over threshold", 6, time.Second, 1},
+		// Six ports, but never more than five within a minute
+		{"spread beyond window", 6, 13 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector := newBuiltinDetectors(testDetectorConfig())[0]
+			var events []SecurityEvent
+			for i := 0; i < tt.ports; i++ {
+				events = append(events, connection(time.Duration(i)*tt.step, "192.0.2.1", "10.0.0.1", 1000+i))
+			}
+
+			detections := feed(detector, events...)
+			if len(detections) != tt.want {
+				t.Fatalf("got %d detections, want %d", len(detections), tt.want)
+			}
+			if tt.want > 0 {
+				d := detections[0]
+				if d.RuleID != "builtin:port-scan-vertical" || d.ThreatType != "Port Scan" || d.SourceIP != "192.0.2.1" {
+					t.Errorf("detection = %s %s from %s", d.RuleID, d.ThreatType, d.SourceIP)
+				}
+				if d.Evidence.Count != 6 || d.Evidence.Threshold != 5 {
+					t.Errorf("evidence count %d threshold %d, want 6 and 5", d.Evidence.Count, d.Evidence.Threshold)
+				}
+			}
+		})
+	}
+}
+
+func TestPortScanHorizontal(t *testing.T) {
+	detector := newBuiltinDetectors(testDetectorConfig())[0]
+	var events []SecurityEvent
+	for i := 0; i < 5; i++ {
+		events = append(events, connection(time.Duration(i)*time.Second, "192.0.2.1", fmt.Sprintf("10.0.0.%d", i+1), 445))
+	}
+
+	detections := feed(detector, events...)
+	if len(detections) != 1 || detections[0].RuleID != "builtin:port-scan-horizontal" {
+		t.Fatalf("got %+v, want one horizontal scan", detections)
+	}
+	if got := detections[0].Evidence.Group["dest_port"]; got != "445" {
+		t.Errorf("grouped by port %q, want 445", got)
+	}
+}
+
+func TestPortScanCooldown(t *testing.T) {
+	detector := newBuiltinDetectors(testDetectorConfig())[0]
+	scan := func(start time.Duration) []SecurityEvent {
+		var events []SecurityEvent
+		for i := 0; i < 6; i++ {
+			events = append(events, connection(start+time.Duration(i)*time.Second, "192.0.2.1", "10.0.0.1", 1000+i))
+		}
+		return events
+	}
+
+	if n := len(feed(detector, scan(0)...)); n != 1 {
+		t.Fatalf("first scan raised %d detections, want 1", n)
+	}
+	if n := len(feed(detector, scan(2*time.Minute)...)); n != 0 {
+		t.Fatalf("scan within the cooldown raised %d detections, want 0", n)
+	}
+	if n := len(feed(detector, scan(15*time.Minute)...)); n != 1 {
+		t.Fatalf("scan after the cooldown raised %d detections, want 1", n)
+	}
+}
+
+func TestBruteForce(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		step     time.Duration
+		port     int
+		protocol string
+		want     int
+	}{
+		{"at threshold", 3, time.Second, 22, "TCP", 0},
+		{"over threshold", 4, time.Second, 22, "TCP", 1},
+		{"spread beyond window", 4, 30 * time.Second, 22, "TCP", 0},
+		{"unwatched port", 10, time.Second, 80, "TCP", 0},
+		{"not TCP", 10, time.Second, 22, "UDP", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector := newBuiltinDetectors(testDetectorConfig())[1]
+			var events []SecurityEvent
+			for i := 0; i < tt.attempts; i++ {
+				event := connection(time.Duration(i)*tt.step, "192.0.2.1", "10.0.0.1", tt.port)
+				event.Protocol = tt.protocol
+				events = append(events, event)
+			}
+
+			detections := feed(detector, events...)
+			if len(detections) != tt.want {
+				t.Fatalf("got %d detections, want %d", len(detections), tt.want)
+			}
+			if tt.want > 0 {
+				d := detections[0]
+				if d.RuleID != "builtin:brute-force-ssh" || d.ThreatName != "Brute.Force.SSH" || d.Port != 22 {
+					t.Errorf("detection = %s %s on port %d", d.RuleID, d.ThreatName, d.Port)
+				}
+			}
+		})
+	}
+}
+
+func TestSYNFlood(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []SecurityEvent
+		want   int
+	}{
+		{"at threshold", []SecurityEvent{synFlow(0, "192.0.2.1", 60, tcpFlagSYN), synFlow(time.Second, "192.0.2.1", 40, tcpFlagSYN)}, 0},
+		{"over threshold", []SecurityEvent{synFlow(0, "192.0.2.1", 60, tcpFlagSYN), synFlow(time.Second, "192.0.2.1", 41, tcpFlagSYN)}, 1},
+		{"spread beyond window", []SecurityEvent{synFlow(0, "192.0.2.1", 60, tcpFlagSYN), synFlow(11*time.Second, "192.0.2.1", 60, tcpFlagSYN)}, 0},
+		{"completed handshakes", []SecurityEvent{synFlow(0, "192.0.2.1", 200, tcpFlagSYN|tcpFlagACK)}, 0},
+		{"flags unknown", []SecurityEvent{synFlow(0, "192.0.2.1", 200, -1)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector := newBuiltinDetectors(testDetectorConfig())[2]
+			detections := feed(detector, tt.events...)
+			if len(detections) != tt.want {
+				t.Fatalf("got %d detections, want %d", len(detections), tt.want)
+			}
+			if tt.want > 0 {
+				d := detections[0]
+				if d.ThreatType != "DDoS Attack" || d.SourceIP != "192.0.2.1" || d.SourceIPs != nil {
+					t.Errorf("detection = %s from %q %v, want one source", d.ThreatType, d.SourceIP, d.SourceIPs)
+				}
+			}
+		})
+	}
+}
+
+func TestSYNFloodMultipleSources(t *testing.T) {
+	detector := newBuiltinDetectors(testDetectorConfig())[2]
+	detections := feed(detector,
+		synFlow(0, "198.51.100.7", 40, tcpFlagSYN),
+		synFlow(time.Second, "192.0.2.1", 40, tcpFlagSYN),
+		synFlow(2*time.Second, "198.51.100.7", 40, tcpFlagSYN),
+	)
+	if len(detections) != 1 {
+		t.Fatalf("got %d detections, want 1", len(detections))
+	}
+
+	// A distributed flood has no single source address
+	d := detections[0]
+	if d.SourceIP != "" {
+		t.Errorf("SourceIP = %q, want empty", d.SourceIP)
+	}
+	if want := []string{"192.0.2.1", "198.51.100.7"}; !reflect.DeepEqual(d.SourceIPs, want) {
+		t.Errorf("SourceIPs = %v, want %v", d.SourceIPs, want)
+	}
+}
+
+func TestDetectorsPrune(t *testing.T) {
+	detector := newBuiltinDetectors(testDetectorConfig())[1].(*bruteForceDetector)
+	feed(detector, connection(0, "192.0.2.1", "10.0.0.1", 22))
+	if len(detector.attempts.entries) != 1 {
+		t.Fatalf("tracking %d keys, want 1", len(detector.attempts.entries))
+	}
+
+	detector.Prune(detectorEpoch.Add(30 * time.Second))
+	if len(detector.attempts.entries) != 1 {
+		t.Fatal("pruned a key still inside its window")
+	}
+	detector.Prune(detectorEpoch.Add(2 * time.Minute))
+	if len(detector.attempts.entries) != 0 {
+		t.Fatal("kept a key idle for longer than its window")
+	}
+}
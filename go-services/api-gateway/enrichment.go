@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// IPEnrichment is the context gathered for an IP address seen on a threat or alert
+type IPEnrichment struct {
+	IP           string    `json:"ip"`
+	Class        string    `json:"class"`
+	CountryCode  string    `json:"country_code,omitempty"`
+	Country      string    `json:"country,omitempty"`
+	ASN          uint      `json:"asn,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	Hostnames    []string  `json:"hostnames,omitempty"`
+	EnrichedAt   time.Time `json:"enriched_at"`
+}
+
+// ipRange is a named special-purpose address block
+type ipRange struct {
+	class   string
+	network *net.IPNet
+}
+
+// specialRanges classifies non-public address space (RFC 6890 and friends).
+// More specific blocks come first.
+var specialRanges = func() []ipRange {
+	blocks := []struct{ class, cidr string }{
+		{"unspecified", "0.0.0.0/32"},
+		{"reserved", "0.0.0.0/8"},
+		{"private", "10.0.0.0/8"},
+		{"cgnat", "100.64.0.0/10"},
+		{"loopback", "127.0.0.0/8"},
+		{"link_local", "169.254.0.0/16"},
+		{"private", "172.16.0.0/12"},
+		{"documentation", "192.0.2.0/24"},
+		{"reserved", "192.0.0.0/24"},
+		{"private", "192.168.0.0/16"},
+		{"reserved", "198.18.0.0/15"},
+		{"documentation", "198.51.100.0/24"},
+		{"documentation", "203.0.113.0/24"},
+		{"multicast", "224.0.0.0/4"},
+		{"broadcast", "255.255.255.255/32"},
+		{"reserved", "240.0.0.0/4"},
+		{"unspecified", "::/128"},
+		{"loopback", "::1/128"},
+		{"documentation", "2001:db8::/32"},
+		{"private", "fc00::/7"},
+		{"link_local", "fe80::/10"},
+		{"multicast", "ff00::/8"},
+	}
+
+	ranges := make([]ipRange, 0, len(blocks))
+	for _, block := range blocks {
+		_, network, _ := net.ParseCIDR(block.cidr)
+		ranges = append(ranges, ipRange{class: block.class, network: network})
+	}
+	return ranges
+}()
+
+// classifyIP returns the address class of an IP ("public" when not special)
+func classifyIP(ip net.IP) string {
+	if ip == nil {
+		return "invalid"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, r := range specialRanges {
+		if r.network.Contains(ip) {
+			return r.class
+		}
+	}
+	// Translated and tunnelled IPv6 reaches whatever IPv4 address it embeds
+	if embedded := embeddedIPv4(ip); embedded != nil {
+		return classifyIP(embedded)
+	}
+	return "public"
+}
+
+// IPv6 blocks that carry an IPv4 address: NAT64 (RFC 6052) and
+// IPv4-compatible addresses in the low 32 bits, 6to4 (RFC 3056) in bits 16-47
+var (
+	nat64Prefix      = mustParseCIDR("64:ff9b::/96")
+	ipv4CompatPrefix = mustParseCIDR("::/96")
+	sixToFourPrefix  = mustParseCIDR("2002::/16")
+)
+
+// mustParseCIDR parses a CIDR known to be valid
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// embeddedIPv4 returns the IPv4 address an IPv6 address embeds, or nil
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+	switch {
+	case nat64Prefix.Contains(ip), ipv4CompatPrefix.Contains(ip):
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+	case sixToFourPrefix.Contains(ip):
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4()
+	}
+	return nil
+}
+
+// dnsCacheEntry is a cached reverse DNS answer
+type dnsCacheEntry struct {
+	names   []string
+	expires time.Time
+}
+
+// Enricher looks up GeoIP, ASN and reverse DNS information for addresses
+type Enricher struct {
+	countryDB   *maxminddb.Reader
+	asnDB       *maxminddb.Reader
+	reverseDNS  bool
+	dnsTimeout  time.Duration
+	dnsTTL      time.Duration
+	negativeTTL time.Duration
+	// dnsCacheSize bounds dnsCache between prunes; 0 means unbounded
+	dnsCacheSize int
+	dnsCache     map[string]dnsCacheEntry
+	dnsMu        sync.Mutex
+	queue        chan enrichmentJob
+	// done stops the workers; Close waits for them before releasing the
+	// databases they read
+	done      chan struct{}
+	closeOnce sync.Once
+	workers   sync.WaitGroup
+}
+
+// enrichmentJob asks a worker to enrich a stored threat or alert
+type enrichmentJob struct {
+	kind string
+	id   string
+}
+
+var enricher = &Enricher{
+	dnsCacheSize: 10000,
+	dnsCache:     make(map[string]dnsCacheEntry),
+	queue:        make(chan enrichmentJob, 1000),
+	done:         make(chan struct{}),
+}
+
+// Configure opens the MaxMind databases and applies reverse DNS settings
+func (e *Enricher) Configure() {
+	e.reverseDNS = getEnvBool("ENABLE_REVERSE_DNS", true)
+	e.dnsTimeout = getEnvDuration("REVERSE_DNS_TIMEOUT", 2*time.Second)
+	e.dnsTTL = getEnvDuration("REVERSE_DNS_CACHE_TTL", time.Hour)
+	e.negativeTTL = getEnvDuration("REVERSE_DNS_NEGATIVE_TTL", 10*time.Minute)
+	e.dnsCacheSize = getEnvInt("REVERSE_DNS_CACHE_SIZE", e.dnsCacheSize)
+
+	if path := getEnv("GEOIP_COUNTRY_DB", ""); path != "" {
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			log.Printf("Failed to open GeoIP country database %s: %v", path, err)
+		} else {
+			e.countryDB = db
+			log.Printf("Loaded GeoIP country database %s (%s)", path, db.Metadata.DatabaseType)
+		}
+	}
+
+	if path := getEnv("GEOIP_ASN_DB", ""); path != "" {
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			log.Printf("Failed to open GeoIP ASN database %s: %v", path, err)
+		} else {
+			e.asnDB = db
+			log.Printf("Loaded GeoIP ASN database %s (%s)", path, db.Metadata.DatabaseType)
+		}
+	}
+}
+
+// Close stops the workers, waiting for lookups in progress, and releases the
+// MaxMind databases. Jobs still queued are dropped.
+func (e *Enricher) Close() {
+	e.closeOnce.Do(func() { close(e.done) })
+	e.workers.Wait()
+
+	if e.countryDB != nil {
+		e.countryDB.Close()
+	}
+	if e.asnDB != nil {
+		e.asnDB.Close()
+	}
+}
+
+// Status reports which enrichment sources are available
+func (e *Enricher) Status() map[string]interface{} {
+	e.dnsMu.Lock()
+	cached := len(e.dnsCache)
+	e.dnsMu.Unlock()
+
+	return map[string]interface{}{
+		"geoip_country":  e.countryDB != nil,
+		"geoip_asn":      e.asnDB != nil,
+		"reverse_dns":    e.reverseDNS,
+		"dns_cache_size": cached,
+		"queued_lookups": len(e.queue),
+	}
+}
+
+// Enrich gathers all available context for an IP address. Values that are
+// not addresses (e.g. "unknown" or "multiple") are returned as class "invalid".
+func (e *Enricher) Enrich(address string) *IPEnrichment {
+	result := &IPEnrichment{IP: address, EnrichedAt: time.Now()}
+
+	ip := net.ParseIP(address)
+	result.Class = classifyIP(ip)
+	if ip == nil {
+		return result
+	}
+
+	if result.Class == "public" {
+		if e.countryDB != nil {
+			var record struct {
+				Country struct {
+					ISOCode string            `maxminddb:"iso_code"`
+					Names   map[string]string `maxminddb:"names"`
+				} `maxminddb:"country"`
+				RegisteredCountry struct {
+					ISOCode string            `maxminddb:"iso_code"`
+					Names   map[string]string `maxminddb:"names"`
+				} `maxminddb:"registered_country"`
+			}
+			if err := e.countryDB.Lookup(ip, &record); err == nil {
+				result.CountryCode = record.Country.ISOCode
+				result.Country = record.Country.Names["en"]
+				if result.CountryCode == "" {
+					result.CountryCode = record.RegisteredCountry.ISOCode
+					result.Country = record.RegisteredCountry.Names["en"]
+				}
+			}
+		}
+
+		if e.asnDB != nil {
+			var record struct {
+				Number       uint   `maxminddb:"autonomous_system_number"`
+				Organization string `maxminddb:"autonomous_system_organization"`
+			}
+			if err := e.asnDB.Lookup(ip, &record); err == nil {
+				result.ASN = record.Number
+				result.Organization = record.Organization
+			}
+		}
+	}
+
+	if e.reverseDNS && result.Class != "unspecified" && result.Class != "multicast" && result.Class != "broadcast" {
+		result.Hostnames = e.lookupAddr(ip.String())
+	}
+
+	return result
+}
+
+// lookupAddr resolves PTR records, caching answers and failures
+func (e *Enricher) lookupAddr(address string) []string {
+	now := time.Now()
+
+	e.dnsMu.Lock()
+	entry, ok := e.dnsCache[address]
+	e.dnsMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.names
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.dnsTimeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, address)
+	ttl := e.dnsTTL
+	if err != nil || len(names) == 0 {
+		names = nil
+		ttl = e.negativeTTL
+	}
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+
+	e.dnsMu.Lock()
+	if _, cached := e.dnsCache[address]; !cached && e.dnsCacheSize > 0 && len(e.dnsCache) >= e.dnsCacheSize {
+		e.evictDNSEntries(now)
+	}
+	e.dnsCache[address] = dnsCacheEntry{names: names, expires: now.Add(ttl)}
+	e.dnsMu.Unlock()
+
+	return names
+}
+
+// evictDNSEntries makes room in a full reverse DNS cache by dropping expired
+// answers, or the one closest to expiring when none has. The caller must hold
+// dnsMu.
+func (e *Enricher) evictDNSEntries(now time.Time) {
+	var oldest string
+	var oldestExpiry time.Time
+	for address, entry := range e.dnsCache {
+		if now.After(entry.expires) {
+			delete(e.dnsCache, address)
+			continue
+		}
+		if oldest == "" || entry.expires.Before(oldestExpiry) {
+			oldest, oldestExpiry = address, entry.expires
+		}
+	}
+	if len(e.dnsCache) >= e.dnsCacheSize {
+		delete(e.dnsCache, oldest)
+	}
+}
+
+// pruneDNSCache drops expired reverse DNS answers
+func (e *Enricher) pruneDNSCache() {
+	now := time.Now()
+
+	e.dnsMu.Lock()
+	defer e.dnsMu.Unlock()
+
+	for address, entry := range e.dnsCache {
+		if now.After(entry.expires) {
+			delete(e.dnsCache, address)
+		}
+	}
+}
+
+// EnrichAddresses enriches each non-empty named address
+func (e *Enricher) EnrichAddresses(addresses map[string]string) map[string]*IPEnrichment {
+	result := make(map[string]*IPEnrichment)
+	for field, address := range addresses {
+		if address == "" {
+			continue
+		}
+		result[field] = e.Enrich(address)
+	}
+	return result
+}
+
+// QueueThreat schedules background enrichment of a stored threat. When the
+// queue is full the threat is queued again when it is next read.
+func (e *Enricher) QueueThreat(id string) {
+	select {
+	case e.queue <- enrichmentJob{kind: "threat", id: id}:
+	default:
+	}
+}
+
+// QueueAlert schedules background enrichment of a stored alert. When the
+// queue is full the alert is queued again when it is next read.
+func (e *Enricher) QueueAlert(id string) {
+	select {
+	case e.queue <- enrichmentJob{kind: "alert", id: id}:
+	default:
+	}
+}
+
+// work processes queued jobs until the enricher is closed
+func (e *Enricher) work() {
+	defer e.workers.Done()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case job := <-e.queue:
+			e.process(job)
+		}
+	}
+}
+
+// process enriches one threat or alert, stores the result and publishes an
+// update so Last-Modified and cached responses reflect it
+func (e *Enricher) process(job enrichmentJob) {
+	switch job.kind {
+	case "threat":
+		dataMux.RLock()
+		threat, exists := threats[job.id]
+		var addresses map[string]string
+		if exists {
+			addresses = map[string]string{"source_ip": threat.SourceIP, "target_ip": threat.TargetIP}
+		}
+		dataMux.RUnlock()
+		if !exists {
+			return
+		}
+
+		enrichment := e.EnrichAddresses(addresses)
+		dataMux.Lock()
+		threat.Enrichment = enrichment
+		dataMux.Unlock()
+		publishEvent(nil, EventThreatUpdated, "threat", job.id, threat)
+	case "alert":
+		dataMux.RLock()
+		alert, exists := alerts[job.id]
+		var addresses map[string]string
+		if exists {
+			addresses = map[string]string{"source_ip": alert.SourceIP}
+		}
+		dataMux.RUnlock()
+		if !exists {
+			return
+		}
+
+		enrichment := e.EnrichAddresses(addresses)
+		dataMux.Lock()
+		alert.Enrichment = enrichment
+		dataMux.Unlock()
+		publishEvent(nil, EventAlertUpdated, "alert", job.id, alert)
+	}
+}
+
+// queueAlertEnrichment queues an alert the background worker has not
+// enriched yet, like queueThreatEnrichment does for threats
+func queueAlertEnrichment(alert *Alert) {
+	if alert.Enrichment == nil {
+		enricher.QueueAlert(alert.ID)
+	}
+}
+
+// queueThreatEnrichment queues a threat the background worker has not
+// enriched yet, because the queue was full when it was stored. Lookups never
+// run on the request path; the caller returns what is stored so far.
+func queueThreatEnrichment(threat *Threat) {
+	if threat.Enrichment == nil {
+		enricher.QueueThreat(threat.ID)
+	}
+}
+
+// matchesEnrichmentFilter reports whether an enrichment satisfies the
+// country, asn and ip_class filters (empty filters match everything)
+func matchesEnrichmentFilter(enrichment *IPEnrichment, country, asn, class string) bool {
+	if country == "" && asn == "" && class == "" {
+		return true
+	}
+	if enrichment == nil {
+		return false
+	}
+	if country != "" && !strings.EqualFold(enrichment.CountryCode, country) {
+		return false
+	}
+	if asn != "" && strconv.FormatUint(uint64(enrichment.ASN), 10) != strings.TrimPrefix(strings.ToUpper(asn), "AS") {
+		return false
+	}
+	if class != "" && enrichment.Class != class {
+		return false
+	}
+	return true
+}
+
+// startEnrichment opens the GeoIP databases, starts the enrichment workers
+// and queues existing threats and alerts
+func startEnrichment() {
+	enricher.Configure()
+
+	workers := getEnvInt("ENRICHMENT_WORKERS", 4)
+	for i := 0; i < workers; i++ {
+		enricher.workers.Add(1)
+		go enricher.work()
+	}
+
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			enricher.pruneDNSCache()
+		}
+	}()
+
+	dataMux.RLock()
+	var threatIDs, alertIDs []string
+	for id := range threats {
+		threatIDs = append(threatIDs, id)
+	}
+	for id := range alerts {
+		alertIDs = append(alertIDs, id)
+	}
+	dataMux.RUnlock()
+
+	for _, id := range threatIDs {
+		enricher.QueueThreat(id)
+	}
+	for _, id := range alertIDs {
+		enricher.QueueAlert(id)
+	}
+}
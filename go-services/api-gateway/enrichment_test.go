@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useTestEnrichmentQueue swaps the enricher's queue for an empty one that no
+// worker reads, so tests can see which jobs were queued
+func useTestEnrichmentQueue(t *testing.T) chan enrichmentJob {
+	t.Helper()
+
+	queue := make(chan enrichmentJob, 10)
+	saved := enricher.queue
+	enricher.queue = queue
+	t.Cleanup(func() { enricher.queue = saved })
+	return queue
+}
+
+func TestReadingThreatQueuesEnrichment(t *testing.T) {
+	_, token := testUser(t, "analyst")
+	router := newRouter()
+	queue := useTestEnrichmentQueue(t)
+
+	id := testThreat(t)
+	dataMux.Lock()
+	threats[id].SourceIP = "192.0.2.1"
+	dataMux.Unlock()
+
+	requests := map[string]func() int{
+		"rest": func() int {
+			return doRequest(t, router, http.MethodGet, "/api/v1/threats/"+id, nil, bearer(token)...).Code
+		},
+		"graphql": func() int {
+			query := map[string]string{"query": `{ threat(id: "` + id + `") { id } }`}
+			return doRequest(t, router, http.MethodPost, "/graphql", query, bearer(token)...).Code
+		},
+	}
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			if code := request(); code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", code)
+			}
+
+			select {
+			case job := <-queue:
+				if job.kind != "threat" || job.id != id {
+					t.Errorf("queued %s %s, want threat %s", job.kind, job.id, id)
+				}
+			default:
+				t.Fatal("reading an unenriched threat did not queue enrichment")
+			}
+
+			dataMux.RLock()
+			enriched := threats[id].Enrichment != nil
+			dataMux.RUnlock()
+			if enriched {
+				t.Error("threat was enriched on the request path")
+			}
+		})
+	}
+
+	// Once the worker has stored enrichment, reads do not queue it again
+	enricher.process(enrichmentJob{kind: "threat", id: id})
+	doRequest(t, router, http.MethodGet, "/api/v1/threats/"+id, nil, bearer(token)...)
+	if len(queue) != 0 {
+		t.Errorf("reading an enriched threat queued %d jobs", len(queue))
+	}
+}
+
+func TestReadingAlertQueuesEnrichment(t *testing.T) {
+	_, token := testUser(t, "analyst")
+	router := newRouter()
+	queue := useTestEnrichmentQueue(t)
+
+	dataMux.Lock()
+	id := nextResourceID("ALT", len(alerts), func(id string) bool { _, ok := alerts[id]; return ok })
+	alerts[id] = &Alert{ID: id, Title: "unenriched", Severity: "low", SourceIP: "192.0.2.1", Timestamp: time.Now()}
+	dataMux.Unlock()
+	t.Cleanup(func() {
+		dataMux.Lock()
+		delete(alerts, id)
+		dataMux.Unlock()
+	})
+
+	requests := map[string]func() int{
+		"rest": func() int {
+			return doRequest(t, router, http.MethodGet, "/api/v1/alerts/"+id, nil, bearer(token)...).Code
+		},
+		"graphql": func() int {
+			query := map[string]string{"query": `{ alert(id: "` + id + `") { id } }`}
+			return doRequest(t, router, http.MethodPost, "/graphql", query, bearer(token)...).Code
+		},
+	}
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			if code := request(); code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", code)
+			}
+
+			select {
+			case job := <-queue:
+				if job.kind != "alert" || job.id != id {
+					t.Errorf("queued %s %s, want alert %s", job.kind, job.id, id)
+				}
+			default:
+				t.Fatal("reading an unenriched alert did not queue enrichment")
+			}
+		})
+	}
+
+	dataMux.Lock()
+	alerts[id].Enrichment = map[string]*IPEnrichment{}
+	dataMux.Unlock()
+	doRequest(t, router, http.MethodGet, "/api/v1/alerts/"+id, nil, bearer(token)...)
+	if len(queue) != 0 {
+		t.Errorf("reading an enriched alert queued %d jobs", len(queue))
+	}
+}
+
+func TestEnrichmentPublishesUpdate(t *testing.T) {
+	useTestCache(t)
+	_, token := testUser(t, "analyst")
+	router := newRouter()
+	events := captureEvents(t, EventAlertUpdated)
+
+	dataMux.Lock()
+	id := nextResourceID("ALT", len(alerts), func(id string) bool { _, ok := alerts[id]; return ok })
+	created := time.Now().Add(-time.Hour)
+	alerts[id] = &Alert{ID: id, Title: "enriched later", Severity: "low", SourceIP: "192.0.2.1", Timestamp: created}
+	dataMux.Unlock()
+	t.Cleanup(func() {
+		dataMux.Lock()
+		delete(alerts, id)
+		dataMux.Unlock()
+	})
+
+	cacheStatus(t, router, "/api/v1/dashboard/stats", token)
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", token); got != "HIT" {
+		t.Fatalf("second GET = %s, want HIT", got)
+	}
+	before := resourceModified("alert", id, created)
+
+	enricher.process(enrichmentJob{kind: "alert", id: id})
+
+	if event := nextEvent(t, events); event.ResourceID != id {
+		t.Errorf("published an update for %s, want %s", event.ResourceID, id)
+	}
+	if after := resourceModified("alert", id, created); !after.After(before) {
+		t.Errorf("Last-Modified stayed at %v after enrichment", before)
+	}
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", token); got != "MISS" {
+		t.Errorf("GET after enrichment = %s, want MISS", got)
+	}
+}
+
+func TestDNSCacheBound(t *testing.T) {
+	e := &Enricher{
+		dnsTimeout:   time.Millisecond,
+		negativeTTL:  time.Hour,
+		dnsCacheSize: 3,
+		dnsCache:     make(map[string]dnsCacheEntry),
+	}
+	now := time.Now()
+	e.dnsCache["192.0.2.1"] = dnsCacheEntry{expires: now.Add(-time.Minute)}
+	e.dnsCache["192.0.2.2"] = dnsCacheEntry{expires: now.Add(time.Minute)}
+	e.dnsCache["192.0.2.3"] = dnsCacheEntry{expires: now.Add(2 * time.Minute)}
+
+	// The expired answer makes room first
+	e.lookupAddr("192.0.2.4")
+	if _, ok := e.dnsCache["192.0.2.1"]; ok || len(e.dnsCache) != 3 {
+		t.Errorf("cache = %v, want the expired entry replaced", e.dnsCache)
+	}
+
+	// Then the answer closest to expiring
+	e.lookupAddr("192.0.2.5")
+	if _, ok := e.dnsCache["192.0.2.2"]; ok || len(e.dnsCache) != 3 {
+		t.Errorf("cache = %v, want the soonest-expiring entry replaced", e.dnsCache)
+	}
+}
+
+func TestEnricherCloseStopsWorkers(t *testing.T) {
+	e := &Enricher{
+		dnsCache: make(map[string]dnsCacheEntry),
+		queue:    make(chan enrichmentJob, 10),
+		done:     make(chan struct{}),
+	}
+	for i := 0; i < 4; i++ {
+		e.workers.Add(1)
+		go e.work()
+	}
+
+	// Close returns only once every worker has exited, so nothing can be
+	// inside a database lookup when the databases are released
+	e.Close()
+	e.QueueAlert("ALT-closed")
+	if len(e.queue) != 1 {
+		t.Errorf("a worker consumed a job after Close returned")
+	}
+
+	// Closing again is harmless
+	e.Close()
+}
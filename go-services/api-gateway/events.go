@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Event types published on the event bus
+const (
+	EventAlertCreated           = "alert.created"
+	EventAlertUpdated           = "alert.updated"
+	EventAlertDeleted           = "alert.deleted"
+	EventThreatCreated          = "threat.created"
+	EventThreatDetected         = "threat.detected"
+	EventThreatUpdated          = "threat.updated"
+	EventThreatAnalyzed         = "threat.analyzed"
+	EventThreatDeleted          = "threat.deleted"
+	EventFirewallRuleChanged    = "firewall.rule.changed"
+	EventUserCreated            = "user.created"
+	EventUserUpdated            = "user.updated"
+	EventUserDeleted            = "user.deleted"
+	EventAPIKeyCreated          = "apikey.created"
+	EventAPIKeyUpdated          = "apikey.updated"
+	EventAPIKeyRevoked          = "apikey.revoked"
+	EventWebhookCreated         = "webhook.created"
+	EventWebhookUpdated         = "webhook.updated"
+	EventWebhookDeleted         = "webhook.deleted"
+	EventWebhookDisabled        = "webhook.disabled"
+	EventBackupCreated          = "backup.created"
+	EventBackupRestored         = "backup.restored"
+	EventMonitoringStarted      = "network.monitoring.started"
+	EventMonitoringStopped      = "network.monitoring.stopped"
+	EventDetectionRulesReloaded = "detection.rules.reloaded"
+	EventIntelFeedRefreshed     = "intel.feed.refreshed"
+)
+
+// Event is a domain event describing a change in the system
+type Event struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Actor      string      `json:"actor"`
+	Resource   string      `json:"resource"`
+	ResourceID string      `json:"resource_id,omitempty"`
+	Severity   string      `json:"severity,omitempty"`
+	RequestID  string      `json:"request_id,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+
+	// origin is the span of the request that caused the event, so work
+	// it triggers later can be linked back to it
+	origin trace.SpanContext
+}
+
+// matchEventType reports whether an event type matches a subscription
+// pattern: "*", an exact type, or a prefix wildcard such as "alert.*"
+func matchEventType(pattern, eventType string) bool {
+	switch {
+	case pattern == "*" || pattern == eventType:
+		return true
+	case strings.HasSuffix(pattern, ".*"):
+		return strings.HasPrefix(eventType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// eventSubscriber receives matching events on its own goroutine
+type eventSubscriber struct {
+	name     string
+	patterns []string
+	events   chan Event
+	dropped  atomic.Int64
+}
+
+func (s *eventSubscriber) matches(eventType string) bool {
+	for _, pattern := range s.patterns {
+		if matchEventType(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventBus is an in-process publish/subscribe bus. Publishing never blocks:
+// a subscriber that falls behind drops events rather than stalling handlers.
+type EventBus struct {
+	subscribers map[int]*eventSubscriber
+	nextSub     int
+	mu          sync.RWMutex
+	nextID      atomic.Int64
+	published   atomic.Int64
+}
+
+var eventBus = newEventBus()
+
+func newEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[int]*eventSubscriber)}
+}
+
+// Subscribe registers a handler for events matching any of the patterns and
+// returns a function that removes the subscription
+func (b *EventBus) Subscribe(name string, buffer int, handler func(Event), patterns ...string) func() {
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	sub := &eventSubscriber{name: name, patterns: patterns, events: make(chan Event, buffer)}
+
+	b.mu.Lock()
+	b.nextSub++
+	id := b.nextSub
+	b.subscribers[id] = sub
+	b.mu.Unlock()
+
+	go func() {
+		for event := range sub.events {
+			handler(event)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, id)
+			close(sub.events)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Publish assigns an ID and timestamp to an event and delivers it to every
+// matching subscriber
+func (b *EventBus) Publish(event Event) Event {
+	event.ID = fmt.Sprintf("evt_%d", b.nextID.Add(1))
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	b.published.Add(1)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subscribers {
+		if !sub.matches(event.Type) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			if sub.dropped.Add(1)%100 == 1 {
+				log.Printf("Event subscriber %s is falling behind, dropping %s", sub.name, event.Type)
+			}
+		}
+	}
+	return event
+}
+
+// Stats returns per-subscriber queue depth and drop counters
+func (b *EventBus) Stats() map[string]interface{} {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	subscribers := make([]gin.H, 0, len(b.subscribers))
+	for _, sub := range b.subscribers {
+		subscribers = append(subscribers, gin.H{
+			"name":     sub.name,
+			"patterns": sub.patterns,
+			"queued":   len(sub.events),
+			"dropped":  sub.dropped.Load(),
+		})
+	}
+
+	return map[string]interface{}{
+		"published":   b.published.Load(),
+		"subscribers": subscribers,
+	}
+}
+
+// eventSnapshot copies mutable resources so subscribers never observe later
+// changes (or race with them) and strips secrets from the payload. Callers
+// must not hold dataMux or usersMux. API keys and webhooks are copied
+// without a lock, so callers pass a copy or hold apiKeysMux or webhooksMux.
+func eventSnapshot(data interface{}) (interface{}, string) {
+	switch v := data.(type) {
+	case *Alert:
+		dataMux.RLock()
+		defer dataMux.RUnlock()
+		snapshot := *v
+		return &snapshot, v.Severity
+	case *Threat:
+		dataMux.RLock()
+		defer dataMux.RUnlock()
+		snapshot := *v
+		return &snapshot, v.Severity
+	case *FirewallRule:
+		dataMux.RLock()
+		defer dataMux.RUnlock()
+		snapshot := *v
+		return &snapshot, ""
+	case *User:
+		usersMux.RLock()
+		defer usersMux.RUnlock()
+		return gin.H{
+			"id":      v.ID,
+			"email":   v.Email,
+			"name":    v.Name,
+			"company": v.Company,
+			"role":    v.Role,
+		}, ""
+	case *APIKey:
+		snapshot := *v
+		snapshot.Key = ""
+		return &snapshot, ""
+	case *Webhook:
+		snapshot := *v
+		snapshot.Secret = ""
+		snapshot.RoutingKey = ""
+		return &snapshot, ""
+	}
+	return data, ""
+}
+
+// publishEvent publishes an event on behalf of the request's user. c may be
+// nil for events raised by background components.
+func publishEvent(c *gin.Context, eventType, resource, resourceID string, data interface{}) {
+	actor := "system"
+	requestID := ""
+	var origin trace.SpanContext
+	if c != nil {
+		if userID, exists := c.Get("user_id"); exists {
+			actor = fmt.Sprintf("%v", userID)
+		}
+		requestID = c.GetString("request_id")
+		if c.Request != nil {
+			origin = trace.SpanContextFromContext(c.Request.Context())
+		}
+	}
+
+	snapshot, severity := eventSnapshot(data)
+	now := time.Now()
+	markModified(eventType, resource, resourceID, now)
+	invalidateResponses(eventType, resource)
+	countEvent(eventType, snapshot)
+	eventBus.Publish(Event{
+		Type:       eventType,
+		Timestamp:  now,
+		Actor:      actor,
+		Resource:   resource,
+		ResourceID: resourceID,
+		Severity:   severity,
+		RequestID:  requestID,
+		Data:       snapshot,
+		origin:     origin,
+	})
+}
+
+// notifyEvent turns high-severity alerts and threats into notifications for
+// admins and analysts
+func notifyEvent(event Event) {
+	if event.Severity != "high" && event.Severity != "critical" {
+		return
+	}
+
+	var notifType, title, message, link string
+	switch data := event.Data.(type) {
+	case *Alert:
+		notifType = "alert"
+		title = "New " + strings.ToUpper(event.Severity[:1]) + event.Severity[1:] + " Alert"
+		message = data.Title
+		link = "/dashboard/alerts/" + data.ID
+	case *Threat:
+		notifType = "threat"
+		title = "Threat Detected"
+		message = fmt.Sprintf("%s from %s", data.Name, data.SourceIP)
+		link = "/dashboard/threats/" + data.ID
+	default:
+		return
+	}
+
+	usersMux.RLock()
+	var recipients []string
+	for _, user := range users {
+		if user.Role == "admin" || user.Role == "analyst" {
+			recipients = append(recipients, user.ID)
+		}
+	}
+	usersMux.RUnlock()
+
+	for _, userID := range recipients {
+		createNotification(userID, notifType, title, message, event.Severity, link)
+	}
+}
+
+// auditEvent records a domain event in the audit log
+func auditEvent(event Event) {
+	auditLogsMux.Lock()
+	defer auditLogsMux.Unlock()
+
+	auditLogID++
+	auditLogs = append(auditLogs, &AuditLog{
+		ID:         fmt.Sprintf("audit_%d", auditLogID),
+		Timestamp:  event.Timestamp,
+		UserID:     event.Actor,
+		Action:     event.Type,
+		Resource:   event.Resource,
+		ResourceID: event.ResourceID,
+		RequestID:  event.RequestID,
+		Metadata: map[string]interface{}{
+			"event_id": event.ID,
+			"severity": event.Severity,
+		},
+	})
+
+	if len(auditLogs) > 10000 {
+		auditLogs = auditLogs[len(auditLogs)-10000:]
+	}
+}
+
+// startEventBus wires the built-in subscribers to the event bus
+func startEventBus() {
+	go hub.run()
+	go publishStats(wsStatsInterval)
+
+	eventBus.Subscribe("webhooks", 1000, triggerWebhook)
+	eventBus.Subscribe("websocket", 1000, broadcastEvent)
+	eventBus.Subscribe("notifications", 1000, notifyEvent, "alert.created", "threat.detected")
+	eventBus.Subscribe("audit", 1000, auditEvent)
+}
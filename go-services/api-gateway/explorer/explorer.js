@@ -0,0 +1,416 @@
+// GraphQL explorer for the NetGuard API gateway. It is served from the
+// gateway binary, so it must not load anything from other origins.
+(function () {
+	'use strict';
+
+	var endpoint = location.pathname.replace(/\/+$/, '');
+	var wsEndpoint = (location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + endpoint;
+
+	var defaultQuery = [
+		'# Queries and mutations are sent over HTTP, subscriptions over',
+		'# the graphql-transport-ws websocket protocol.',
+		'query RecentAlerts($limit: Int) {',
+		'  alerts(limit: $limit) {',
+		'    edges {',
+		'      id',
+		'      title',
+		'      severity',
+		'      status',
+		'      timestamp',
+		'    }',
+		'    pageInfo {',
+		'      totalCount',
+		'      hasNextPage',
+		'    }',
+		'  }',
+		'}',
+		''
+	].join('\n');
+
+	var introspectionQuery = [
+		'query IntrospectionQuery {',
+		'  __schema {',
+		'    queryType { name }',
+		'    mutationType { name }',
+		'    subscriptionType { name }',
+		'    types {',
+		'      kind name description',
+		'      fields { name description args { name type { ...TypeRef } defaultValue } type { ...TypeRef } }',
+		'      inputFields { name description type { ...TypeRef } defaultValue }',
+		'      enumValues { name description }',
+		'    }',
+		'  }',
+		'}',
+		'fragment TypeRef on __Type {',
+		'  kind name',
+		'  ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } }',
+		'}'
+	].join('\n');
+
+	var el = function (id) { return document.getElementById(id); };
+	var queryInput = el('query');
+	var variablesInput = el('variables');
+	var credentialInput = el('credential');
+	var authKind = el('auth-kind');
+	var result = el('result');
+	var status = el('status');
+	var runButton = el('run');
+	var stopButton = el('stop');
+	var docs = el('docs');
+
+	var socket = null;
+	var schema = null;
+	var docsHistory = [];
+
+	// Editor state survives reloads; credentials only last for the tab
+	queryInput.value = localStorage.getItem('netguard.graphql.query') || defaultQuery;
+	variablesInput.value = localStorage.getItem('netguard.graphql.variables') || '{\n  "limit": 5\n}';
+	credentialInput.value = sessionStorage.getItem('netguard.graphql.credential') || '';
+	authKind.value = sessionStorage.getItem('netguard.graphql.authKind') || 'token';
+
+	queryInput.addEventListener('input', function () {
+		localStorage.setItem('netguard.graphql.query', queryInput.value);
+	});
+	variablesInput.addEventListener('input', function () {
+		localStorage.setItem('netguard.graphql.variables', variablesInput.value);
+	});
+	credentialInput.addEventListener('change', function () {
+		sessionStorage.setItem('netguard.graphql.credential', credentialInput.value);
+		schema = null;
+	});
+	authKind.addEventListener('change', function () {
+		sessionStorage.setItem('netguard.graphql.authKind', authKind.value);
+		schema = null;
+	});
+
+	function setStatus(text, isError) {
+		status.textContent = text;
+		status.className = isError ? 'error' : '';
+	}
+
+	function show(value) {
+		result.textContent = typeof value === 'string' ? value : JSON.stringify(value, null, 2);
+	}
+
+	function authHeaders() {
+		var credential = credentialInput.value.trim();
+		if (!credential) {
+			return {};
+		}
+		return authKind.value === 'apikey' ? { 'X-API-Key': credential } : { 'Authorization': 'Bearer ' + credential };
+	}
+
+	function parseVariables() {
+		var text = variablesInput.value.trim();
+		return text ? JSON.parse(text) : {};
+	}
+
+	// operationType returns the type of the first operation in the document
+	function operationType(query) {
+		var stripped = query.replace(/#[^\n]*/g, '').replace(/"""[\s\S]*?"""|"(?:\\.|[^"\\])*"/g, '""');
+		var match = stripped.match(/(?:^|[\n}])\s*(query|mutation|subscription)\b/);
+		return match ? match[1] : 'query';
+	}
+
+	function execute(query, variables) {
+		return fetch(endpoint, {
+			method: 'POST',
+			headers: Object.assign({ 'Content-Type': 'application/json' }, authHeaders()),
+			body: JSON.stringify({ query: query, variables: variables })
+		}).then(function (response) {
+			return response.json().then(function (body) {
+				if (!response.ok && !body.errors) {
+					throw new Error(body.error || response.statusText);
+				}
+				return body;
+			});
+		});
+	}
+
+	function run() {
+		var variables;
+		try {
+			variables = parseVariables();
+		} catch (err) {
+			setStatus('Variables are not valid JSON: ' + err.message, true);
+			return;
+		}
+
+		stop();
+		var query = queryInput.value;
+		if (operationType(query) === 'subscription') {
+			subscribe(query, variables);
+			return;
+		}
+
+		var started = performance.now();
+		setStatus('Running…');
+		execute(query, variables).then(function (body) {
+			setStatus('Completed in ' + Math.round(performance.now() - started) + ' ms', !!body.errors);
+			show(body);
+		}).catch(function (err) {
+			setStatus(err.message, true);
+		});
+	}
+
+	function subscribe(query, variables) {
+		var events = [];
+		var payload = {};
+		var headers = authHeaders();
+		Object.keys(headers).forEach(function (key) { payload[key] = headers[key]; });
+
+		var ws = new WebSocket(wsEndpoint, 'graphql-transport-ws');
+		socket = ws;
+		runButton.hidden = true;
+		stopButton.hidden = false;
+		setStatus('Connecting…');
+		show('');
+
+		ws.onopen = function () {
+			ws.send(JSON.stringify({ type: 'connection_init', payload: payload }));
+		};
+		ws.onmessage = function (message) {
+			var msg = JSON.parse(message.data);
+			switch (msg.type) {
+			case 'connection_ack':
+				setStatus('Subscribed, waiting for events…');
+				ws.send(JSON.stringify({ id: '1', type: 'subscribe', payload: { query: query, variables: variables } }));
+				break;
+			case 'ping':
+				ws.send(JSON.stringify({ type: 'pong' }));
+				break;
+			case 'next':
+				events.unshift(msg.payload);
+				events.length = Math.min(events.length, 50);
+				setStatus('Received ' + new Date().toLocaleTimeString());
+				show(events);
+				break;
+			case 'error':
+				setStatus('Subscription failed', true);
+				show({ errors: msg.payload });
+				break;
+			case 'complete':
+				stop();
+				setStatus('Subscription completed');
+				break;
+			}
+		};
+		ws.onclose = function (event) {
+			// A socket already stopped by the user has been replaced or cleared
+			if (socket !== ws) {
+				return;
+			}
+			if (event.code !== 1000) {
+				setStatus('Connection closed: ' + (event.reason || event.code), true);
+			}
+			socket = null;
+			runButton.hidden = false;
+			stopButton.hidden = true;
+		};
+	}
+
+	function stop() {
+		if (!socket) {
+			return;
+		}
+		var closing = socket;
+		socket = null;
+		if (closing.readyState === WebSocket.OPEN) {
+			closing.send(JSON.stringify({ id: '1', type: 'complete' }));
+		}
+		closing.close(1000);
+		runButton.hidden = false;
+		stopButton.hidden = true;
+		setStatus('Stopped');
+	}
+
+	// Documentation explorer
+
+	function typeName(ref) {
+		if (ref.kind === 'NON_NULL') {
+			return typeName(ref.ofType) + '!';
+		}
+		if (ref.kind === 'LIST') {
+			return '[' + typeName(ref.ofType) + ']';
+		}
+		return ref.name;
+	}
+
+	function namedType(ref) {
+		return ref.ofType ? namedType(ref.ofType) : ref.name;
+	}
+
+	function node(tag, className, text) {
+		var n = document.createElement(tag);
+		if (className) {
+			n.className = className;
+		}
+		if (text !== undefined) {
+			n.textContent = text;
+		}
+		return n;
+	}
+
+	function typeLink(ref) {
+		var span = node('span');
+		var text = typeName(ref);
+		var name = namedType(ref);
+		var at = text.indexOf(name);
+		span.appendChild(document.createTextNode(text.slice(0, at)));
+		var link = node('a', '', name);
+		link.addEventListener('click', function () { showType(name, true); });
+		span.appendChild(link);
+		span.appendChild(document.createTextNode(text.slice(at + name.length)));
+		return span;
+	}
+
+	function renderField(field) {
+		var row = node('div', 'field');
+		row.appendChild(node('span', 'field-name', field.name));
+		if (field.args && field.args.length) {
+			row.appendChild(document.createTextNode('('));
+			field.args.forEach(function (arg, i) {
+				if (i > 0) {
+					row.appendChild(document.createTextNode(', '));
+				}
+				row.appendChild(document.createTextNode(arg.name + ': '));
+				row.appendChild(typeLink(arg.type));
+			});
+			row.appendChild(document.createTextNode(')'));
+		}
+		row.appendChild(document.createTextNode(': '));
+		row.appendChild(typeLink(field.type));
+		if (field.description) {
+			row.appendChild(node('p', 'description', field.description));
+		}
+		return row;
+	}
+
+	function renderPath() {
+		var path = el('docs-path');
+		path.textContent = '';
+		var home = node('a', '', 'Schema');
+		home.addEventListener('click', function () { docsHistory = []; showRoot(); });
+		path.appendChild(home);
+		docsHistory.forEach(function (name, i) {
+			path.appendChild(document.createTextNode('› '));
+			var link = node('a', '', name);
+			link.addEventListener('click', function () {
+				docsHistory = docsHistory.slice(0, i);
+				showType(name, true);
+			});
+			path.appendChild(link);
+		});
+	}
+
+	function showRoot() {
+		var body = el('docs-body');
+		body.textContent = '';
+		renderPath();
+		body.appendChild(node('h2', '', 'Root types'));
+		[['query', schema.queryType], ['mutation', schema.mutationType], ['subscription', schema.subscriptionType]].forEach(function (root) {
+			if (!root[1]) {
+				return;
+			}
+			var row = node('div', 'field');
+			row.appendChild(node('span', 'field-name', root[0]));
+			row.appendChild(document.createTextNode(': '));
+			row.appendChild(typeLink({ kind: 'OBJECT', name: root[1].name }));
+			body.appendChild(row);
+		});
+
+		body.appendChild(node('h3', '', 'All types'));
+		schema.types.filter(function (t) { return t.name.indexOf('__') !== 0; }).forEach(function (t) {
+			var row = node('div', 'field');
+			row.appendChild(typeLink({ kind: t.kind, name: t.name }));
+			body.appendChild(row);
+		});
+	}
+
+	function showType(name, push) {
+		var type = schema.types.filter(function (t) { return t.name === name; })[0];
+		if (!type) {
+			return;
+		}
+		if (push) {
+			docsHistory.push(name);
+		}
+		renderPath();
+
+		var body = el('docs-body');
+		body.textContent = '';
+		body.appendChild(node('h2', '', type.name));
+		if (type.description) {
+			body.appendChild(node('p', 'muted', type.description));
+		}
+
+		var fields = type.fields || type.inputFields;
+		if (fields && fields.length) {
+			body.appendChild(node('h3', '', 'Fields'));
+			fields.forEach(function (field) { body.appendChild(renderField(field)); });
+		}
+		if (type.enumValues && type.enumValues.length) {
+			body.appendChild(node('h3', '', 'Values'));
+			type.enumValues.forEach(function (value) {
+				var row = node('div', 'field');
+				row.appendChild(node('span', 'field-name', value.name));
+				body.appendChild(row);
+			});
+		}
+		if (!fields && !type.enumValues) {
+			body.appendChild(node('p', 'muted', type.kind.toLowerCase() + ' scalar'));
+		}
+	}
+
+	function loadDocs() {
+		if (schema) {
+			docsHistory = [];
+			showRoot();
+			return;
+		}
+		el('docs-body').textContent = 'Loading schema…';
+		execute(introspectionQuery, {}).then(function (body) {
+			if (body.errors) {
+				throw new Error(body.errors[0].message);
+			}
+			schema = body.data.__schema;
+			docsHistory = [];
+			showRoot();
+		}).catch(function (err) {
+			el('docs-body').textContent = 'Could not load the schema: ' + err.message;
+		});
+	}
+
+	el('docs-toggle').addEventListener('click', function () {
+		docs.hidden = !docs.hidden;
+		if (!docs.hidden) {
+			loadDocs();
+		}
+	});
+
+	el('prettify').addEventListener('click', function () {
+		try {
+			variablesInput.value = JSON.stringify(parseVariables(), null, 2);
+			localStorage.setItem('netguard.graphql.variables', variablesInput.value);
+		} catch (err) {
+			setStatus('Variables are not valid JSON: ' + err.message, true);
+		}
+	});
+
+	runButton.addEventListener('click', run);
+	stopButton.addEventListener('click', stop);
+
+	[queryInput, variablesInput].forEach(function (input) {
+		input.addEventListener('keydown', function (event) {
+			if (event.key === 'Enter' && (event.ctrlKey || event.metaKey)) {
+				event.preventDefault();
+				run();
+			} else if (event.key === 'Tab' && !event.shiftKey) {
+				event.preventDefault();
+				var start = input.selectionStart;
+				input.value = input.value.slice(0, start) + '  ' + input.value.slice(input.selectionEnd);
+				input.selectionStart = input.selectionEnd = start + 2;
+			}
+		});
+	});
+})();
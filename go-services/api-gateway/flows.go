@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxFlowEndpoints  = 10000
+	maxFlowInterfaces = 4096
+	maxActiveFlows    = 100000
+	flowActiveWindow  = 60 * time.Second
+	flowExporterTTL   = time.Hour
+)
+
+// well-known service ports used to label flows by application protocol
+var flowServicePorts = map[int]string{
+	20: "FTP", 21: "FTP", 22: "SSH", 23: "Telnet", 25: "SMTP", 53: "DNS",
+	67: "DHCP", 68: "DHCP", 80: "HTTP", 110: "POP3", 123: "NTP", 143: "IMAP",
+	161: "SNMP", 389: "LDAP", 443: "HTTPS", 445: "SMB", 587: "SMTP",
+	993: "IMAPS", 995: "POP3S", 1433: "MSSQL", 3306: "MySQL", 3389: "RDP",
+	5432: "PostgreSQL", 6379: "Redis", 8080: "HTTP", 8443: "HTTPS",
+}
+
+var ipProtocolNames = map[int]string{
+	1: "ICMP", 6: "TCP", 17: "UDP", 47: "GRE", 50: "ESP", 58: "ICMPv6",
+}
+
+// trafficCounter accumulates bytes, packets and flows
+type trafficCounter struct {
+	Bytes   uint64 `json:"bytes"`
+	Packets uint64 `json:"packets"`
+	Flows   uint64 `json:"flows"`
+}
+
+func (t *trafficCounter) add(rec FlowRecord) {
+	t.Bytes += rec.Bytes
+	t.Packets += rec.Packets
+	t.Flows++
+}
+
+// interfaceCounter tracks traffic seen on one exporter interface
+type interfaceCounter struct {
+	Exporter   string `json:"exporter"`
+	Index      int    `json:"index"`
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
+	PacketsIn  uint64 `json:"packets_in"`
+	PacketsOut uint64 `json:"packets_out"`
+	Flows      uint64 `json:"flows"`
+	lastSeen   time.Time
+}
+
+// endpointCounter tracks traffic sent and received by one IP address
+type endpointCounter struct {
+	IP        string `json:"ip"`
+	BytesSent uint64 `json:"bytes_sent"`
+	BytesRecv uint64 `json:"bytes_recv"`
+	Flows     uint64 `json:"flows"`
+}
+
+// bandwidthBucket holds the traffic of one time slot split by direction
+type bandwidthBucket struct {
+	slot     int64
+	Inbound  uint64
+	Outbound uint64
+	Internal uint64
+	Packets  uint64
+}
+
+// FlowAggregator aggregates decoded flows per interface, protocol and endpoint
+type FlowAggregator struct {
+	mu         sync.RWMutex
+	startedAt  time.Time
+	localNets  []*net.IPNet
+	totals     trafficCounter
+	protocols  map[string]*trafficCounter
+	interfaces map[string]*interfaceCounter
+	endpoints  map[string]*endpointCounter
+	seconds    [60]bandwidthBucket
+	hours      [24]bandwidthBucket
+	active     map[string]time.Time
+	lastFlow   time.Time
+}
+
+func newFlowAggregator(localNetworks []string) *FlowAggregator {
+	agg := &FlowAggregator{
+		startedAt:  time.Now(),
+		protocols:  make(map[string]*trafficCounter),
+		interfaces: make(map[string]*interfaceCounter),
+		endpoints:  make(map[string]*endpointCounter),
+		active:     make(map[string]time.Time),
+	}
+
+	for _, cidr := range localNetworks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			agg.localNets = append(agg.localNets, network)
+		} else {
+			log.Printf("Ignoring invalid local network %q: %v", cidr, err)
+		}
+	}
+
+	return agg
+}
+
+// isLocal reports whether an IP belongs to one of the configured local networks
+func (a *FlowAggregator) isLocal(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range a.localNets {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// flowApplication labels a flow with an application protocol name
+func flowApplication(rec FlowRecord) string {
+	if rec.Protocol == 6 || rec.Protocol == 17 {
+		if name, ok := flowServicePorts[rec.DstPort]; ok {
+			return name
+		}
+		if name, ok := flowServicePorts[rec.SrcPort]; ok {
+			return name
+		}
+	}
+	if name, ok := ipProtocolNames[rec.Protocol]; ok {
+		return name
+	}
+	return fmt.Sprintf("IP-%d", rec.Protocol)
+}
+
+// bucketFor returns the ring bucket for a slot, resetting it if it is stale
+func bucketFor(ring []bandwidthBucket, slot int64) *bandwidthBucket {
+	bucket := &ring[slot%int64(len(ring))]
+	if bucket.slot != slot {
+		*bucket = bandwidthBucket{slot: slot}
+	}
+	return bucket
+}
+
+// Add records a decoded flow
+func (a *FlowAggregator) Add(rec FlowRecord) {
+	srcLocal := a.isLocal(rec.SrcIP)
+	dstLocal := a.isLocal(rec.DstIP)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.totals.add(rec)
+	a.lastFlow = rec.Received
+
+	app := flowApplication(rec)
+	if a.protocols[app] == nil {
+		a.protocols[app] = &trafficCounter{}
+	}
+	a.protocols[app].add(rec)
+
+	if rec.InputIf > 0 {
+		iface := a.interfaceFor(rec.Exporter, rec.InputIf, rec.Received)
+		iface.BytesIn += rec.Bytes
+		iface.PacketsIn += rec.Packets
+		iface.Flows++
+	}
+	if rec.OutputIf > 0 {
+		iface := a.interfaceFor(rec.Exporter, rec.OutputIf, rec.Received)
+		iface.BytesOut += rec.Bytes
+		iface.PacketsOut += rec.Packets
+		if rec.InputIf != rec.OutputIf {
+			iface.Flows++
+		}
+	}
+
+	a.endpointFor(rec.SrcIP).BytesSent += rec.Bytes
+	a.endpointFor(rec.SrcIP).Flows++
+	a.endpointFor(rec.DstIP).BytesRecv += rec.Bytes
+	a.endpointFor(rec.DstIP).Flows++
+	if len(a.endpoints) > maxFlowEndpoints {
+		a.pruneEndpoints()
+	}
+
+	second := bucketFor(a.seconds[:], rec.Received.Unix())
+	hour := bucketFor(a.hours[:], rec.Received.Unix()/3600)
+	for _, bucket := range []*bandwidthBucket{second, hour} {
+		switch {
+		case dstLocal && !srcLocal:
+			bucket.Inbound += rec.Bytes
+		case srcLocal && !dstLocal:
+			bucket.Outbound += rec.Bytes
+		default:
+			bucket.Internal += rec.Bytes
+		}
+		bucket.Packets += rec.Packets
+	}
+
+	key := fmt.Sprintf("%d|%s|%d|%s|%d", rec.Protocol, rec.SrcIP, rec.SrcPort, rec.DstIP, rec.DstPort)
+	if _, exists := a.active[key]; !exists && len(a.active) >= maxActiveFlows {
+		a.pruneActiveLocked()
+		// Still full of live flows: stop tracking new ones until some expire
+		// rather than growing without bound
+		if len(a.active) >= maxActiveFlows {
+			return
+		}
+	}
+	a.active[key] = rec.Received
+}
+
+// interfaceFor returns the counter for an exporter interface, evicting the
+// longest idle interface when the limit is hit
+func (a *FlowAggregator) interfaceFor(exporter string, index int, seen time.Time) *interfaceCounter {
+	key := fmt.Sprintf("%s#%d", exporter, index)
+	iface, exists := a.interfaces[key]
+	if !exists {
+		if len(a.interfaces) >= maxFlowInterfaces {
+			oldest := ""
+			for k, candidate := range a.interfaces {
+				if oldest == "" || candidate.lastSeen.Before(a.interfaces[oldest].lastSeen) {
+					oldest = k
+				}
+			}
+			delete(a.interfaces, oldest)
+		}
+		iface = &interfaceCounter{Exporter: exporter, Index: index}
+		a.interfaces[key] = iface
+	}
+	iface.lastSeen = seen
+	return iface
+}
+
+func (a *FlowAggregator) endpointFor(ip string) *endpointCounter {
+	endpoint, exists := a.endpoints[ip]
+	if !exists {
+		endpoint = &endpointCounter{IP: ip}
+		a.endpoints[ip] = endpoint
+	}
+	return endpoint
+}
+
+// pruneEndpoints keeps the busiest half of the endpoints once the limit is hit
+func (a *FlowAggregator) pruneEndpoints() {
+	list := make([]*endpointCounter, 0, len(a.endpoints))
+	for _, endpoint := range a.endpoints {
+		list = append(list, endpoint)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].BytesSent+list[i].BytesRecv > list[j].BytesSent+list[j].BytesRecv
+	})
+	for _, endpoint := range list[maxFlowEndpoints/2:] {
+		delete(a.endpoints, endpoint.IP)
+	}
+}
+
+// prune forgets flows that have not been seen within the active window and
+// interfaces of exporters that have gone quiet
+func (a *FlowAggregator) prune() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pruneActiveLocked()
+
+	cutoff := time.Now().Add(-flowExporterTTL)
+	for key, iface := range a.interfaces {
+		if iface.lastSeen.Before(cutoff) {
+			delete(a.interfaces, key)
+		}
+	}
+}
+
+// pruneActiveLocked forgets flows that have not been seen within the active
+// window. The caller holds a.mu.
+func (a *FlowAggregator) pruneActiveLocked() {
+	cutoff := time.Now().Add(-flowActiveWindow)
+	for key, seen := range a.active {
+		if seen.Before(cutoff) {
+			delete(a.active, key)
+		}
+	}
+}
+
+// Rates returns inbound, outbound and total bytes per second and packets per
+// second averaged over the last minute
+func (a *FlowAggregator) Rates() (inbound, outbound, total, packets float64) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	now := time.Now().Unix()
+	window := float64(len(a.seconds))
+	if elapsed := time.Since(a.startedAt).Seconds(); elapsed < window {
+		window = elapsed
+	}
+	if window < 1 {
+		window = 1
+	}
+
+	var in, out, internal, pkts uint64
+	for _, bucket := range a.seconds {
+		if bucket.slot > now-int64(len(a.seconds)) && bucket.slot <= now {
+			in += bucket.Inbound
+			out += bucket.Outbound
+			internal += bucket.Internal
+			pkts += bucket.Packets
+		}
+	}
+
+	return float64(in) / window, float64(out) / window, float64(in+out+internal) / window, float64(pkts) / window
+}
+
+// Totals returns the cumulative traffic counters
+func (a *FlowAggregator) Totals() trafficCounter {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.totals
+}
+
+// ActiveFlows returns the number of distinct flows seen in the last minute
+func (a *FlowAggregator) ActiveFlows() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	cutoff := time.Now().Add(-flowActiveWindow)
+	count := 0
+	for _, seen := range a.active {
+		if seen.After(cutoff) {
+			count++
+		}
+	}
+	return count
+}
+
+// TopProtocols returns application protocols ordered by byte share
+func (a *FlowAggregator) TopProtocols(limit int) []gin.H {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	names := make([]string, 0, len(a.protocols))
+	for name := range a.protocols {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return a.protocols[names[i]].Bytes > a.protocols[names[j]].Bytes
+	})
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+
+	result := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		counter := a.protocols[name]
+		percentage := 0.0
+		if a.totals.Bytes > 0 {
+			percentage = roundTo(float64(counter.Bytes)/float64(a.totals.Bytes)*100, 1)
+		}
+		result = append(result, gin.H{
+			"protocol":   name,
+			"percentage": percentage,
+			"bytes":      counter.Bytes,
+			"packets":    counter.Packets,
+			"flows":      counter.Flows,
+		})
+	}
+	return result
+}
+
+// Interfaces returns per-interface traffic counters
+func (a *FlowAggregator) Interfaces() []gin.H {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	list := make([]*interfaceCounter, 0, len(a.interfaces))
+	for _, iface := range a.interfaces {
+		list = append(list, iface)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Exporter != list[j].Exporter {
+			return list[i].Exporter < list[j].Exporter
+		}
+		return list[i].Index < list[j].Index
+	})
+
+	result := make([]gin.H, 0, len(list))
+	for _, iface := range list {
+		result = append(result, gin.H{
+			"name":        fmt.Sprintf("%s/if%d", iface.Exporter, iface.Index),
+			"exporter":    iface.Exporter,
+			"index":       iface.Index,
+			"packets":     iface.PacketsIn + iface.PacketsOut,
+			"bytes":       iface.BytesIn + iface.BytesOut,
+			"bytes_in":    iface.BytesIn,
+			"bytes_out":   iface.BytesOut,
+			"packets_in":  iface.PacketsIn,
+			"packets_out": iface.PacketsOut,
+			"flows":       iface.Flows,
+		})
+	}
+	return result
+}
+
+// TopEndpoints returns the endpoints that moved the most bytes
+func (a *FlowAggregator) TopEndpoints(limit int) []*endpointCounter {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	list := make([]*endpointCounter, 0, len(a.endpoints))
+	for _, endpoint := range a.endpoints {
+		copied := *endpoint
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].BytesSent+list[i].BytesRecv > list[j].BytesSent+list[j].BytesRecv
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// HourlyBandwidth returns average inbound/outbound MB/s for each of the last 24 hours
+func (a *FlowAggregator) HourlyBandwidth() []gin.H {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	currentHour := time.Now().Unix() / 3600
+	result := make([]gin.H, 0, len(a.hours))
+	for slot := currentHour - int64(len(a.hours)) + 1; slot <= currentHour; slot++ {
+		bucket := a.hours[slot%int64(len(a.hours))]
+		if bucket.slot != slot {
+			continue
+		}
+
+		seconds := 3600.0
+		if slot == currentHour {
+			seconds = float64(time.Now().Unix()%3600 + 1)
+		}
+		result = append(result, gin.H{
+			"hour":     time.Unix(slot*3600, 0).Format("15:04"),
+			"inbound":  roundTo(float64(bucket.Inbound)/seconds/1e6, 2),
+			"outbound": roundTo(float64(bucket.Outbound)/seconds/1e6, 2),
+			"internal": roundTo(float64(bucket.Internal)/seconds/1e6, 2),
+		})
+	}
+	return result
+}
+
+// FlowCollector receives NetFlow v5/v9 and IPFIX datagrams over UDP
+type FlowCollector struct {
+	addr         string
+	conn         *net.UDPConn
+	templates    *flowTemplates
+	stats        *FlowAggregator
+	handlers     []func(FlowRecord)
+	handlersMu   sync.RWMutex
+	packets      atomic.Uint64
+	decodeErrors atomic.Uint64
+	startedAt    time.Time
+	done         chan struct{}
+}
+
+var (
+	flowStats     = newFlowAggregator(getEnvList("FLOW_LOCAL_NETWORKS", []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}))
+	flowCollector *FlowCollector
+)
+
+func newFlowCollector(addr string, stats *FlowAggregator) *FlowCollector {
+	return &FlowCollector{
+		addr:      addr,
+		templates: newFlowTemplates(),
+		stats:     stats,
+		done:      make(chan struct{}),
+	}
+}
+
+// OnFlow registers a handler that is called for every decoded flow
+func (fc *FlowCollector) OnFlow(handler func(FlowRecord)) {
+	fc.handlersMu.Lock()
+	defer fc.handlersMu.Unlock()
+	fc.handlers = append(fc.handlers, handler)
+}
+
+// Start binds the UDP socket and starts decoding datagrams
+func (fc *FlowCollector) Start() error {
+	udpAddr, err := net.ResolveUDPAddr("udp", fc.addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+
+	fc.conn = conn
+	fc.startedAt = time.Now()
+
+	go fc.readLoop()
+	go fc.cleanupLoop()
+
+	return nil
+}
+
+// Addr returns the bound UDP address, useful when listening on port 0
+func (fc *FlowCollector) Addr() net.Addr {
+	if fc.conn == nil {
+		return nil
+	}
+	return fc.conn.LocalAddr()
+}
+
+// Stop closes the UDP socket
+func (fc *FlowCollector) Stop() {
+	if fc.conn == nil {
+		return
+	}
+	close(fc.done)
+	fc.conn.Close()
+}
+
+func (fc *FlowCollector) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, remote, err := fc.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-fc.done:
+				return
+			default:
+				log.Printf("Flow collector read error: %v", err)
+				continue
+			}
+		}
+
+		fc.packets.Add(1)
+		records, err := decodeFlowPacket(buf[:n], remote.IP.String(), fc.templates)
+		if err != nil {
+			fc.decodeErrors.Add(1)
+		}
+
+		fc.handlersMu.RLock()
+		handlers := fc.handlers
+		fc.handlersMu.RUnlock()
+
+		for _, rec := range records {
+			fc.stats.Add(rec)
+			for _, handler := range handlers {
+				handler(rec)
+			}
+		}
+	}
+}
+
+func (fc *FlowCollector) cleanupLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fc.done:
+			return
+		case <-ticker.C:
+			fc.stats.prune()
+			fc.templates.prune()
+		}
+	}
+}
+
+// Status returns collector counters
+func (fc *FlowCollector) Status() gin.H {
+	return gin.H{
+		"listen_addr":   fc.Addr().String(),
+		"datagrams":     fc.packets.Load(),
+		"decode_errors": fc.decodeErrors.Load(),
+		"templates":     fc.templates.count(),
+		"started_at":    fc.startedAt,
+	}
+}
+
+// startFlowCollector starts the UDP flow collector if it is enabled
+func startFlowCollector() {
+	if !getEnvBool("ENABLE_FLOW_COLLECTOR", true) {
+		return
+	}
+
+	collector := newFlowCollector(getEnv("FLOW_COLLECTOR_ADDR", ":2055"), flowStats)
+	if err := collector.Start(); err != nil {
+		log.Printf("Failed to start flow collector: %v", err)
+		// Flows are optional input, so the gateway keeps serving without them
+		registerHealthCheck(HealthCheck{
+			Name:      "flow_collector",
+			Readiness: true,
+			Check: func(ctx context.Context) (gin.H, error) {
+				return nil, healthWarning("not listening: %v", err)
+			},
+		})
+		return
+	}
+
+	flowCollector = collector
+	log.Printf("Flow collector listening on %s", collector.Addr())
+
+	registerHealthCheck(HealthCheck{
+		Name:      "flow_collector",
+		Readiness: true,
+		Check: func(ctx context.Context) (gin.H, error) {
+			return collector.Status(), nil
+		},
+	})
+}
+
+// flowUptime returns how long flows have been collected
+func flowUptime() time.Duration {
+	if flowCollector == nil {
+		return 0
+	}
+	return time.Since(flowCollector.startedAt)
+}
+
+// formatBandwidth formats a bytes-per-second rate for display
+func formatBandwidth(bytesPerSecond float64) string {
+	switch {
+	case bytesPerSecond >= 1e9:
+		return fmt.Sprintf("%.1f GB/s", bytesPerSecond/1e9)
+	case bytesPerSecond >= 1e6:
+		return fmt.Sprintf("%.1f MB/s", bytesPerSecond/1e6)
+	case bytesPerSecond >= 1e3:
+		return fmt.Sprintf("%.1f KB/s", bytesPerSecond/1e3)
+	default:
+		return fmt.Sprintf("%.0f B/s", bytesPerSecond)
+	}
+}
+
+// roundTo rounds a float to the given number of decimal places
+func roundTo(value float64, places int) float64 {
+	scale := 1.0
+	for i := 0; i < places; i++ {
+		scale *= 10
+	}
+	return float64(int64(value*scale+0.5)) / scale
+}
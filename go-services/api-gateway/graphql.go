@@ -1,105 +1,116 @@
 package main
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/graph-gophers/graphql-go/introspection"
+	gqlotel "github.com/graph-gophers/graphql-go/trace/otel"
 )
 
-// GraphQL handler
-func graphqlHandler(c *gin.Context) {
-	// TODO: Implement GraphQL using graphql-go or gqlgen
-	
-	var req struct {
-		Query     string                 `json:"query"`
-		Variables map[string]interface{} `json:"variables"`
+var (
+	graphqlSchema        *graphql.Schema
+	graphqlMaxComplexity int
+)
+
+// startGraphQL parses the schema and binds it to the resolvers
+func startGraphQL() {
+	opts := []graphql.SchemaOpt{
+		graphql.MaxDepth(getEnvInt("GRAPHQL_MAX_DEPTH", 10)),
+		graphql.MaxParallelism(getEnvInt("GRAPHQL_MAX_PARALLELISM", 10)),
+		graphql.Tracer(graphqlTracer{gqlotel.DefaultTracer()}),
+	}
+	if !getEnvBool("GRAPHQL_INTROSPECTION", true) {
+		opts = append(opts, graphql.DisableIntrospection())
+	}
+
+	graphqlSchema = graphql.MustParseSchema(schema, &graphqlResolver{}, opts...)
+	graphqlMaxComplexity = getEnvInt("GRAPHQL_MAX_COMPLEXITY", 1000)
+}
+
+// graphqlTracer traces operations and resolvers without recording query
+// variables, which can carry credentials
+type graphqlTracer struct {
+	*gqlotel.Tracer
+}
+
+func (t graphqlTracer) TraceQuery(ctx context.Context, queryString, operationName string, variables map[string]interface{}, varTypes map[string]*introspection.Type) (context.Context, func([]*gqlerrors.QueryError)) {
+	return t.Tracer.TraceQuery(ctx, queryString, operationName, nil, varTypes)
+}
+
+// graphqlRequest is an operation posted over HTTP or sent in a
+// graphql-transport-ws subscribe message
+type graphqlRequest struct {
+	Query         string                 `json:"query" binding:"required"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// check validates the operation and enforces the complexity limit before any
+// resolver runs; depth is enforced during validation
+func (r *graphqlRequest) check() []*gqlerrors.QueryError {
+	if errs := graphqlSchema.ValidateWithVariables(r.Query, r.Variables); len(errs) > 0 {
+		return errs
+	}
+
+	complexity, err := queryComplexity(r.Query, r.OperationName, r.Variables)
+	if err != nil {
+		return []*gqlerrors.QueryError{gqlerrors.Errorf("%s", err)}
+	}
+	if graphqlMaxComplexity > 0 && complexity > graphqlMaxComplexity {
+		return []*gqlerrors.QueryError{gqlerrors.Errorf("query complexity %d exceeds the limit of %d", complexity, graphqlMaxComplexity)}
 	}
+	return nil
+}
 
+// GraphQL handler
+func graphqlHandler(c *gin.Context) {
+	var req graphqlRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Example response
-	c.JSON(http.StatusOK, gin.H{
-		"data": gin.H{
-			"alerts": []gin.H{
-				{
-					"id":       "alert_1",
-					"severity": "high",
-					"type":     "port_scan",
-				},
-			},
-		},
-	})
-}
-
-// GraphQL Playground handler
-func playgroundHandler(c *gin.Context) {
-	html := `
-<!DOCTYPE html>
-<html>
-<head>
-	<meta charset=utf-8/>
-	<meta name="viewport" content="user-scalable=no, initial-scale=1.0, minimum-scale=1.0, maximum-scale=1.0, minimal-ui">
-	<title>GraphQL Playground</title>
-	<link rel="stylesheet" href="//cdn.jsdelivr.net/npm/graphql-playground-react/build/static/css/index.css" />
-	<link rel="shortcut icon" href="//cdn.jsdelivr.net/npm/graphql-playground-react/build/favicon.png" />
-	<script src="//cdn.jsdelivr.net/npm/graphql-playground-react/build/static/js/middleware.js"></script>
-</head>
-<body>
-	<div id="root">
-		<style>
-			body {
-				background-color: rgb(23, 42, 58);
-				font-family: Open Sans, sans-serif;
-				height: 90vh;
-			}
-			#root {
-				height: 100%;
-				width: 100%;
-				display: flex;
-				align-items: center;
-				justify-content: center;
-			}
-			.loading {
-				font-size: 32px;
-				font-weight: 200;
-				color: rgba(255, 255, 255, .6);
-				margin-left: 20px;
-			}
-			img {
-				width: 78px;
-				height: 78px;
-			}
-			.title {
-				font-weight: 400;
-			}
-		</style>
-		<img src='//cdn.jsdelivr.net/npm/graphql-playground-react/build/logo.png' alt=''>
-		<div class="loading"> Loading
-			<span class="title">GraphQL Playground</span>
-		</div>
-	</div>
-	<script>window.addEventListener('load', function (event) {
-		GraphQLPlayground.init(document.getElementById('root'), {
-			endpoint: '/graphql'
-		})
-	})</script>
-</body>
-</html>
-	`
-	c.Header("Content-Type", "text/html")
-	c.String(http.StatusOK, html)
-}
-
-// GraphQL schema definition
+	if errs := req.check(); len(errs) > 0 {
+		c.JSON(http.StatusOK, gin.H{"errors": errs})
+		return
+	}
+
+	ctx := context.WithValue(c.Request.Context(), graphqlRequestKey{}, c)
+	c.JSON(http.StatusOK, graphqlSchema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+}
+
+// graphqlGetHandler serves graphql-transport-ws subscriptions to websocket
+// clients and the explorer to browsers
+func graphqlGetHandler(c *gin.Context) {
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		serveGraphQLWebsocket(c)
+		return
+	}
+	explorerHandler(c)
+}
+
+// GraphQL schema definition. Field names follow the Alert, Threat and
+// FirewallRule structs; severities and statuses use the same lowercase
+// strings as the REST API.
 const schema = `
+schema {
+	query: Query
+	mutation: Mutation
+	subscription: Subscription
+}
+
 type Query {
-	alerts(page: Int, limit: Int, severity: String): AlertConnection!
+	alerts(page: Int, limit: Int, severity: String, status: String): AlertConnection!
 	alert(id: ID!): Alert
-	threats(page: Int, limit: Int): ThreatConnection!
+	threats(page: Int, limit: Int, severity: String, status: String): ThreatConnection!
 	threat(id: ID!): Threat
+	firewallRules: [FirewallRule!]!
+	firewallRule(id: ID!): FirewallRule
 	networkStats: NetworkStats!
 	dashboardStats: DashboardStats!
 }
@@ -108,61 +119,84 @@ type Mutation {
 	createAlert(input: CreateAlertInput!): Alert!
 	updateAlert(id: ID!, input: UpdateAlertInput!): Alert!
 	deleteAlert(id: ID!): Boolean!
-	
+
 	addFirewallRule(input: FirewallRuleInput!): FirewallRule!
 	deleteFirewallRule(id: ID!): Boolean!
-	
+
 	startMonitoring(interface: String!): MonitoringStatus!
 	stopMonitoring: MonitoringStatus!
 }
 
 type Subscription {
 	alertCreated: Alert!
+	alertUpdated: Alert!
 	threatDetected: Threat!
+	threatUpdated: Threat!
 	networkStatsUpdated: NetworkStats!
 }
 
 type Alert {
 	id: ID!
-	severity: Severity!
-	type: String!
-	sourceIP: String!
+	title: String!
 	description: String!
+	severity: String!
+	status: String!
 	timestamp: String!
-	status: AlertStatus!
+	source: String!
+	sourceIP: String
+	ruleID: String
+	threatID: String
 }
 
 type Threat {
 	id: ID!
+	name: String!
 	type: String!
-	severity: Severity!
-	source: String!
-	detectedAt: String!
-	status: ThreatStatus!
+	severity: String!
+	status: String!
+	sourceIP: String!
+	sourceIPs: [String!]!
+	targetIP: String!
+	port: Int!
+	timestamp: String!
+	detections: Int!
+	ruleID: String
+}
+
+type FirewallRule {
+	id: ID!
+	name: String!
+	action: String!
+	protocol: String!
+	sourceIP: String
+	destIP: String
+	port: Int!
+	enabled: Boolean!
+	createdAt: String!
 }
 
 type NetworkStats {
-	packetsCaptured: Int!
-	bytesProcessed: Int!
+	packetsCaptured: Float!
+	bytesProcessed: Float!
+	flowsProcessed: Float!
+	packetsPerSecond: Float!
+	bytesPerSecond: Float!
+	activeConnections: Int!
 	alertsGenerated: Int!
+	threatsDetected: Int!
 	uptimeSeconds: Int!
 }
 
 type DashboardStats {
 	totalAlerts: Int!
+	activeAlerts: Int!
+	totalThreats: Int!
 	activeThreats: Int!
-	blockedIPs: Int!
-	networkUptime: Float!
-	packetsProcessed: Int!
-}
-
-type FirewallRule {
-	id: ID!
-	action: String!
-	sourceIP: String
-	port: Int
-	protocol: String
-	description: String
+	firewallRules: Int!
+	activeUsers: Int!
+	packetsPerSecond: Float!
+	bytesPerSecond: Float!
+	activeConnections: Int!
 }
 
 type AlertConnection {
@@ -176,6 +210,8 @@ type ThreatConnection {
 }
 
 type PageInfo {
+	page: Int!
+	limit: Int!
 	hasNextPage: Boolean!
 	hasPreviousPage: Boolean!
 	totalCount: Int!
@@ -187,42 +223,24 @@ type MonitoringStatus {
 	startedAt: String
 }
 
-enum Severity {
-	LOW
-	MEDIUM
-	HIGH
-	CRITICAL
-}
-
-enum AlertStatus {
-	ACTIVE
-	ACKNOWLEDGED
-	RESOLVED
-}
-
-enum ThreatStatus {
-	ACTIVE
-	MITIGATED
-	FALSE_POSITIVE
-}
-
 input CreateAlertInput {
-	severity: Severity!
-	type: String!
-	sourceIP: String!
-	description: String
+	title: String!
+	description: String!
+	severity: String!
+	source: String
+	sourceIP: String
 }
 
 input UpdateAlertInput {
-	status: AlertStatus
-	notes: String
+	status: String!
 }
 
 input FirewallRuleInput {
+	name: String!
 	action: String!
+	protocol: String!
 	sourceIP: String
+	destIP: String
 	port: Int
-	protocol: String
-	description: String
 }
 `
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// graphqlListFields are fields returning lists whose cost scales with the
+// page size; they default to the REST page size when no limit is given
+var graphqlListFields = map[string]int{
+	"alerts":        20,
+	"threats":       20,
+	"firewallRules": 20,
+}
+
+// maxQueryCost caps estimates so nested lists and fragments cannot overflow
+const maxQueryCost = math.MaxInt32
+
+// gqlToken is a lexical token of a GraphQL document
+type gqlToken struct {
+	kind  byte // 'n' name, 'v' number, 's' string, '$' variable, or the punctuator itself
+	value string
+}
+
+// lexGraphQL splits a document into tokens, dropping whitespace, commas and comments
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',':
+			i++
+		case ch == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(src[i+3:], `"""`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated block string")
+			}
+			tokens = append(tokens, gqlToken{kind: 's'})
+			i += end + 6
+		case ch == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, gqlToken{kind: 's'})
+			i = j + 1
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{kind: '.', value: "..."})
+			i += 3
+		case ch == '$' || ch == '_' || ch == '-' || isAlphaNum(ch):
+			number := ch == '-' || (ch >= '0' && ch <= '9')
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || isAlphaNum(src[j]) || (number && (src[j] == '.' || src[j] == '+' || src[j] == '-'))) {
+				j++
+			}
+			word := src[i:j]
+			kind := byte('n')
+			switch {
+			case ch == '$':
+				kind, word = '$', word[1:]
+			case number:
+				kind = 'v'
+			}
+			tokens = append(tokens, gqlToken{kind: kind, value: word})
+			i = j
+		default:
+			tokens = append(tokens, gqlToken{kind: ch, value: string(ch)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func isAlphaNum(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+// complexityEstimator walks a validated document's selection sets
+type complexityEstimator struct {
+	tokens    []gqlToken
+	pos       int
+	variables map[string]interface{}
+	fragments map[string][]gqlToken
+	costs     map[string]int
+	resolving map[string]bool
+}
+
+func (e *complexityEstimator) peek() gqlToken {
+	if e.pos < len(e.tokens) {
+		return e.tokens[e.pos]
+	}
+	return gqlToken{}
+}
+
+func (e *complexityEstimator) next() gqlToken {
+	tok := e.peek()
+	e.pos++
+	return tok
+}
+
+// skipGroup skips a balanced (), [] or {} group starting at the current token
+func (e *complexityEstimator) skipGroup() {
+	open := e.next().kind
+	closing := map[byte]byte{'(': ')', '[': ']', '{': '}'}[open]
+	for depth := 1; depth > 0 && e.pos < len(e.tokens); {
+		switch e.next().kind {
+		case open:
+			depth++
+		case closing:
+			depth--
+		}
+	}
+}
+
+// skipDirectives skips any @directive(args)
+func (e *complexityEstimator) skipDirectives() {
+	for e.peek().kind == '@' {
+		e.next()
+		e.next()
+		if e.peek().kind == '(' {
+			e.skipGroup()
+		}
+	}
+}
+
+// limitArgument reads a field's arguments and returns its "limit" value
+func (e *complexityEstimator) limitArgument() int {
+	limit := 0
+	e.next() // (
+	for depth := 1; depth > 0 && e.pos < len(e.tokens); {
+		tok := e.next()
+		switch tok.kind {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case 'n':
+			if depth != 1 || tok.value != "limit" || e.peek().kind != ':' {
+				continue
+			}
+			e.next()
+			value := e.next()
+			switch value.kind {
+			case 'v':
+				limit, _ = strconv.Atoi(value.value)
+			case '$':
+				switch v := e.variables[value.value].(type) {
+				case float64:
+					limit = int(v)
+				case int:
+					limit = v
+				}
+			}
+		}
+	}
+	return limit
+}
+
+// selectionSet returns the cost of the selection set at the current position
+func (e *complexityEstimator) selectionSet() (int, error) {
+	if e.next().kind != '{' {
+		return 0, fmt.Errorf("expected selection set")
+	}
+
+	cost := 0
+	for e.pos < len(e.tokens) {
+		tok := e.peek()
+		switch tok.kind {
+		case '}':
+			e.next()
+			return cost, nil
+
+		case '.':
+			e.next()
+			if e.peek().kind == 'n' && e.peek().value != "on" {
+				// Fragment spread
+				name := e.next().value
+				e.skipDirectives()
+				fragmentCost, err := e.fragment(name)
+				if err != nil {
+					return 0, err
+				}
+				cost = min(cost+fragmentCost, maxQueryCost)
+				continue
+			}
+			// Inline fragment
+			if e.peek().value == "on" {
+				e.next()
+				e.next()
+			}
+			e.skipDirectives()
+			inline, err := e.selectionSet()
+			if err != nil {
+				return 0, err
+			}
+			cost = min(cost+inline, maxQueryCost)
+
+		case 'n':
+			name := e.next().value
+			if e.peek().kind == ':' {
+				e.next()
+				name = e.next().value
+			}
+			limit := 0
+			if e.peek().kind == '(' {
+				limit = e.limitArgument()
+			}
+			e.skipDirectives()
+
+			fieldCost := 1
+			if e.peek().kind == '{' {
+				children, err := e.selectionSet()
+				if err != nil {
+					return 0, err
+				}
+				multiplier := 1
+				if defaultSize, isList := graphqlListFields[name]; isList {
+					multiplier = defaultSize
+					if limit > 0 {
+						multiplier = min(limit, graphqlMaxLimit)
+					}
+				}
+				fieldCost = min(fieldCost+multiplier*children, maxQueryCost)
+			}
+			cost = min(cost+fieldCost, maxQueryCost)
+
+		default:
+			return 0, fmt.Errorf("unexpected token %q", tok.value)
+		}
+	}
+	return 0, fmt.Errorf("unterminated selection set")
+}
+
+// fragment returns the cost of a named fragment's selection set. Costs are
+// memoized, so spreading a fragment many times does not re-walk it.
+func (e *complexityEstimator) fragment(name string) (int, error) {
+	if cost, ok := e.costs[name]; ok {
+		return cost, nil
+	}
+	tokens, ok := e.fragments[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown fragment %s", name)
+	}
+	if e.resolving[name] {
+		return 0, fmt.Errorf("fragment %s spreads itself", name)
+	}
+
+	e.resolving[name] = true
+	defer delete(e.resolving, name)
+
+	saved, savedPos := e.tokens, e.pos
+	e.tokens, e.pos = tokens, 0
+	cost, err := e.selectionSet()
+	e.tokens, e.pos = saved, savedPos
+	if err == nil {
+		e.costs[name] = cost
+	}
+	return cost, err
+}
+
+// queryComplexity estimates the cost of an operation: one point per field,
+// with the selections under list fields multiplied by the page size, which
+// is clamped the same way the resolvers clamp it
+func queryComplexity(query, operationName string, variables map[string]interface{}) (int, error) {
+	tokens, err := lexGraphQL(query)
+	if err != nil {
+		return 0, err
+	}
+
+	e := &complexityEstimator{
+		variables: variables,
+		fragments: map[string][]gqlToken{},
+		costs:     map[string]int{},
+		resolving: map[string]bool{},
+	}
+
+	// Split the document into fragments and operations
+	type operation struct {
+		name   string
+		tokens []gqlToken
+	}
+	var operations []operation
+
+	e.tokens = tokens
+	for e.pos < len(e.tokens) {
+		tok := e.next()
+		switch {
+		case tok.kind == 'n' && tok.value == "fragment":
+			name := e.next().value
+			e.next() // on
+			e.next() // type condition
+			e.skipDirectives()
+			start := e.pos
+			e.skipGroup()
+			e.fragments[name] = e.tokens[start:e.pos]
+
+		case tok.kind == '{' || tok.kind == 'n':
+			op := operation{}
+			if tok.kind == 'n' {
+				if e.peek().kind == 'n' {
+					op.name = e.next().value
+				}
+				if e.peek().kind == '(' {
+					e.skipGroup()
+				}
+				e.skipDirectives()
+			} else {
+				e.pos--
+			}
+			start := e.pos
+			e.skipGroup()
+			op.tokens = e.tokens[start:e.pos]
+			operations = append(operations, op)
+
+		default:
+			return 0, fmt.Errorf("unexpected token %q", tok.value)
+		}
+	}
+
+	for _, op := range operations {
+		if operationName != "" && op.name != operationName {
+			continue
+		}
+		e.tokens, e.pos = op.tokens, 0
+		return e.selectionSet()
+	}
+	return 0, fmt.Errorf("operation %q not found", operationName)
+}
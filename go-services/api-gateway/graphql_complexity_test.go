@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestQueryComplexity(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]interface{}
+		want      int
+	}{
+		{"scalar fields", `{ alert(id: "ALT-001") { id title } }`, "", nil, 3},
+		{"default page size", `{ alerts { edges { id title } } }`, "", nil, 61},
+		{"explicit limit", `{ alerts(limit: 5) { edges { id title } } }`, "", nil, 16},
+		{"limit clamped like the resolvers", `{ alerts(limit: 100000) { edges { id title } } }`, "", nil, 301},
+		{"variable limit", `query($n: Int) { alerts(limit: $n) { edges { id title } } }`, "", map[string]interface{}{"n": float64(50)}, 151},
+		{"variable limit clamped", `query($n: Int) { alerts(limit: $n) { edges { id } } }`, "", map[string]interface{}{"n": float64(5000)}, 201},
+		{"fragment spread", `{ alerts { ...page } } fragment page on AlertConnection { edges { id } }`, "", nil, 41},
+		{"inline fragment", `{ alerts { ... on AlertConnection { edges { id } } } }`, "", nil, 41},
+		{"named operation", `query small { stats { totalAlerts } } query large { alerts { edges { id } } }`, "small", nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queryComplexity(tt.query, tt.operation, tt.variables)
+			if err != nil {
+				t.Fatalf("queryComplexity: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("complexity = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryComplexityErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+	}{
+		{"unknown fragment", `{ alerts { ...missing } }`, ""},
+		{"cyclic fragment", `{ alerts { ...a } } fragment a on AlertConnection { ...b } fragment b on AlertConnection { ...a }`, ""},
+		{"unterminated selection set", `{ alerts { edges { id }`, ""},
+		{"unterminated string", `{ alert(id: "ALT-001) { id } }`, ""},
+		{"unknown operation", `query other { stats { totalAlerts } }`, "named"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := queryComplexity(tt.query, tt.operation, nil); err == nil {
+				t.Error("queryComplexity accepted an invalid document")
+			}
+		})
+	}
+}
+
+// A chain of fragments that each spread the next twice doubles the cost at
+// every level; it must be costed once per fragment and saturate rather than
+// overflow
+func TestQueryComplexityFragmentFanOut(t *testing.T) {
+	const levels = 64
+
+	var doc strings.Builder
+	doc.WriteString(`{ alerts { edges { ...f0 } } }`)
+	for i := 0; i < levels; i++ {
+		fmt.Fprintf(&doc, " fragment f%d on Alert { id ...f%d ...f%d }", i, i+1, i+1)
+	}
+	fmt.Fprintf(&doc, " fragment f%d on Alert { id }", levels)
+
+	got, err := queryComplexity(doc.String(), "", nil)
+	if err != nil {
+		t.Fatalf("queryComplexity: %v", err)
+	}
+	if got != maxQueryCost {
+		t.Errorf("complexity = %d, want the %d ceiling", got, maxQueryCost)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The GraphQL explorer is built into the binary so it works without access
+// to a CDN
+//
+//go:embed explorer
+var explorerFiles embed.FS
+
+// explorerCSP only allows the explorer's own assets and connections back to
+// the gateway
+const explorerCSP = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self' ws: wss:; img-src 'self' data:; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// explorerAsset is an embedded file with a content hash for cache busting
+type explorerAsset struct {
+	data        []byte
+	hash        string
+	contentType string
+}
+
+var (
+	explorerEnabled = getEnvBool("GRAPHQL_PLAYGROUND", true)
+	explorerAssets  = map[string]*explorerAsset{}
+	explorerPage    []byte
+	explorerStarted = time.Now()
+)
+
+// startGraphQLExplorer hashes the embedded assets and renders the explorer
+// page with versioned asset URLs
+func startGraphQLExplorer() {
+	if !explorerEnabled {
+		log.Printf("GraphQL explorer disabled")
+		return
+	}
+
+	for name, contentType := range map[string]string{
+		"explorer.js":  "text/javascript; charset=utf-8",
+		"explorer.css": "text/css; charset=utf-8",
+	} {
+		data, err := fs.ReadFile(explorerFiles, path.Join("explorer", name))
+		if err != nil {
+			log.Fatalf("GraphQL explorer asset %s missing: %v", name, err)
+		}
+		sum := sha256.Sum256(data)
+		explorerAssets[name] = &explorerAsset{data: data, hash: hex.EncodeToString(sum[:8]), contentType: contentType}
+	}
+
+	page := template.Must(template.ParseFS(explorerFiles, "explorer/index.html"))
+	var buf bytes.Buffer
+	err := page.Execute(&buf, map[string]string{
+		"Script":     "/graphql/assets/explorer.js?v=" + explorerAssets["explorer.js"].hash,
+		"Stylesheet": "/graphql/assets/explorer.css?v=" + explorerAssets["explorer.css"].hash,
+	})
+	if err != nil {
+		log.Fatalf("GraphQL explorer page: %v", err)
+	}
+	explorerPage = buf.Bytes()
+}
+
+// explorerHandler serves the explorer page. The page itself is revalidated on
+// every load so new asset versions are picked up after a deploy.
+func explorerHandler(c *gin.Context) {
+	if !explorerEnabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "GraphQL explorer is disabled"})
+		return
+	}
+
+	c.Header("Content-Security-Policy", explorerCSP)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", explorerPage)
+}
+
+// explorerAssetHandler serves embedded scripts and stylesheets. Requests for
+// the current version are cacheable forever; anything else must revalidate.
+func explorerAssetHandler(c *gin.Context) {
+	asset, ok := explorerAssets[c.Param("file")]
+	if !explorerEnabled || !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+		return
+	}
+
+	if c.Query("v") == asset.hash {
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+	c.Header("Content-Type", asset.contentType)
+	c.Header("ETag", `"`+asset.hash+`"`)
+	c.Header("X-Content-Type-Options", "nosniff")
+	http.ServeContent(c.Writer, c.Request, "", explorerStarted, bytes.NewReader(asset.data))
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphqlRequestKey stores the gin context of a GraphQL request so resolvers
+// can attribute events to the authenticated user
+type graphqlRequestKey struct{}
+
+func requestGinContext(ctx context.Context) *gin.Context {
+	c, _ := ctx.Value(graphqlRequestKey{}).(*gin.Context)
+	return c
+}
+
+// graphqlResolver is the root resolver for queries, mutations and subscriptions
+type graphqlResolver struct{}
+
+// optionalString returns nil for empty strings so they resolve to null
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// stringValue dereferences an optional string argument
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// pageInfoResolver resolves PageInfo
+type pageInfoResolver struct {
+	page, limit, total int
+}
+
+func (p *pageInfoResolver) Page() int32              { return int32(p.page) }
+func (p *pageInfoResolver) Limit() int32             { return int32(p.limit) }
+func (p *pageInfoResolver) HasNextPage() bool        { return p.page*p.limit < p.total }
+func (p *pageInfoResolver) HasPreviousPage() bool    { return p.page > 1 }
+func (p *pageInfoResolver) TotalCount() int32        { return int32(p.total) }
+func (p *pageInfoResolver) bounds() (start, end int) { return pageBounds(p.page, p.limit, p.total) }
+
+// graphqlMaxLimit is the largest page size a list field returns
+const graphqlMaxLimit = 100
+
+// newPageInfo applies the REST defaults (page 1, 20 per page, at most 100)
+func newPageInfo(page, limit *int32, total int) *pageInfoResolver {
+	p := &pageInfoResolver{page: 1, limit: 20, total: total}
+	if page != nil && *page > 0 {
+		p.page = int(*page)
+	}
+	if limit != nil && *limit > 0 {
+		p.limit = int(*limit)
+	}
+	if p.limit > graphqlMaxLimit {
+		p.limit = graphqlMaxLimit
+	}
+	return p
+}
+
+// pageBounds returns the slice bounds of a page
+func pageBounds(page, limit, total int) (int, int) {
+	start := (page - 1) * limit
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+// alertResolver resolves an Alert from a snapshot taken under dataMux
+type alertResolver struct{ a Alert }
+
+func (r *alertResolver) ID() graphql.ID      { return graphql.ID(r.a.ID) }
+func (r *alertResolver) Title() string       { return r.a.Title }
+func (r *alertResolver) Description() string { return r.a.Description }
+func (r *alertResolver) Severity() string    { return r.a.Severity }
+func (r *alertResolver) Status() string      { return r.a.Status }
+func (r *alertResolver) Timestamp() string   { return r.a.Timestamp.Format(time.RFC3339) }
+func (r *alertResolver) Source() string      { return r.a.Source }
+func (r *alertResolver) SourceIP() *string   { return optionalString(r.a.SourceIP) }
+func (r *alertResolver) RuleID() *string     { return optionalString(r.a.RuleID) }
+func (r *alertResolver) ThreatID() *string   { return optionalString(r.a.ThreatID) }
+
+// threatResolver resolves a Threat from a snapshot taken under dataMux
+type threatResolver struct{ t Threat }
+
+func (r *threatResolver) ID() graphql.ID      { return graphql.ID(r.t.ID) }
+func (r *threatResolver) Name() string        { return r.t.Name }
+func (r *threatResolver) Type() string        { return r.t.Type }
+func (r *threatResolver) Severity() string    { return r.t.Severity }
+func (r *threatResolver) Status() string      { return r.t.Status }
+func (r *threatResolver) SourceIP() string    { return r.t.SourceIP }
+func (r *threatResolver) SourceIPs() []string { return append([]string{}, r.t.SourceIPs...) }
+func (r *threatResolver) TargetIP() string    { return r.t.TargetIP }
+func (r *threatResolver) Port() int32         { return int32(r.t.Port) }
+func (r *threatResolver) Timestamp() string   { return r.t.Timestamp.Format(time.RFC3339) }
+func (r *threatResolver) Detections() int32   { return int32(r.t.Detections) }
+func (r *threatResolver) RuleID() *string     { return optionalString(r.t.RuleID) }
+
+// firewallRuleResolver resolves a FirewallRule from a snapshot
+type firewallRuleResolver struct{ f FirewallRule }
+
+func (r *firewallRuleResolver) ID() graphql.ID    { return graphql.ID(r.f.ID) }
+func (r *firewallRuleResolver) Name() string      { return r.f.Name }
+func (r *firewallRuleResolver) Action() string    { return r.f.Action }
+func (r *firewallRuleResolver) Protocol() string  { return r.f.Protocol }
+func (r *firewallRuleResolver) SourceIP() *string { return optionalString(r.f.SourceIP) }
+func (r *firewallRuleResolver) DestIP() *string   { return optionalString(r.f.DestIP) }
+func (r *firewallRuleResolver) Port() int32       { return int32(r.f.Port) }
+func (r *firewallRuleResolver) Enabled() bool     { return r.f.Enabled }
+func (r *firewallRuleResolver) CreatedAt() string { return r.f.CreatedAt.Format(time.RFC3339) }
+
+// alertConnectionResolver resolves one page of alerts
+type alertConnectionResolver struct {
+	edges    []*alertResolver
+	pageInfo *pageInfoResolver
+}
+
+func (r *alertConnectionResolver) Edges() []*alertResolver     { return r.edges }
+func (r *alertConnectionResolver) PageInfo() *pageInfoResolver { return r.pageInfo }
+
+// threatConnectionResolver resolves one page of threats
+type threatConnectionResolver struct {
+	edges    []*threatResolver
+	pageInfo *pageInfoResolver
+}
+
+func (r *threatConnectionResolver) Edges() []*threatResolver    { return r.edges }
+func (r *threatConnectionResolver) PageInfo() *pageInfoResolver { return r.pageInfo }
+
+type listArgs struct {
+	Page     *int32
+	Limit    *int32
+	Severity *string
+	Status   *string
+}
+
+// Alerts returns alerts newest first
+func (r *graphqlResolver) Alerts(args listArgs) *alertConnectionResolver {
+	dataMux.RLock()
+	list := make([]Alert, 0, len(alerts))
+	for _, alert := range alerts {
+		if args.Severity != nil && alert.Severity != *args.Severity {
+			continue
+		}
+		if args.Status != nil && alert.Status != *args.Status {
+			continue
+		}
+		list = append(list, *alert)
+	}
+	dataMux.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Timestamp.After(list[j].Timestamp) })
+
+	pageInfo := newPageInfo(args.Page, args.Limit, len(list))
+	start, end := pageInfo.bounds()
+	edges := make([]*alertResolver, 0, end-start)
+	for _, alert := range list[start:end] {
+		edges = append(edges, &alertResolver{alert})
+	}
+	return &alertConnectionResolver{edges: edges, pageInfo: pageInfo}
+}
+
+// Alert returns one alert
+func (r *graphqlResolver) Alert(args struct{ ID graphql.ID }) *alertResolver {
+	dataMux.RLock()
+	defer dataMux.RUnlock()
+
+	alert, exists := alerts[string(args.ID)]
+	if !exists {
+		return nil
+	}
+	queueAlertEnrichment(alert)
+	return &alertResolver{*alert}
+}
+
+// Threats returns threats newest first
+func (r *graphqlResolver) Threats(args listArgs) *threatConnectionResolver {
+	dataMux.RLock()
+	list := make([]Threat, 0, len(threats))
+	for _, threat := range threats {
+		if args.Severity != nil && threat.Severity != *args.Severity {
+			continue
+		}
+		if args.Status != nil && threat.Status != *args.Status {
+			continue
+		}
+		list = append(list, *threat)
+	}
+	dataMux.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Timestamp.After(list[j].Timestamp) })
+
+	pageInfo := newPageInfo(args.Page, args.Limit, len(list))
+	start, end := pageInfo.bounds()
+	edges := make([]*threatResolver, 0, end-start)
+	for _, threat := range list[start:end] {
+		edges = append(edges, &threatResolver{threat})
+	}
+	return &threatConnectionResolver{edges: edges, pageInfo: pageInfo}
+}
+
+// Threat returns one threat
+func (r *graphqlResolver) Threat(args struct{ ID graphql.ID }) *threatResolver {
+	dataMux.RLock()
+	threat, exists := threats[string(args.ID)]
+	var snapshot Threat
+	if exists {
+		snapshot = *threat
+	}
+	dataMux.RUnlock()
+
+	if !exists {
+		return nil
+	}
+
+	queueThreatEnrichment(&snapshot)
+	return &threatResolver{snapshot}
+}
+
+// FirewallRules returns all firewall rules ordered by ID
+func (r *graphqlResolver) FirewallRules() []*firewallRuleResolver {
+	dataMux.RLock()
+	rules := make([]*firewallRuleResolver, 0, len(firewallRules))
+	for _, rule := range firewallRules {
+		rules = append(rules, &firewallRuleResolver{*rule})
+	}
+	dataMux.RUnlock()
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].f.ID < rules[j].f.ID })
+	return rules
+}
+
+// FirewallRule returns one firewall rule
+func (r *graphqlResolver) FirewallRule(args struct{ ID graphql.ID }) *firewallRuleResolver {
+	dataMux.RLock()
+	defer dataMux.RUnlock()
+
+	rule, exists := firewallRules[string(args.ID)]
+	if !exists {
+		return nil
+	}
+	return &firewallRuleResolver{*rule}
+}
+
+// networkStatsResolver resolves NetworkStats
+type networkStatsResolver struct {
+	totals            trafficCounter
+	packetsPerSecond  float64
+	bytesPerSecond    float64
+	activeConnections int
+	alerts, threats   int
+	uptime            time.Duration
+}
+
+func (r *networkStatsResolver) PacketsCaptured() float64  { return float64(r.totals.Packets) }
+func (r *networkStatsResolver) BytesProcessed() float64   { return float64(r.totals.Bytes) }
+func (r *networkStatsResolver) FlowsProcessed() float64   { return float64(r.totals.Flows) }
+func (r *networkStatsResolver) PacketsPerSecond() float64 { return r.packetsPerSecond }
+func (r *networkStatsResolver) BytesPerSecond() float64   { return r.bytesPerSecond }
+func (r *networkStatsResolver) ActiveConnections() int32  { return int32(r.activeConnections) }
+func (r *networkStatsResolver) AlertsGenerated() int32    { return int32(r.alerts) }
+func (r *networkStatsResolver) ThreatsDetected() int32    { return int32(r.threats) }
+func (r *networkStatsResolver) UptimeSeconds() int32      { return int32(r.uptime.Seconds()) }
+
+// currentNetworkStats collects the same figures as getNetworkStats
+func currentNetworkStats() *networkStatsResolver {
+	_, _, bytesPerSecond, packetsPerSecond := flowStats.Rates()
+
+	dataMux.RLock()
+	alertCount := len(alerts)
+	threatCount := len(threats)
+	dataMux.RUnlock()
+
+	return &networkStatsResolver{
+		totals:            flowStats.Totals(),
+		packetsPerSecond:  packetsPerSecond,
+		bytesPerSecond:    bytesPerSecond,
+		activeConnections: flowStats.ActiveFlows(),
+		alerts:            alertCount,
+		threats:           threatCount,
+		uptime:            flowUptime(),
+	}
+}
+
+// NetworkStats returns live traffic statistics
+func (r *graphqlResolver) NetworkStats() *networkStatsResolver {
+	return currentNetworkStats()
+}
+
+// dashboardStatsResolver resolves DashboardStats
+type dashboardStatsResolver struct {
+	totalAlerts, activeAlerts   int
+	totalThreats, activeThreats int
+	firewallRules, activeUsers  int
+	network                     *networkStatsResolver
+}
+
+func (r *dashboardStatsResolver) TotalAlerts() int32        { return int32(r.totalAlerts) }
+func (r *dashboardStatsResolver) ActiveAlerts() int32       { return int32(r.activeAlerts) }
+func (r *dashboardStatsResolver) TotalThreats() int32       { return int32(r.totalThreats) }
+func (r *dashboardStatsResolver) ActiveThreats() int32      { return int32(r.activeThreats) }
+func (r *dashboardStatsResolver) FirewallRules() int32      { return int32(r.firewallRules) }
+func (r *dashboardStatsResolver) ActiveUsers() int32        { return int32(r.activeUsers) }
+func (r *dashboardStatsResolver) PacketsPerSecond() float64 { return r.network.packetsPerSecond }
+func (r *dashboardStatsResolver) BytesPerSecond() float64   { return r.network.bytesPerSecond }
+func (r *dashboardStatsResolver) ActiveConnections() int32  { return int32(r.network.activeConnections) }
+
+// DashboardStats returns dashboard counters
+func (r *graphqlResolver) DashboardStats() *dashboardStatsResolver {
+	stats := &dashboardStatsResolver{network: currentNetworkStats()}
+
+	dataMux.RLock()
+	stats.totalAlerts = len(alerts)
+	for _, alert := range alerts {
+		if alert.Status != "resolved" {
+			stats.activeAlerts++
+		}
+	}
+	stats.totalThreats = len(threats)
+	for _, threat := range threats {
+		switch threat.Status {
+		case "resolved", "mitigated", "blocked", "benign":
+		default:
+			stats.activeThreats++
+		}
+	}
+	stats.firewallRules = len(firewallRules)
+	dataMux.RUnlock()
+
+	usersMux.RLock()
+	stats.activeUsers = len(users)
+	usersMux.RUnlock()
+
+	return stats
+}
+
+// CreateAlert creates an alert like POST /alerts
+func (r *graphqlResolver) CreateAlert(ctx context.Context, args struct {
+	Input struct {
+		Title       string
+		Description string
+		Severity    string
+		Source      *string
+		SourceIP    *string
+	}
+}) (*alertResolver, error) {
+	alert := &Alert{
+		Title:       args.Input.Title,
+		Description: args.Input.Description,
+		Severity:    args.Input.Severity,
+		Status:      "active",
+		Timestamp:   time.Now(),
+		Source:      stringValue(args.Input.Source),
+		SourceIP:    stringValue(args.Input.SourceIP),
+	}
+	alert.Intel = alertIntelMatches(alert)
+
+	dataMux.Lock()
+	alert.ID = nextResourceID("ALT", len(alerts), func(id string) bool { _, ok := alerts[id]; return ok })
+	alerts[alert.ID] = alert
+	snapshot := *alert
+	dataMux.Unlock()
+
+	enricher.QueueAlert(alert.ID)
+	publishEvent(requestGinContext(ctx), EventAlertCreated, "alert", alert.ID, &snapshot)
+
+	return &alertResolver{snapshot}, nil
+}
+
+// UpdateAlert changes an alert's status like PUT /alerts/:id
+func (r *graphqlResolver) UpdateAlert(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input struct{ Status string }
+}) (*alertResolver, error) {
+	id := string(args.ID)
+
+	dataMux.Lock()
+	alert, exists := alerts[id]
+	var snapshot Alert
+	if exists {
+		alert.Status = args.Input.Status
+		snapshot = *alert
+	}
+	dataMux.Unlock()
+
+	if !exists {
+		return nil, errors.New("alert not found")
+	}
+
+	publishEvent(requestGinContext(ctx), EventAlertUpdated, "alert", id, &snapshot)
+	return &alertResolver{snapshot}, nil
+}
+
+// DeleteAlert deletes an alert like DELETE /alerts/:id
+func (r *graphqlResolver) DeleteAlert(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	id := string(args.ID)
+
+	dataMux.Lock()
+	alert, exists := alerts[id]
+	var snapshot Alert
+	if exists {
+		delete(alerts, id)
+		snapshot = *alert
+	}
+	dataMux.Unlock()
+
+	if !exists {
+		return false, errors.New("alert not found")
+	}
+
+	publishEvent(requestGinContext(ctx), EventAlertDeleted, "alert", id, &snapshot)
+	return true, nil
+}
+
+// AddFirewallRule adds a rule like POST /firewall/rules
+func (r *graphqlResolver) AddFirewallRule(ctx context.Context, args struct {
+	Input struct {
+		Name     string
+		Action   string
+		Protocol string
+		SourceIP *string
+		DestIP   *string
+		Port     *int32
+	}
+}) (*firewallRuleResolver, error) {
+	rule := &FirewallRule{
+		Name:      args.Input.Name,
+		Action:    args.Input.Action,
+		Protocol:  args.Input.Protocol,
+		SourceIP:  stringValue(args.Input.SourceIP),
+		DestIP:    stringValue(args.Input.DestIP),
+		Enabled:   true,
+		CreatedAt: time.Now(),
+	}
+	if args.Input.Port != nil {
+		rule.Port = int(*args.Input.Port)
+	}
+
+	dataMux.Lock()
+	rule.ID = nextResourceID("FW", len(firewallRules), func(id string) bool { _, ok := firewallRules[id]; return ok })
+	firewallRules[rule.ID] = rule
+	dataMux.Unlock()
+
+	publishEvent(requestGinContext(ctx), EventFirewallRuleChanged, "firewall_rule", rule.ID, gin.H{"action": "created", "rule": *rule})
+	return &firewallRuleResolver{*rule}, nil
+}
+
+// DeleteFirewallRule deletes a rule like DELETE /firewall/rules/:id
+func (r *graphqlResolver) DeleteFirewallRule(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	id := string(args.ID)
+
+	dataMux.Lock()
+	rule, exists := firewallRules[id]
+	if exists {
+		delete(firewallRules, id)
+	}
+	dataMux.Unlock()
+
+	if !exists {
+		return false, errors.New("firewall rule not found")
+	}
+
+	publishEvent(requestGinContext(ctx), EventFirewallRuleChanged, "firewall_rule", id, gin.H{"action": "deleted", "rule": *rule})
+	return true, nil
+}
+
+// monitoringStatusResolver resolves MonitoringStatus
+type monitoringStatusResolver struct {
+	running   bool
+	iface     string
+	startedAt time.Time
+}
+
+func (r *monitoringStatusResolver) IsRunning() bool    { return r.running }
+func (r *monitoringStatusResolver) Interface() *string { return optionalString(r.iface) }
+func (r *monitoringStatusResolver) StartedAt() *string {
+	if r.startedAt.IsZero() {
+		return nil
+	}
+	return optionalString(r.startedAt.Format(time.RFC3339))
+}
+
+// StartMonitoring starts monitoring an interface like POST /network/monitor/start
+func (r *graphqlResolver) StartMonitoring(ctx context.Context, args struct{ Interface string }) *monitoringStatusResolver {
+	publishEvent(requestGinContext(ctx), EventMonitoringStarted, "network", args.Interface, gin.H{"interface": args.Interface})
+	return &monitoringStatusResolver{running: true, iface: args.Interface, startedAt: time.Now()}
+}
+
+// StopMonitoring stops monitoring like POST /network/monitor/stop
+func (r *graphqlResolver) StopMonitoring(ctx context.Context) *monitoringStatusResolver {
+	publishEvent(requestGinContext(ctx), EventMonitoringStopped, "network", "", nil)
+	return &monitoringStatusResolver{}
+}
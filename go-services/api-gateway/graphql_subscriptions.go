@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// graphqlSubscriptionBuffer is how many events a slow subscriber may fall
+// behind before the event bus starts dropping them
+const graphqlSubscriptionBuffer = 64
+
+// subscribeGraphQL forwards bus events to a subscription until its context
+// is cancelled
+func subscribeGraphQL(ctx context.Context, name string, handler func(Event), patterns ...string) {
+	unsubscribe := eventBus.Subscribe("graphql."+name, graphqlSubscriptionBuffer, handler, patterns...)
+	go func() {
+		<-ctx.Done()
+		unsubscribe()
+	}()
+}
+
+// alertSubscription streams alerts carried by the given event types
+func alertSubscription(ctx context.Context, name string, eventTypes ...string) <-chan *alertResolver {
+	out := make(chan *alertResolver)
+	subscribeGraphQL(ctx, name, func(event Event) {
+		alert, ok := event.Data.(*Alert)
+		if !ok {
+			return
+		}
+		select {
+		case out <- &alertResolver{*alert}:
+		case <-ctx.Done():
+		}
+	}, eventTypes...)
+	return out
+}
+
+// threatSubscription streams threats carried by the given event types
+func threatSubscription(ctx context.Context, name string, eventTypes ...string) <-chan *threatResolver {
+	out := make(chan *threatResolver)
+	subscribeGraphQL(ctx, name, func(event Event) {
+		threat, ok := event.Data.(*Threat)
+		if !ok {
+			return
+		}
+		select {
+		case out <- &threatResolver{*threat}:
+		case <-ctx.Done():
+		}
+	}, eventTypes...)
+	return out
+}
+
+// AlertCreated streams alerts raised by the API, GraphQL and the detection engine
+func (r *graphqlResolver) AlertCreated(ctx context.Context) <-chan *alertResolver {
+	return alertSubscription(ctx, "alertCreated", EventAlertCreated)
+}
+
+// AlertUpdated streams alerts whose status changed
+func (r *graphqlResolver) AlertUpdated(ctx context.Context) <-chan *alertResolver {
+	return alertSubscription(ctx, "alertUpdated", EventAlertUpdated)
+}
+
+// ThreatDetected streams threats submitted for analysis or found by detectors
+func (r *graphqlResolver) ThreatDetected(ctx context.Context) <-chan *threatResolver {
+	return threatSubscription(ctx, "threatDetected", EventThreatCreated, EventThreatDetected)
+}
+
+// ThreatUpdated streams threats that were updated or finished analysis
+func (r *graphqlResolver) ThreatUpdated(ctx context.Context) <-chan *threatResolver {
+	return threatSubscription(ctx, "threatUpdated", EventThreatUpdated, EventThreatAnalyzed)
+}
+
+// NetworkStatsUpdated streams live traffic statistics at the websocket stats interval
+func (r *graphqlResolver) NetworkStatsUpdated(ctx context.Context) <-chan *networkStatsResolver {
+	out := make(chan *networkStatsResolver)
+	go func() {
+		ticker := time.NewTicker(wsStatsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case out <- currentNetworkStats():
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
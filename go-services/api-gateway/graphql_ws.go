@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+)
+
+// graphqlTransportWS is the subprotocol of the graphql-ws library, see
+// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const graphqlTransportWS = "graphql-transport-ws"
+
+const (
+	graphqlWSMaxMessageSize = 64 << 10
+	graphqlWSMaxOperations  = 50
+)
+
+// graphql-transport-ws close codes
+const (
+	graphqlWSInvalidMessage      = 4400
+	graphqlWSUnauthorized        = 4401
+	graphqlWSForbidden           = 4403
+	graphqlWSSubprotocolRejected = 4406
+	graphqlWSInitTimeout         = 4408
+	graphqlWSSubscriberExists    = 4409
+	graphqlWSTooManyInitRequests = 4429
+)
+
+var graphqlWSInitWait = getEnvDuration("GRAPHQL_WS_INIT_TIMEOUT", 10*time.Second)
+
+var graphqlUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkWebsocketOrigin,
+	Subprotocols:    []string{graphqlTransportWS},
+}
+
+// graphqlWSMessage is a client message
+type graphqlWSMessage struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// graphqlWSConn is one graphql-transport-ws connection. The read loop owns
+// user; operations are guarded by mu and writes by writeMu.
+type graphqlWSConn struct {
+	c          *gin.Context
+	conn       *websocket.Conn
+	ctx        context.Context
+	user       *User
+	operations map[string]context.CancelFunc
+	running    sync.WaitGroup
+	mu         sync.Mutex
+	writeMu    sync.Mutex
+}
+
+// serveGraphQLWebsocket runs GraphQL operations over graphql-transport-ws.
+// The client authenticates in connection_init with an "Authorization",
+// "token" or "X-API-Key" payload field, or with the handshake credentials
+// accepted by the other websocket endpoints.
+func serveGraphQLWebsocket(c *gin.Context) {
+	conn, err := graphqlUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade GraphQL connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	websocketConnectionsTotal.WithLabelValues("graphql").Inc()
+	websocketConnections.WithLabelValues("graphql").Inc()
+	defer websocketConnections.WithLabelValues("graphql").Dec()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	s := &graphqlWSConn{
+		c:          c,
+		conn:       conn,
+		ctx:        ctx,
+		operations: make(map[string]context.CancelFunc),
+	}
+
+	// Resolvers hold on to the gin context, so they must finish before the
+	// handler returns it to the pool
+	defer func() {
+		cancel()
+		s.running.Wait()
+	}()
+
+	if conn.Subprotocol() != graphqlTransportWS {
+		s.closeWith(graphqlWSSubprotocolRejected, "Subprotocol not acceptable")
+		return
+	}
+
+	conn.SetReadLimit(graphqlWSMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(graphqlWSInitWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	go s.keepalive()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if s.user == nil && errors.As(err, &netErr) && netErr.Timeout() {
+				s.closeWith(graphqlWSInitTimeout, "Connection initialisation timeout")
+			}
+			return
+		}
+		if s.user != nil {
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		}
+
+		var msg graphqlWSMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type == "" {
+			s.closeWith(graphqlWSInvalidMessage, "Invalid message")
+			return
+		}
+		if !s.handle(msg) {
+			return
+		}
+	}
+}
+
+// handle processes one client message and reports whether the connection
+// stays open
+func (s *graphqlWSConn) handle(msg graphqlWSMessage) bool {
+	switch msg.Type {
+	case "connection_init":
+		if s.user != nil {
+			s.closeWith(graphqlWSTooManyInitRequests, "Too many initialisation requests")
+			return false
+		}
+		user, method, ok := s.authenticate(msg.Payload)
+		if !ok {
+			authFailuresTotal.WithLabelValues("invalid_credentials").Inc()
+			s.closeWith(graphqlWSForbidden, "Forbidden")
+			return false
+		}
+		s.user = user
+		s.c.Set("user", user)
+		s.c.Set("user_id", user.ID)
+		s.c.Set("auth_method", method)
+		s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return s.send("", "connection_ack", nil) == nil
+
+	case "ping":
+		return s.send("", "pong", nil) == nil
+
+	case "pong":
+		return true
+
+	case "subscribe":
+		if s.user == nil {
+			s.closeWith(graphqlWSUnauthorized, "Unauthorized")
+			return false
+		}
+		var req graphqlRequest
+		if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil || req.Query == "" {
+			s.closeWith(graphqlWSInvalidMessage, "Invalid subscribe message")
+			return false
+		}
+		return s.subscribe(msg.ID, req)
+
+	case "complete":
+		s.stop(msg.ID)
+		return true
+	}
+
+	s.closeWith(graphqlWSInvalidMessage, "Unexpected message type "+msg.Type)
+	return false
+}
+
+// authenticate checks the connection_init payload, falling back to the
+// credentials sent with the websocket handshake
+func (s *graphqlWSConn) authenticate(payload json.RawMessage) (*User, string, bool) {
+	var params map[string]interface{}
+	if len(payload) > 0 {
+		json.Unmarshal(payload, &params)
+	}
+	param := func(keys ...string) string {
+		for _, key := range keys {
+			if value, ok := params[key].(string); ok && value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	apiKey := param("X-API-Key", "x-api-key", "apiKey", "api_key")
+	token := bearerToken(param("Authorization", "authorization"))
+	if token == "" {
+		token = param("token")
+	}
+	if apiKey == "" && token == "" {
+		apiKey, token = websocketCredentials(s.c)
+	}
+	return authenticateCredentials(apiKey, token)
+}
+
+// subscribe starts an operation; queries and mutations yield a single result
+func (s *graphqlWSConn) subscribe(id string, req graphqlRequest) bool {
+	s.mu.Lock()
+	if _, exists := s.operations[id]; exists {
+		s.mu.Unlock()
+		s.closeWith(graphqlWSSubscriberExists, "Subscriber for "+id+" already exists")
+		return false
+	}
+	tooMany := len(s.operations) >= graphqlWSMaxOperations
+	s.mu.Unlock()
+
+	if tooMany {
+		return s.send(id, "error", []*gqlerrors.QueryError{gqlerrors.Errorf("at most %d operations may run on one connection", graphqlWSMaxOperations)}) == nil
+	}
+	if errs := req.check(); len(errs) > 0 {
+		return s.send(id, "error", errs) == nil
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(s.ctx, graphqlRequestKey{}, s.c))
+	s.mu.Lock()
+	s.operations[id] = cancel
+	s.mu.Unlock()
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer cancel()
+
+		responses, err := graphqlSchema.Subscribe(ctx, req.Query, req.OperationName, req.Variables)
+		if err != nil {
+			s.stop(id)
+			s.send(id, "error", []*gqlerrors.QueryError{gqlerrors.Errorf("%s", err)})
+			return
+		}
+		for response := range responses {
+			if ctx.Err() == nil {
+				s.send(id, "next", response)
+			}
+		}
+
+		// Operations the client completed itself are not completed again
+		s.mu.Lock()
+		finished := ctx.Err() == nil
+		if finished {
+			delete(s.operations, id)
+		}
+		s.mu.Unlock()
+
+		if finished {
+			s.send(id, "complete", nil)
+		}
+	}()
+	return true
+}
+
+// stop cancels an operation at the client's request
+func (s *graphqlWSConn) stop(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cancel, ok := s.operations[id]; ok {
+		cancel()
+		delete(s.operations, id)
+	}
+}
+
+// send writes a server message
+func (s *graphqlWSConn) send(id, messageType string, payload interface{}) error {
+	msg := gin.H{"type": messageType}
+	if id != "" {
+		msg["id"] = id
+	}
+	if payload != nil {
+		msg["payload"] = payload
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return s.conn.WriteJSON(msg)
+}
+
+// closeWith closes the connection with a protocol close code
+func (s *graphqlWSConn) closeWith(code int, reason string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+}
+
+// keepalive pings the client until the connection closes
+func (s *graphqlWSConn) keepalive() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.writeMu.Lock()
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := s.conn.WriteMessage(websocket.PingMessage, nil)
+			s.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
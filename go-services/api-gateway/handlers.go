@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -19,6 +20,14 @@ type Alert struct {
 	Status      string    `json:"status"`
 	Timestamp   time.Time `json:"timestamp"`
 	Source      string    `json:"source"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	SourceIPs   []string  `json:"source_ips,omitempty"`
+	RuleID      string    `json:"rule_id,omitempty"`
+	ThreatID    string    `json:"threat_id,omitempty"`
+
+	Evidence   *DetectionEvidence       `json:"evidence,omitempty"`
+	Intel      []IntelMatch             `json:"intel,omitempty"`
+	Enrichment map[string]*IPEnrichment `json:"enrichment,omitempty"`
 }
 
 // Threat represents a security threat
@@ -29,10 +38,16 @@ type Threat struct {
 	Severity   string    `json:"severity"`
 	Status     string    `json:"status"`
 	SourceIP   string    `json:"source_ip"`
+	SourceIPs  []string  `json:"source_ips,omitempty"`
 	TargetIP   string    `json:"target_ip"`
 	Port       int       `json:"port"`
 	Timestamp  time.Time `json:"timestamp"`
 	Detections int       `json:"detections"`
+	RuleID     string    `json:"rule_id,omitempty"`
+
+	Evidence   *DetectionEvidence       `json:"evidence,omitempty"`
+	Intel      []IntelMatch             `json:"intel,omitempty"`
+	Enrichment map[string]*IPEnrichment `json:"enrichment,omitempty"`
 }
 
 // FirewallRule represents a firewall rule
@@ -71,6 +86,17 @@ func init() {
 	initSampleData()
 }
 
+// nextResourceID returns the next free sequential ID for a prefix such as
+// "ALT" or "THR". Callers must hold dataMux.
+func nextResourceID(prefix string, count int, exists func(string) bool) string {
+	for n := count + 1; ; n++ {
+		id := fmt.Sprintf("%s-%03d", prefix, n)
+		if !exists(id) {
+			return id
+		}
+	}
+}
+
 func initSampleData() {
 	// Sample alerts
 	alerts["ALT-001"] = &Alert{
@@ -169,18 +195,23 @@ func listAlerts(c *gin.Context) {
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
 	severity := c.Query("severity")
 
+	defer traceData(c.Request.Context(), "alerts.list")()
 	dataMux.RLock()
 	defer dataMux.RUnlock()
 
 	var alertList []*Alert
+	var newest time.Time
 	for _, alert := range alerts {
 		if severity != "" && alert.Severity != severity {
 			continue
 		}
 		alertList = append(alertList, alert)
+		newest = latest(newest, resourceModified("alert", alert.ID, alert.Timestamp))
 	}
+	// Map order is random; a stable order keeps the ETag stable too
+	sort.Slice(alertList, func(i, j int) bool { return alertList[i].ID < alertList[j].ID })
 
-	c.JSON(http.StatusOK, gin.H{
+	writeConditionalJSON(c, gin.H{
 		"alerts": alertList,
 		"pagination": gin.H{
 			"page":  page,
@@ -190,22 +221,24 @@ func listAlerts(c *gin.Context) {
 		"filters": gin.H{
 			"severity": severity,
 		},
-	})
+	}, collectionModified("alert", newest))
 }
 
 func getAlert(c *gin.Context) {
 	id := c.Param("id")
 
+	defer traceData(c.Request.Context(), "alerts.get")()
 	dataMux.RLock()
-	alert, exists := alerts[id]
-	dataMux.RUnlock()
+	defer dataMux.RUnlock()
 
+	alert, exists := alerts[id]
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, alert)
+	queueAlertEnrichment(alert)
+	writeConditionalJSON(c, alert, resourceModified("alert", id, alert.Timestamp))
 }
 
 func createAlert(c *gin.Context) {
@@ -214,6 +247,7 @@ func createAlert(c *gin.Context) {
 		Description string `json:"description" binding:"required"`
 		Severity    string `json:"severity" binding:"required"`
 		Source      string `json:"source"`
+		SourceIP    string `json:"source_ip"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -221,25 +255,34 @@ func createAlert(c *gin.Context) {
 		return
 	}
 
-	id := fmt.Sprintf("ALT-%03d", len(alerts)+1)
 	alert := &Alert{
-		ID:          id,
 		Title:       req.Title,
 		Description: req.Description,
 		Severity:    req.Severity,
 		Status:      "active",
 		Timestamp:   time.Now(),
 		Source:      req.Source,
+		SourceIP:    req.SourceIP,
 	}
+	alert.Intel = alertIntelMatches(alert)
 
+	end := traceData(c.Request.Context(), "alerts.create")
 	dataMux.Lock()
+	id := nextResourceID("ALT", len(alerts), func(id string) bool { _, ok := alerts[id]; return ok })
+	alert.ID = id
 	alerts[id] = alert
+	// The enricher writes to the stored alert from here on
+	snapshot := *alert
 	dataMux.Unlock()
+	end()
+
+	enricher.QueueAlert(id)
+	publishEvent(c, EventAlertCreated, "alert", id, &snapshot)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"id":      id,
 		"message": "Alert created successfully",
-		"alert":   alert,
+		"alert":   snapshot,
 	})
 }
 
@@ -255,39 +298,67 @@ func updateAlert(c *gin.Context) {
 		return
 	}
 
+	end := traceData(c.Request.Context(), "alerts.update")
 	dataMux.Lock()
 	alert, exists := alerts[id]
-	if exists {
+	var etag string
+	var snapshot Alert
+	matched := exists && ifMatch(c, alert)
+	if matched {
 		alert.Status = req.Status
+		snapshot = *alert
+	} else if exists {
+		etag = resourceETag(alert)
 	}
 	dataMux.Unlock()
+	end()
 
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
 		return
 	}
+	if !matched {
+		preconditionFailed(c, etag)
+		return
+	}
+
+	publishEvent(c, EventAlertUpdated, "alert", id, &snapshot)
 
 	c.JSON(http.StatusOK, gin.H{
 		"id":      id,
 		"message": "Alert updated successfully",
-		"alert":   alert,
+		"alert":   snapshot,
 	})
 }
 
 func deleteAlert(c *gin.Context) {
 	id := c.Param("id")
 
+	end := traceData(c.Request.Context(), "alerts.delete")
 	dataMux.Lock()
-	_, exists := alerts[id]
-	if exists {
+	alert, exists := alerts[id]
+	var etag string
+	var snapshot Alert
+	matched := exists && ifMatch(c, alert)
+	if matched {
 		delete(alerts, id)
+		snapshot = *alert
+	} else if exists {
+		etag = resourceETag(alert)
 	}
 	dataMux.Unlock()
+	end()
 
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
 		return
 	}
+	if !matched {
+		preconditionFailed(c, etag)
+		return
+	}
+
+	publishEvent(c, EventAlertDeleted, "alert", id, &snapshot)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Alert deleted successfully",
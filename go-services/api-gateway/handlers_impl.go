@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -10,25 +12,46 @@ import (
 
 // Threat handlers
 func listThreats(c *gin.Context) {
+	country := c.Query("country")
+	asn := c.Query("asn")
+	ipClass := c.Query("ip_class")
+
+	defer traceData(c.Request.Context(), "threats.list")()
 	dataMux.RLock()
 	defer dataMux.RUnlock()
 
 	var threatList []*Threat
+	var newest time.Time
 	for _, threat := range threats {
+		if !matchesEnrichmentFilter(threat.Enrichment["source_ip"], country, asn, ipClass) {
+			continue
+		}
 		threatList = append(threatList, threat)
+		newest = latest(newest, resourceModified("threat", threat.ID, threat.Timestamp))
 	}
+	sort.Slice(threatList, func(i, j int) bool { return threatList[i].ID < threatList[j].ID })
 
-	c.JSON(http.StatusOK, gin.H{
+	writeConditionalJSON(c, gin.H{
 		"threats": threatList,
 		"total":   len(threatList),
-	})
+		"filters": gin.H{
+			"country":  country,
+			"asn":      asn,
+			"ip_class": ipClass,
+		},
+	}, collectionModified("threat", newest))
 }
 
 func getThreat(c *gin.Context) {
 	id := c.Param("id")
 
+	defer traceData(c.Request.Context(), "threats.get")()
 	dataMux.RLock()
 	threat, exists := threats[id]
+	var snapshot Threat
+	if exists {
+		snapshot = *threat
+	}
 	dataMux.RUnlock()
 
 	if !exists {
@@ -36,13 +59,17 @@ func getThreat(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, threat)
+	queueThreatEnrichment(&snapshot)
+
+	writeConditionalJSON(c, snapshot, resourceModified("threat", id, snapshot.Timestamp))
 }
 
 func analyzeThreat(c *gin.Context) {
 	var req struct {
-		Data string `json:"data" binding:"required"`
-		Type string `json:"type"`
+		Data    string             `json:"data"`
+		Type    string             `json:"type"`
+		Packets []AnalyzerPacket   `json:"packets"`
+		Logs    []AnalyzerLogEntry `json:"logs"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -50,13 +77,35 @@ func analyzeThreat(c *gin.Context) {
 		return
 	}
 
-	// Create new threat from analysis
-	id := fmt.Sprintf("THR-%03d", len(threats)+1)
+	analysis := AnalysisRequest{Type: req.Type, Packets: req.Packets, Logs: req.Logs}
+	if req.Data != "" && len(analysis.Packets) == 0 && len(analysis.Logs) == 0 {
+		// data may carry JSON packets or log entries; anything else is
+		// analyzed as a single log message
+		if req.Type == "logs" || json.Unmarshal([]byte(req.Data), &analysis.Packets) != nil {
+			analysis.Packets = nil
+			if json.Unmarshal([]byte(req.Data), &analysis.Logs) != nil {
+				analysis.Logs = []AnalyzerLogEntry{{
+					Timestamp: float64(time.Now().Unix()),
+					Level:     "info",
+					Source:    "api",
+					Message:   req.Data,
+				}}
+			}
+		}
+	}
+	if len(analysis.Packets) == 0 && len(analysis.Logs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "data, packets or logs is required"})
+		return
+	}
+
+	// Create the threat up front; the analyzer verdict updates it
+	dataMux.Lock()
+	id := nextResourceID("THR", len(threats), func(id string) bool { _, ok := threats[id]; return ok })
 	threat := &Threat{
 		ID:         id,
 		Name:       fmt.Sprintf("Analyzed.%s", req.Type),
 		Type:       req.Type,
-		Severity:   "medium",
+		Severity:   "unknown",
 		Status:     "analyzing",
 		SourceIP:   "unknown",
 		TargetIP:   "unknown",
@@ -64,33 +113,100 @@ func analyzeThreat(c *gin.Context) {
 		Timestamp:  time.Now(),
 		Detections: 1,
 	}
-
-	dataMux.Lock()
+	if len(analysis.Packets) > 0 {
+		threat.SourceIP = analysis.Packets[0].SourceIP
+		threat.TargetIP = analysis.Packets[0].DestinationIP
+		threat.Port = analysis.Packets[0].DestinationPort
+		threat.Detections = len(analysis.Packets)
+	}
 	threats[id] = threat
+	// The enricher and the analysis job write to the stored threat from here on
+	snapshot := *threat
 	dataMux.Unlock()
 
+	enricher.QueueThreat(id)
+	publishEvent(c, EventThreatCreated, "threat", id, &snapshot)
+
+	job, err := analysisService.Submit(c.Request.Context(), id, analysis)
+	if err != nil {
+		// Nothing will ever analyze the threat, so do not leave it behind
+		// as "analyzing"
+		dataMux.Lock()
+		delete(threats, id)
+		dataMux.Unlock()
+		publishEvent(c, EventThreatDeleted, "threat", id, &snapshot)
+
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":     job.ID,
+		"threat_id":  id,
+		"status":     job.Status,
+		"status_url": "/api/v1/threats/analyze/" + job.ID,
+		"message":    "Threat analysis queued",
+	})
+}
+
+// getAnalysisJob returns the status and verdict of an analysis job
+func getAnalysisJob(c *gin.Context) {
+	job, exists := analysisService.Get(c.Param("job_id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Analysis job not found"})
+		return
+	}
+
+	// Copy the threat under the lock: the worker updates it when the job
+	// finishes
+	var threat *Threat
+	dataMux.RLock()
+	if stored, exists := threats[job.ThreatID]; exists {
+		snapshot := *stored
+		threat = &snapshot
+	}
+	dataMux.RUnlock()
+
 	c.JSON(http.StatusOK, gin.H{
-		"analysis_id": id,
-		"status":      "completed",
-		"threat":      threat,
-		"message":     "Threat analysis completed",
+		"job":    job,
+		"threat": threat,
 	})
 }
 
 // Firewall handlers
 func listFirewallRules(c *gin.Context) {
+	defer traceData(c.Request.Context(), "firewall_rules.list")()
 	dataMux.RLock()
 	defer dataMux.RUnlock()
 
 	var ruleList []*FirewallRule
+	var newest time.Time
 	for _, rule := range firewallRules {
 		ruleList = append(ruleList, rule)
+		newest = latest(newest, resourceModified("firewall_rule", rule.ID, rule.CreatedAt))
 	}
+	sort.Slice(ruleList, func(i, j int) bool { return ruleList[i].ID < ruleList[j].ID })
 
-	c.JSON(http.StatusOK, gin.H{
+	writeConditionalJSON(c, gin.H{
 		"rules": ruleList,
 		"total": len(ruleList),
-	})
+	}, collectionModified("firewall_rule", newest))
+}
+
+func getFirewallRule(c *gin.Context) {
+	id := c.Param("id")
+
+	defer traceData(c.Request.Context(), "firewall_rules.get")()
+	dataMux.RLock()
+	defer dataMux.RUnlock()
+
+	rule, exists := firewallRules[id]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firewall rule not found"})
+		return
+	}
+
+	writeConditionalJSON(c, rule, resourceModified("firewall_rule", id, rule.CreatedAt))
 }
 
 func addFirewallRule(c *gin.Context) {
@@ -108,9 +224,7 @@ func addFirewallRule(c *gin.Context) {
 		return
 	}
 
-	id := fmt.Sprintf("FW-%03d", len(firewallRules)+1)
 	rule := &FirewallRule{
-		ID:        id,
 		Name:      req.Name,
 		Action:    req.Action,
 		Protocol:  req.Protocol,
@@ -121,9 +235,15 @@ func addFirewallRule(c *gin.Context) {
 		CreatedAt: time.Now(),
 	}
 
+	end := traceData(c.Request.Context(), "firewall_rules.create")
 	dataMux.Lock()
+	id := nextResourceID("FW", len(firewallRules), func(id string) bool { _, ok := firewallRules[id]; return ok })
+	rule.ID = id
 	firewallRules[id] = rule
 	dataMux.Unlock()
+	end()
+
+	publishEvent(c, EventFirewallRuleChanged, "firewall_rule", id, gin.H{"action": "created", "rule": *rule})
 
 	c.JSON(http.StatusCreated, gin.H{
 		"id":      id,
@@ -135,17 +255,29 @@ func addFirewallRule(c *gin.Context) {
 func deleteFirewallRule(c *gin.Context) {
 	id := c.Param("id")
 
+	end := traceData(c.Request.Context(), "firewall_rules.delete")
 	dataMux.Lock()
-	_, exists := firewallRules[id]
-	if exists {
+	rule, exists := firewallRules[id]
+	var etag string
+	matched := exists && ifMatch(c, rule)
+	if matched {
 		delete(firewallRules, id)
+	} else if exists {
+		etag = resourceETag(rule)
 	}
 	dataMux.Unlock()
+	end()
 
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Firewall rule not found"})
 		return
 	}
+	if !matched {
+		preconditionFailed(c, etag)
+		return
+	}
+
+	publishEvent(c, EventFirewallRuleChanged, "firewall_rule", id, gin.H{"action": "deleted", "rule": *rule})
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Firewall rule deleted successfully",
@@ -189,22 +321,39 @@ func listInterfaces(c *gin.Context) {
 }
 
 func getNetworkStats(c *gin.Context) {
+	totals := flowStats.Totals()
+	inbound, outbound, _, _ := flowStats.Rates()
+
+	dataMux.RLock()
+	alertCount := len(alerts)
+	threatCount := len(threats)
+	dataMux.RUnlock()
+
 	stats := gin.H{
-		"packets_captured":  15234 + (time.Now().Unix() % 1000),
-		"bytes_processed":   1024000000 + (time.Now().Unix() % 1000000),
-		"alerts_generated":  42 + (time.Now().Unix() % 10),
-		"threats_detected":  7 + (time.Now().Unix() % 5),
-		"uptime_seconds":    time.Now().Unix() % 86400,
-		"active_connections": 42 + (time.Now().Second() % 20),
+		"packets_captured":   totals.Packets,
+		"bytes_processed":    totals.Bytes,
+		"flows_processed":    totals.Flows,
+		"alerts_generated":   alertCount,
+		"threats_detected":   threatCount,
+		"uptime_seconds":     int(flowUptime().Seconds()),
+		"active_connections": flowStats.ActiveFlows(),
 		"bandwidth_usage": gin.H{
-			"inbound":  "125.5 MB/s",
-			"outbound": "87.3 MB/s",
+			"inbound":      formatBandwidth(inbound),
+			"outbound":     formatBandwidth(outbound),
+			"inbound_bps":  inbound * 8,
+			"outbound_bps": outbound * 8,
 		},
+		"top_protocols": flowStats.TopProtocols(10),
+		"top_endpoints": flowStats.TopEndpoints(10),
+		"interfaces":    flowStats.Interfaces(),
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"stats": stats,
-	})
+	response := gin.H{"stats": stats}
+	if flowCollector != nil {
+		response["collector"] = flowCollector.Status()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 func startMonitoring(c *gin.Context) {
@@ -217,6 +366,8 @@ func startMonitoring(c *gin.Context) {
 		return
 	}
 
+	publishEvent(c, EventMonitoringStarted, "network", req.Interface, gin.H{"interface": req.Interface})
+
 	c.JSON(http.StatusOK, gin.H{
 		"message":   "Monitoring started successfully",
 		"interface": req.Interface,
@@ -226,6 +377,8 @@ func startMonitoring(c *gin.Context) {
 }
 
 func stopMonitoring(c *gin.Context) {
+	publishEvent(c, EventMonitoringStopped, "network", "", nil)
+
 	c.JSON(http.StatusOK, gin.H{
 		"message":    "Monitoring stopped successfully",
 		"status":     "stopped",
@@ -234,31 +387,42 @@ func stopMonitoring(c *gin.Context) {
 }
 
 // User management handlers
+
+// userResponse is the public representation of a user, which its ETag covers
+func userResponse(user *User) gin.H {
+	return gin.H{
+		"id":         user.ID,
+		"email":      user.Email,
+		"name":       user.Name,
+		"company":    user.Company,
+		"role":       user.Role,
+		"created_at": user.CreatedAt,
+	}
+}
+
 func listUsers(c *gin.Context) {
+	defer traceData(c.Request.Context(), "users.list")()
 	usersMux.RLock()
 	defer usersMux.RUnlock()
 
 	var userList []gin.H
+	var newest time.Time
 	for _, user := range users {
-		userList = append(userList, gin.H{
-			"id":         user.ID,
-			"email":      user.Email,
-			"name":       user.Name,
-			"company":    user.Company,
-			"role":       user.Role,
-			"created_at": user.CreatedAt,
-		})
+		userList = append(userList, userResponse(user))
+		newest = latest(newest, resourceModified("user", user.ID, user.CreatedAt))
 	}
+	sort.Slice(userList, func(i, j int) bool { return userList[i]["id"].(string) < userList[j]["id"].(string) })
 
-	c.JSON(http.StatusOK, gin.H{
+	writeConditionalJSON(c, gin.H{
 		"users": userList,
 		"total": len(userList),
-	})
+	}, collectionModified("user", newest))
 }
 
 func getUser(c *gin.Context) {
 	id := c.Param("id")
 
+	defer traceData(c.Request.Context(), "users.get")()
 	usersMux.RLock()
 	defer usersMux.RUnlock()
 
@@ -275,14 +439,7 @@ func getUser(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"id":         foundUser.ID,
-		"email":      foundUser.Email,
-		"name":       foundUser.Name,
-		"company":    foundUser.Company,
-		"role":       foundUser.Role,
-		"created_at": foundUser.CreatedAt,
-	})
+	writeConditionalJSON(c, userResponse(foundUser), resourceModified("user", id, foundUser.CreatedAt))
 }
 
 func updateUser(c *gin.Context) {
@@ -298,12 +455,23 @@ func updateUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// Only admins may change roles, or anyone could make themselves admin
+	if req.Role != "" && !requireAdmin(c) {
+		return
+	}
 
+	end := traceData(c.Request.Context(), "users.update")
 	usersMux.Lock()
 	var foundUser *User
+	var etag string
+	matched := false
 	for _, user := range users {
 		if user.ID == id {
 			foundUser = user
+			if matched = ifMatch(c, userResponse(user)); !matched {
+				etag = resourceETag(userResponse(user))
+				break
+			}
 			if req.Name != "" {
 				user.Name = req.Name
 			}
@@ -317,11 +485,18 @@ func updateUser(c *gin.Context) {
 		}
 	}
 	usersMux.Unlock()
+	end()
 
 	if foundUser == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	if !matched {
+		preconditionFailed(c, etag)
+		return
+	}
+
+	publishEvent(c, EventUserUpdated, "user", id, foundUser)
 
 	c.JSON(http.StatusOK, gin.H{
 		"id":      id,
@@ -339,21 +514,35 @@ func updateUser(c *gin.Context) {
 func deleteUser(c *gin.Context) {
 	id := c.Param("id")
 
+	end := traceData(c.Request.Context(), "users.delete")
 	usersMux.Lock()
-	var found bool
+	var found *User
+	var etag string
+	matched := false
 	for email, user := range users {
 		if user.ID == id {
-			delete(users, email)
-			found = true
+			found = user
+			if matched = ifMatch(c, userResponse(user)); matched {
+				delete(users, email)
+			} else {
+				etag = resourceETag(userResponse(user))
+			}
 			break
 		}
 	}
 	usersMux.Unlock()
+	end()
 
-	if !found {
+	if found == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	if !matched {
+		preconditionFailed(c, etag)
+		return
+	}
+
+	publishEvent(c, EventUserDeleted, "user", id, found)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "User deleted successfully",
@@ -373,6 +562,8 @@ func getDashboardStats(c *gin.Context) {
 	userCount := len(users)
 	usersMux.RUnlock()
 
+	_, _, bytesPerSecond, packetsPerSecond := flowStats.Rates()
+
 	stats := gin.H{
 		"total_alerts":        alertCount,
 		"active_alerts":       alertCount,
@@ -381,10 +572,10 @@ func getDashboardStats(c *gin.Context) {
 		"firewall_rules":      firewallRuleCount,
 		"active_users":        userCount,
 		"network_interfaces":  3,
-		"packets_per_second":  1234.5 + float64(time.Now().Second()%100),
-		"bytes_per_second":    5242880 + (time.Now().Unix() % 1000000),
-		"active_connections":  42 + (time.Now().Second() % 20),
-		"threats_detected":    7 + (time.Now().Second() % 10),
+		"packets_per_second":  packetsPerSecond,
+		"bytes_per_second":    bytesPerSecond,
+		"active_connections":  flowStats.ActiveFlows(),
+		"threats_detected":    threatCount,
 		"uptime_hours":        24,
 		"cpu_usage":           45.5,
 		"memory_usage":        62.3,
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// createResource POSTs body to path and returns the created resource's ID,
+// deleting it again when the test ends
+func createResource(t *testing.T, router http.Handler, token, path string, body interface{}) string {
+	t.Helper()
+
+	w := doRequest(t, router, http.MethodPost, path, body, bearer(token)...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST %s = %d, want 201: %s", path, w.Code, w.Body)
+	}
+	id, _ := decodeBody(t, w)["id"].(string)
+	if id == "" {
+		t.Fatalf("POST %s returned no id: %s", path, w.Body)
+	}
+	t.Cleanup(func() {
+		dataMux.Lock()
+		delete(alerts, id)
+		delete(firewallRules, id)
+		dataMux.Unlock()
+	})
+	return id
+}
+
+func TestCreateAfterDeleteKeepsIDsUnique(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "admin")
+
+	tests := []struct {
+		name       string
+		collection string
+		item       string
+		body       func(name string) interface{}
+		field      string
+	}{
+		{
+			name:       "alerts",
+			collection: "/api/v1/alerts",
+			item:       "/api/v1/alerts/",
+			body: func(name string) interface{} {
+				return map[string]string{"title": name, "description": "test", "severity": "low"}
+			},
+			field: "title",
+		},
+		{
+			name:       "firewall rules",
+			collection: "/api/v1/firewall/rules",
+			item:       "/api/v1/firewall/rules/",
+			body: func(name string) interface{} {
+				return map[string]string{"name": name, "action": "deny", "protocol": "tcp"}
+			},
+			field: "name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := createResource(t, router, token, tt.collection, tt.body("first"))
+			second := createResource(t, router, token, tt.collection, tt.body("second"))
+
+			if w := doRequest(t, router, http.MethodDelete, tt.item+first, nil, bearer(token)...); w.Code != http.StatusOK {
+				t.Fatalf("DELETE %s = %d, want 200: %s", first, w.Code, w.Body)
+			}
+
+			// With the first one gone the count is back to where it was when
+			// the second was created, which must not hand out its ID again
+			third := createResource(t, router, token, tt.collection, tt.body("third"))
+			if third == second {
+				t.Fatalf("created %s over an existing resource", third)
+			}
+
+			w := doRequest(t, router, http.MethodGet, tt.item+second, nil, bearer(token)...)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d, want 200", second, w.Code)
+			}
+			if got := decodeBody(t, w)[tt.field]; got != "second" {
+				t.Errorf("%s %s = %v after create, want second", tt.field, second, got)
+			}
+		})
+	}
+}
+
+func TestConcurrentCreatesGetDistinctIDs(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "admin")
+
+	const creates = 20
+	ids := make(chan string, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := map[string]string{"title": fmt.Sprintf("concurrent %d", i), "description": "test", "severity": "low"}
+			w := doRequest(t, router, http.MethodPost, "/api/v1/alerts", body, bearer(token)...)
+			if w.Code != http.StatusCreated {
+				t.Errorf("POST = %d, want 201", w.Code)
+				return
+			}
+			id, _ := decodeBody(t, w)["id"].(string)
+			ids <- id
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("ID %s handed out twice", id)
+		}
+		seen[id] = true
+	}
+	t.Cleanup(func() {
+		dataMux.Lock()
+		for id := range seen {
+			delete(alerts, id)
+		}
+		dataMux.Unlock()
+	})
+}
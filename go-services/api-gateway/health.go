@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Health check statuses, worst last
+const (
+	healthPass = "pass"
+	healthWarn = "warn"
+	healthFail = "fail"
+)
+
+// HealthCheck is a check a subsystem registers on the health registry.
+// Liveness checks should only fail when restarting the process would help,
+// such as a deadlocked store or a stalled worker loop. Readiness checks take
+// the instance out of load balancing while a dependency it needs is down.
+type HealthCheck struct {
+	Name      string
+	Liveness  bool
+	Readiness bool
+	// Critical readiness checks make the instance unready when they fail;
+	// the others only mark it degraded
+	Critical bool
+	// Timeout bounds a single run of Check (default 2s)
+	Timeout time.Duration
+	// Interval is how long a result is reused before Check runs again, so
+	// frequent probes do not hammer dependencies (default 5s)
+	Interval time.Duration
+	// Check returns details to report and an error when unhealthy. Wrap an
+	// error with healthWarning to report it as degraded instead of failed.
+	Check func(ctx context.Context) (gin.H, error)
+}
+
+// HealthResult is the outcome of one run of a check
+type HealthResult struct {
+	Status     string    `json:"status"`
+	Message    string    `json:"message,omitempty"`
+	Details    gin.H     `json:"details,omitempty"`
+	Critical   bool      `json:"critical"`
+	Liveness   bool      `json:"liveness"`
+	Readiness  bool      `json:"readiness"`
+	DurationMS float64   `json:"duration_ms"`
+	CheckedAt  time.Time `json:"checked_at"`
+	Cached     bool      `json:"cached"`
+}
+
+// healthWarningError marks a check failure as degraded rather than failed
+type healthWarningError struct {
+	err error
+}
+
+func (e healthWarningError) Error() string { return e.err.Error() }
+func (e healthWarningError) Unwrap() error { return e.err }
+
+// healthWarning reports a degraded but working dependency
+func healthWarning(format string, args ...interface{}) error {
+	return healthWarningError{fmt.Errorf(format, args...)}
+}
+
+type registeredCheck struct {
+	HealthCheck
+	mu      sync.Mutex
+	last    *HealthResult
+	running atomic.Bool
+}
+
+var (
+	healthChecks    = map[string]*registeredCheck{}
+	healthChecksMux sync.RWMutex
+
+	// draining fails readiness once shutdown starts so load balancers stop
+	// sending new requests while in-flight ones finish
+	draining atomic.Bool
+
+	healthCheckStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "health_check_status",
+		Help: "Latest result of each health check: 1 pass, 0.5 warn, 0 fail.",
+	}, []string{"check"})
+)
+
+// registerHealthCheck adds a check to the registry, replacing any check with
+// the same name
+func registerHealthCheck(check HealthCheck) {
+	if check.Timeout <= 0 {
+		check.Timeout = 2 * time.Second
+	}
+	if check.Interval <= 0 {
+		check.Interval = 5 * time.Second
+	}
+
+	healthChecksMux.Lock()
+	defer healthChecksMux.Unlock()
+
+	healthChecks[check.Name] = &registeredCheck{HealthCheck: check}
+}
+
+// run returns the cached result while it is fresh, otherwise runs the check.
+// A check that does not finish within its timeout fails; it is not started
+// again until the stuck run returns, so a hung dependency cannot pile up
+// goroutines.
+func (rc *registeredCheck) run() HealthResult {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.last != nil && time.Since(rc.last.CheckedAt) < rc.Interval {
+		result := *rc.last
+		result.Cached = true
+		return result
+	}
+
+	result := HealthResult{
+		Status:    healthPass,
+		Critical:  rc.Critical,
+		Liveness:  rc.Liveness,
+		Readiness: rc.Readiness,
+		CheckedAt: time.Now(),
+	}
+
+	if !rc.running.CompareAndSwap(false, true) {
+		result.Status = healthFail
+		result.Message = "previous run has not finished"
+	} else {
+		type outcome struct {
+			details gin.H
+			err     error
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), rc.Timeout)
+		defer cancel()
+
+		done := make(chan outcome, 1)
+		go func() {
+			defer rc.running.Store(false)
+			details, err := rc.Check(ctx)
+			done <- outcome{details, err}
+		}()
+
+		select {
+		case o := <-done:
+			result.Details = o.details
+			if o.err != nil {
+				result.Status = healthFail
+				result.Message = o.err.Error()
+				var warning healthWarningError
+				if errors.As(o.err, &warning) {
+					result.Status = healthWarn
+				}
+			}
+		case <-ctx.Done():
+			result.Status = healthFail
+			result.Message = fmt.Sprintf("timed out after %s", rc.Timeout)
+		}
+	}
+	result.DurationMS = milliseconds(time.Since(result.CheckedAt).Seconds())
+
+	switch result.Status {
+	case healthPass:
+		healthCheckStatus.WithLabelValues(rc.Name).Set(1)
+	case healthWarn:
+		healthCheckStatus.WithLabelValues(rc.Name).Set(0.5)
+	default:
+		healthCheckStatus.WithLabelValues(rc.Name).Set(0)
+	}
+
+	rc.last = &result
+	return result
+}
+
+// runHealthChecks runs the selected checks concurrently and combines them:
+// fail if a check that is critical for this probe failed, warn if any other
+// check did not pass
+func runHealthChecks(selected func(*registeredCheck) bool, critical func(*registeredCheck) bool) (string, map[string]HealthResult) {
+	healthChecksMux.RLock()
+	var checks []*registeredCheck
+	for _, rc := range healthChecks {
+		if selected(rc) {
+			checks = append(checks, rc)
+		}
+	}
+	healthChecksMux.RUnlock()
+
+	results := make([]HealthResult, len(checks))
+	var wg sync.WaitGroup
+	for i, rc := range checks {
+		wg.Add(1)
+		go func(i int, rc *registeredCheck) {
+			defer wg.Done()
+			results[i] = rc.run()
+		}(i, rc)
+	}
+	wg.Wait()
+
+	status := healthPass
+	byName := make(map[string]HealthResult, len(checks))
+	for i, rc := range checks {
+		result := results[i]
+		byName[rc.Name] = result
+		switch {
+		case result.Status == healthFail && critical(rc):
+			status = healthFail
+		case result.Status != healthPass && status == healthPass:
+			status = healthWarn
+		}
+	}
+	return status, byName
+}
+
+// healthStatusCode is 503 for a failed probe. Degraded still serves
+// traffic, so it is 200.
+func healthStatusCode(status string) int {
+	if status == healthFail {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// getLivenessCheck is the Kubernetes liveness probe. Only liveness checks
+// run, and any failing one fails the probe so the pod is restarted.
+func getLivenessCheck(c *gin.Context) {
+	status, checks := runHealthChecks(
+		func(rc *registeredCheck) bool { return rc.Liveness },
+		func(rc *registeredCheck) bool { return true },
+	)
+
+	c.JSON(healthStatusCode(status), gin.H{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// getReadinessCheck is the Kubernetes readiness probe. It fails when a
+// critical readiness check fails or the server is shutting down.
+func getReadinessCheck(c *gin.Context) {
+	status, checks := runHealthChecks(
+		func(rc *registeredCheck) bool { return rc.Readiness },
+		func(rc *registeredCheck) bool { return rc.Critical },
+	)
+	if draining.Load() {
+		status = healthFail
+	}
+
+	c.JSON(healthStatusCode(status), gin.H{
+		"ready":    status != healthFail,
+		"status":   status,
+		"draining": draining.Load(),
+		"checks":   checks,
+	})
+}
+
+// getHealthCheck returns detailed health check: every registered check, plus
+// runtime and data store figures
+func getHealthCheck(c *gin.Context) {
+	status, checks := runHealthChecks(
+		func(rc *registeredCheck) bool { return true },
+		func(rc *registeredCheck) bool { return rc.Liveness || rc.Critical },
+	)
+
+	dataMux.RLock()
+	alertCount := len(alerts)
+	threatCount := len(threats)
+	dataMux.RUnlock()
+
+	usersMux.RLock()
+	userCount := len(users)
+	usersMux.RUnlock()
+
+	c.JSON(healthStatusCode(status), gin.H{
+		"status": status,
+		"checks": checks,
+		"data": gin.H{
+			"alerts":  alertCount,
+			"threats": threatCount,
+			"users":   userCount,
+		},
+		"uptime":    time.Since(startTime).String(),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// tryLock reports whether lock could be taken within ctx. Pass a read lock:
+// a waiting writer would hold up every reader behind it. A store that stays
+// locked for the whole timeout is busy, for example behind a backup restore,
+// which only affects readiness; deadlocks are left to the lock watchdog.
+func tryLock(ctx context.Context, lock func(), unlock func()) error {
+	acquired := make(chan struct{})
+	go func() {
+		lock()
+		unlock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		return errors.New("lock not acquired before timeout")
+	}
+}
+
+// storeLock is the lock of an in-memory store, watched for deadlocks
+type storeLock struct {
+	name     string
+	lock     func()
+	unlock   func()
+	acquired atomic.Int64 // unix nanoseconds of the last acquisition
+}
+
+var storeLocks = []*storeLock{
+	{name: "data", lock: dataMux.RLock, unlock: dataMux.RUnlock},
+	{name: "webhooks", lock: webhooksMux.RLock, unlock: webhooksMux.RUnlock},
+	{name: "users", lock: usersMux.RLock, unlock: usersMux.RUnlock},
+	{name: "api_keys", lock: apiKeysMux.RLock, unlock: apiKeysMux.RUnlock},
+}
+
+// watch takes the lock every interval and records when it succeeded. Each
+// store has its own goroutine, so one stuck lock does not hide the others.
+func (s *storeLock) watch(interval time.Duration) {
+	s.acquired.Store(time.Now().UnixNano())
+	go func() {
+		for {
+			time.Sleep(interval)
+			s.lock()
+			s.unlock()
+			s.acquired.Store(time.Now().UnixNano())
+		}
+	}()
+}
+
+// heldFor returns how long ago the lock was last acquired
+func (s *storeLock) heldFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, s.acquired.Load()))
+}
+
+// deadlockCheck fails when a store lock has not been acquired for longer than
+// timeout. Requests that hold a lock for a while, such as a restore, are well
+// below it; a lock that is never released is not.
+func deadlockCheck(locks []*storeLock, timeout time.Duration) func(ctx context.Context) (gin.H, error) {
+	return func(ctx context.Context) (gin.H, error) {
+		now := time.Now()
+		details := gin.H{"timeout": timeout.String()}
+		var stuck []string
+		for _, s := range locks {
+			held := s.heldFor(now)
+			details[s.name] = held.Round(time.Millisecond).String()
+			if held > timeout {
+				stuck = append(stuck, s.name)
+			}
+		}
+		if len(stuck) > 0 {
+			return details, fmt.Errorf("store locks not acquired for over %s: %v", timeout, stuck)
+		}
+		return details, nil
+	}
+}
+
+// startHealthChecks registers the checks of the gateway itself. Subsystems
+// register their own when they start.
+func startHealthChecks() {
+	deadlockTimeout := getEnvDuration("HEALTH_DEADLOCK_TIMEOUT", 2*time.Minute)
+	for _, s := range storeLocks {
+		s.watch(5 * time.Second)
+	}
+	registerHealthCheck(HealthCheck{
+		Name:     "deadlock",
+		Liveness: true,
+		Interval: time.Second,
+		Check:    deadlockCheck(storeLocks, deadlockTimeout),
+	})
+
+	registerHealthCheck(HealthCheck{
+		Name:      "storage",
+		Readiness: true,
+		Critical:  true,
+		Check: func(ctx context.Context) (gin.H, error) {
+			if err := tryLock(ctx, dataMux.RLock, dataMux.RUnlock); err != nil {
+				return nil, fmt.Errorf("data store: %w", err)
+			}
+			dataMux.RLock()
+			details := gin.H{
+				"alerts":         len(alerts),
+				"threats":        len(threats),
+				"firewall_rules": len(firewallRules),
+			}
+			dataMux.RUnlock()
+
+			if err := tryLock(ctx, webhooksMux.RLock, webhooksMux.RUnlock); err != nil {
+				return details, fmt.Errorf("webhook store: %w", err)
+			}
+			return details, nil
+		},
+	})
+
+	registerHealthCheck(HealthCheck{
+		Name:      "auth",
+		Readiness: true,
+		Critical:  true,
+		Check: func(ctx context.Context) (gin.H, error) {
+			if err := tryLock(ctx, usersMux.RLock, usersMux.RUnlock); err != nil {
+				return nil, fmt.Errorf("user store: %w", err)
+			}
+			usersMux.RLock()
+			userCount, sessionCount := len(users), len(sessions)
+			usersMux.RUnlock()
+
+			apiKeysMux.RLock()
+			keyCount := len(apiKeys)
+			apiKeysMux.RUnlock()
+
+			details := gin.H{"users": userCount, "sessions": sessionCount, "api_keys": keyCount}
+			if userCount == 0 {
+				return details, healthWarning("no users are registered, nobody can log in")
+			}
+			return details, nil
+		},
+	})
+
+	maxGoroutines := getEnvInt("HEALTH_MAX_GOROUTINES", 10000)
+	registerHealthCheck(HealthCheck{
+		Name:      "runtime",
+		Readiness: true,
+		Interval:  time.Second,
+		Check: func(ctx context.Context) (gin.H, error) {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			goroutines := runtime.NumGoroutine()
+
+			details := gin.H{
+				"goroutines": goroutines,
+				"heap_mb":    m.HeapAlloc / 1024 / 1024,
+				"sys_mb":     m.Sys / 1024 / 1024,
+			}
+			if goroutines > maxGoroutines {
+				return details, healthWarning("%d goroutines running, more than %d", goroutines, maxGoroutines)
+			}
+			return details, nil
+		},
+	})
+}
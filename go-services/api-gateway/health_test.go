@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBusyStoreOnlyFailsReadiness(t *testing.T) {
+	startHealthChecks()
+	router := newRouter()
+
+	// A long write, such as a backup restore, holds the data store lock
+	dataMux.Lock()
+	var readyW, liveW *httptest.ResponseRecorder
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		readyW = doRequest(t, router, http.MethodGet, "/ready", nil)
+	}()
+	go func() {
+		defer wg.Done()
+		liveW = doRequest(t, router, http.MethodGet, "/health/live", nil)
+	}()
+	wg.Wait()
+	dataMux.Unlock()
+
+	readyCode, ready := readyW.Code, decodeBody(t, readyW)
+	liveCode, live := liveW.Code, decodeBody(t, liveW)
+	if readyCode != http.StatusServiceUnavailable {
+		t.Errorf("readiness status = %d, want 503", readyCode)
+	}
+	if storage, _ := ready["checks"].(map[string]interface{})["storage"].(map[string]interface{}); storage["status"] != healthFail {
+		t.Errorf("storage readiness = %v, want fail", storage)
+	}
+	if liveCode != http.StatusOK {
+		t.Errorf("liveness status = %d, want 200: %v", liveCode, live)
+	}
+}
+
+func TestDeadlockCheck(t *testing.T) {
+	var mu sync.Mutex
+	lock := &storeLock{name: "test", lock: mu.Lock, unlock: mu.Unlock}
+	lock.watch(5 * time.Millisecond)
+	check := deadlockCheck([]*storeLock{lock}, 100*time.Millisecond)
+
+	if _, err := check(context.Background()); err != nil {
+		t.Fatalf("check of a free lock failed: %v", err)
+	}
+
+	mu.Lock()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := check(context.Background()); err != nil {
+		t.Errorf("lock held for less than the timeout failed the check: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := check(context.Background()); err == nil {
+		t.Error("lock held for longer than the timeout passed the check")
+	}
+	mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := check(context.Background())
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("check still failing after the lock was released: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
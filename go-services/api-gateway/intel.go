@@ -0,0 +1,718 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const maxFeedSize = 50 << 20
+
+// minIntelRefreshInterval keeps a zero or tiny interval from refreshing a
+// feed in a tight loop
+const minIntelRefreshInterval = time.Minute
+
+// Indicator is an indicator of compromise loaded from a threat intel feed
+type Indicator struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	Value       string     `json:"value"`
+	Source      string     `json:"source"`
+	Confidence  int        `json:"confidence"`
+	Description string     `json:"description,omitempty"`
+	Labels      []string   `json:"labels,omitempty"`
+	FirstSeen   time.Time  `json:"first_seen"`
+	LastSeen    time.Time  `json:"last_seen"`
+	ValidUntil  *time.Time `json:"valid_until,omitempty"`
+
+	network *net.IPNet
+}
+
+// IntelMatch records an observed value that matched an indicator
+type IntelMatch struct {
+	Field       string `json:"field"`
+	Observed    string `json:"observed"`
+	Indicator   string `json:"indicator"`
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Confidence  int    `json:"confidence"`
+	Description string `json:"description,omitempty"`
+}
+
+// IntelFeed describes a feed to load on a schedule
+type IntelFeed struct {
+	Name       string `json:"name" yaml:"name"`
+	Format     string `json:"format" yaml:"format"`
+	URL        string `json:"url,omitempty" yaml:"url"`
+	Path       string `json:"path,omitempty" yaml:"path"`
+	Interval   string `json:"interval" yaml:"interval"`
+	Confidence int    `json:"confidence" yaml:"confidence"`
+
+	LastRefresh time.Time `json:"last_refresh"`
+	LastError   string    `json:"last_error,omitempty"`
+	Indicators  int       `json:"indicators"`
+
+	interval time.Duration
+}
+
+// ThreatIntel stores indicators and matches observed values against them
+type ThreatIntel struct {
+	feeds      []*IntelFeed
+	indicators map[string]*Indicator
+	exact      map[string][]*Indicator
+	networks   map[int]map[string][]*Indicator
+	mu         sync.RWMutex
+	client     *http.Client
+}
+
+var threatIntel = newThreatIntel()
+
+func newThreatIntel() *ThreatIntel {
+	return &ThreatIntel{
+		indicators: make(map[string]*Indicator),
+		exact:      make(map[string][]*Indicator),
+		networks:   make(map[int]map[string][]*Indicator),
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+var (
+	stixComparison = regexp.MustCompile(`(ipv4-addr|ipv6-addr|domain-name|url|file):([A-Za-z0-9_.'\-]+)\s*=\s*'((?:[^'\\]|\\.)*)'`)
+	hashPattern    = regexp.MustCompile(`^[A-Fa-f0-9]{32}$|^[A-Fa-f0-9]{40}$|^[A-Fa-f0-9]{64}$`)
+	domainPattern  = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+)
+
+// classifyIndicator infers the type of a raw indicator value
+func classifyIndicator(value string) (string, string) {
+	value = strings.TrimSpace(value)
+	if ip := net.ParseIP(value); ip != nil {
+		if ip.To4() != nil {
+			return "ipv4", ip.String()
+		}
+		return "ipv6", ip.String()
+	}
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return "cidr", network.String()
+	}
+	if strings.Contains(value, "://") {
+		return "url", value
+	}
+	if hashPattern.MatchString(value) {
+		return "hash", strings.ToLower(value)
+	}
+	if domainPattern.MatchString(value) {
+		return "domain", strings.ToLower(strings.TrimSuffix(value, "."))
+	}
+	return "", value
+}
+
+// parsePlainFeed parses a list with one IP, CIDR, domain, URL or hash per line
+func parsePlainFeed(data []byte) []*Indicator {
+	var indicators []*Indicator
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' || r == ';' })
+		if len(fields) == 0 {
+			continue
+		}
+
+		kind, value := classifyIndicator(fields[0])
+		if kind == "" {
+			continue
+		}
+		indicators = append(indicators, &Indicator{Type: kind, Value: value})
+	}
+	return indicators
+}
+
+// parseCSVFeed parses a CSV feed with a header naming the indicator column
+func parseCSVFeed(data []byte) ([]*Indicator, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{"value": 0, "type": -1, "confidence": -1, "description": -1}
+	hasHeader := false
+	for i, name := range rows[0] {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "indicator", "value", "ioc", "ip", "ip_address", "ipaddress", "domain", "url", "hash":
+			columns["value"] = i
+			hasHeader = true
+		case "type", "indicator_type":
+			columns["type"] = i
+		case "confidence", "score":
+			columns["confidence"] = i
+		case "description", "comment", "threat":
+			columns["description"] = i
+		}
+	}
+	if hasHeader {
+		rows = rows[1:]
+	}
+
+	column := func(row []string, name string) string {
+		if i := columns[name]; i >= 0 && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var indicators []*Indicator
+	for _, row := range rows {
+		kind, value := classifyIndicator(column(row, "value"))
+		if kind == "" {
+			continue
+		}
+		indicator := &Indicator{Type: kind, Value: value, Description: column(row, "description")}
+		if confidence, err := strconv.Atoi(column(row, "confidence")); err == nil {
+			indicator.Confidence = confidence
+		}
+		indicators = append(indicators, indicator)
+	}
+	return indicators, nil
+}
+
+// parseSTIXBundle extracts indicators from a STIX 2.1 bundle
+func parseSTIXBundle(data []byte) ([]*Indicator, error) {
+	var bundle struct {
+		Type    string `json:"type"`
+		Objects []struct {
+			Type        string     `json:"type"`
+			ID          string     `json:"id"`
+			Name        string     `json:"name"`
+			Description string     `json:"description"`
+			Pattern     string     `json:"pattern"`
+			PatternType string     `json:"pattern_type"`
+			Confidence  *int       `json:"confidence"`
+			Labels      []string   `json:"indicator_types"`
+			ValidUntil  *time.Time `json:"valid_until"`
+			Revoked     bool       `json:"revoked"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Type != "bundle" {
+		return nil, fmt.Errorf("not a STIX bundle")
+	}
+
+	var indicators []*Indicator
+	for _, object := range bundle.Objects {
+		if object.Type != "indicator" || object.Revoked {
+			continue
+		}
+		if object.PatternType != "" && object.PatternType != "stix" {
+			continue
+		}
+
+		description := object.Description
+		if description == "" {
+			description = object.Name
+		}
+
+		for _, match := range stixComparison.FindAllStringSubmatch(object.Pattern, -1) {
+			value := strings.ReplaceAll(match[3], `\'`, "'")
+			if match[1] == "file" && !strings.HasPrefix(match[2], "hashes.") {
+				continue
+			}
+
+			kind, normalised := classifyIndicator(value)
+			if kind == "" {
+				continue
+			}
+			indicator := &Indicator{
+				ID:          object.ID,
+				Type:        kind,
+				Value:       normalised,
+				Description: description,
+				Labels:      object.Labels,
+				ValidUntil:  object.ValidUntil,
+			}
+			if object.Confidence != nil {
+				indicator.Confidence = *object.Confidence
+			}
+			indicators = append(indicators, indicator)
+		}
+	}
+	return indicators, nil
+}
+
+// parseFeed parses feed data in the given format
+func parseFeed(format string, data []byte) ([]*Indicator, error) {
+	switch strings.ToLower(format) {
+	case "", "plain", "txt", "list":
+		return parsePlainFeed(data), nil
+	case "csv":
+		return parseCSVFeed(data)
+	case "stix", "stix2", "stix2.1":
+		return parseSTIXBundle(data)
+	default:
+		return nil, fmt.Errorf("unsupported feed format %q", format)
+	}
+}
+
+// fetchFeed reads the raw feed from its file path or URL
+func (ti *ThreatIntel) fetchFeed(feed *IntelFeed) ([]byte, error) {
+	if feed.Path != "" {
+		return os.ReadFile(feed.Path)
+	}
+
+	resp, err := ti.client.Get(feed.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feed returned HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+}
+
+// Refresh reloads one feed and replaces the indicators it contributed
+func (ti *ThreatIntel) Refresh(feed *IntelFeed) error {
+	data, err := ti.fetchFeed(feed)
+	if err == nil {
+		var parsed []*Indicator
+		if parsed, err = parseFeed(feed.Format, data); err == nil {
+			ti.replaceSource(feed, parsed)
+		}
+	}
+
+	ti.mu.Lock()
+	feed.LastRefresh = time.Now()
+	feed.LastError = ""
+	if err != nil {
+		feed.LastError = err.Error()
+	}
+	ti.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	rescanIntelMatches()
+	return nil
+}
+
+// replaceSource swaps in a new set of indicators for a feed
+func (ti *ThreatIntel) replaceSource(feed *IntelFeed, parsed []*Indicator) {
+	now := time.Now()
+
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	previous := make(map[string]*Indicator)
+	for key, indicator := range ti.indicators {
+		if indicator.Source == feed.Name {
+			previous[key] = indicator
+			delete(ti.indicators, key)
+		}
+	}
+
+	for i, indicator := range parsed {
+		if indicator.ValidUntil != nil && indicator.ValidUntil.Before(now) {
+			continue
+		}
+
+		key := feed.Name + "|" + indicator.Value
+		indicator.Source = feed.Name
+		indicator.LastSeen = now
+		indicator.FirstSeen = now
+		if old, ok := previous[key]; ok {
+			indicator.FirstSeen = old.FirstSeen
+		}
+		if indicator.ID == "" {
+			indicator.ID = fmt.Sprintf("%s-%d", feed.Name, i+1)
+		}
+		if indicator.Confidence == 0 {
+			indicator.Confidence = feed.Confidence
+		}
+		if indicator.Type == "cidr" {
+			_, indicator.network, _ = net.ParseCIDR(indicator.Value)
+		}
+		ti.indicators[key] = indicator
+	}
+
+	feed.Indicators = 0
+	for _, indicator := range ti.indicators {
+		if indicator.Source == feed.Name {
+			feed.Indicators++
+		}
+	}
+
+	ti.rebuildIndex()
+}
+
+// rebuildIndex rebuilds the lookup indexes. Callers must hold ti.mu.
+func (ti *ThreatIntel) rebuildIndex() {
+	ti.exact = make(map[string][]*Indicator)
+	ti.networks = make(map[int]map[string][]*Indicator)
+
+	for _, indicator := range ti.indicators {
+		if indicator.network == nil {
+			ti.exact[indicator.Value] = append(ti.exact[indicator.Value], indicator)
+			continue
+		}
+		ones, _ := indicator.network.Mask.Size()
+		if ti.networks[ones] == nil {
+			ti.networks[ones] = make(map[string][]*Indicator)
+		}
+		key := indicator.network.IP.String()
+		ti.networks[ones][key] = append(ti.networks[ones][key], indicator)
+	}
+}
+
+// Lookup returns the indicators matching an IP, domain, URL or hash
+func (ti *ThreatIntel) Lookup(value string) []*Indicator {
+	kind, normalised := classifyIndicator(value)
+	if kind == "" || kind == "cidr" {
+		return nil
+	}
+
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	now := time.Now()
+	var matches []*Indicator
+	add := func(candidates []*Indicator) {
+		for _, indicator := range candidates {
+			if indicator.ValidUntil == nil || indicator.ValidUntil.After(now) {
+				matches = append(matches, indicator)
+			}
+		}
+	}
+
+	add(ti.exact[normalised])
+
+	if kind == "ipv4" || kind == "ipv6" {
+		ip := net.ParseIP(normalised)
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		for ones, networks := range ti.networks {
+			if ones > bits {
+				continue
+			}
+			network := ip.Mask(net.CIDRMask(ones, bits))
+			for _, indicator := range networks[network.String()] {
+				if indicator.network.Contains(ip) {
+					add([]*Indicator{indicator})
+				}
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Confidence > matches[j].Confidence })
+	return matches
+}
+
+// Match checks named observed values and returns a match per indicator hit
+func (ti *ThreatIntel) Match(observed map[string]string) []IntelMatch {
+	var matches []IntelMatch
+	for field, value := range observed {
+		if value == "" {
+			continue
+		}
+		for _, indicator := range ti.Lookup(value) {
+			matches = append(matches, IntelMatch{
+				Field:       field,
+				Observed:    value,
+				Indicator:   indicator.Value,
+				Type:        indicator.Type,
+				Source:      indicator.Source,
+				Confidence:  indicator.Confidence,
+				Description: indicator.Description,
+			})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Field != matches[j].Field {
+			return matches[i].Field < matches[j].Field
+		}
+		return matches[i].Confidence > matches[j].Confidence
+	})
+	return matches
+}
+
+// Indicators returns all indicators, optionally filtered by type and source
+func (ti *ThreatIntel) Indicators(kind, source, query string) []*Indicator {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	var result []*Indicator
+	for _, indicator := range ti.indicators {
+		if kind != "" && indicator.Type != kind {
+			continue
+		}
+		if source != "" && indicator.Source != source {
+			continue
+		}
+		if query != "" && !strings.Contains(indicator.Value, strings.ToLower(query)) {
+			continue
+		}
+		result = append(result, indicator)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Source != result[j].Source {
+			return result[i].Source < result[j].Source
+		}
+		return result[i].Value < result[j].Value
+	})
+	return result
+}
+
+// Feeds returns a snapshot of the configured feeds
+func (ti *ThreatIntel) Feeds() []IntelFeed {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	feeds := make([]IntelFeed, 0, len(ti.feeds))
+	for _, feed := range ti.feeds {
+		feeds = append(feeds, *feed)
+	}
+	return feeds
+}
+
+// Snapshot returns a copy of a feed's configuration and refresh status
+func (ti *ThreatIntel) Snapshot(feed *IntelFeed) IntelFeed {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	return *feed
+}
+
+// Feed returns a configured feed by name
+func (ti *ThreatIntel) Feed(name string) *IntelFeed {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	for _, feed := range ti.feeds {
+		if feed.Name == name {
+			return feed
+		}
+	}
+	return nil
+}
+
+// loadIntelFeeds reads feed definitions from a YAML file
+func loadIntelFeeds(path string) ([]*IntelFeed, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Feeds []*IntelFeed `yaml:"feeds"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, feed := range doc.Feeds {
+		if feed.Name == "" {
+			return nil, fmt.Errorf("feed is missing a name")
+		}
+		if (feed.URL == "") == (feed.Path == "") {
+			return nil, fmt.Errorf("feed %s: exactly one of url or path is required", feed.Name)
+		}
+		if feed.Confidence == 0 {
+			feed.Confidence = 50
+		}
+		feed.interval, err = parseRuleDuration(feed.Interval, time.Hour)
+		if err != nil {
+			return nil, fmt.Errorf("feed %s: invalid interval: %w", feed.Name, err)
+		}
+		if feed.interval < minIntelRefreshInterval {
+			return nil, fmt.Errorf("feed %s: interval %s is below the minimum of %s", feed.Name, feed.interval, minIntelRefreshInterval)
+		}
+		feed.Interval = feed.interval.String()
+	}
+	return doc.Feeds, nil
+}
+
+// startThreatIntel loads the feed configuration and schedules refreshes
+func startThreatIntel() {
+	path := getEnv("INTEL_FEEDS_FILE", "")
+	if path == "" {
+		return
+	}
+
+	feeds, err := loadIntelFeeds(path)
+	if err != nil {
+		log.Printf("Failed to load threat intel feeds from %s: %v", path, err)
+		return
+	}
+
+	threatIntel.mu.Lock()
+	threatIntel.feeds = feeds
+	threatIntel.mu.Unlock()
+
+	for _, feed := range feeds {
+		go func(feed *IntelFeed) {
+			ticker := time.NewTicker(feed.interval)
+			defer ticker.Stop()
+
+			for {
+				if err := threatIntel.Refresh(feed); err != nil {
+					log.Printf("Failed to refresh threat intel feed %s: %v", feed.Name, err)
+				}
+				<-ticker.C
+			}
+		}(feed)
+	}
+}
+
+// threatIntelMatches returns intel matches for a threat's addresses
+func threatIntelMatches(threat *Threat) []IntelMatch {
+	return threatIntel.Match(map[string]string{"source_ip": threat.SourceIP, "target_ip": threat.TargetIP})
+}
+
+// alertIntelMatches returns intel matches for an alert's source address
+func alertIntelMatches(alert *Alert) []IntelMatch {
+	return threatIntel.Match(map[string]string{"source_ip": alert.SourceIP})
+}
+
+// rescanIntelMatches re-evaluates stored threats and alerts after a feed
+// refresh. Threats and alerts whose matches changed are marked modified and
+// their cached responses dropped, as a write through the API would.
+func rescanIntelMatches() {
+	var changedThreats, changedAlerts []string
+	dataMux.Lock()
+	for id, threat := range threats {
+		if matches := threatIntelMatches(threat); !reflect.DeepEqual(matches, threat.Intel) {
+			threat.Intel = matches
+			changedThreats = append(changedThreats, id)
+		}
+	}
+	for id, alert := range alerts {
+		if matches := alertIntelMatches(alert); !reflect.DeepEqual(matches, alert.Intel) {
+			alert.Intel = matches
+			changedAlerts = append(changedAlerts, id)
+		}
+	}
+	dataMux.Unlock()
+
+	now := time.Now()
+	for _, id := range changedThreats {
+		markModified(EventThreatUpdated, "threat", id, now)
+	}
+	if len(changedThreats) > 0 {
+		invalidateResponses(EventThreatUpdated, "threat")
+	}
+	for _, id := range changedAlerts {
+		markModified(EventAlertUpdated, "alert", id, now)
+	}
+	if len(changedAlerts) > 0 {
+		invalidateResponses(EventAlertUpdated, "alert")
+	}
+}
+
+// intelDetector raises detections for flows and connections to or from
+// addresses listed in threat intel feeds
+type intelDetector struct {
+	intel    *ThreatIntel
+	cooldown *cooldowns
+}
+
+func newIntelDetector(intel *ThreatIntel, cooldown time.Duration) *intelDetector {
+	return &intelDetector{intel: intel, cooldown: newCooldowns(cooldown)}
+}
+
+func (d *intelDetector) Name() string { return "builtin:intel-match" }
+
+func (d *intelDetector) Config() map[string]interface{} {
+	return map[string]interface{}{
+		"feeds":    len(d.intel.Feeds()),
+		"cooldown": d.cooldown.period.String(),
+	}
+}
+
+func (d *intelDetector) Process(event SecurityEvent) []Detection {
+	if event.SourceIP == "" && event.DestIP == "" {
+		return nil
+	}
+
+	matches := d.intel.Match(map[string]string{"source_ip": event.SourceIP, "dest_ip": event.DestIP})
+	if len(matches) == 0 {
+		return nil
+	}
+
+	best := matches[0]
+	for _, match := range matches {
+		if match.Confidence > best.Confidence {
+			best = match
+		}
+	}
+
+	key := event.SourceIP + "|" + event.DestIP + "|" + best.Indicator
+	if !d.cooldown.allow(key, event.Timestamp) {
+		return nil
+	}
+
+	severity := "medium"
+	switch {
+	case best.Confidence >= 80:
+		severity = "high"
+	case best.Confidence < 40:
+		severity = "low"
+	}
+
+	return []Detection{{
+		Key:         d.Name() + "\x00" + key,
+		RuleID:      d.Name(),
+		Title:       "Threat Intel Match",
+		Description: fmt.Sprintf("%s traffic involving %s matched indicator %s from %s", event.Type, best.Observed, best.Indicator, best.Source),
+		Severity:    severity,
+		ThreatType:  "Known Malicious Host",
+		ThreatName:  "Intel." + best.Source,
+		SourceIP:    event.SourceIP,
+		TargetIP:    event.DestIP,
+		Port:        event.DestPort,
+		Evidence: &DetectionEvidence{
+			RuleID:    d.Name(),
+			RuleTitle: "Threat Intel Match",
+			Group:     map[string]string{"source_ip": event.SourceIP, "dest_ip": event.DestIP},
+			Count:     1,
+			Window:    "0s",
+			FirstSeen: event.Timestamp,
+			LastSeen:  event.Timestamp,
+			Events:    []SecurityEvent{event},
+		},
+	}}
+}
+
+func (d *intelDetector) Prune(now time.Time) {
+	d.cooldown.prune(now)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listIndicators returns loaded indicators of compromise
+func listIndicators(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	kind := c.Query("type")
+	source := c.Query("source")
+	query := c.Query("q")
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	indicators := threatIntel.Indicators(kind, source, query)
+	total := len(indicators)
+
+	start := (page - 1) * limit
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"indicators": indicators[start:end],
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+		"filters": gin.H{
+			"type":   kind,
+			"source": source,
+			"q":      query,
+		},
+	})
+}
+
+// lookupIndicator checks an IP, domain, URL or hash against loaded feeds
+func lookupIndicator(c *gin.Context) {
+	value := c.Query("value")
+	if value == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value query parameter is required"})
+		return
+	}
+
+	kind, normalised := classifyIndicator(value)
+	if kind == "" || kind == "cidr" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value must be an IP address, domain, URL or hash"})
+		return
+	}
+
+	matches := threatIntel.Lookup(value)
+	if matches == nil {
+		matches = []*Indicator{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"value":      normalised,
+		"type":       kind,
+		"malicious":  len(matches) > 0,
+		"indicators": matches,
+	})
+}
+
+// listIntelFeeds returns the configured feeds and their refresh status
+func listIntelFeeds(c *gin.Context) {
+	feeds := threatIntel.Feeds()
+
+	c.JSON(http.StatusOK, gin.H{
+		"feeds": feeds,
+		"total": len(feeds),
+	})
+}
+
+// refreshIntelFeed reloads a feed immediately. Admin only, since a refresh
+// fetches from the feed's upstream and rescans every threat and alert.
+func refreshIntelFeed(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	feed := threatIntel.Feed(c.Param("name"))
+	if feed == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+		return
+	}
+
+	if err := threatIntel.Refresh(feed); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to refresh feed: " + err.Error()})
+		return
+	}
+
+	status := threatIntel.Snapshot(feed)
+	publishEvent(c, EventIntelFeedRefreshed, "intel_feed", feed.Name, status)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Feed refreshed",
+		"feed":    status,
+	})
+}
+
+// enrichIP returns GeoIP, ASN, reverse DNS and address class details for an IP
+func enrichIP(c *gin.Context) {
+	ip := c.Param("ip")
+	if net.ParseIP(ip) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enrichment": enricher.Enrich(ip),
+		"intel":      threatIntel.Match(map[string]string{"ip": ip}),
+		"sources":    enricher.Status(),
+	})
+}
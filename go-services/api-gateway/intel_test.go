@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefreshIntelFeed(t *testing.T) {
+	_, token := testUser(t, "admin")
+	_, analystToken := testUser(t, "analyst")
+	router := newRouter()
+
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "blocklist.txt")
+	if err := os.WriteFile(listPath, []byte("# test feed\n192.0.2.10\n198.51.100.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := threatIntel
+	threatIntel = newThreatIntel()
+	threatIntel.feeds = []*IntelFeed{
+		{Name: "blocklist", Format: "plain", Path: listPath, Confidence: 80},
+		{Name: "missing", Format: "plain", Path: filepath.Join(dir, "missing.txt")},
+	}
+	t.Cleanup(func() { threatIntel = saved })
+
+	tests := []struct {
+		feed   string
+		status int
+	}{
+		{"blocklist", http.StatusOK},
+		{"missing", http.StatusBadGateway},
+		{"unknown", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.feed, func(t *testing.T) {
+			w := doRequest(t, router, http.MethodPost, "/api/v1/intel/feeds/"+tt.feed+"/refresh", nil, bearer(token)...)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+
+			var body struct {
+				Error string    `json:"error"`
+				Feed  IntelFeed `json:"feed"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if tt.status != http.StatusOK {
+				if body.Error == "" {
+					t.Error("error response has no error message")
+				}
+				return
+			}
+			if body.Feed.Indicators != 2 || body.Feed.LastRefresh.IsZero() || body.Feed.LastError != "" {
+				t.Errorf("feed status = %+v, want 2 indicators refreshed without error", body.Feed)
+			}
+		})
+	}
+
+	if matches := threatIntel.Lookup("198.51.100.7"); len(matches) != 1 {
+		t.Errorf("lookup in the refreshed feed's network found %d indicators, want 1", len(matches))
+	}
+
+	if w := doRequest(t, router, http.MethodPost, "/api/v1/intel/feeds/blocklist/refresh", nil, bearer(analystToken)...); w.Code != http.StatusForbidden {
+		t.Errorf("analyst refresh = %d, want 403", w.Code)
+	}
+}
+
+func TestIntelRescanMarksMatchesModified(t *testing.T) {
+	useTestCache(t)
+	_, token := testUser(t, "analyst")
+	router := newRouter()
+
+	listPath := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(listPath, []byte("192.0.2.10\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saved := threatIntel
+	threatIntel = newThreatIntel()
+	t.Cleanup(func() { threatIntel = saved })
+
+	dataMux.Lock()
+	id := nextResourceID("ALT", len(alerts), func(id string) bool { _, ok := alerts[id]; return ok })
+	created := time.Now().Add(-time.Hour)
+	alerts[id] = &Alert{ID: id, Title: "listed source", Severity: "low", SourceIP: "192.0.2.10", Timestamp: created}
+	dataMux.Unlock()
+	t.Cleanup(func() {
+		dataMux.Lock()
+		delete(alerts, id)
+		dataMux.Unlock()
+	})
+
+	cacheStatus(t, router, "/api/v1/dashboard/stats", token)
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", token); got != "HIT" {
+		t.Fatalf("second GET = %s, want HIT", got)
+	}
+	before := resourceModified("alert", id, created)
+
+	// A scheduled refresh, which no request publishes an event for
+	if err := threatIntel.Refresh(&IntelFeed{Name: "blocklist", Format: "plain", Path: listPath, Confidence: 80}); err != nil {
+		t.Fatal(err)
+	}
+
+	dataMux.RLock()
+	matched := len(alerts[id].Intel)
+	dataMux.RUnlock()
+	if matched != 1 {
+		t.Fatalf("alert has %d intel matches after the refresh, want 1", matched)
+	}
+	if after := resourceModified("alert", id, created); !after.After(before) {
+		t.Errorf("Last-Modified stayed at %v after the rescan", before)
+	}
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", token); got != "MISS" {
+		t.Errorf("GET after the rescan = %s, want MISS", got)
+	}
+}
+
+func TestLoadIntelFeedsInterval(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"", time.Hour, false},
+		{"5m", 5 * time.Minute, false},
+		{"1m", time.Minute, false},
+		{"30s", 0, true},
+		{"0s", 0, true},
+		{"-5m", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.interval, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "feeds.yml")
+			config := "feeds:\n  - name: blocklist\n    path: /tmp/blocklist.txt\n    interval: \"" + tt.interval + "\"\n"
+			if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			feeds, err := loadIntelFeeds(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("interval %q accepted as %s", tt.interval, feeds[0].interval)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if feeds[0].interval != tt.want {
+				t.Errorf("interval = %s, want %s", feeds[0].interval, tt.want)
+			}
+		})
+	}
+}
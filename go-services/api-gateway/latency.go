@@ -0,0 +1,268 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyAccuracy is the relative error of latency quantiles: a reported
+// p99 of 200ms means the true p99 lies within 2ms of it
+const latencyAccuracy = 0.01
+
+var (
+	latencyGamma    = (1 + latencyAccuracy) / (1 - latencyAccuracy)
+	latencyLogGamma = math.Log(latencyGamma)
+)
+
+// minLatency is the smallest latency the sketch tells apart, one microsecond.
+// Anything faster lands in the lowest bucket.
+const minLatency = 1e-6
+
+// latencySketch is a mergeable quantile sketch of request latencies in
+// seconds. Buckets grow geometrically, so every quantile is exact to within
+// latencyAccuracy and memory depends on the spread of latencies rather than
+// the number of requests.
+type latencySketch struct {
+	buckets      map[int]uint64
+	count        uint64
+	sum          float64
+	min          float64
+	max          float64
+	errors       uint64
+	serverErrors uint64
+	slow         uint64
+}
+
+func newLatencySketch() *latencySketch {
+	return &latencySketch{buckets: make(map[int]uint64)}
+}
+
+func latencyBucket(seconds float64) int {
+	if seconds < minLatency {
+		seconds = minLatency
+	}
+	return int(math.Ceil(math.Log(seconds) / latencyLogGamma))
+}
+
+// add records one request. Client and server errors count against the error
+// rate, server errors and slow requests against the SLOs.
+func (s *latencySketch) add(seconds float64, status int, slow bool) {
+	s.buckets[latencyBucket(seconds)]++
+	if s.count == 0 || seconds < s.min {
+		s.min = seconds
+	}
+	if seconds > s.max {
+		s.max = seconds
+	}
+	s.count++
+	s.sum += seconds
+	if status >= 400 {
+		s.errors++
+	}
+	if status >= 500 {
+		s.serverErrors++
+	}
+	if slow {
+		s.slow++
+	}
+}
+
+func (s *latencySketch) merge(other *latencySketch) {
+	if other.count == 0 {
+		return
+	}
+	for bucket, n := range other.buckets {
+		s.buckets[bucket] += n
+	}
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+	s.errors += other.errors
+	s.serverErrors += other.serverErrors
+	s.slow += other.slow
+}
+
+// quantiles estimates each q-quantile (0 to 1) in seconds
+func (s *latencySketch) quantiles(qs ...float64) []float64 {
+	values := make([]float64, len(qs))
+	if s.count == 0 {
+		return values
+	}
+
+	indexes := make([]int, 0, len(s.buckets))
+	for bucket := range s.buckets {
+		indexes = append(indexes, bucket)
+	}
+	sort.Ints(indexes)
+
+	for i, q := range qs {
+		if q <= 0 {
+			values[i] = s.min
+			continue
+		}
+		rank := uint64(math.Min(1, q) * float64(s.count-1))
+		values[i] = s.max
+		if q >= 1 {
+			continue
+		}
+		var seen uint64
+		for _, bucket := range indexes {
+			seen += s.buckets[bucket]
+			if seen > rank {
+				// The middle of the bucket, clamped to what was observed
+				value := 2 * math.Pow(latencyGamma, float64(bucket)) / (latencyGamma + 1)
+				values[i] = math.Max(s.min, math.Min(s.max, value))
+				break
+			}
+		}
+	}
+	return values
+}
+
+// latencyRing keeps one sketch per fixed-width slot of wall clock time, so a
+// window is the merge of the slots it covers. Slots are reused once they
+// fall out of the ring.
+type latencyRing struct {
+	width time.Duration
+	slots []latencySlot
+}
+
+type latencySlot struct {
+	start  int64
+	sketch *latencySketch
+}
+
+func newLatencyRing(width time.Duration, count int) *latencyRing {
+	return &latencyRing{width: width, slots: make([]latencySlot, count)}
+}
+
+func (r *latencyRing) slot(now time.Time) *latencySketch {
+	start := now.UnixNano() / int64(r.width)
+	slot := &r.slots[start%int64(len(r.slots))]
+	if slot.sketch == nil || slot.start != start {
+		slot.start = start
+		slot.sketch = newLatencySketch()
+	}
+	return slot.sketch
+}
+
+// window merges the slots overlapping the last d into into
+func (r *latencyRing) window(now time.Time, d time.Duration, into *latencySketch) {
+	current := now.UnixNano() / int64(r.width)
+	oldest := now.Add(-d).UnixNano() / int64(r.width)
+	for _, slot := range r.slots {
+		if slot.sketch != nil && slot.start > oldest && slot.start <= current {
+			into.merge(slot.sketch)
+		}
+	}
+}
+
+// routeLatency holds the latency of one route: since the last reset, and
+// over the sliding windows. Ten second slots cover the short windows and one
+// minute slots the hour, which keeps the 1m window within ten seconds of
+// exact without keeping 360 slots per route.
+type routeLatency struct {
+	mu      sync.Mutex
+	total   *latencySketch
+	seconds *latencyRing
+	minutes *latencyRing
+}
+
+func newRouteLatency() *routeLatency {
+	return &routeLatency{
+		total:   newLatencySketch(),
+		seconds: newLatencyRing(10*time.Second, 30),
+		minutes: newLatencyRing(time.Minute, 60),
+	}
+}
+
+// latencyWindows are the windows reported by the performance endpoints. The
+// empty window is everything since the last reset.
+var latencyWindows = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+}
+
+func (l *routeLatency) add(now time.Time, seconds float64, status int, slow bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total.add(seconds, status, slow)
+	l.seconds.slot(now).add(seconds, status, slow)
+	l.minutes.slot(now).add(seconds, status, slow)
+}
+
+// window returns a sketch of the requests in the last d, or since the last
+// reset when d is zero
+func (l *routeLatency) window(now time.Time, d time.Duration) *latencySketch {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sketch := newLatencySketch()
+	switch {
+	case d == 0:
+		sketch.merge(l.total)
+	case d <= 5*time.Minute:
+		l.seconds.window(now, d, sketch)
+	default:
+		l.minutes.window(now, d, sketch)
+	}
+	return sketch
+}
+
+var (
+	// routeLatencies is keyed by "METHOD:route"
+	routeLatencies    = make(map[string]*routeLatency)
+	routeLatenciesMux sync.RWMutex
+)
+
+// recordLatency adds a finished request to its route's sketches
+func recordLatency(route, method string, status int, seconds float64) {
+	key := method + ":" + route
+
+	routeLatenciesMux.RLock()
+	latency, exists := routeLatencies[key]
+	routeLatenciesMux.RUnlock()
+
+	if !exists {
+		routeLatenciesMux.Lock()
+		if latency, exists = routeLatencies[key]; !exists {
+			latency = newRouteLatency()
+			routeLatencies[key] = latency
+		}
+		routeLatenciesMux.Unlock()
+	}
+
+	latency.add(time.Now(), seconds, status, seconds > sloLatencyThreshold.Seconds())
+}
+
+// latencySnapshot returns every route's sketch for a window
+func latencySnapshot(d time.Duration) map[string]*latencySketch {
+	routeLatenciesMux.RLock()
+	defer routeLatenciesMux.RUnlock()
+
+	now := time.Now()
+	sketches := make(map[string]*latencySketch, len(routeLatencies))
+	for key, latency := range routeLatencies {
+		if sketch := latency.window(now, d); sketch.count > 0 {
+			sketches[key] = sketch
+		}
+	}
+	return sketches
+}
+
+// resetLatencies drops all recorded latencies
+func resetLatencies() {
+	routeLatenciesMux.Lock()
+	defer routeLatenciesMux.Unlock()
+
+	routeLatencies = make(map[string]*routeLatency)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// setupLogging replaces the default logger with a structured one. Existing
+// log.Printf calls go through it too, so every line is JSON (or logfmt with
+// LOG_FORMAT=text) at the level set by LOG_LEVEL.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.EqualFold(getEnv("LOG_FORMAT", "json"), "text") {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler).With("service", "api-gateway"))
+}
+
+// newRequestID returns a time-ordered UUID so IDs sort by arrival
+func newRequestID() string {
+	if id, err := uuid.NewV7(); err == nil {
+		return id.String()
+	}
+	return uuid.NewString()
+}
+
+// validRequestID accepts caller supplied IDs that are safe to log and
+// forward: short and limited to URL-safe characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, ch := range id {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_', ch == '.', ch == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// requestIDFrom returns the request ID carried by ctx, if any
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// requestLogger writes one structured line per request once it completes
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", c.GetString("request_id")),
+			slog.String("method", c.Request.Method),
+			slog.String("route", route),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", span.TraceID().String()))
+		}
+		if userID := c.GetString("user_id"); userID != "" {
+			attrs = append(attrs, slog.String("user_id", userID))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -15,6 +16,14 @@ import (
 )
 
 func main() {
+	// Structured logging first so startup messages are JSON too
+	setupLogging()
+	shutdownTracing := setupTracing()
+
+	// Register the gateway's own health checks; subsystems add theirs as
+	// they start
+	startHealthChecks()
+
 	// Initialize sample notifications
 	initNotifications()
 
@@ -24,24 +33,113 @@ func main() {
 	// Start cache cleanup
 	startCacheCleanup()
 
-	// Initialize Gin router
-	router := gin.Default()
+	// Start NetFlow/IPFIX collector
+	startFlowCollector()
+
+	// Start webhook delivery queue
+	startWebhookDispatcher()
+
+	// Start event bus subscribers (webhooks, websockets, notifications, audit, cache)
+	startEventBus()
+
+	// Start threat intel feeds
+	startThreatIntel()
+
+	// Start GeoIP/ASN/reverse DNS enrichment
+	startEnrichment()
+
+	// Start detection engine
+	startDetectionEngine()
+
+	// Start threat analyzer
+	startAnalysisService()
+
+	// Build the GraphQL schema and explorer
+	startGraphQL()
+	startGraphQLExplorer()
+
+	router := newRouter()
+
+	// Create HTTP server
+	srv := &http.Server{
+		Addr:         ":8080",
+		Handler:      traceHandler(router),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	// End SSE streams once shutdown starts, so Shutdown can return
+	srv.RegisterOnShutdown(stopStreams)
+
+	// Start server in goroutine
+	go func() {
+		slog.Info("API gateway starting", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// Graceful shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	slog.Info("Shutting down server")
+
+	// Fail readiness first and give load balancers time to notice before
+	// the listener closes
+	draining.Store(true)
+	time.Sleep(getEnvDuration("SHUTDOWN_DRAIN_DELAY", 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Keep going when requests outlive the timeout: the collectors and
+	// queues below still need stopping and spans flushing
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+
+	if flowCollector != nil {
+		flowCollector.Stop()
+	}
+	enricher.Close()
+	webhookDispatcher.Close()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
+	}
+
+	slog.Info("Server exited")
+}
+
+// newRouter builds the gateway's routes and middleware
+func newRouter() *gin.Engine {
+	// Initialize Gin router; requestLogger replaces gin's text access log
+	router := gin.New()
 
 	// Add middlewares
-	router.Use(rateLimitMiddleware())
+	router.Use(gin.Recovery())
+	router.Use(requestIDMiddleware())
+	router.Use(traceRoute())
+	router.Use(requestLogger())
 	router.Use(performanceMiddleware())
+	router.Use(rateLimitMiddleware())
 
 	// CORS configuration
 	config := cors.DefaultConfig()
-	config.AllowOrigins = []string{"http://localhost:3000", "http://localhost:3001", "http://localhost:4200"}
+	config.AllowOrigins = defaultAllowedOrigins
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "X-API-Key", "Accept"}
-	config.ExposeHeaders = []string{"Content-Length", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
+	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", "X-API-Key", "X-Request-ID", "Accept", "If-Match", "If-None-Match", "If-Modified-Since"}
+	config.ExposeHeaders = []string{"Content-Length", "X-Request-ID", "ETag", "Last-Modified", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-RateLimit-Policy", "Retry-After"}
 	config.AllowCredentials = true
 	router.Use(cors.New(config))
 
-	// Health check endpoints
+	// Health check endpoints: /health/live and /ready are the Kubernetes
+	// liveness and readiness probes, /health reports every check
 	router.GET("/health", getHealthCheck)
+	router.GET("/health/live", getLivenessCheck)
+	router.GET("/health/ready", getReadinessCheck)
 	router.GET("/ready", getReadinessCheck)
 	router.GET("/system/info", getSystemInfo)
 
@@ -93,11 +191,11 @@ func main() {
 			protected.DELETE("/notifications/:id", deleteNotification)
 
 			// Analytics
-			protected.GET("/analytics/alerts", getAlertAnalytics)
-			protected.GET("/analytics/threats", getThreatAnalytics)
-			protected.GET("/analytics/firewall", getFirewallAnalytics)
-			protected.GET("/analytics/system", getSystemAnalytics)
-			protected.GET("/analytics/timeseries/:resource", getTimeSeriesData)
+			protected.GET("/analytics/alerts", cacheResponse("analytics", 30*time.Second, "alert"), getAlertAnalytics)
+			protected.GET("/analytics/threats", cacheResponse("analytics", 30*time.Second, "threat"), getThreatAnalytics)
+			protected.GET("/analytics/firewall", cacheResponse("analytics", 30*time.Second, "firewall_rule"), getFirewallAnalytics)
+			protected.GET("/analytics/system", cacheResponse("analytics", 30*time.Second, "alert", "threat", "firewall_rule", "user"), getSystemAnalytics)
+			protected.GET("/analytics/timeseries/:resource", cacheResponse("timeseries", time.Minute, "alert", "threat"), getTimeSeriesData)
 
 			// Batch operations
 			protected.POST("/batch/alerts/delete", batchDeleteAlerts)
@@ -114,10 +212,18 @@ func main() {
 
 			// Webhooks
 			protected.GET("/webhooks", listWebhooks)
+			protected.GET("/webhooks/:id", getWebhook)
 			protected.POST("/webhooks", createWebhook)
 			protected.PUT("/webhooks/:id", updateWebhook)
 			protected.DELETE("/webhooks/:id", deleteWebhook)
 			protected.POST("/webhooks/:id/test", testWebhook)
+			protected.POST("/webhooks/:id/preview", previewWebhook)
+			protected.GET("/webhooks/:id/deliveries", listWebhookDeliveries)
+			protected.GET("/webhooks/:id/deliveries/:delivery_id", getWebhookDelivery)
+			protected.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", redeliverWebhook)
+			protected.GET("/admin/rate-limits", getRateLimitPolicies)
+			protected.GET("/admin/webhook-policy", getWebhookPolicy)
+			protected.PUT("/admin/webhook-policy", updateWebhookPolicy)
 
 			// Audit Logs
 			protected.GET("/audit-logs", getAuditLogs)
@@ -131,15 +237,16 @@ func main() {
 			protected.GET("/compliance/checklist", getComplianceChecklist)
 
 			// Reports
-			protected.GET("/reports/security", generateSecurityReport)
-			protected.GET("/reports/threats", generateThreatReport)
-			protected.GET("/reports/network", generateNetworkReport)
+			protected.GET("/reports/security", cacheResponse("reports", time.Minute, "alert", "threat", "firewall_rule"), generateSecurityReport)
+			protected.GET("/reports/threats", cacheResponse("reports", time.Minute, "threat"), generateThreatReport)
+			protected.GET("/reports/network", cacheResponse("reports", time.Minute, "network"), generateNetworkReport)
 			protected.POST("/reports/schedule", scheduleReport)
 
 			// Performance
 			protected.GET("/performance/metrics", getPerformanceMetrics)
 			protected.GET("/performance/slowest", getSlowestEndpoints)
 			protected.GET("/performance/most-used", getMostUsedEndpoints)
+			protected.GET("/performance/slo", getSLOStatus)
 			protected.POST("/performance/reset", resetPerformanceMetrics)
 
 			// Backup & Restore
@@ -148,11 +255,41 @@ func main() {
 			protected.POST("/backup/restore", restoreBackup)
 			protected.GET("/backup/info", getBackupInfo)
 
-			// Cache
+			// Server-Sent Events
+			protected.GET("/stream", streamHandler)
+			protected.GET("/stream/alerts", streamAlertsHandler)
+			protected.GET("/stream/threats", streamThreatsHandler)
+			protected.GET("/stream/stats", streamStatsHandler)
+
+			// Detection
+			protected.POST("/events", ingestEvents)
+			protected.GET("/events/stats", func(c *gin.Context) {
+				stats := eventBus.Stats()
+				stats["websocket"] = hub.Stats()
+				c.JSON(http.StatusOK, stats)
+			})
+			protected.GET("/detection/rules", listDetectionRules)
+			protected.POST("/detection/rules/reload", reloadDetectionRules)
+			protected.GET("/detection/stats", getDetectionStats)
+
+			// Threat intelligence
+			protected.GET("/intel/indicators", listIndicators)
+			protected.GET("/intel/lookup", lookupIndicator)
+			protected.GET("/intel/feeds", listIntelFeeds)
+			protected.POST("/intel/feeds/:name/refresh", refreshIntelFeed)
+			protected.GET("/enrichment/:ip", enrichIP)
+
+			// Cache (admin only: the Redis backend is shared by every replica)
 			protected.GET("/cache/stats", func(c *gin.Context) {
+				if !requireAdmin(c) {
+					return
+				}
 				c.JSON(http.StatusOK, cache.GetStats())
 			})
 			protected.POST("/cache/clear", func(c *gin.Context) {
+				if !requireAdmin(c) {
+					return
+				}
 				cache.Clear()
 				c.JSON(http.StatusOK, gin.H{"message": "Cache cleared"})
 			})
@@ -180,6 +317,7 @@ func main() {
 			firewall := protected.Group("/firewall")
 			{
 				firewall.GET("/rules", listFirewallRules)
+				firewall.GET("/rules/:id", getFirewallRule)
 				firewall.POST("/rules", addFirewallRule)
 				firewall.DELETE("/rules/:id", deleteFirewallRule)
 			}
@@ -190,6 +328,7 @@ func main() {
 				threats.GET("", listThreats)
 				threats.GET("/:id", getThreat)
 				threats.POST("/analyze", analyzeThreat)
+				threats.GET("/analyze/:job_id", getAnalysisJob)
 			}
 
 			// User management endpoints
@@ -204,51 +343,21 @@ func main() {
 			// Dashboard endpoints
 			dashboard := protected.Group("/dashboard")
 			{
-				dashboard.GET("/stats", getDashboardStats)
-				dashboard.GET("/recent-activity", getRecentActivity)
+				dashboard.GET("/stats", cacheResponse("dashboard", 10*time.Second, "alert", "threat", "firewall_rule", "user", "network"), getDashboardStats)
+				dashboard.GET("/recent-activity", cacheResponse("dashboard", 10*time.Second, "alert", "threat"), getRecentActivity)
 			}
 		}
 	}
 
-	// GraphQL endpoint
-	router.POST("/graphql", graphqlHandler)
-	router.GET("/graphql", playgroundHandler)
+	// GraphQL endpoint (GET upgrades to graphql-transport-ws subscriptions or serves the explorer)
+	router.POST("/graphql", authOrAPIKeyMiddleware(), graphqlHandler)
+	router.GET("/graphql", graphqlGetHandler)
+	router.GET("/graphql/assets/:file", explorerAssetHandler)
 
 	// WebSocket endpoints for real-time updates
 	router.GET("/ws", websocketHandler)
 	router.GET("/ws/stats", statsWebSocketHandler)
 	router.GET("/ws/threats", threatsWebSocketHandler)
 
-	// Create HTTP server
-	srv := &http.Server{
-		Addr:         ":8080",
-		Handler:      router,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
-	}
-
-	// Start server in goroutine
-	go func() {
-		log.Println("🚀 API Gateway starting on :8080")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
-		}
-	}()
-
-	// Graceful shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-
-	log.Println("🛑 Shutting down server...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
-	}
-
-	log.Println("✅ Server exited")
+	return router
 }
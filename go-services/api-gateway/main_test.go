@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(io.Discard)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	startGraphQL()
+	os.Exit(m.Run())
+}
+
+// testUser adds a user with the given role and a session for it, removing
+// both when the test ends. It returns the user and its bearer token.
+func testUser(t *testing.T, role string) (*User, string) {
+	t.Helper()
+
+	id := generateToken()[:12]
+	user := &User{
+		ID:        "user_" + id,
+		Email:     id + "@example.com",
+		Name:      "Test " + role,
+		Role:      role,
+		CreatedAt: time.Now(),
+	}
+	token := generateToken()
+
+	usersMux.Lock()
+	users[user.Email] = user
+	sessions[token] = &Session{Token: token, UserID: user.Email, ExpiresAt: time.Now().Add(time.Hour)}
+	usersMux.Unlock()
+
+	t.Cleanup(func() {
+		usersMux.Lock()
+		delete(users, user.Email)
+		delete(sessions, token)
+		usersMux.Unlock()
+	})
+	return user, token
+}
+
+// doRequest sends a request through router. body is encoded as JSON unless
+// it is nil; headers are name and value pairs.
+func doRequest(t *testing.T, router http.Handler, method, path string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// bearer is the Authorization header pair for a session token
+func bearer(token string) []string {
+	return []string{"Authorization", "Bearer " + token}
+}
+
+// decodeBody decodes a JSON response into a map
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+	return body
+}
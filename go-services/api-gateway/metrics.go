@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus instruments served on /metrics alongside the Go runtime
+// collectors. Names match the dashboards and alert rules in
+// infrastructure/monitoring. Labels only take bounded values: matched route
+// templates rather than raw paths, and fixed reason and outcome names.
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency, by route, method and status code.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "method", "status"})
+
+	alertsCreatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alerts_created_total",
+		Help: "Alerts created by users, the API and the detection engine, by severity.",
+	}, []string{"severity"})
+
+	threatsDetectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "threats_detected_total",
+		Help: "Threats detected by the detection engine and threat analysis, by type.",
+	}, []string{"threat_type"})
+
+	firewallRuleChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "firewall_rule_changes_total",
+		Help: "Firewall rule changes, by action (created, deleted, enabled, disabled).",
+	}, []string{"action"})
+
+	webhookDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Webhook delivery attempts, by outcome (succeeded, retrying, failed).",
+	}, []string{"outcome"})
+
+	rateLimitRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_rejections_total",
+		Help: "Requests rejected with 429, by rate limit policy.",
+	}, []string{"policy"})
+
+	authFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_failures_total",
+		Help: "Failed logins and rejected credentials, by reason.",
+	}, []string{"reason"})
+
+	websocketConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_connections",
+		Help: "Open websocket connections, by endpoint (events or graphql).",
+	}, []string{"endpoint"})
+
+	websocketConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_connections_total",
+		Help: "Websocket connections accepted, by endpoint (events or graphql).",
+	}, []string{"endpoint"})
+)
+
+// metricSeverities and metricThreatTypes are the values the severity and
+// threat_type labels take. Both fields come from API input, so anything else
+// is counted as "other" rather than minting a new series.
+var (
+	metricSeverities = map[string]bool{
+		"info": true, "low": true, "medium": true, "high": true, "critical": true,
+	}
+	metricThreatTypes = map[string]bool{
+		"Brute Force": true, "Credential Stuffing": true, "Data Exfiltration": true,
+		"DDoS Attack": true, "Known Malicious Host": true, "Malware": true,
+		"Port Scan": true, "Reconnaissance": true, "Suspicious Activity": true,
+	}
+)
+
+// boundedLabel returns value when it is one of known, otherwise "other"
+func boundedLabel(value string, known map[string]bool) string {
+	if known[value] {
+		return value
+	}
+	return "other"
+}
+
+// metricsRoute is the route label for a request. Unmatched paths share one
+// label so scanners probing random URLs cannot blow up the series count.
+func metricsRoute(c *gin.Context) string {
+	if route := c.FullPath(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
+
+// observeRequest records a finished request, both for Prometheus and for the
+// windowed latency sketches behind /performance, so the two always agree on
+// what was counted. Long-lived websocket and SSE connections are counted but
+// kept out of the latency histogram, the sketches and the SLOs.
+func observeRequest(route, method string, status int, seconds float64, longLived bool) {
+	code := strconv.Itoa(status)
+	httpRequestsTotal.WithLabelValues(route, method, code).Inc()
+	if longLived {
+		return
+	}
+	httpRequestDuration.WithLabelValues(route, method, code).Observe(seconds)
+	recordLatency(route, method, status, seconds)
+}
+
+// countEvent updates the domain counters fed by published events, so writes
+// through REST, GraphQL, batch operations and background detection are all
+// counted in one place
+func countEvent(eventType string, data interface{}) {
+	switch eventType {
+	case EventAlertCreated:
+		if alert, ok := data.(*Alert); ok {
+			alertsCreatedTotal.WithLabelValues(boundedLabel(alert.Severity, metricSeverities)).Inc()
+		}
+	case EventThreatDetected:
+		if threat, ok := data.(*Threat); ok {
+			threatsDetectedTotal.WithLabelValues(boundedLabel(threat.Type, metricThreatTypes)).Inc()
+		}
+	case EventFirewallRuleChanged:
+		if change, ok := data.(gin.H); ok {
+			if action, ok := change["action"].(string); ok {
+				firewallRuleChangesTotal.WithLabelValues(action).Inc()
+			}
+		}
+	}
+}
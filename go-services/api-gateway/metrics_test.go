@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCountEventBoundsLabels(t *testing.T) {
+	before := testutil.ToFloat64(alertsCreatedTotal.WithLabelValues("other"))
+	countEvent(EventAlertCreated, &Alert{Severity: "sev-" + generateToken()})
+	if got := testutil.ToFloat64(alertsCreatedTotal.WithLabelValues("other")); got != before+1 {
+		t.Errorf("unknown severity counted as other %v times, want %v", got, before+1)
+	}
+
+	before = testutil.ToFloat64(alertsCreatedTotal.WithLabelValues("high"))
+	countEvent(EventAlertCreated, &Alert{Severity: "high"})
+	if got := testutil.ToFloat64(alertsCreatedTotal.WithLabelValues("high")); got != before+1 {
+		t.Errorf("high severity counted %v times, want %v", got, before+1)
+	}
+
+	before = testutil.ToFloat64(threatsDetectedTotal.WithLabelValues("other"))
+	countEvent(EventThreatDetected, &Threat{Type: "type-" + generateToken()})
+	if got := testutil.ToFloat64(threatsDetectedTotal.WithLabelValues("other")); got != before+1 {
+		t.Errorf("unknown threat type counted as other %v times, want %v", got, before+1)
+	}
+
+	// Only the known values and "other" may have series
+	if n := testutil.CollectAndCount(alertsCreatedTotal); n > len(metricSeverities)+1 {
+		t.Errorf("alerts_created_total has %d series, want at most %d", n, len(metricSeverities)+1)
+	}
+}
+
+func TestLongLivedRequestsSkipLatency(t *testing.T) {
+	resetLatencies()
+	t.Cleanup(resetLatencies)
+
+	router := gin.New()
+	router.Use(performanceMiddleware())
+	router.GET("/quick", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/events", func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		c.Status(http.StatusOK)
+	})
+	router.GET("/socket", func(c *gin.Context) { c.Status(http.StatusSwitchingProtocols) })
+
+	streams := httpRequestsTotal.WithLabelValues("/events", "GET", "200")
+	before := testutil.ToFloat64(streams)
+
+	doRequest(t, router, http.MethodGet, "/quick", nil)
+	doRequest(t, router, http.MethodGet, "/events", nil)
+	doRequest(t, router, http.MethodGet, "/socket", nil, "Connection", "Upgrade", "Upgrade", "websocket")
+
+	sketches := latencySnapshot(time.Minute)
+	if _, ok := sketches["GET:/quick"]; !ok {
+		t.Error("ordinary request missing from the latency sketches")
+	}
+	for _, key := range []string{"GET:/events", "GET:/socket"} {
+		if _, ok := sketches[key]; ok {
+			t.Errorf("long-lived request %s recorded in the latency sketches", key)
+		}
+	}
+
+	if got := testutil.ToFloat64(streams) - before; got != 1 {
+		t.Errorf("stream request counted %v times, want 1", got)
+	}
+}
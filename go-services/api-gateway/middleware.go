@@ -29,7 +29,7 @@ func loggingMiddleware() gin.HandlerFunc {
 			}
 
 			if uid, ok := userID.(string); ok {
-				logActivity(uid, userEmail, action, resource, "", c.ClientIP(), status, nil)
+				logActivity(uid, userEmail, action, resource, "", c.ClientIP(), c.GetString("request_id"), status, nil)
 			}
 		}
 	}
@@ -52,18 +52,20 @@ func corsMiddleware() gin.HandlerFunc {
 	}
 }
 
-// Request ID middleware
+// requestIDMiddleware gives every request an ID, reusing a well-formed
+// X-Request-ID from the caller so a request can be followed across services.
+// The ID is stored on the gin context and the request context and echoed in
+// the response.
 func requestIDMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Generate or get request ID
-		requestID := c.GetHeader("X-Request-ID")
-		if requestID == "" {
-			// TODO: Generate UUID
-			requestID = "req_123456"
+		requestID := c.GetHeader(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
 		}
 
 		c.Set("request_id", requestID)
-		c.Writer.Header().Set("X-Request-ID", requestID)
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), requestID))
+		c.Writer.Header().Set(requestIDHeader, requestID)
 
 		c.Next()
 	}
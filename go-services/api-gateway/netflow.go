@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// FlowRecord represents a single flow decoded from NetFlow v5, v9 or IPFIX
+type FlowRecord struct {
+	Exporter string    `json:"exporter"`
+	Version  int       `json:"version"`
+	SrcIP    string    `json:"src_ip"`
+	DstIP    string    `json:"dst_ip"`
+	SrcPort  int       `json:"src_port"`
+	DstPort  int       `json:"dst_port"`
+	Protocol int       `json:"protocol"`
+	TCPFlags int       `json:"tcp_flags"`
+	Packets  uint64    `json:"packets"`
+	Bytes    uint64    `json:"bytes"`
+	InputIf  int       `json:"input_if"`
+	OutputIf int       `json:"output_if"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Received time.Time `json:"received"`
+}
+
+// Information element IDs shared by NetFlow v9 and IPFIX
+const (
+	fieldInBytes          = 1
+	fieldInPkts           = 2
+	fieldProtocol         = 4
+	fieldTCPFlags         = 6
+	fieldL4SrcPort        = 7
+	fieldIPv4SrcAddr      = 8
+	fieldInputSNMP        = 10
+	fieldL4DstPort        = 11
+	fieldIPv4DstAddr      = 12
+	fieldOutputSNMP       = 14
+	fieldLastSwitched     = 21
+	fieldFirstSwitched    = 22
+	fieldOutBytes         = 23
+	fieldOutPkts          = 24
+	fieldIPv6SrcAddr      = 27
+	fieldIPv6DstAddr      = 28
+	fieldOctetTotalCount  = 85
+	fieldPacketTotalCount = 86
+	fieldFlowStartSeconds = 150
+	fieldFlowEndSeconds   = 151
+	fieldFlowStartMillis  = 152
+	fieldFlowEndMillis    = 153
+	ipfixVariableLength   = 65535
+	netflowV5HeaderLength = 24
+	netflowV5RecordLength = 48
+	netflowV9HeaderLength = 20
+	ipfixHeaderLength     = 16
+)
+
+var errShortPacket = errors.New("flow packet truncated")
+
+// templateField describes one field of a v9/IPFIX template
+type templateField struct {
+	ID         uint16
+	Length     uint16
+	Enterprise uint32
+}
+
+// Template cache bounds. Exporters resend templates periodically, so an entry
+// that has not been refreshed within the TTL belongs to an exporter that is
+// gone or has restarted with new template IDs.
+const (
+	maxFlowTemplates = 4096
+	flowTemplateTTL  = 30 * time.Minute
+)
+
+// flowTemplate is a cached template and when it was last received
+type flowTemplate struct {
+	fields []templateField
+	seen   time.Time
+}
+
+// flowTemplates caches v9 and IPFIX templates per exporter and observation domain
+type flowTemplates struct {
+	templates map[string]flowTemplate
+	mu        sync.RWMutex
+}
+
+func newFlowTemplates() *flowTemplates {
+	return &flowTemplates{templates: make(map[string]flowTemplate)}
+}
+
+func templateKey(exporter string, version int, domain uint32, id uint16) string {
+	return fmt.Sprintf("%s/%d/%d/%d", exporter, version, domain, id)
+}
+
+// set caches a template, evicting the least recently refreshed one when the
+// cache is full
+func (t *flowTemplates) set(key string, fields []templateField) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.templates[key]; !exists && len(t.templates) >= maxFlowTemplates {
+		oldest := ""
+		var oldestSeen time.Time
+		for k, tmpl := range t.templates {
+			if oldest == "" || tmpl.seen.Before(oldestSeen) {
+				oldest, oldestSeen = k, tmpl.seen
+			}
+		}
+		delete(t.templates, oldest)
+	}
+	t.templates[key] = flowTemplate{fields: fields, seen: time.Now()}
+}
+
+func (t *flowTemplates) get(key string) ([]templateField, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tmpl, ok := t.templates[key]
+	if !ok || time.Since(tmpl.seen) > flowTemplateTTL {
+		return nil, false
+	}
+	return tmpl.fields, true
+}
+
+// prune drops templates that have not been refreshed within the TTL
+func (t *flowTemplates) prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-flowTemplateTTL)
+	for key, tmpl := range t.templates {
+		if tmpl.seen.Before(cutoff) {
+			delete(t.templates, key)
+		}
+	}
+}
+
+// count returns the number of cached templates
+func (t *flowTemplates) count() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.templates)
+}
+
+// decodeFlowPacket decodes a NetFlow v5, v9 or IPFIX datagram into flow records
+func decodeFlowPacket(data []byte, exporter string, templates *flowTemplates) ([]FlowRecord, error) {
+	if len(data) < 2 {
+		return nil, errShortPacket
+	}
+
+	switch version := binary.BigEndian.Uint16(data[0:2]); version {
+	case 5:
+		return decodeNetFlowV5(data, exporter)
+	case 9:
+		return decodeNetFlowV9(data, exporter, templates)
+	case 10:
+		return decodeIPFIX(data, exporter, templates)
+	default:
+		return nil, fmt.Errorf("unsupported flow version %d", version)
+	}
+}
+
+// decodeNetFlowV5 decodes a NetFlow v5 datagram (fixed record format)
+func decodeNetFlowV5(data []byte, exporter string) ([]FlowRecord, error) {
+	if len(data) < netflowV5HeaderLength {
+		return nil, errShortPacket
+	}
+
+	count := int(binary.BigEndian.Uint16(data[2:4]))
+	sysUptime := binary.BigEndian.Uint32(data[4:8])
+	unixSecs := binary.BigEndian.Uint32(data[8:12])
+	unixNsecs := binary.BigEndian.Uint32(data[12:16])
+	exportTime := time.Unix(int64(unixSecs), int64(unixNsecs))
+
+	if len(data) < netflowV5HeaderLength+count*netflowV5RecordLength {
+		return nil, errShortPacket
+	}
+
+	now := time.Now()
+	records := make([]FlowRecord, 0, count)
+	for i := 0; i < count; i++ {
+		r := data[netflowV5HeaderLength+i*netflowV5RecordLength:]
+		first := binary.BigEndian.Uint32(r[24:28])
+		last := binary.BigEndian.Uint32(r[28:32])
+
+		records = append(records, FlowRecord{
+			Exporter: exporter,
+			Version:  5,
+			SrcIP:    net.IP(r[0:4]).String(),
+			DstIP:    net.IP(r[4:8]).String(),
+			InputIf:  int(binary.BigEndian.Uint16(r[12:14])),
+			OutputIf: int(binary.BigEndian.Uint16(r[14:16])),
+			Packets:  uint64(binary.BigEndian.Uint32(r[16:20])),
+			Bytes:    uint64(binary.BigEndian.Uint32(r[20:24])),
+			Start:    uptimeToTime(exportTime, sysUptime, first),
+			End:      uptimeToTime(exportTime, sysUptime, last),
+			SrcPort:  int(binary.BigEndian.Uint16(r[32:34])),
+			DstPort:  int(binary.BigEndian.Uint16(r[34:36])),
+			TCPFlags: int(r[37]),
+			Protocol: int(r[38]),
+			Received: now,
+		})
+	}
+
+	return records, nil
+}
+
+// decodeNetFlowV9 decodes a NetFlow v9 datagram, learning templates as they arrive
+func decodeNetFlowV9(data []byte, exporter string, templates *flowTemplates) ([]FlowRecord, error) {
+	if len(data) < netflowV9HeaderLength {
+		return nil, errShortPacket
+	}
+
+	sysUptime := binary.BigEndian.Uint32(data[4:8])
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(data[8:12])), 0)
+	sourceID := binary.BigEndian.Uint32(data[16:20])
+
+	var records []FlowRecord
+	offset := netflowV9HeaderLength
+	for offset+4 <= len(data) {
+		setID := binary.BigEndian.Uint16(data[offset : offset+2])
+		setLength := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		if setLength < 4 || offset+setLength > len(data) {
+			return records, errShortPacket
+		}
+		body := data[offset+4 : offset+setLength]
+		offset += setLength
+
+		switch {
+		case setID == 0:
+			if err := parseTemplates(body, exporter, 9, sourceID, false, templates); err != nil {
+				return records, err
+			}
+		case setID == 1:
+			// Options templates describe exporter metadata, not flows
+		case setID >= 256:
+			fields, ok := templates.get(templateKey(exporter, 9, sourceID, setID))
+			if !ok {
+				continue
+			}
+			decoded := decodeDataSet(body, fields, exporter, 9, func(rec *FlowRecord, id uint16, value []byte) {
+				switch id {
+				case fieldFirstSwitched:
+					rec.Start = uptimeToTime(exportTime, sysUptime, uint32(readUint(value)))
+				case fieldLastSwitched:
+					rec.End = uptimeToTime(exportTime, sysUptime, uint32(readUint(value)))
+				}
+			})
+			records = append(records, decoded...)
+		}
+	}
+
+	return records, nil
+}
+
+// decodeIPFIX decodes an IPFIX (NetFlow v10) message
+func decodeIPFIX(data []byte, exporter string, templates *flowTemplates) ([]FlowRecord, error) {
+	if len(data) < ipfixHeaderLength {
+		return nil, errShortPacket
+	}
+
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < ipfixHeaderLength || length > len(data) {
+		return nil, errShortPacket
+	}
+	data = data[:length]
+	domainID := binary.BigEndian.Uint32(data[12:16])
+
+	var records []FlowRecord
+	offset := ipfixHeaderLength
+	for offset+4 <= len(data) {
+		setID := binary.BigEndian.Uint16(data[offset : offset+2])
+		setLength := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		if setLength < 4 || offset+setLength > len(data) {
+			return records, errShortPacket
+		}
+		body := data[offset+4 : offset+setLength]
+		offset += setLength
+
+		switch {
+		case setID == 2:
+			if err := parseTemplates(body, exporter, 10, domainID, true, templates); err != nil {
+				return records, err
+			}
+		case setID == 3:
+			// Options templates describe exporter metadata, not flows
+		case setID >= 256:
+			fields, ok := templates.get(templateKey(exporter, 10, domainID, setID))
+			if !ok {
+				continue
+			}
+			decoded := decodeDataSet(body, fields, exporter, 10, func(rec *FlowRecord, id uint16, value []byte) {
+				switch id {
+				case fieldFlowStartSeconds:
+					rec.Start = time.Unix(int64(readUint(value)), 0)
+				case fieldFlowEndSeconds:
+					rec.End = time.Unix(int64(readUint(value)), 0)
+				case fieldFlowStartMillis:
+					rec.Start = time.UnixMilli(int64(readUint(value)))
+				case fieldFlowEndMillis:
+					rec.End = time.UnixMilli(int64(readUint(value)))
+				}
+			})
+			records = append(records, decoded...)
+		}
+	}
+
+	return records, nil
+}
+
+// parseTemplates parses a v9 template flowset or an IPFIX template set
+func parseTemplates(body []byte, exporter string, version int, domain uint32, ipfix bool, templates *flowTemplates) error {
+	offset := 0
+	for offset+4 <= len(body) {
+		id := binary.BigEndian.Uint16(body[offset : offset+2])
+		fieldCount := int(binary.BigEndian.Uint16(body[offset+2 : offset+4]))
+		offset += 4
+
+		// Padding at the end of a set is all zeros
+		if id == 0 && fieldCount == 0 {
+			break
+		}
+		// IDs below 256 name set types, so a template using one is corrupt
+		if id < 256 {
+			return fmt.Errorf("invalid template ID %d", id)
+		}
+
+		fields := make([]templateField, 0, fieldCount)
+		for i := 0; i < fieldCount; i++ {
+			if offset+4 > len(body) {
+				return errShortPacket
+			}
+			field := templateField{
+				ID:     binary.BigEndian.Uint16(body[offset : offset+2]),
+				Length: binary.BigEndian.Uint16(body[offset+2 : offset+4]),
+			}
+			offset += 4
+
+			if ipfix && field.ID&0x8000 != 0 {
+				if offset+4 > len(body) {
+					return errShortPacket
+				}
+				field.ID &^= 0x8000
+				field.Enterprise = binary.BigEndian.Uint32(body[offset : offset+4])
+				offset += 4
+			}
+			fields = append(fields, field)
+		}
+
+		templates.set(templateKey(exporter, version, domain, id), fields)
+	}
+
+	return nil
+}
+
+// decodeDataSet decodes the records of a data set using its template. The
+// timeField callback handles the version specific timestamp fields.
+func decodeDataSet(body []byte, fields []templateField, exporter string, version int, timeField func(*FlowRecord, uint16, []byte)) []FlowRecord {
+	minLength := 0
+	for _, field := range fields {
+		if field.Length == ipfixVariableLength {
+			minLength++
+		} else {
+			minLength += int(field.Length)
+		}
+	}
+	if minLength == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var records []FlowRecord
+	offset := 0
+	for offset+minLength <= len(body) {
+		rec := FlowRecord{Exporter: exporter, Version: version, Received: now}
+
+		complete := true
+		for _, field := range fields {
+			length := int(field.Length)
+			if field.Length == ipfixVariableLength {
+				if offset >= len(body) {
+					complete = false
+					break
+				}
+				length = int(body[offset])
+				offset++
+				if length == 255 {
+					if offset+2 > len(body) {
+						complete = false
+						break
+					}
+					length = int(binary.BigEndian.Uint16(body[offset : offset+2]))
+					offset += 2
+				}
+			}
+			if offset+length > len(body) {
+				complete = false
+				break
+			}
+
+			value := body[offset : offset+length]
+			offset += length
+
+			// Enterprise specific elements are not part of the flow model
+			if field.Enterprise != 0 {
+				continue
+			}
+			applyFlowField(&rec, field.ID, value)
+			timeField(&rec, field.ID, value)
+		}
+
+		if !complete {
+			break
+		}
+		if rec.Start.IsZero() {
+			rec.Start = now
+		}
+		if rec.End.IsZero() {
+			rec.End = rec.Start
+		}
+		records = append(records, rec)
+	}
+
+	return records
+}
+
+// applyFlowField maps a template field onto the normalised flow record
+func applyFlowField(rec *FlowRecord, id uint16, value []byte) {
+	switch id {
+	case fieldInBytes, fieldOutBytes, fieldOctetTotalCount:
+		rec.Bytes += readUint(value)
+	case fieldInPkts, fieldPacketTotalCount, fieldOutPkts:
+		rec.Packets += readUint(value)
+	case fieldProtocol:
+		rec.Protocol = int(readUint(value))
+	case fieldTCPFlags:
+		rec.TCPFlags = int(readUint(value))
+	case fieldL4SrcPort:
+		rec.SrcPort = int(readUint(value))
+	case fieldL4DstPort:
+		rec.DstPort = int(readUint(value))
+	case fieldInputSNMP:
+		rec.InputIf = int(readUint(value))
+	case fieldOutputSNMP:
+		rec.OutputIf = int(readUint(value))
+	case fieldIPv4SrcAddr, fieldIPv6SrcAddr:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			rec.SrcIP = net.IP(value).String()
+		}
+	case fieldIPv4DstAddr, fieldIPv6DstAddr:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			rec.DstIP = net.IP(value).String()
+		}
+	}
+}
+
+// readUint reads a big-endian unsigned integer of up to 8 bytes
+func readUint(value []byte) uint64 {
+	if len(value) > 8 {
+		value = value[len(value)-8:]
+	}
+	var n uint64
+	for _, b := range value {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+// uptimeToTime converts a router sysUptime offset (ms) into wall clock time
+func uptimeToTime(exportTime time.Time, sysUptime, uptime uint32) time.Time {
+	return exportTime.Add(-time.Duration(int64(sysUptime)-int64(uptime)) * time.Millisecond)
+}
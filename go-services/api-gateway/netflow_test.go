@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// Datagrams as exporters send them, hex encoded
+const (
+	// NetFlow v5, two records: 192.0.2.10:51515 -> 10.0.0.5:443 TCP (10
+	// packets, 1500 bytes) and 10.0.0.5:40000 -> 198.51.100.53:53 UDP
+	capturedNetFlowV5 = "000500020036ee806553f100000000000000000100000000c000020a0a00000500000000000100020000000a000005dc0036c7700036ea98c93b01bb001b060000000000181800000a000005c63364350000000000020001000000010000004c0036ec8c0036ec8c9c400035000011000000000018180000"
+
+	// NetFlow v9 template flowset for template 256, source ID 7
+	capturedNetFlowV9Template = "000900010036ee806553f1000000000100000007000000300100000a00080004000c000400070002000b0002000400010006000100020004000100040016000400150004"
+
+	// NetFlow v9 data flowset for template 256 with two bytes of padding:
+	// 203.0.113.9:44321 -> 10.1.2.3:22 TCP SYN, 3 packets, 180 bytes
+	capturedNetFlowV9Data = "000900010036ee806553f100000000010000000701000024cb0071090a010203ad210016060200000003000000b40036daf80036dee00000"
+
+	// IPFIX template 300 and one record using it: 2001:db8::1:443 ->
+	// 2001:db8::2:50000 TCP, 12 packets, 9000 bytes, with an enterprise
+	// field and a variable length enterprise field
+	capturedIPFIX = "000a009d6553f10a00000001000000010002003c012c000b001b0010001c001000070002000b0002000400010001000800020008009800080099000880640004000000098065ffff00000009012c005120010db800000000000000000000000120010db800000000000000000000000201bbc350060000000000002328000000000000000c0000018bcfe568000000018bcfe57b88000004d203616263"
+)
+
+var netflowExportTime = time.Unix(1700000000, 0)
+
+func capturedPacket(t *testing.T, data string) []byte {
+	t.Helper()
+
+	packet, err := hex.DecodeString(data)
+	if err != nil {
+		t.Fatalf("bad capture: %v", err)
+	}
+	return packet
+}
+
+func TestDecodeNetFlowV5(t *testing.T) {
+	records, err := decodeFlowPacket(capturedPacket(t, capturedNetFlowV5), "192.0.2.1", newFlowTemplates())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("decoded %d records, want 2", len(records))
+	}
+
+	rec := records[0]
+	want := FlowRecord{
+		Exporter: "192.0.2.1", Version: 5,
+		SrcIP: "192.0.2.10", DstIP: "10.0.0.5", SrcPort: 51515, DstPort: 443,
+		Protocol: 6, TCPFlags: 0x1b, Packets: 10, Bytes: 1500, InputIf: 1, OutputIf: 2,
+	}
+	rec.Received = time.Time{}
+	if !rec.Start.Equal(netflowExportTime.Add(-10*time.Second)) || !rec.End.Equal(netflowExportTime.Add(-time.Second)) {
+		t.Errorf("flow ran from %s to %s, want the 10th to the last second before export", rec.Start, rec.End)
+	}
+	rec.Start, rec.End = time.Time{}, time.Time{}
+	if rec != want {
+		t.Errorf("first record = %+v, want %+v", rec, want)
+	}
+
+	if records[1].Protocol != 17 || records[1].DstPort != 53 || records[1].DstIP != "198.51.100.53" {
+		t.Errorf("second record = %+v, want a DNS flow to 198.51.100.53", records[1])
+	}
+}
+
+func TestDecodeNetFlowV9(t *testing.T) {
+	templates := newFlowTemplates()
+
+	// Data arriving before its template cannot be decoded yet
+	records, err := decodeFlowPacket(capturedPacket(t, capturedNetFlowV9Data), "192.0.2.1", templates)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("data before template = %d records, %v; want none and no error", len(records), err)
+	}
+
+	if _, err := decodeFlowPacket(capturedPacket(t, capturedNetFlowV9Template), "192.0.2.1", templates); err != nil {
+		t.Fatalf("decode template: %v", err)
+	}
+	if templates.count() != 1 {
+		t.Fatalf("learned %d templates, want 1", templates.count())
+	}
+
+	records, err = decodeFlowPacket(capturedPacket(t, capturedNetFlowV9Data), "192.0.2.1", templates)
+	if err != nil {
+		t.Fatalf("decode data: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("decoded %d records, want 1 (padding is not a record)", len(records))
+	}
+	rec := records[0]
+	if rec.Version != 9 || rec.SrcIP != "203.0.113.9" || rec.DstIP != "10.1.2.3" || rec.SrcPort != 44321 || rec.DstPort != 22 {
+		t.Errorf("record = %+v, want 203.0.113.9:44321 -> 10.1.2.3:22", rec)
+	}
+	if rec.Protocol != 6 || rec.TCPFlags != 0x02 || rec.Packets != 3 || rec.Bytes != 180 {
+		t.Errorf("record = %+v, want a 3 packet 180 byte TCP SYN flow", rec)
+	}
+	if !rec.Start.Equal(netflowExportTime.Add(-5*time.Second)) || !rec.End.Equal(netflowExportTime.Add(-4*time.Second)) {
+		t.Errorf("flow ran from %s to %s, want 5s to 4s before export", rec.Start, rec.End)
+	}
+
+	// Templates belong to one exporter
+	records, _ = decodeFlowPacket(capturedPacket(t, capturedNetFlowV9Data), "192.0.2.2", templates)
+	if len(records) != 0 {
+		t.Errorf("another exporter's data decoded with this exporter's template")
+	}
+}
+
+func TestDecodeIPFIX(t *testing.T) {
+	records, err := decodeFlowPacket(capturedPacket(t, capturedIPFIX), "192.0.2.1", newFlowTemplates())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("decoded %d records, want 1", len(records))
+	}
+
+	rec := records[0]
+	if rec.Version != 10 || rec.SrcIP != "2001:db8::1" || rec.DstIP != "2001:db8::2" || rec.SrcPort != 443 || rec.DstPort != 50000 {
+		t.Errorf("record = %+v, want [2001:db8::1]:443 -> [2001:db8::2]:50000", rec)
+	}
+	if rec.Protocol != 6 || rec.Packets != 12 || rec.Bytes != 9000 {
+		t.Errorf("record = %+v, want a 12 packet 9000 byte TCP flow", rec)
+	}
+	start := time.UnixMilli(1700000000000)
+	if !rec.Start.Equal(start) || !rec.End.Equal(start.Add(5*time.Second)) {
+		t.Errorf("flow ran from %s to %s, want 5s from %s", rec.Start, rec.End, start)
+	}
+}
+
+func TestDecodeMalformedFlowPackets(t *testing.T) {
+	v5 := capturedPacket(t, capturedNetFlowV5)
+	v9Template := capturedPacket(t, capturedNetFlowV9Template)
+	ipfix := capturedPacket(t, capturedIPFIX)
+
+	// patch returns a copy of packet with bytes replaced at offset
+	patch := func(packet []byte, offset int, bytes ...byte) []byte {
+		patched := append([]byte(nil), packet...)
+		copy(patched[offset:], bytes)
+		return patched
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"v5 header truncated", v5[:20]},
+		{"v5 record truncated", v5[:len(v5)-10]},
+		{"v5 count beyond records", patch(v5, 2, 0, 3)},
+		{"v9 header truncated", v9Template[:12]},
+		{"v9 flowset beyond packet", v9Template[:len(v9Template)-8]},
+		{"v9 flowset length below header", patch(v9Template, 22, 0, 2)},
+		// The template claims 11 fields, so the last runs past the flowset
+		{"v9 template field count beyond flowset", patch(v9Template, 26, 0, 11)},
+		{"v9 template ID reserved for sets", patch(v9Template, 24, 0, 2)},
+		{"ipfix length beyond packet", patch(ipfix, 2, 0xff, 0xff)},
+		{"ipfix length below header", patch(ipfix, 2, 0, 8)},
+		// The enterprise number of the last template field is cut off
+		{"ipfix enterprise number truncated", patch(patch(ipfix[:74], 2, 0, 74), 18, 0, 58)},
+		{"unknown version", patch(v5, 0, 0, 7)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templates := newFlowTemplates()
+			records, err := decodeFlowPacket(tt.packet, "192.0.2.1", templates)
+			if err == nil {
+				t.Fatalf("decoded %d records, want an error", len(records))
+			}
+			if templates.count() != 0 {
+				t.Errorf("learned %d templates from a malformed packet", templates.count())
+			}
+		})
+	}
+}
+
+func TestDecodeTruncatedDataSet(t *testing.T) {
+	templates := newFlowTemplates()
+	if _, err := decodeFlowPacket(capturedPacket(t, capturedNetFlowV9Template), "192.0.2.1", templates); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shrink the data flowset (and the datagram) so it ends mid-record
+	data := capturedPacket(t, capturedNetFlowV9Data)
+	data = data[:len(data)-12]
+	data[23] -= 12
+
+	records, err := decodeFlowPacket(data, "192.0.2.1", templates)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("decoded %d records from a partial record, want none", len(records))
+	}
+}
+
+func TestFlowCollector(t *testing.T) {
+	stats := newFlowAggregator([]string{"10.0.0.0/8"})
+	collector := newFlowCollector("127.0.0.1:0", stats)
+
+	received := make(chan FlowRecord, 10)
+	collector.OnFlow(func(rec FlowRecord) { received <- rec })
+	if err := collector.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Stop()
+
+	conn, err := net.Dial("udp", collector.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{0, 5, 0})
+	conn.Write(capturedPacket(t, capturedNetFlowV5))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case rec := <-received:
+			if rec.Exporter != "127.0.0.1" {
+				t.Errorf("exporter = %q, want 127.0.0.1", rec.Exporter)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d of 2 flows", i)
+		}
+	}
+
+	totals := stats.Totals()
+	if totals.Packets != 11 || totals.Bytes != 1576 {
+		t.Errorf("totals = %d packets %d bytes, want 11 and 1576", totals.Packets, totals.Bytes)
+	}
+	status := collector.Status()
+	if status["datagrams"] != uint64(2) || status["decode_errors"] != uint64(1) {
+		t.Errorf("status = %v, want 2 datagrams and 1 decode error", status)
+	}
+}
+
+func TestFlowTemplateCacheBounds(t *testing.T) {
+	templates := newFlowTemplates()
+	fields := []templateField{{ID: fieldInBytes, Length: 4}}
+
+	for i := 0; i < maxFlowTemplates+10; i++ {
+		templates.set(templateKey("192.0.2.1", 9, 0, uint16(256+i)), fields)
+	}
+	if templates.count() != maxFlowTemplates {
+		t.Errorf("cached %d templates, want the limit of %d", templates.count(), maxFlowTemplates)
+	}
+	if _, ok := templates.get(templateKey("192.0.2.1", 9, 0, 256)); ok {
+		t.Error("oldest template survived eviction")
+	}
+
+	// Age one template past the TTL: it stops decoding and is pruned
+	key := templateKey("192.0.2.1", 9, 0, uint16(256+maxFlowTemplates))
+	templates.mu.Lock()
+	templates.templates[key] = flowTemplate{fields: fields, seen: time.Now().Add(-flowTemplateTTL - time.Minute)}
+	templates.mu.Unlock()
+
+	if _, ok := templates.get(key); ok {
+		t.Error("expired template still used for decoding")
+	}
+	templates.prune()
+	if templates.count() != maxFlowTemplates-1 {
+		t.Errorf("cached %d templates after prune, want %d", templates.count(), maxFlowTemplates-1)
+	}
+}
+
+func TestFlowAggregatorBounds(t *testing.T) {
+	stats := newFlowAggregator(nil)
+	now := time.Now()
+
+	for i := 0; i < maxFlowInterfaces+10; i++ {
+		stats.Add(FlowRecord{Exporter: "192.0.2.1", InputIf: i + 1, Protocol: 6, Bytes: 1, Packets: 1, Received: now.Add(time.Duration(i) * time.Millisecond)})
+	}
+	if len(stats.interfaces) != maxFlowInterfaces {
+		t.Errorf("tracked %d interfaces, want the limit of %d", len(stats.interfaces), maxFlowInterfaces)
+	}
+	if _, ok := stats.interfaces["192.0.2.1#1"]; ok {
+		t.Error("longest idle interface survived eviction")
+	}
+
+	// An exporter that has gone quiet is forgotten along with its flows
+	stats.Add(FlowRecord{Exporter: "192.0.2.99", InputIf: 1, Protocol: 6, SrcPort: 1, Received: now.Add(-flowExporterTTL - time.Minute)})
+	stats.prune()
+	if _, ok := stats.interfaces["192.0.2.99#1"]; ok {
+		t.Error("idle exporter interface survived prune")
+	}
+	if stats.ActiveFlows() != 1 || len(stats.active) != 1 {
+		t.Errorf("active flows = %d tracked %d, want the one live flow", stats.ActiveFlows(), len(stats.active))
+	}
+}
@@ -49,6 +49,8 @@ func createNotification(userID, notifType, title, message, severity, link string
 	if len(notifications[userID]) > 100 {
 		notifications[userID] = notifications[userID][len(notifications[userID])-100:]
 	}
+
+	broadcastNotification(notif)
 }
 
 // listNotifications returns user notifications
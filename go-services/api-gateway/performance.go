@@ -1,193 +1,198 @@
 package main
 
 import (
+	"math"
 	"net/http"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// PerformanceMetric represents a performance metric
+// PerformanceMetric summarises requests to one route over a window.
+// Durations are in milliseconds with microsecond precision; percentiles come
+// from a latency sketch and are accurate to within 1%.
 type PerformanceMetric struct {
 	Endpoint      string
 	Method        string
 	Count         int64
-	TotalDuration int64
-	MinDuration   int64
-	MaxDuration   int64
+	TotalDuration float64
+	MinDuration   float64
+	MaxDuration   float64
 	AvgDuration   float64
+	P50           float64
+	P95           float64
+	P99           float64
 	ErrorCount    int64
-	LastAccessed  time.Time
+	ErrorRate     float64
 }
 
-var (
-	perfMetrics    = make(map[string]*PerformanceMetric)
-	perfMetricsMux sync.RWMutex
-)
-
-// performanceMiddleware tracks performance metrics
+// performanceMiddleware records request latency by route, method and status
 func performanceMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		startTime := time.Now()
+		upgrade := c.IsWebsocket()
 
 		// Process request
 		c.Next()
 
-		// Calculate duration
-		duration := time.Since(startTime).Milliseconds()
-
-		// Track metrics
-		key := c.Request.Method + ":" + c.FullPath()
-		trackPerformance(key, c.Request.Method, c.FullPath(), duration, c.Writer.Status())
+		// Websocket and SSE connections last as long as the client stays
+		// connected, so their duration says nothing about latency
+		longLived := upgrade || strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream")
+		observeRequest(metricsRoute(c), c.Request.Method, c.Writer.Status(), time.Since(startTime).Seconds(), longLived)
 	}
 }
 
-// trackPerformance records performance metrics
-func trackPerformance(key, method, endpoint string, duration int64, statusCode int) {
-	perfMetricsMux.Lock()
-	defer perfMetricsMux.Unlock()
-
-	metric, exists := perfMetrics[key]
-	if !exists {
-		metric = &PerformanceMetric{
-			Endpoint:    endpoint,
-			Method:      method,
-			MinDuration: duration,
-			MaxDuration: duration,
-		}
-		perfMetrics[key] = metric
+// newPerformanceMetric summarises a sketch
+func newPerformanceMetric(method, endpoint string, sketch *latencySketch) *PerformanceMetric {
+	percentiles := sketch.quantiles(0.5, 0.95, 0.99)
+	return &PerformanceMetric{
+		Endpoint:      endpoint,
+		Method:        method,
+		Count:         int64(sketch.count),
+		TotalDuration: milliseconds(sketch.sum),
+		MinDuration:   milliseconds(sketch.min),
+		MaxDuration:   milliseconds(sketch.max),
+		AvgDuration:   milliseconds(sketch.sum / float64(sketch.count)),
+		P50:           milliseconds(percentiles[0]),
+		P95:           milliseconds(percentiles[1]),
+		P99:           milliseconds(percentiles[2]),
+		ErrorCount:    int64(sketch.errors),
+		ErrorRate:     float64(sketch.errors) / float64(sketch.count) * 100,
 	}
+}
 
-	metric.Count++
-	metric.TotalDuration += duration
-	metric.LastAccessed = time.Now()
+// milliseconds converts seconds, rounded to the microsecond
+func milliseconds(seconds float64) float64 {
+	return math.Round(seconds*1e6) / 1000
+}
 
-	if duration < metric.MinDuration {
-		metric.MinDuration = duration
+// performanceWindow reads the "window" query parameter: 1m, 5m, 1h, or
+// empty for everything since the last reset. It answers 400 for anything
+// else.
+func performanceWindow(c *gin.Context) (string, time.Duration, bool) {
+	window := c.Query("window")
+	if window == "" {
+		return "all", 0, true
 	}
-	if duration > metric.MaxDuration {
-		metric.MaxDuration = duration
-	}
-
-	metric.AvgDuration = float64(metric.TotalDuration) / float64(metric.Count)
-
-	if statusCode >= 400 {
-		metric.ErrorCount++
+	d, ok := latencyWindows[window]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window must be 1m, 5m or 1h"})
+		return "", 0, false
 	}
+	return window, d, true
 }
 
-// getPerformanceMetrics returns performance metrics
-func getPerformanceMetrics(c *gin.Context) {
-	perfMetricsMux.RLock()
-	defer perfMetricsMux.RUnlock()
-
+// currentPerformance returns per route metrics over a window
+func currentPerformance(d time.Duration) ([]*PerformanceMetric, *latencySketch) {
+	overall := newLatencySketch()
 	var metrics []*PerformanceMetric
-	for _, metric := range perfMetrics {
-		metrics = append(metrics, metric)
+	for key, sketch := range latencySnapshot(d) {
+		method, endpoint, _ := strings.Cut(key, ":")
+		metrics = append(metrics, newPerformanceMetric(method, endpoint, sketch))
+		overall.merge(sketch)
 	}
+	return metrics, overall
+}
 
-	// Calculate totals
-	var totalRequests int64
-	var totalErrors int64
-	var totalDuration int64
+// topEndpoints sorts metrics by a key, highest first, and keeps the first
+// "limit" (default 10)
+func topEndpoints(c *gin.Context, metrics []*PerformanceMetric, key func(*PerformanceMetric) float64) []*PerformanceMetric {
+	sort.Slice(metrics, func(i, j int) bool {
+		return key(metrics[i]) > key(metrics[j])
+	})
 
-	for _, metric := range metrics {
-		totalRequests += metric.Count
-		totalErrors += metric.ErrorCount
-		totalDuration += metric.TotalDuration
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit < 1 || len(metrics) < limit {
+		limit = len(metrics)
 	}
+	return metrics[:limit]
+}
 
-	avgResponseTime := float64(0)
-	if totalRequests > 0 {
-		avgResponseTime = float64(totalDuration) / float64(totalRequests)
+// getPerformanceMetrics returns performance metrics
+func getPerformanceMetrics(c *gin.Context) {
+	window, d, ok := performanceWindow(c)
+	if !ok {
+		return
 	}
+	metrics, overall := currentPerformance(d)
 
 	errorRate := float64(0)
-	if totalRequests > 0 {
-		errorRate = float64(totalErrors) / float64(totalRequests) * 100
+	avgResponseTime := float64(0)
+	if overall.count > 0 {
+		errorRate = float64(overall.errors) / float64(overall.count) * 100
+		avgResponseTime = milliseconds(overall.sum / float64(overall.count))
 	}
+	percentiles := overall.quantiles(0.5, 0.95, 0.99)
 
 	c.JSON(http.StatusOK, gin.H{
+		"window":  window,
 		"metrics": metrics,
 		"summary": gin.H{
-			"total_requests":     totalRequests,
-			"total_errors":       totalErrors,
-			"error_rate":         errorRate,
-			"avg_response_time":  avgResponseTime,
-			"total_endpoints":    len(metrics),
+			"total_requests":    overall.count,
+			"total_errors":      overall.errors,
+			"error_rate":        errorRate,
+			"avg_response_time": avgResponseTime,
+			"p50":               milliseconds(percentiles[0]),
+			"p95":               milliseconds(percentiles[1]),
+			"p99":               milliseconds(percentiles[2]),
+			"total_endpoints":   len(metrics),
 		},
 	})
 }
 
-// getSlowestEndpoints returns slowest endpoints
+// getSlowestEndpoints returns the slowest endpoints by p95, or by the
+// percentile or average named in "by" (p50, p95, p99, avg, max)
 func getSlowestEndpoints(c *gin.Context) {
-	perfMetricsMux.RLock()
-	defer perfMetricsMux.RUnlock()
-
-	var metrics []*PerformanceMetric
-	for _, metric := range perfMetrics {
-		metrics = append(metrics, metric)
+	window, d, ok := performanceWindow(c)
+	if !ok {
+		return
 	}
 
-	// Sort by average duration (simple bubble sort for small dataset)
-	for i := 0; i < len(metrics)-1; i++ {
-		for j := i + 1; j < len(metrics); j++ {
-			if metrics[i].AvgDuration < metrics[j].AvgDuration {
-				metrics[i], metrics[j] = metrics[j], metrics[i]
-			}
-		}
+	orders := map[string]func(*PerformanceMetric) float64{
+		"p50": func(m *PerformanceMetric) float64 { return m.P50 },
+		"p95": func(m *PerformanceMetric) float64 { return m.P95 },
+		"p99": func(m *PerformanceMetric) float64 { return m.P99 },
+		"avg": func(m *PerformanceMetric) float64 { return m.AvgDuration },
+		"max": func(m *PerformanceMetric) float64 { return m.MaxDuration },
 	}
-
-	// Get top 10
-	limit := 10
-	if len(metrics) < limit {
-		limit = len(metrics)
+	by := c.DefaultQuery("by", "p95")
+	order, exists := orders[by]
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "by must be p50, p95, p99, avg or max"})
+		return
 	}
 
+	metrics, _ := currentPerformance(d)
 	c.JSON(http.StatusOK, gin.H{
-		"slowest_endpoints": metrics[:limit],
+		"window":            window,
+		"by":                by,
+		"slowest_endpoints": topEndpoints(c, metrics, order),
 		"total":             len(metrics),
 	})
 }
 
 // getMostUsedEndpoints returns most frequently used endpoints
 func getMostUsedEndpoints(c *gin.Context) {
-	perfMetricsMux.RLock()
-	defer perfMetricsMux.RUnlock()
-
-	var metrics []*PerformanceMetric
-	for _, metric := range perfMetrics {
-		metrics = append(metrics, metric)
-	}
-
-	// Sort by count
-	for i := 0; i < len(metrics)-1; i++ {
-		for j := i + 1; j < len(metrics); j++ {
-			if metrics[i].Count < metrics[j].Count {
-				metrics[i], metrics[j] = metrics[j], metrics[i]
-			}
-		}
-	}
-
-	// Get top 10
-	limit := 10
-	if len(metrics) < limit {
-		limit = len(metrics)
+	window, d, ok := performanceWindow(c)
+	if !ok {
+		return
 	}
 
+	metrics, _ := currentPerformance(d)
 	c.JSON(http.StatusOK, gin.H{
-		"most_used_endpoints": metrics[:limit],
+		"window":              window,
+		"most_used_endpoints": topEndpoints(c, metrics, func(m *PerformanceMetric) float64 { return float64(m.Count) }),
 		"total":               len(metrics),
 	})
 }
 
-// resetPerformanceMetrics resets all performance metrics
+// resetPerformanceMetrics resets all performance metrics. The Prometheus
+// counters on /metrics are cumulative and are not affected.
 func resetPerformanceMetrics(c *gin.Context) {
-	perfMetricsMux.Lock()
-	defer perfMetricsMux.Unlock()
-
-	perfMetrics = make(map[string]*PerformanceMetric)
+	resetLatencies()
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Performance metrics reset successfully",
@@ -2,164 +2,505 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
 )
 
-// RateLimiter tracks request rates per IP
+// RateLimitPolicy limits requests to matching routes. Limit requests are
+// allowed per Period, with up to Burst of them back to back. Policies are
+// tried in order and the first match wins; a Limit of 0 disables limiting.
+type RateLimitPolicy struct {
+	Name    string   `json:"name" yaml:"name"`
+	Methods []string `json:"methods,omitempty" yaml:"methods"`
+	Routes  []string `json:"routes,omitempty" yaml:"routes"`
+	Limit   int      `json:"limit" yaml:"limit"`
+	Period  string   `json:"period" yaml:"period"`
+	Burst   int      `json:"burst" yaml:"burst"`
+	Key     string   `json:"key" yaml:"key"` // "identity" (API key, user, then IP) or "ip"
+
+	period time.Duration
+}
+
+// matches reports whether the policy applies to a request. Routes are gin
+// route templates such as "/api/v1/alerts/:id", or prefixes ending in "*".
+func (p *RateLimitPolicy) matches(method, route string) bool {
+	if len(p.Methods) > 0 {
+		found := false
+		for _, m := range p.Methods {
+			if strings.EqualFold(m, method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(p.Routes) == 0 {
+		return true
+	}
+	for _, pattern := range p.Routes {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(route, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == route {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitPlan scales every policy for API keys assigned to the plan
+type RateLimitPlan struct {
+	Name       string  `json:"name" yaml:"name"`
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"`
+}
+
+// rateLimitResult is the outcome of a rate limit check
+type rateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // until the next request is allowed
+	Reset      time.Duration // until the bucket is full again
+}
+
+// RateLimitStore keeps GCRA buckets. Take checks the bucket at key and, when
+// consume is set, spends one request from it. It returns whether the request
+// is allowed, how long until it would be, and how long until the bucket is
+// full again.
+type RateLimitStore interface {
+	Take(key string, interval, tolerance time.Duration, consume bool) (allowed bool, retryAfter, reset time.Duration, err error)
+	Cleanup()
+}
+
+// memoryRateLimitStore keeps buckets in this process
+type memoryRateLimitStore struct {
+	buckets map[string]time.Time
+	mu      sync.Mutex
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]time.Time)}
+}
+
+func (m *memoryRateLimitStore) Take(key string, interval, tolerance time.Duration, consume bool) (bool, time.Duration, time.Duration, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tat := m.buckets[key]
+	if tat.Before(now) {
+		tat = now
+	}
+
+	if allowAt := tat.Add(interval - tolerance); now.Before(allowAt) {
+		return false, allowAt.Sub(now), tat.Sub(now), nil
+	}
+	if consume {
+		tat = tat.Add(interval)
+		m.buckets[key] = tat
+	}
+	return true, 0, tat.Sub(now), nil
+}
+
+// Cleanup forgets buckets that have refilled completely
+func (m *memoryRateLimitStore) Cleanup() {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, tat := range m.buckets {
+		if tat.Before(now) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// RateLimiter is a GCRA (generic cell rate algorithm) limiter: each bucket is
+// a single "theoretical arrival time", so checks are O(1) regardless of the
+// limit. Store errors fail open.
 type RateLimiter struct {
-	requests map[string][]time.Time
-	mu       sync.RWMutex
-	limit    int
-	window   time.Duration
+	store    RateLimitStore
+	backend  string
+	policies []*RateLimitPolicy
+	plans    map[string]*RateLimitPlan
+	enabled  bool
+	errors   atomic.Int64
+	mu       sync.Mutex
+}
+
+var rateLimiter = newRateLimiter()
+
+func newRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		store:   newMemoryRateLimitStore(),
+		backend: "memory",
+		plans:   make(map[string]*RateLimitPlan),
+		enabled: true,
+	}
+}
+
+// defaultRateLimitPolicies protect the credential endpoints, allow more
+// reads than writes and exempt health checks. RATE_LIMIT requests per
+// RATE_WINDOW seconds applies to everything else.
+func defaultRateLimitPolicies() []*RateLimitPolicy {
+	limit := getEnvInt("RATE_LIMIT", 100)
+	window := time.Duration(getEnvInt("RATE_WINDOW", 60)) * time.Second
+
+	return []*RateLimitPolicy{
+		{Name: "health", Routes: []string{"/health", "/health/*", "/ready", "/metrics"}, Limit: 0},
+		{Name: "auth", Methods: []string{"POST"}, Routes: []string{"/api/v1/auth/login", "/api/v1/auth/register", "/api/v1/auth/refresh"}, Limit: 10, Period: "1m", Burst: 5, Key: "ip"},
+		{Name: "read", Methods: []string{"GET", "HEAD"}, Limit: limit * 3, Period: window.String()},
+		{Name: "default", Limit: limit, Period: window.String()},
+	}
+}
+
+// defaultRateLimitPlans are the API key plans
+func defaultRateLimitPlans() []*RateLimitPlan {
+	return []*RateLimitPlan{
+		{Name: "free", Multiplier: 1},
+		{Name: "pro", Multiplier: 5},
+		{Name: "enterprise", Multiplier: 20},
+	}
 }
 
-var rateLimiter = &RateLimiter{
-	requests: make(map[string][]time.Time),
-	limit:    100, // 100 requests
-	window:   time.Minute,
+// Configure validates and installs policies and plans. The last policy
+// should match every request; requests matching none are not limited.
+func (rl *RateLimiter) Configure(policies []*RateLimitPolicy, plans []*RateLimitPlan) error {
+	names := map[string]bool{}
+	for _, policy := range policies {
+		if policy.Name == "" {
+			return fmt.Errorf("rate limit policy is missing a name")
+		}
+		if names[policy.Name] {
+			return fmt.Errorf("duplicate rate limit policy %s", policy.Name)
+		}
+		names[policy.Name] = true
+
+		if policy.Limit < 0 || policy.Burst < 0 {
+			return fmt.Errorf("policy %s: limit and burst must not be negative", policy.Name)
+		}
+		period, err := parseRuleDuration(policy.Period, time.Minute)
+		if err != nil || period <= 0 {
+			return fmt.Errorf("policy %s: invalid period %q", policy.Name, policy.Period)
+		}
+		policy.period = period
+		policy.Period = period.String()
+		if policy.Burst == 0 {
+			policy.Burst = policy.Limit
+		}
+		switch policy.Key {
+		case "":
+			policy.Key = "identity"
+		case "identity", "ip":
+		default:
+			return fmt.Errorf("policy %s: key must be identity or ip", policy.Name)
+		}
+	}
+
+	planMap := make(map[string]*RateLimitPlan, len(plans))
+	for _, plan := range plans {
+		if plan.Name == "" || plan.Multiplier <= 0 {
+			return fmt.Errorf("rate limit plan %q needs a name and a positive multiplier", plan.Name)
+		}
+		planMap[plan.Name] = plan
+	}
+
+	rl.mu.Lock()
+	rl.policies = policies
+	rl.plans = planMap
+	rl.mu.Unlock()
+	return nil
 }
 
-// checkRateLimit checks if IP has exceeded rate limit
-func (rl *RateLimiter) checkRateLimit(ip string) bool {
+// HasPlan reports whether an API key plan exists
+func (rl *RateLimiter) HasPlan(name string) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
-	windowStart := now.Add(-rl.window)
+	_, ok := rl.plans[name]
+	return ok
+}
 
-	// Get existing requests for this IP
-	requests := rl.requests[ip]
+// policy returns the first policy matching a request
+func (rl *RateLimiter) policy(method, route string) *RateLimitPolicy {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-	// Filter out old requests
-	var validRequests []time.Time
-	for _, reqTime := range requests {
-		if reqTime.After(windowStart) {
-			validRequests = append(validRequests, reqTime)
+	for _, policy := range rl.policies {
+		if policy.matches(method, route) {
+			return policy
 		}
 	}
+	return nil
+}
+
+// scaled returns a policy's limit and burst for an API key plan
+func (rl *RateLimiter) scaled(policy *RateLimitPolicy, plan string) (limit, burst int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limit, burst = policy.Limit, policy.Burst
+	if p, ok := rl.plans[plan]; ok {
+		limit = int(math.Ceil(float64(limit) * p.Multiplier))
+		burst = int(math.Ceil(float64(burst) * p.Multiplier))
+	}
+	return limit, burst
+}
 
-	// Check if limit exceeded
-	if len(validRequests) >= rl.limit {
-		return false
+// take checks a bucket and, when consume is set, spends one request from it
+func (rl *RateLimiter) take(key string, limit, burst int, period time.Duration, consume bool) rateLimitResult {
+	interval := period / time.Duration(limit)
+	tolerance := interval * time.Duration(burst)
+
+	allowed, retryAfter, reset, err := rl.store.Take(key, interval, tolerance, consume)
+	if err != nil {
+		if rl.errors.Add(1)%100 == 1 {
+			log.Printf("Rate limit store failed, allowing request: %v", err)
+		}
+		return rateLimitResult{Allowed: true, Limit: limit, Remaining: burst}
 	}
 
-	// Add current request
-	validRequests = append(validRequests, now)
-	rl.requests[ip] = validRequests
+	result := rateLimitResult{Allowed: allowed, Limit: limit, RetryAfter: retryAfter, Reset: reset}
+	if allowed {
+		result.Remaining = int((tolerance - reset) / interval)
+	}
+	return result
+}
 
-	return true
+// Check spends one request of the identity's bucket for a policy
+func (rl *RateLimiter) Check(policy *RateLimitPolicy, identity, plan string) rateLimitResult {
+	limit, burst := rl.scaled(policy, plan)
+	return rl.take(policy.Name+"|"+identity, limit, burst, policy.period, true)
 }
 
-// getRateLimitInfo returns rate limit info for IP
-func (rl *RateLimiter) getRateLimitInfo(ip string) (int, int, time.Time) {
-	rl.mu.RLock()
-	defer rl.mu.RUnlock()
+// Peek reports an identity's bucket for a policy without spending from it
+func (rl *RateLimiter) Peek(policy *RateLimitPolicy, identity, plan string) rateLimitResult {
+	limit, burst := rl.scaled(policy, plan)
+	return rl.take(policy.Name+"|"+identity, limit, burst, policy.period, false)
+}
 
-	now := time.Now()
-	windowStart := now.Add(-rl.window)
+// Policies returns the configured policies and plans
+func (rl *RateLimiter) Policies() ([]*RateLimitPolicy, []*RateLimitPlan) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	plans := make([]*RateLimitPlan, 0, len(rl.plans))
+	for _, plan := range rl.plans {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Multiplier < plans[j].Multiplier })
+	return rl.policies, plans
+}
 
-	requests := rl.requests[ip]
-	var validCount int
-	var oldestRequest time.Time
+// loadRateLimitConfig reads policies and plans from a YAML file
+func loadRateLimitConfig(path string) ([]*RateLimitPolicy, []*RateLimitPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for _, reqTime := range requests {
-		if reqTime.After(windowStart) {
-			validCount++
-			if oldestRequest.IsZero() || reqTime.Before(oldestRequest) {
-				oldestRequest = reqTime
-			}
+	var doc struct {
+		Policies []*RateLimitPolicy `yaml:"policies"`
+		Plans    []*RateLimitPlan   `yaml:"plans"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Policies) == 0 {
+		doc.Policies = defaultRateLimitPolicies()
+	}
+	if len(doc.Plans) == 0 {
+		doc.Plans = defaultRateLimitPlans()
+	}
+	return doc.Policies, doc.Plans, nil
+}
+
+// configureRateLimiter selects the bucket store from RATE_LIMIT_BACKEND and
+// installs the built-in policies or those from RATE_LIMIT_POLICIES_FILE
+func configureRateLimiter() {
+	rateLimiter.enabled = getEnvBool("ENABLE_RATE_LIMITING", true)
+
+	switch backend := getEnv("RATE_LIMIT_BACKEND", "memory"); backend {
+	case "memory":
+	case "redis":
+		rateLimiter.store = newRedisRateLimitStore(sharedRedis())
+		rateLimiter.backend = backend
+	default:
+		log.Fatalf("Unknown RATE_LIMIT_BACKEND %q (memory or redis)", backend)
+	}
+
+	policies, plans := defaultRateLimitPolicies(), defaultRateLimitPlans()
+	if path := getEnv("RATE_LIMIT_POLICIES_FILE", ""); path != "" {
+		var err error
+		policies, plans, err = loadRateLimitConfig(path)
+		if err != nil {
+			log.Fatalf("Failed to load rate limit policies from %s: %v", path, err)
 		}
 	}
 
-	remaining := rl.limit - validCount
-	if remaining < 0 {
-		remaining = 0
+	if err := rateLimiter.Configure(policies, plans); err != nil {
+		log.Fatalf("Invalid rate limit policies: %v", err)
 	}
+}
+
+// rateLimitIdentity returns who a request is limited as: a valid API key,
+// then a signed-in user, then the client IP. Invalid credentials fall back
+// to the IP so they cannot be used to mint fresh buckets.
+func rateLimitIdentity(c *gin.Context) (identity, plan string) {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		apiKeysMux.RLock()
+		apiKey, exists := apiKeys[key]
+		apiKeysMux.RUnlock()
+
+		if exists && apiKey.Enabled && time.Now().Before(apiKey.ExpiresAt) {
+			return "key:" + apiKey.ID, apiKey.Plan
+		}
+	}
+
+	if token := bearerToken(c.GetHeader("Authorization")); token != "" {
+		usersMux.RLock()
+		session, exists := sessions[token]
+		usersMux.RUnlock()
+
+		if exists && time.Now().Before(session.ExpiresAt) {
+			return "user:" + session.UserID, ""
+		}
+	}
+
+	return "ip:" + c.ClientIP(), ""
+}
 
-	var resetTime time.Time
-	if !oldestRequest.IsZero() {
-		resetTime = oldestRequest.Add(rl.window)
+// requestRoute returns the matched route template, or the path for requests
+// that matched no route
+func requestRoute(c *gin.Context) string {
+	if route := c.FullPath(); route != "" {
+		return route
 	}
+	return c.Request.URL.Path
+}
 
-	return validCount, remaining, resetTime
+// setRateLimitHeaders describes the caller's bucket for a policy
+func setRateLimitHeaders(c *gin.Context, policy *RateLimitPolicy, result rateLimitResult) {
+	c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("X-RateLimit-Reset", time.Now().Add(result.Reset).Format(time.RFC3339))
+	c.Header("X-RateLimit-Policy", fmt.Sprintf("%s;q=%d;w=%d", policy.Name, result.Limit, int(policy.period.Seconds())))
 }
 
-// rateLimitMiddleware enforces rate limiting
+// rateLimitMiddleware enforces the first policy matching each request
 func rateLimitMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ip := c.ClientIP()
+		if !rateLimiter.enabled {
+			c.Next()
+			return
+		}
 
-		if !rateLimiter.checkRateLimit(ip) {
-			used, _, resetTime := rateLimiter.getRateLimitInfo(ip)
+		policy := rateLimiter.policy(c.Request.Method, requestRoute(c))
+		if policy == nil || policy.Limit == 0 {
+			c.Next()
+			return
+		}
 
-			c.Header("X-RateLimit-Limit", "100")
-			c.Header("X-RateLimit-Remaining", "0")
-			c.Header("X-RateLimit-Reset", resetTime.Format(time.RFC3339))
+		identity, plan := rateLimitIdentity(c)
+		if policy.Key == "ip" {
+			identity, plan = "ip:"+c.ClientIP(), ""
+		}
+
+		result := rateLimiter.Check(policy, identity, plan)
+		setRateLimitHeaders(c, policy, result)
 
+		if !result.Allowed {
+			retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			rateLimitRejectionsTotal.WithLabelValues(policy.Name).Inc()
 			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error":   "Rate limit exceeded",
-				"message": "Too many requests. Please try again later.",
-				"limit":   rateLimiter.limit,
-				"used":    used,
-				"reset":   resetTime.Format(time.RFC3339),
+				"error":       "Rate limit exceeded",
+				"message":     "Too many requests. Please try again later.",
+				"policy":      policy.Name,
+				"limit":       result.Limit,
+				"period":      policy.Period,
+				"retry_after": retryAfter,
 			})
 			c.Abort()
 			return
 		}
 
-		// Add rate limit headers
-		_, remaining, resetTime := rateLimiter.getRateLimitInfo(ip)
-		c.Header("X-RateLimit-Limit", "100")
-		c.Header("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
-		c.Header("X-RateLimit-Reset", resetTime.Format(time.RFC3339))
-
 		c.Next()
 	}
 }
 
-// getRateLimitStatus returns current rate limit status
+// getRateLimitStatus returns the caller's remaining requests under every policy
 func getRateLimitStatus(c *gin.Context) {
-	ip := c.ClientIP()
-	used, remaining, resetTime := rateLimiter.getRateLimitInfo(ip)
+	identity, plan := rateLimitIdentity(c)
+	policies, _ := rateLimiter.Policies()
+
+	status := make([]gin.H, 0, len(policies))
+	for _, policy := range policies {
+		if policy.Limit == 0 {
+			continue
+		}
+		id, p := identity, plan
+		if policy.Key == "ip" {
+			id, p = "ip:"+c.ClientIP(), ""
+		}
+		result := rateLimiter.Peek(policy, id, p)
+		status = append(status, gin.H{
+			"policy":    policy.Name,
+			"limit":     result.Limit,
+			"period":    policy.Period,
+			"remaining": result.Remaining,
+			"reset":     time.Now().Add(result.Reset).Format(time.RFC3339),
+		})
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"ip":        ip,
-		"limit":     rateLimiter.limit,
-		"used":      used,
-		"remaining": remaining,
-		"reset":     resetTime.Format(time.RFC3339),
-		"window":    rateLimiter.window.String(),
+		"identity": identity,
+		"ip":       c.ClientIP(),
+		"plan":     plan,
+		"enabled":  rateLimiter.enabled,
+		"policies": status,
+	})
+}
+
+// getRateLimitPolicies lists the configured policies and API key plans (admin only)
+func getRateLimitPolicies(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	policies, plans := rateLimiter.Policies()
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":  rateLimiter.enabled,
+		"backend":  rateLimiter.backend,
+		"policies": policies,
+		"plans":    plans,
 	})
 }
 
 // Cleanup old rate limit data periodically
 func startRateLimitCleanup() {
+	configureRateLimiter()
+
 	ticker := time.NewTicker(5 * time.Minute)
 	go func() {
 		for range ticker.C {
-			rateLimiter.mu.Lock()
-			now := time.Now()
-			windowStart := now.Add(-rateLimiter.window)
-
-			for ip, requests := range rateLimiter.requests {
-				var validRequests []time.Time
-				for _, reqTime := range requests {
-					if reqTime.After(windowStart) {
-						validRequests = append(validRequests, reqTime)
-					}
-				}
-
-				if len(validRequests) == 0 {
-					delete(rateLimiter.requests, ip)
-				} else {
-					rateLimiter.requests[ip] = validRequests
-				}
-			}
-			rateLimiter.mu.Unlock()
+			rateLimiter.store.Cleanup()
 		}
 	}()
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// createTestAPIKey creates an API key through the API and returns it
+func createTestAPIKey(t *testing.T, router http.Handler, token, plan string) string {
+	t.Helper()
+
+	w := doRequest(t, router, http.MethodPost, "/api/v1/api-keys", map[string]string{"name": "test", "plan": plan}, bearer(token)...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating %q API key = %d, want 201: %s", plan, w.Code, w.Body)
+	}
+	key := decodeBody(t, w)["key"].(string)
+	t.Cleanup(func() {
+		apiKeysMux.Lock()
+		delete(apiKeys, key)
+		apiKeysMux.Unlock()
+	})
+	return key
+}
+
+// useTestRateLimiter replaces the global rate limiter for one test
+func useTestRateLimiter(t *testing.T, policies []*RateLimitPolicy) {
+	t.Helper()
+
+	previous := rateLimiter
+	rateLimiter = newRateLimiter()
+	if err := rateLimiter.Configure(policies, defaultRateLimitPlans()); err != nil {
+		t.Fatalf("configuring rate limiter: %v", err)
+	}
+	t.Cleanup(func() { rateLimiter = previous })
+}
+
+func TestAPIKeyPlanRequiresAdmin(t *testing.T) {
+	router := newRouter()
+	useTestRateLimiter(t, defaultRateLimitPolicies())
+	_, analystToken := testUser(t, "analyst")
+	_, adminToken := testUser(t, "admin")
+
+	w := doRequest(t, router, http.MethodPost, "/api/v1/api-keys", map[string]string{"name": "test", "plan": "pro"}, bearer(analystToken)...)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("analyst creating a pro key = %d, want 403", w.Code)
+	}
+	w = doRequest(t, router, http.MethodPost, "/api/v1/api-keys", map[string]string{"name": "test", "plan": "platinum"}, bearer(adminToken)...)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("creating a key with an unknown plan = %d, want 400", w.Code)
+	}
+	createTestAPIKey(t, router, adminToken, "pro")
+}
+
+func TestAPIKeyPlanRaisesLimit(t *testing.T) {
+	router := newRouter()
+	// Only reads are limited, so creating the keys is not
+	useTestRateLimiter(t, []*RateLimitPolicy{{Name: "read", Methods: []string{"GET"}, Limit: 2, Period: "1h"}})
+	_, adminToken := testUser(t, "admin")
+	freeKey := createTestAPIKey(t, router, adminToken, "")
+	proKey := createTestAPIKey(t, router, adminToken, "pro")
+
+	// allowed counts the requests a key gets before being limited
+	allowed := func(key string) int {
+		for n := 0; n < 100; n++ {
+			w := doRequest(t, router, http.MethodGet, "/api/v1/me", nil, "X-API-Key", key)
+			if w.Code == http.StatusTooManyRequests {
+				return n
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /me = %d, want 200 or 429: %s", w.Code, w.Body)
+			}
+		}
+		return 100
+	}
+
+	if n := allowed(freeKey); n != 2 {
+		t.Errorf("free key allowed %d requests, want 2", n)
+	}
+	// The pro plan multiplies limits by 5
+	if n := allowed(proKey); n != 10 {
+		t.Errorf("pro key allowed %d requests, want 10", n)
+	}
+}
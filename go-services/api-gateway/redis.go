@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisOnce    sync.Once
+	redisConn    *redis.Client
+	redisPrefix  = getEnv("REDIS_KEY_PREFIX", "netguard:")
+	redisTimeout = getEnvDuration("REDIS_TIMEOUT", 250*time.Millisecond)
+)
+
+// sharedRedis returns the client used by the Redis cache and rate limit
+// backends, connecting to REDIS_URL or REDIS_HOST/REDIS_PORT/REDIS_PASSWORD.
+// An unreachable server is not fatal: the client reconnects on its own and
+// callers fail open until it does.
+func sharedRedis() *redis.Client {
+	redisOnce.Do(func() {
+		opts := &redis.Options{
+			Addr:     getEnv("REDIS_HOST", "localhost") + ":" + getEnv("REDIS_PORT", "6379"),
+			Password: getEnv("REDIS_PASSWORD", ""),
+		}
+		if url := getEnv("REDIS_URL", ""); url != "" {
+			var err error
+			if opts, err = redis.ParseURL(url); err != nil {
+				log.Fatalf("Invalid REDIS_URL: %v", err)
+			}
+		}
+		opts.DialTimeout = 2 * time.Second
+		opts.ReadTimeout = redisTimeout
+		opts.WriteTimeout = redisTimeout
+
+		redisConn = redis.NewClient(opts)
+
+		// The cache and rate limits fail open, so Redis being down degrades
+		// the gateway without making it unready
+		registerHealthCheck(HealthCheck{
+			Name:      "redis",
+			Readiness: true,
+			Timeout:   time.Second,
+			Check: func(ctx context.Context) (gin.H, error) {
+				start := time.Now()
+				if err := redisConn.Ping(ctx).Err(); err != nil {
+					return nil, err
+				}
+				return gin.H{"latency_ms": milliseconds(time.Since(start).Seconds())}, nil
+			},
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := redisConn.Ping(ctx).Err(); err != nil {
+			log.Printf("Redis at %s is unreachable, shared cache and rate limits fail open until it recovers: %v", opts.Addr, err)
+		} else {
+			log.Printf("Connected to Redis at %s", opts.Addr)
+		}
+	})
+	return redisConn
+}
+
+// redisContext bounds a single Redis call
+func redisContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisTimeout)
+}
+
+// escapeRedisPattern escapes glob characters so a key prefix can be used
+// with SCAN MATCH
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, ch := range s {
+		switch ch {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+// redisCache is the cache backend shared by all gateway replicas
+type redisCache struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisCache(client *redis.Client) *redisCache {
+	return &redisCache{client: client, prefix: redisPrefix + "cache:"}
+}
+
+func (r *redisCache) Get(key string) ([]byte, bool, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	value, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (r *redisCache) Set(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	return r.client.Set(ctx, r.prefix+key, value, ttl).Err()
+}
+
+func (r *redisCache) Delete(key string) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// DeletePrefix scans for matching keys in batches rather than blocking the
+// server with KEYS. Keys are unlinked once the scan is complete: deleting
+// while scanning may make the cursor skip keys on some servers.
+func (r *redisCache) DeletePrefix(prefix string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisTimeout)
+	defer cancel()
+
+	var keys []string
+	iter := r.client.Scan(ctx, 0, escapeRedisPattern(r.prefix+prefix)+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 500)]
+		if err := r.client.Unlink(ctx, batch...).Err(); err != nil {
+			return err
+		}
+		keys = keys[len(batch):]
+	}
+	return nil
+}
+
+// Cleanup is a no-op: Redis expires keys itself
+func (r *redisCache) Cleanup() {}
+
+func (r *redisCache) Stats() map[string]interface{} {
+	stats := map[string]interface{}{"backend": "redis"}
+
+	ctx, cancel := redisContext()
+	defer cancel()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		stats["status"] = "unreachable"
+		stats["error"] = err.Error()
+	} else {
+		stats["status"] = "connected"
+	}
+	return stats
+}
+
+// gcraScript runs one GCRA step atomically on the server, using the server's
+// clock so replicas with skewed clocks agree. Times are in microseconds.
+var gcraScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tat = tonumber(redis.call("GET", KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local allow_at = tat + interval - tolerance
+if now < allow_at then
+	return {0, allow_at - now, tat - now}
+end
+if ARGV[3] == "1" then
+	tat = tat + interval
+	redis.call("SET", KEYS[1], string.format("%d", tat), "PX", math.ceil((tat - now) / 1000))
+end
+return {1, 0, tat - now}
+`)
+
+// redisRateLimitStore keeps rate limit buckets in Redis so every replica
+// enforces the same limits
+type redisRateLimitStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisRateLimitStore(client *redis.Client) *redisRateLimitStore {
+	return &redisRateLimitStore{client: client, prefix: redisPrefix + "ratelimit:"}
+}
+
+func (r *redisRateLimitStore) Take(key string, interval, tolerance time.Duration, consume bool) (bool, time.Duration, time.Duration, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	flag := "0"
+	if consume {
+		flag = "1"
+	}
+	values, err := gcraScript.Run(ctx, r.client, []string{r.prefix + key},
+		interval.Microseconds(), tolerance.Microseconds(), flag).Int64Slice()
+	if err != nil {
+		return true, 0, 0, err
+	}
+	if len(values) != 3 {
+		return true, 0, 0, errors.New("unexpected GCRA script reply")
+	}
+	return values[0] == 1, time.Duration(values[1]) * time.Microsecond, time.Duration(values[2]) * time.Microsecond, nil
+}
+
+// Cleanup is a no-op: buckets expire once they have refilled
+func (r *redisRateLimitStore) Cleanup() {}
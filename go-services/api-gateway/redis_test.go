@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis starts an in-process Redis server for one test
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// cacheBackends runs a test against every cache backend
+func cacheBackends(t *testing.T, test func(t *testing.T, backend CacheBackend)) {
+	t.Run("memory", func(t *testing.T) { test(t, newMemoryCache(5000)) })
+	t.Run("redis", func(t *testing.T) { test(t, newRedisCache(newTestRedis(t))) })
+}
+
+// rateLimitStores runs a test against every rate limit store
+func rateLimitStores(t *testing.T, test func(t *testing.T, store RateLimitStore)) {
+	t.Run("memory", func(t *testing.T) { test(t, newMemoryRateLimitStore()) })
+	t.Run("redis", func(t *testing.T) { test(t, newRedisRateLimitStore(newTestRedis(t))) })
+}
+
+func TestCacheBackendGetSetDelete(t *testing.T) {
+	cacheBackends(t, func(t *testing.T, backend CacheBackend) {
+		if _, found, err := backend.Get("missing"); found || err != nil {
+			t.Fatalf("Get(missing) = %v, %v; want not found", found, err)
+		}
+		if err := backend.Set("key", []byte("value"), time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		value, found, err := backend.Get("key")
+		if !found || err != nil || string(value) != "value" {
+			t.Fatalf("Get(key) = %q, %v, %v; want value", value, found, err)
+		}
+		if err := backend.Delete("key"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, found, _ := backend.Get("key"); found {
+			t.Fatal("key still cached after Delete")
+		}
+	})
+}
+
+func TestCacheBackendDeletePrefix(t *testing.T) {
+	cacheBackends(t, func(t *testing.T, backend CacheBackend) {
+		// More keys than one SCAN batch, so Redis deletes in several batches
+		for i := 0; i < 1200; i++ {
+			backend.Set(fmt.Sprintf("alerts:%d", i), []byte("x"), time.Minute)
+		}
+		kept := []string{"alertsx", "threats:1", "a*:1", "a[1]"}
+		for _, key := range kept {
+			backend.Set(key, []byte("x"), time.Minute)
+		}
+
+		if err := backend.DeletePrefix("alerts:"); err != nil {
+			t.Fatalf("DeletePrefix: %v", err)
+		}
+		for _, i := range []int{0, 499, 500, 1199} {
+			if _, found, _ := backend.Get(fmt.Sprintf("alerts:%d", i)); found {
+				t.Errorf("alerts:%d survived DeletePrefix(alerts:)", i)
+			}
+		}
+
+		// Glob characters in the prefix match literally
+		if err := backend.DeletePrefix("a*"); err != nil {
+			t.Fatalf("DeletePrefix: %v", err)
+		}
+		if err := backend.DeletePrefix("a["); err != nil {
+			t.Fatalf("DeletePrefix: %v", err)
+		}
+		for _, key := range kept {
+			_, found, _ := backend.Get(key)
+			if want := key[:2] != "a*" && key[:2] != "a["; found != want {
+				t.Errorf("%s cached = %v after deleting prefixes, want %v", key, found, want)
+			}
+		}
+	})
+}
+
+func TestRateLimitStoreGCRA(t *testing.T) {
+	rateLimitStores(t, func(t *testing.T, store RateLimitStore) {
+		// A burst of three, then one request an hour
+		interval, tolerance := time.Hour, 3*time.Hour
+
+		for i := 0; i < 3; i++ {
+			if allowed, _, _, err := store.Take("bucket", interval, tolerance, true); !allowed || err != nil {
+				t.Fatalf("request %d of the burst = %v, %v; want allowed", i+1, allowed, err)
+			}
+		}
+
+		allowed, retryAfter, reset, err := store.Take("bucket", interval, tolerance, true)
+		if allowed || err != nil {
+			t.Fatalf("request after the burst = %v, %v; want rejected", allowed, err)
+		}
+		if retryAfter <= interval-time.Minute || retryAfter > interval {
+			t.Errorf("retry after %s, want about %s", retryAfter, interval)
+		}
+		if reset <= tolerance-time.Minute || reset > tolerance {
+			t.Errorf("reset %s, want about %s", reset, tolerance)
+		}
+
+		// Other keys have their own bucket
+		if allowed, _, _, _ := store.Take("other", interval, tolerance, true); !allowed {
+			t.Error("a fresh bucket rejected its first request")
+		}
+	})
+}
+
+func TestRateLimitStorePeek(t *testing.T) {
+	rateLimitStores(t, func(t *testing.T, store RateLimitStore) {
+		interval, tolerance := time.Hour, time.Hour
+
+		for i := 0; i < 3; i++ {
+			if allowed, _, _, _ := store.Take("bucket", interval, tolerance, false); !allowed {
+				t.Fatalf("peek %d = rejected, want allowed without spending", i+1)
+			}
+		}
+		if allowed, _, _, _ := store.Take("bucket", interval, tolerance, true); !allowed {
+			t.Fatal("first request after peeking = rejected, want allowed")
+		}
+		if allowed, _, _, _ := store.Take("bucket", interval, tolerance, false); allowed {
+			t.Fatal("peek at a spent bucket = allowed, want rejected")
+		}
+	})
+}
+
+func TestRateLimitStoreRefills(t *testing.T) {
+	rateLimitStores(t, func(t *testing.T, store RateLimitStore) {
+		interval := 50 * time.Millisecond
+
+		if allowed, _, _, _ := store.Take("bucket", interval, interval, true); !allowed {
+			t.Fatal("first request = rejected, want allowed")
+		}
+		if allowed, _, _, _ := store.Take("bucket", interval, interval, true); allowed {
+			t.Fatal("second request within the interval = allowed, want rejected")
+		}
+		time.Sleep(2 * interval)
+		if allowed, _, _, _ := store.Take("bucket", interval, interval, true); !allowed {
+			t.Fatal("request after the interval = rejected, want allowed")
+		}
+	})
+}
+
+func TestCacheEndpointsRequireAdmin(t *testing.T) {
+	saved := cache
+	cache = &Cache{backend: newRedisCache(newTestRedis(t))}
+	t.Cleanup(func() { cache = saved })
+
+	router := newRouter()
+	_, adminToken := testUser(t, "admin")
+	_, analystToken := testUser(t, "analyst")
+
+	if w := doRequest(t, router, http.MethodGet, "/api/v1/cache/stats", nil, bearer(analystToken)...); w.Code != http.StatusForbidden {
+		t.Errorf("analyst GET /cache/stats = %d, want 403", w.Code)
+	}
+	if w := doRequest(t, router, http.MethodPost, "/api/v1/cache/clear", nil, bearer(analystToken)...); w.Code != http.StatusForbidden {
+		t.Errorf("analyst POST /cache/clear = %d, want 403", w.Code)
+	}
+
+	w := doRequest(t, router, http.MethodGet, "/api/v1/cache/stats", nil, bearer(adminToken)...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin GET /cache/stats = %d, want 200: %s", w.Code, w.Body)
+	}
+	stats := decodeBody(t, w)
+	if stats["backend"] != "redis" || stats["status"] != "connected" {
+		t.Errorf("stats = %v, want a connected redis backend", stats)
+	}
+	if _, exposed := stats["address"]; exposed {
+		t.Errorf("stats expose the Redis address: %v", stats)
+	}
+	if w := doRequest(t, router, http.MethodPost, "/api/v1/cache/clear", nil, bearer(adminToken)...); w.Code != http.StatusOK {
+		t.Errorf("admin POST /cache/clear = %d, want 200: %s", w.Code, w.Body)
+	}
+}
@@ -140,22 +140,11 @@ func generateNetworkReport(c *gin.Context) {
 		Format: "json",
 		Status: "completed",
 		Data: map[string]interface{}{
-			"interfaces": []gin.H{
-				{"name": "eth0", "packets": 1523400, "bytes": 1024000000, "errors": 0},
-				{"name": "eth1", "packets": 856200, "bytes": 512000000, "errors": 2},
-			},
-			"top_protocols": []gin.H{
-				{"protocol": "HTTPS", "percentage": 65.5},
-				{"protocol": "HTTP", "percentage": 20.3},
-				{"protocol": "SSH", "percentage": 8.2},
-				{"protocol": "DNS", "percentage": 6.0},
-			},
-			"bandwidth_usage": []gin.H{
-				{"hour": "00:00", "inbound": 125.5, "outbound": 87.3},
-				{"hour": "06:00", "inbound": 234.2, "outbound": 156.8},
-				{"hour": "12:00", "inbound": 456.7, "outbound": 298.4},
-				{"hour": "18:00", "inbound": 389.1, "outbound": 245.6},
-			},
+			"interfaces":      flowStats.Interfaces(),
+			"top_protocols":   flowStats.TopProtocols(10),
+			"top_endpoints":   flowStats.TopEndpoints(10),
+			"bandwidth_usage": flowStats.HourlyBandwidth(),
+			"totals":          flowStats.Totals(),
 		},
 		GeneratedAt: time.Now(),
 		GeneratedBy: fmt.Sprintf("%v", userID),
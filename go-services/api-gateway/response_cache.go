@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseCacheEnabled turns the response cache off without touching routes
+var responseCacheEnabled = getEnvBool("RESPONSE_CACHE_ENABLED", true)
+
+// responseGroup is a set of cached routes that go stale together. Writes to
+// any of its resources drop every cached response in the group.
+type responseGroup struct {
+	name      string
+	resources map[string]bool
+	// epoch changes on every invalidation so a response computed before a
+	// write is not stored after the write has invalidated the group
+	epoch atomic.Int64
+}
+
+var (
+	responseGroups    = map[string]*responseGroup{}
+	responseGroupsMux sync.RWMutex
+)
+
+// cachedResponse is what the response cache stores for one request
+type cachedResponse struct {
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	StoredAt    time.Time `json:"stored_at"`
+}
+
+// responseRecorder keeps a copy of the body written by the handler
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// registerResponseGroup returns the named group, adding resources to the
+// ones that invalidate it
+func registerResponseGroup(name string, resources []string) *responseGroup {
+	responseGroupsMux.Lock()
+	defer responseGroupsMux.Unlock()
+
+	group, exists := responseGroups[name]
+	if !exists {
+		group = &responseGroup{name: name, resources: map[string]bool{}}
+		responseGroups[name] = group
+	}
+	for _, resource := range resources {
+		group.resources[resource] = true
+	}
+	return group
+}
+
+// responseCacheKey scopes a response to the group, the caller and the exact
+// path and query. Query parameters are sorted so their order does not matter.
+func responseCacheKey(group string, c *gin.Context) string {
+	scope := "anonymous"
+	if userID, exists := c.Get("user_id"); exists {
+		scope = fmt.Sprint(userID)
+	}
+	key := "response:" + group + ":" + scope + ":" + c.Request.URL.Path
+	if query := c.Request.URL.Query(); len(query) > 0 {
+		key += "?" + query.Encode()
+	}
+	return key
+}
+
+// cacheResponse caches successful GET responses of a route for ttl, which
+// CACHE_TTL_<GROUP> overrides. Responses are invalidated early when an event
+// for one of resources is published. Clients can skip the lookup with
+// Cache-Control: no-cache.
+func cacheResponse(group string, ttl time.Duration, resources ...string) gin.HandlerFunc {
+	ttl = getEnvDuration("CACHE_TTL_"+strings.ToUpper(group), ttl)
+	g := registerResponseGroup(group, resources)
+
+	return func(c *gin.Context) {
+		if !responseCacheEnabled || ttl <= 0 || c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+
+		key := responseCacheKey(group, c)
+		if !strings.Contains(c.GetHeader("Cache-Control"), "no-cache") {
+			end := traceData(c.Request.Context(), "cache.get")
+			data, ok := cache.Get(key)
+			end()
+			if ok {
+				var entry cachedResponse
+				if err := json.Unmarshal(data, &entry); err == nil {
+					c.Header("X-Cache", "HIT")
+					c.Header("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+					c.Data(entry.Status, entry.ContentType, entry.Body)
+					c.Abort()
+					return
+				}
+				cache.Delete(key)
+			}
+		}
+
+		epoch := g.epoch.Load()
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Header("X-Cache", "MISS")
+		c.Next()
+
+		if recorder.Status() != http.StatusOK || g.epoch.Load() != epoch {
+			return
+		}
+		data, err := json.Marshal(cachedResponse{
+			Status:      recorder.Status(),
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+			StoredAt:    time.Now(),
+		})
+		if err != nil {
+			return
+		}
+		defer traceData(c.Request.Context(), "cache.set")()
+		cache.Set(key, data, ttl)
+		// A write that landed between the check above and the Set has
+		// already deleted the group; drop what was just stored too
+		if g.epoch.Load() != epoch {
+			cache.Delete(key)
+		}
+	}
+}
+
+// invalidateResponses drops cached responses made stale by a write. It runs
+// in publishEvent rather than as a bus subscriber, so the write's response is
+// not sent before the cache forgets the old data. A restored backup replaces
+// all data, so it invalidates every group.
+func invalidateResponses(eventType, resource string) {
+	responseGroupsMux.RLock()
+	defer responseGroupsMux.RUnlock()
+
+	for name, group := range responseGroups {
+		if group.resources[resource] || eventType == EventBackupRestored {
+			group.epoch.Add(1)
+			invalidateCache("response:" + name + ":")
+		}
+	}
+}
+
+// expireResponseGroups marks every group stale, so responses being computed
+// while the cache is cleared are not stored afterwards
+func expireResponseGroups() {
+	responseGroupsMux.RLock()
+	defer responseGroupsMux.RUnlock()
+
+	for _, group := range responseGroups {
+		group.epoch.Add(1)
+	}
+}
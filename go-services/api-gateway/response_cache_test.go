@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useTestCache gives the test an empty in-memory cache
+func useTestCache(t *testing.T) {
+	t.Helper()
+
+	saved := cache
+	cache = &Cache{backend: newMemoryCache(100)}
+	t.Cleanup(func() { cache = saved })
+}
+
+// cacheStatus GETs path and returns its X-Cache header
+func cacheStatus(t *testing.T, router http.Handler, path, token string) string {
+	t.Helper()
+
+	w := doRequest(t, router, http.MethodGet, path, nil, bearer(token)...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d: %s", path, w.Code, w.Body)
+	}
+	return w.Header().Get("X-Cache")
+}
+
+func TestResponseCacheKeyScoping(t *testing.T) {
+	useTestCache(t)
+	router := newRouter()
+	_, alice := testUser(t, "analyst")
+	_, bob := testUser(t, "analyst")
+
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", alice); got != "MISS" {
+		t.Errorf("alice's first GET = %s, want MISS", got)
+	}
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", alice); got != "HIT" {
+		t.Errorf("alice's second GET = %s, want HIT", got)
+	}
+	// Responses are cached per caller, never shared between users
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", bob); got != "MISS" {
+		t.Errorf("bob's first GET = %s, want MISS", got)
+	}
+
+	if got := cacheStatus(t, router, "/api/v1/analytics/timeseries/alerts?interval=hour&range=24h", alice); got != "MISS" {
+		t.Errorf("first timeseries GET = %s, want MISS", got)
+	}
+	if got := cacheStatus(t, router, "/api/v1/analytics/timeseries/alerts?range=24h&interval=hour", alice); got != "HIT" {
+		t.Errorf("timeseries GET with reordered query = %s, want HIT", got)
+	}
+	if got := cacheStatus(t, router, "/api/v1/analytics/timeseries/alerts?range=7d&interval=hour", alice); got != "MISS" {
+		t.Errorf("timeseries GET with another range = %s, want MISS", got)
+	}
+}
+
+func TestWriteInvalidatesResponsesImmediately(t *testing.T) {
+	useTestCache(t)
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+
+	cacheStatus(t, router, "/api/v1/dashboard/stats", token)
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", token); got != "HIT" {
+		t.Fatalf("second GET = %s, want HIT", got)
+	}
+
+	// No waiting for the event bus: the next read must already miss
+	createResource(t, router, token, "/api/v1/alerts", map[string]string{"title": "cached", "description": "test", "severity": "low"})
+	if got := cacheStatus(t, router, "/api/v1/dashboard/stats", token); got != "MISS" {
+		t.Errorf("GET after creating an alert = %s, want MISS", got)
+	}
+}
+
+func TestCacheClearExpiresResponseGroups(t *testing.T) {
+	useTestCache(t)
+	group := registerResponseGroup("dashboard", nil)
+	epoch := group.epoch.Load()
+
+	cache.Set("response:dashboard:user_1:/api/v1/dashboard/stats", []byte("{}"), time.Minute)
+	cache.Clear()
+
+	if group.epoch.Load() == epoch {
+		t.Error("Clear left the dashboard group's epoch unchanged")
+	}
+	if _, ok := cache.Get("response:dashboard:user_1:/api/v1/dashboard/stats"); ok {
+		t.Error("response still cached after Clear")
+	}
+}
+
+func TestMemoryCacheLRUBound(t *testing.T) {
+	m := newMemoryCache(3)
+	for _, key := range []string{"a", "b", "c"} {
+		m.Set(key, []byte(key), time.Minute)
+	}
+	m.Get("a") // a becomes the most recently used
+	m.Set("d", []byte("d"), time.Minute)
+
+	if _, found, _ := m.Get("b"); found {
+		t.Error("least recently used key b was not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, found, _ := m.Get(key); !found {
+			t.Errorf("key %s evicted", key)
+		}
+	}
+	stats := m.Stats()
+	if stats["total_items"] != 3 || stats["evictions"] != int64(1) {
+		t.Errorf("stats = %v, want 3 items and 1 eviction", stats)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Service level objectives applied to every route. A request is good for
+// availability unless it fails with a 5xx, and good for latency when it
+// finishes within the threshold.
+var (
+	sloAvailabilityTarget = sloTarget("SLO_AVAILABILITY_TARGET", 99.9)
+	sloLatencyTarget      = sloTarget("SLO_LATENCY_TARGET", 99)
+	sloLatencyThreshold   = getEnvDuration("SLO_LATENCY_THRESHOLD", 500*time.Millisecond)
+	// sloFastBurnRate is the burn rate that pages: at 14.4 a 30 day error
+	// budget lasts about two days
+	sloFastBurnRate = getEnvFloat("SLO_FAST_BURN_RATE", 14.4)
+)
+
+// sloWindows are the windows burn rates are reported over. A route is
+// alerting only when both burn fast, so a short spike that has already
+// ended does not page.
+var sloWindows = []string{"5m", "1h"}
+
+// sloTarget reads a target percentage, which must leave some error budget
+func sloTarget(key string, fallback float64) float64 {
+	target := getEnvFloat(key, fallback)
+	if target <= 0 || target >= 100 {
+		log.Printf("%s must be between 0 and 100 exclusive, using %v", key, fallback)
+		return fallback
+	}
+	return target
+}
+
+// sloIndicator compares the bad requests in a window to what a target
+// allows. A burn rate of 1 spends the error budget exactly as fast as the
+// target permits; above 1 the budget runs out early.
+func sloIndicator(requests, bad uint64, target float64) gin.H {
+	ratio := float64(0)
+	if requests > 0 {
+		ratio = float64(bad) / float64(requests)
+	}
+	return gin.H{
+		"requests":  requests,
+		"bad":       bad,
+		"good_rate": (1 - ratio) * 100,
+		"burn_rate": ratio / (1 - target/100),
+	}
+}
+
+// routeSLO reports both SLOs of one route over every SLO window
+func routeSLO(windows map[string]*latencySketch) (gin.H, float64, bool) {
+	availability := gin.H{}
+	latency := gin.H{}
+	alertingAvailability, alertingLatency := true, true
+	var hourBurn float64
+
+	for _, window := range sloWindows {
+		sketch := windows[window]
+		if sketch == nil {
+			sketch = newLatencySketch()
+		}
+		a := sloIndicator(sketch.count, sketch.serverErrors, sloAvailabilityTarget)
+		l := sloIndicator(sketch.count, sketch.slow, sloLatencyTarget)
+		availability[window] = a
+		latency[window] = l
+
+		alertingAvailability = alertingAvailability && a["burn_rate"].(float64) >= sloFastBurnRate
+		alertingLatency = alertingLatency && l["burn_rate"].(float64) >= sloFastBurnRate
+		if window == "1h" {
+			hourBurn = max(a["burn_rate"].(float64), l["burn_rate"].(float64))
+		}
+	}
+
+	alerting := alertingAvailability || alertingLatency
+	return gin.H{
+		"availability": availability,
+		"latency":      latency,
+		"alerting":     alerting,
+	}, hourBurn, alerting
+}
+
+// getSLOStatus reports per route error budget burn against the availability
+// and latency SLOs, the routes burning fastest over the last hour first
+func getSLOStatus(c *gin.Context) {
+	byWindow := map[string]map[string]*latencySketch{}
+	routes := map[string]bool{}
+	for _, window := range sloWindows {
+		byWindow[window] = latencySnapshot(latencyWindows[window])
+		for key := range byWindow[window] {
+			routes[key] = true
+		}
+	}
+
+	type entry struct {
+		body gin.H
+		burn float64
+	}
+	var entries []entry
+	alerting := 0
+	for key := range routes {
+		windows := map[string]*latencySketch{}
+		for _, window := range sloWindows {
+			windows[window] = byWindow[window][key]
+		}
+		body, burn, isAlerting := routeSLO(windows)
+		method, endpoint, _ := strings.Cut(key, ":")
+		body["endpoint"] = endpoint
+		body["method"] = method
+		entries = append(entries, entry{body, burn})
+		if isAlerting {
+			alerting++
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].burn > entries[j].burn
+	})
+
+	routeSLOs := make([]gin.H, 0, len(entries))
+	for _, e := range entries {
+		routeSLOs = append(routeSLOs, e.body)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"objectives": gin.H{
+			"availability_target":  sloAvailabilityTarget,
+			"latency_target":       sloLatencyTarget,
+			"latency_threshold_ms": milliseconds(sloLatencyThreshold.Seconds()),
+			"fast_burn_rate":       sloFastBurnRate,
+			"windows":              sloWindows,
+		},
+		"routes":   routeSLOs,
+		"total":    len(routeSLOs),
+		"alerting": alerting,
+	})
+}
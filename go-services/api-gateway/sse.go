@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+var sseHeartbeat = getEnvDuration("SSE_HEARTBEAT_INTERVAL", 15*time.Second)
+
+// streamsContext is cancelled when the server shuts down. Streams never end
+// on their own, so without it srv.Shutdown would wait out its whole timeout.
+var streamsContext, stopStreams = context.WithCancel(context.Background())
+
+// sseEnvelope is the part of a hub message used to frame it as an SSE event
+type sseEnvelope struct {
+	Seq  int64  `json:"seq"`
+	Type string `json:"type"`
+}
+
+// streamEvents serves hub messages as Server-Sent Events. Each event's id is
+// the hub's "<epoch>:<seq>" position, so a reconnecting EventSource resumes
+// through the Last-Event-ID header exactly like a websocket client using
+// resume_from.
+func streamEvents(c *gin.Context, defaultTopics []string) {
+	userID, _ := c.Get("user_id")
+
+	topics, ok := requestedTopics(c, defaultTopics)
+	if !ok {
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	resumeEpoch, resumeFrom, err := parseResumeFrom(lastEventID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Last-Event-ID must be <epoch>:<sequence number>"})
+		return
+	}
+
+	// Streams outlive the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("SSE stream cannot clear write deadline: %v", err)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	client := &Client{
+		send:        make(chan []byte, 1024),
+		userID:      userID.(string),
+		topics:      topics,
+		resumeEpoch: resumeEpoch,
+		resumeFrom:  resumeFrom,
+	}
+	client.reply(gin.H{
+		"type":   "connected",
+		"topics": client.subscriptions(),
+		"epoch":  hub.epoch,
+		"seq":    hub.lastSeq.Load(),
+	})
+
+	hub.register <- client
+	defer func() { hub.unregister <- client }()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+
+		case <-streamsContext.Done():
+			return
+
+		case message, ok := <-client.send:
+			if !ok {
+				return
+			}
+
+			var envelope sseEnvelope
+			if err := json.Unmarshal(message, &envelope); err != nil {
+				log.Printf("SSE stream dropped malformed hub message: %v", err)
+				continue
+			}
+
+			event := sse.Event{Event: envelope.Type, Data: string(message)}
+			if envelope.Seq > 0 {
+				event.Id = resumePosition(hub.epoch, envelope.Seq)
+			}
+			if err := sse.Encode(c.Writer, event); err != nil {
+				return
+			}
+			c.Writer.Flush()
+
+		case <-heartbeat.C:
+			if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// streamHandler streams alerts, threats, stats and notifications
+func streamHandler(c *gin.Context) {
+	streamEvents(c, []string{"alerts", "threats", "stats", "notifications"})
+}
+
+// streamAlertsHandler streams alert events
+func streamAlertsHandler(c *gin.Context) {
+	streamEvents(c, []string{"alerts"})
+}
+
+// streamThreatsHandler streams threat events
+func streamThreatsHandler(c *gin.Context) {
+	streamEvents(c, []string{"threats"})
+}
+
+// streamStatsHandler streams live network statistics
+func streamStatsHandler(c *gin.Context) {
+	streamEvents(c, []string{"stats"})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var startTestHub sync.Once
+
+func TestShutdownEndsStreams(t *testing.T) {
+	startTestHub.Do(func() { go hub.run() })
+	_, token := testUser(t, "analyst")
+
+	previous, previousStop := streamsContext, stopStreams
+	streamsContext, stopStreams = context.WithCancel(context.Background())
+	t.Cleanup(func() { streamsContext, stopStreams = previous, previousStop })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: newRouter()}
+	srv.RegisterOnShutdown(stopStreams)
+	go srv.Serve(listener)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/api/v1/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Wait for the connected event so the stream is being served
+	if event := readStreamEvent(t, bufio.NewReader(resp.Body)); event.event != "connected" {
+		t.Fatalf("first stream event = %q, want connected", event.event)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown with an open stream: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %s with an open stream", elapsed)
+	}
+}
+
+// sseEvent is one event read from a stream
+type sseEvent struct {
+	id, event string
+	data      struct {
+		Type  string `json:"type"`
+		Topic string `json:"topic"`
+		Event Event  `json:"event"`
+	}
+}
+
+// openStream connects to an SSE endpoint and waits for its connected event,
+// after which the stream is registered with the hub
+func openStream(t *testing.T, srv *httptest.Server, path, token, lastEventID string) *bufio.Reader {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s = %d", path, resp.StatusCode)
+	}
+
+	stream := bufio.NewReader(resp.Body)
+	if event := readStreamEvent(t, stream); event.event != "connected" {
+		t.Fatalf("first stream event = %q, want connected", event.event)
+	}
+	return stream
+}
+
+// readStreamEvent reads the next event, skipping keepalive comments
+func readStreamEvent(t *testing.T, stream *bufio.Reader) sseEvent {
+	t.Helper()
+
+	var event sseEvent
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && event.event != "":
+			return event
+		case strings.HasPrefix(line, "id:"):
+			event.id = strings.TrimPrefix(line, "id:")
+		case strings.HasPrefix(line, "event:"):
+			event.event = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:"):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event.data); err != nil {
+				t.Fatalf("decoding event data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+// streamTestServer serves the router with bus events forwarded to the hub
+func streamTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	startTestHub.Do(func() { go hub.run() })
+	t.Cleanup(eventBus.Subscribe("test-stream", 100, broadcastEvent))
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamDeliversBusEvents(t *testing.T) {
+	srv := streamTestServer(t)
+	_, token := testUser(t, "analyst")
+	stream := openStream(t, srv, "/api/v1/stream", token, "")
+
+	eventBus.Publish(Event{Type: EventAlertCreated, Resource: "alert", ResourceID: "ALT-stream"})
+
+	event := readStreamEvent(t, stream)
+	if event.event != "event" || event.data.Topic != "alerts" || event.data.Event.ResourceID != "ALT-stream" {
+		t.Errorf("streamed %s on %s for %s, want the alert event", event.event, event.data.Topic, event.data.Event.ResourceID)
+	}
+	if epoch, seq, err := parseResumeFrom(event.id); err != nil || epoch != hub.epoch || seq == 0 {
+		t.Errorf("event id = %q, want <epoch>:<seq> of this hub", event.id)
+	}
+}
+
+func TestStreamTopicFiltering(t *testing.T) {
+	srv := streamTestServer(t)
+	_, token := testUser(t, "analyst")
+	alertStream := openStream(t, srv, "/api/v1/stream/alerts", token, "")
+	threatStream := openStream(t, srv, "/api/v1/stream?topics=threats", token, "")
+
+	// The hub routes in publish order, so each stream's first event shows
+	// whether the other topic's event was filtered out
+	eventBus.Publish(Event{Type: EventThreatCreated, Resource: "threat", ResourceID: "THR-stream"})
+	eventBus.Publish(Event{Type: EventAlertCreated, Resource: "alert", ResourceID: "ALT-stream"})
+
+	if event := readStreamEvent(t, alertStream); event.data.Event.ResourceID != "ALT-stream" {
+		t.Errorf("alerts stream got %s on %s, want only the alert", event.data.Event.ResourceID, event.data.Topic)
+	}
+	if event := readStreamEvent(t, threatStream); event.data.Event.ResourceID != "THR-stream" {
+		t.Errorf("threats stream got %s on %s, want only the threat", event.data.Event.ResourceID, event.data.Topic)
+	}
+}
+
+func TestStreamResumesFromLastEventID(t *testing.T) {
+	srv := streamTestServer(t)
+	_, token := testUser(t, "analyst")
+
+	stream := openStream(t, srv, "/api/v1/stream/alerts", token, "")
+	eventBus.Publish(Event{Type: EventAlertCreated, Resource: "alert", ResourceID: "ALT-seen"})
+	seen := readStreamEvent(t, stream)
+	if seen.data.Event.ResourceID != "ALT-seen" {
+		t.Fatalf("streamed %s, want ALT-seen", seen.data.Event.ResourceID)
+	}
+
+	// Published while no stream is open, so only the replay buffer has it
+	eventBus.Publish(Event{Type: EventAlertCreated, Resource: "alert", ResourceID: "ALT-missed"})
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.lastSeq.Load() <= mustSeq(t, seen.id) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resumed := openStream(t, srv, "/api/v1/stream/alerts", token, seen.id)
+	event := readStreamEvent(t, resumed)
+	if event.data.Event.ResourceID != "ALT-missed" {
+		t.Errorf("resumed stream replayed %s, want ALT-missed", event.data.Event.ResourceID)
+	}
+	if mustSeq(t, event.id) <= mustSeq(t, seen.id) {
+		t.Errorf("replayed event id %s is not after Last-Event-ID %s", event.id, seen.id)
+	}
+}
+
+// mustSeq returns the sequence number of an SSE event id
+func mustSeq(t *testing.T, id string) int64 {
+	t.Helper()
+
+	_, seq, err := parseResumeFrom(id)
+	if err != nil {
+		t.Fatalf("event id %q: %v", id, err)
+	}
+	return seq
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the gateway's own spans. It resolves the global provider
+// lazily, so spans started before setupTracing are simply not recorded.
+var tracer = otel.Tracer("github.com/securecloud/api-gateway")
+
+// setupTracing installs the W3C trace context propagator and, unless
+// OTEL_TRACES_EXPORTER is none, a tracer provider exporting to an OTLP
+// collector (OTEL_EXPORTER_OTLP_ENDPOINT, default http://localhost:4318) or
+// to stdout. Sampling follows OTEL_TRACES_SAMPLER. The returned function
+// flushes buffered spans on shutdown.
+func setupTracing() func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	name := getEnv("OTEL_TRACES_EXPORTER", "none")
+	switch name {
+	case "none":
+		// Trace context is still propagated, so callers' traces continue
+		// through the gateway to the services it calls
+		return func(context.Context) error { return nil }
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout", "console":
+		exporter, err = stdouttrace.New()
+	default:
+		log.Fatalf("Unknown OTEL_TRACES_EXPORTER %q (otlp, stdout or none)", name)
+	}
+	if err != nil {
+		log.Fatalf("Failed to create trace exporter: %v", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(context.Background(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			attribute.String("service.name", "api-gateway"),
+			attribute.String("service.version", "1.0.0"),
+		),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		log.Printf("Incomplete trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("Tracing enabled with %s exporter", name)
+
+	return provider.Shutdown
+}
+
+// traceHandler wraps the router so every inbound request continues the
+// caller's trace from its traceparent header or starts a new one. Probes and
+// metrics scrapes are not traced.
+func traceHandler(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "http.server", otelhttp.WithFilter(func(r *http.Request) bool {
+		switch r.URL.Path {
+		case "/health", "/health/live", "/health/ready", "/ready", "/metrics":
+			return false
+		}
+		return true
+	}))
+}
+
+// traceRoute names the server span after the matched route rather than the
+// raw path, and tags it with the request ID
+func traceRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		span := trace.SpanFromContext(c.Request.Context())
+		if route := c.FullPath(); route != "" {
+			span.SetName(c.Request.Method + " " + route)
+			span.SetAttributes(attribute.String("http.route", route))
+		}
+		span.SetAttributes(attribute.String("request.id", c.GetString("request_id")))
+
+		c.Next()
+	}
+}
+
+// tracedTransport traces outbound requests and injects trace context so
+// internal services join the caller's trace
+func tracedTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
+
+// tracedExternalTransport traces outbound requests without sending trace
+// context, for calls to third parties such as webhook receivers
+func tracedExternalTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()))
+}
+
+// traceData starts a span around a read or write of a data store and
+// returns the function that ends it
+func traceData(ctx context.Context, operation string) func() {
+	_, span := tracer.Start(ctx, "data "+operation, trace.WithAttributes(attribute.String("data.operation", operation)))
+	return func() { span.End() }
+}
+
+// startLinkedSpan starts the root span of background work, such as a webhook
+// delivery or threat analysis, linked to the request that queued it
+func startLinkedSpan(ctx context.Context, name string, origin trace.SpanContext, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithNewRoot(), trace.WithAttributes(attrs...)}
+	if origin.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+	}
+	return tracer.Start(ctx, name, opts...)
+}
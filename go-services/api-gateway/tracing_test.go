@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentSpan  = "00f067aa0ba902b7"
+	testTraceparent = "00-" + testTraceID + "-" + testParentSpan + "-01"
+)
+
+// useTestTracing records spans in memory with the propagator setupTracing
+// installs, restoring the global provider and propagator afterwards
+func useTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	savedProvider, savedPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() {
+		provider.Shutdown(t.Context())
+		otel.SetTracerProvider(savedProvider)
+		otel.SetTextMapPropagator(savedPropagator)
+	})
+	return recorder
+}
+
+// tracedRouter is a router with the gateway's tracing middleware, one API
+// route and one probe
+func tracedRouter() http.Handler {
+	router := gin.New()
+	router.Use(traceRoute())
+	router.GET("/api/v1/alerts/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return traceHandler(router)
+}
+
+func TestTracingContinuesCallerTrace(t *testing.T) {
+	recorder := useTestTracing(t)
+
+	if w := doRequest(t, tracedRouter(), http.MethodGet, "/api/v1/alerts/ALT-001", nil, "traceparent", testTraceparent); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+
+	var server sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.SpanKind() == trace.SpanKindServer {
+			server = span
+		}
+	}
+	if server == nil {
+		t.Fatal("no server span recorded")
+	}
+	if got := server.SpanContext().TraceID().String(); got != testTraceID {
+		t.Errorf("trace ID = %s, want the caller's %s", got, testTraceID)
+	}
+	if got := server.Parent().SpanID().String(); got != testParentSpan || !server.Parent().IsRemote() {
+		t.Errorf("parent span = %s, want the caller's remote span %s", got, testParentSpan)
+	}
+	if server.Name() != "GET /api/v1/alerts/:id" {
+		t.Errorf("span name = %q, want the matched route", server.Name())
+	}
+}
+
+func TestTracingProbesAreNotTraced(t *testing.T) {
+	recorder := useTestTracing(t)
+
+	doRequest(t, tracedRouter(), http.MethodGet, "/health", nil, "traceparent", testTraceparent)
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Errorf("liveness probe recorded %d spans", len(spans))
+	}
+}
+
+func TestTracedTransports(t *testing.T) {
+	useTestTracing(t)
+
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	// The context of a request that arrived with the caller's traceparent
+	parent := propagation.TraceContext{}.Extract(t.Context(), propagation.HeaderCarrier{"Traceparent": {testTraceparent}})
+
+	tests := []struct {
+		name      string
+		transport http.RoundTripper
+		propagate bool
+	}{
+		{"internal", tracedTransport(http.DefaultTransport), true},
+		{"external", tracedExternalTransport(http.DefaultTransport), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequestWithContext(parent, http.MethodGet, upstream.URL, nil)
+			resp, err := (&http.Client{Transport: tt.transport}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			traceparent := received.Get("traceparent")
+			if tt.propagate {
+				sc := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(t.Context(), propagation.HeaderCarrier(received)))
+				if sc.TraceID().String() != testTraceID {
+					t.Errorf("traceparent %q does not continue trace %s", traceparent, testTraceID)
+				}
+			} else if traceparent != "" {
+				t.Errorf("external call sent traceparent %q", traceparent)
+			}
+		})
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const webhookResponseSnippet = 512
+
+// WebhookDelivery is one event queued for one webhook, with its attempts
+type WebhookDelivery struct {
+	ID          string            `json:"id"`
+	WebhookID   string            `json:"webhook_id"`
+	EventID     string            `json:"event_id"`
+	EventType   string            `json:"event_type"`
+	RequestID   string            `json:"request_id,omitempty"`
+	Status      string            `json:"status"`
+	Payload     json.RawMessage   `json:"payload,omitempty"`
+	Attempts    []DeliveryAttempt `json:"attempts"`
+	NextAttempt *time.Time        `json:"next_attempt,omitempty"`
+	RedeliverOf string            `json:"redeliver_of,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+
+	inFlight bool
+	origin   trace.SpanContext
+}
+
+// DeliveryAttempt records the outcome of one HTTP request to a webhook
+type DeliveryAttempt struct {
+	Number     int       `json:"number"`
+	Timestamp  time.Time `json:"timestamp"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Duration   int64     `json:"duration_ms"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// WebhookDispatcher delivers webhook payloads from a queue, retrying failed
+// deliveries with exponential backoff and optionally persisting the queue
+type WebhookDispatcher struct {
+	deliveries   map[string]*WebhookDelivery
+	mu           sync.Mutex
+	work         chan string
+	client       *http.Client
+	maxAttempts  int
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	disableAfter int
+	retention    int
+	path         string
+	dirty        atomic.Bool
+	nextID       atomic.Int64
+	// lastTick and saveFailed feed the health checks
+	lastTick   atomic.Int64
+	saveFailed atomic.Bool
+}
+
+var webhookDispatcher *WebhookDispatcher
+
+// signWebhookPayload returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// generateWebhookSecret creates a random signing secret
+func generateWebhookSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// generateWebhookID creates a random webhook ID, so webhooks created in the
+// same instant (or before a restart) never share one
+func generateWebhookID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "wh_" + hex.EncodeToString(b)
+}
+
+// Enqueue queues a payload for delivery to a webhook
+func (d *WebhookDispatcher) Enqueue(webhookID string, event Event, payload []byte) *WebhookDelivery {
+	now := time.Now()
+	delivery := &WebhookDelivery{
+		ID:          fmt.Sprintf("dlv_%d_%d", now.Unix(), d.nextID.Add(1)),
+		WebhookID:   webhookID,
+		EventID:     event.ID,
+		EventType:   event.Type,
+		RequestID:   event.RequestID,
+		origin:      event.origin,
+		Status:      "pending",
+		Payload:     payload,
+		Attempts:    []DeliveryAttempt{},
+		NextAttempt: &now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	d.mu.Lock()
+	d.deliveries[delivery.ID] = delivery
+	select {
+	case d.work <- delivery.ID:
+		delivery.inFlight = true
+	default:
+	}
+	d.mu.Unlock()
+
+	d.dirty.Store(true)
+	return delivery
+}
+
+// Redeliver queues a copy of an earlier delivery
+func (d *WebhookDispatcher) Redeliver(webhookID, deliveryID string) (*WebhookDelivery, bool) {
+	d.mu.Lock()
+	original, exists := d.deliveries[deliveryID]
+	d.mu.Unlock()
+	if !exists || original.WebhookID != webhookID {
+		return nil, false
+	}
+
+	delivery := d.Enqueue(webhookID, Event{ID: original.EventID, Type: original.EventType, RequestID: original.RequestID, origin: original.origin}, original.Payload)
+
+	d.mu.Lock()
+	delivery.RedeliverOf = original.ID
+	d.mu.Unlock()
+
+	return delivery, true
+}
+
+// Deliveries returns snapshots of a webhook's deliveries, newest first
+func (d *WebhookDispatcher) Deliveries(webhookID string) []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var result []WebhookDelivery
+	for _, delivery := range d.deliveries {
+		if delivery.WebhookID == webhookID {
+			snapshot := *delivery
+			snapshot.Attempts = append([]DeliveryAttempt(nil), delivery.Attempts...)
+			result = append(result, snapshot)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result
+}
+
+// Delivery returns a snapshot of one delivery
+func (d *WebhookDispatcher) Delivery(webhookID, deliveryID string) (WebhookDelivery, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delivery, exists := d.deliveries[deliveryID]
+	if !exists || delivery.WebhookID != webhookID {
+		return WebhookDelivery{}, false
+	}
+	snapshot := *delivery
+	snapshot.Attempts = append([]DeliveryAttempt(nil), delivery.Attempts...)
+	return snapshot, true
+}
+
+// schedule hands due deliveries to the workers
+func (d *WebhookDispatcher) schedule() {
+	now := time.Now()
+
+	d.mu.Lock()
+	var due []*WebhookDelivery
+	for _, delivery := range d.deliveries {
+		if delivery.inFlight || delivery.NextAttempt == nil || delivery.NextAttempt.After(now) {
+			continue
+		}
+		due = append(due, delivery)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(*due[j].NextAttempt) })
+
+	for _, delivery := range due {
+		select {
+		case d.work <- delivery.ID:
+			delivery.inFlight = true
+		default:
+		}
+	}
+	d.mu.Unlock()
+}
+
+// retryDelay returns the backoff before the given retry, with jitter
+func (d *WebhookDispatcher) retryDelay(attempt int) time.Duration {
+	delay := d.backoff
+	for i := 1; i < attempt && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.maxBackoff {
+		delay = d.maxBackoff
+	}
+	jitter, _ := rand.Int(rand.Reader, big.NewInt(int64(delay/5)+1))
+	return delay + time.Duration(jitter.Int64())
+}
+
+// attempt performs one delivery attempt
+func (d *WebhookDispatcher) attempt(id string) {
+	d.mu.Lock()
+	delivery, exists := d.deliveries[id]
+	if !exists {
+		d.mu.Unlock()
+		return
+	}
+	payload := delivery.Payload
+	number := len(delivery.Attempts) + 1
+	eventType := delivery.EventType
+	webhookID := delivery.WebhookID
+	requestID := delivery.RequestID
+	origin := delivery.origin
+	d.mu.Unlock()
+
+	ctx, span := startLinkedSpan(context.Background(), "webhook.deliver", origin,
+		attribute.String("webhook.id", webhookID),
+		attribute.String("webhook.delivery_id", id),
+		attribute.String("webhook.event", eventType),
+		attribute.Int("webhook.attempt", number),
+	)
+	defer span.End()
+
+	webhooksMux.RLock()
+	webhook, found := webhooks[webhookID]
+	var url, secret string
+	var enabled bool
+	if found {
+		url, secret, enabled = webhook.URL, webhook.Secret, webhook.Enabled
+	}
+	webhooksMux.RUnlock()
+
+	result := DeliveryAttempt{Number: number, Timestamp: time.Now()}
+	switch {
+	case !found:
+		result.Error = "webhook no longer exists"
+	case !enabled && eventType != "test":
+		result.Error = "webhook is disabled"
+	default:
+		d.send(ctx, &result, delivery.ID, webhookID, eventType, requestID, url, secret, payload)
+	}
+	success := result.Error == "" && result.StatusCode >= 200 && result.StatusCode < 300
+	if !success {
+		message := result.Error
+		if message == "" {
+			message = fmt.Sprintf("HTTP %d", result.StatusCode)
+		}
+		span.SetStatus(codes.Error, message)
+	}
+
+	d.mu.Lock()
+	delivery.inFlight = false
+	delivery.Attempts = append(delivery.Attempts, result)
+	delivery.UpdatedAt = time.Now()
+	switch {
+	case success:
+		delivery.Status = "succeeded"
+		delivery.NextAttempt = nil
+	case !found || !enabled || number >= d.maxAttempts:
+		delivery.Status = "failed"
+		delivery.NextAttempt = nil
+	default:
+		delivery.Status = "retrying"
+		next := time.Now().Add(d.retryDelay(number))
+		delivery.NextAttempt = &next
+	}
+	outcome := delivery.Status
+	d.mu.Unlock()
+	d.dirty.Store(true)
+	webhookDeliveriesTotal.WithLabelValues(outcome).Inc()
+
+	if found && enabled {
+		d.recordResult(webhookID, success, result)
+	}
+}
+
+// send makes the signed HTTP request and fills in the attempt result
+func (d *WebhookDispatcher) send(ctx context.Context, result *DeliveryAttempt, deliveryID, webhookID, eventType, requestID, url, secret string, payload []byte) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "NetGuard-Webhook/1.0")
+	req.Header.Set("X-Webhook-ID", webhookID)
+	req.Header.Set("X-Webhook-Delivery", deliveryID)
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+	if secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+signWebhookPayload(secret, timestamp, payload))
+	}
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	result.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+
+	// Read at most the policy's response limit so a hostile endpoint cannot
+	// stream an unbounded body at the gateway
+	body := io.LimitReader(resp.Body, webhookPolicy.MaxResponseBytes())
+	snippet, _ := io.ReadAll(io.LimitReader(body, webhookResponseSnippet))
+	io.Copy(io.Discard, body)
+	result.StatusCode = resp.StatusCode
+	result.Response = string(snippet)
+}
+
+// recordResult tracks consecutive failures and disables failing webhooks
+func (d *WebhookDispatcher) recordResult(webhookID string, success bool, result DeliveryAttempt) {
+	webhooksMux.Lock()
+	webhook, exists := webhooks[webhookID]
+	if !exists {
+		webhooksMux.Unlock()
+		return
+	}
+
+	now := result.Timestamp
+	webhook.LastDeliveryAt = &now
+	disabled := false
+	if success {
+		webhook.FailureCount = 0
+	} else {
+		webhook.FailureCount++
+		if d.disableAfter > 0 && webhook.FailureCount >= d.disableAfter && webhook.Enabled {
+			webhook.Enabled = false
+			webhook.DisabledReason = fmt.Sprintf("disabled after %d consecutive failed deliveries", webhook.FailureCount)
+			disabled = true
+		}
+	}
+	snapshot := *webhook
+	webhooksMux.Unlock()
+	d.dirty.Store(true)
+
+	if disabled {
+		log.Printf("Webhook %s disabled after %d consecutive failures", webhookID, d.disableAfter)
+		publishEvent(nil, EventWebhookDisabled, "webhook", webhookID, &snapshot)
+	}
+}
+
+// prune drops finished deliveries beyond the per-webhook retention
+func (d *WebhookDispatcher) prune() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	byWebhook := make(map[string][]*WebhookDelivery)
+	for _, delivery := range d.deliveries {
+		if delivery.NextAttempt == nil && !delivery.inFlight {
+			byWebhook[delivery.WebhookID] = append(byWebhook[delivery.WebhookID], delivery)
+		}
+	}
+
+	for _, finished := range byWebhook {
+		if len(finished) <= d.retention {
+			continue
+		}
+		sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.After(finished[j].CreatedAt) })
+		for _, delivery := range finished[d.retention:] {
+			delete(d.deliveries, delivery.ID)
+		}
+		d.dirty.Store(true)
+	}
+}
+
+// webhookStore is the on-disk format of the webhook queue
+type webhookStore struct {
+	Webhooks   []storedWebhook    `json:"webhooks"`
+	Deliveries []*WebhookDelivery `json:"deliveries"`
+}
+
+// storedWebhook keeps the signing secret and routing key, which are never
+// serialised in API responses
+type storedWebhook struct {
+	*Webhook
+	Secret     string `json:"secret"`
+	RoutingKey string `json:"routing_key,omitempty"`
+}
+
+// save writes webhooks and deliveries to the store file
+func (d *WebhookDispatcher) save() error {
+	webhooksMux.RLock()
+	store := webhookStore{}
+	for _, webhook := range webhooks {
+		snapshot := *webhook
+		store.Webhooks = append(store.Webhooks, storedWebhook{Webhook: &snapshot, Secret: webhook.Secret, RoutingKey: webhook.RoutingKey})
+	}
+	webhooksMux.RUnlock()
+
+	d.mu.Lock()
+	for _, delivery := range d.deliveries {
+		snapshot := *delivery
+		snapshot.Attempts = append([]DeliveryAttempt(nil), delivery.Attempts...)
+		store.Deliveries = append(store.Deliveries, &snapshot)
+	}
+	d.mu.Unlock()
+
+	data, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// load restores webhooks and deliveries from the store file
+func (d *WebhookDispatcher) load() error {
+	data, err := os.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var store webhookStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return err
+	}
+
+	webhooksMux.Lock()
+	for _, stored := range store.Webhooks {
+		if stored.Webhook == nil {
+			continue
+		}
+		stored.Webhook.Secret = stored.Secret
+		stored.Webhook.RoutingKey = stored.RoutingKey
+		if stored.Webhook.Format == WebhookFormatTemplate {
+			compiled, err := parseWebhookTemplate(stored.Webhook.Template)
+			if err != nil {
+				log.Printf("Webhook %s has an invalid template: %v", stored.ID, err)
+			}
+			stored.Webhook.compiled = compiled
+		}
+		webhooks[stored.ID] = stored.Webhook
+	}
+	webhooksMux.Unlock()
+
+	d.mu.Lock()
+	for _, delivery := range store.Deliveries {
+		d.deliveries[delivery.ID] = delivery
+	}
+	d.mu.Unlock()
+
+	log.Printf("Loaded %d webhooks and %d deliveries from %s", len(store.Webhooks), len(store.Deliveries), d.path)
+	return nil
+}
+
+// Close saves the store if it has pending changes
+func (d *WebhookDispatcher) Close() {
+	if d.path != "" && d.dirty.Swap(false) {
+		if err := d.save(); err != nil {
+			log.Printf("Failed to save webhook store: %v", err)
+		}
+	}
+}
+
+// markWebhooksChanged schedules the webhook store to be saved
+func markWebhooksChanged() {
+	if webhookDispatcher != nil {
+		webhookDispatcher.dirty.Store(true)
+	}
+}
+
+// startWebhookDispatcher loads the persisted queue and starts delivery workers
+func startWebhookDispatcher() {
+	configureWebhookPolicy()
+
+	// Deliveries are traced, but trace context is not sent to receivers
+	client := webhookPolicy.Client(getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second))
+	client.Transport = tracedExternalTransport(client.Transport)
+
+	d := &WebhookDispatcher{
+		deliveries:   make(map[string]*WebhookDelivery),
+		work:         make(chan string, 100),
+		client:       client,
+		maxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		backoff:      getEnvDuration("WEBHOOK_RETRY_BACKOFF", 30*time.Second),
+		maxBackoff:   getEnvDuration("WEBHOOK_MAX_BACKOFF", time.Hour),
+		disableAfter: getEnvInt("WEBHOOK_DISABLE_AFTER", 20),
+		retention:    getEnvInt("WEBHOOK_DELIVERY_RETENTION", 100),
+		path:         getEnv("WEBHOOK_STORE_PATH", ""),
+	}
+	webhookDispatcher = d
+
+	if d.path != "" {
+		if err := os.MkdirAll(filepath.Dir(d.path), 0o755); err != nil {
+			log.Printf("Failed to create webhook store directory: %v", err)
+		}
+		if err := d.load(); err != nil {
+			log.Printf("Failed to load webhook store %s: %v", d.path, err)
+		}
+	}
+
+	for i := 0; i < getEnvInt("WEBHOOK_WORKERS", 4); i++ {
+		go func() {
+			for id := range d.work {
+				d.attempt(id)
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for tick := 0; ; tick++ {
+			<-ticker.C
+			d.lastTick.Store(time.Now().UnixNano())
+			d.schedule()
+
+			if tick%60 == 0 {
+				d.prune()
+			}
+			if d.path != "" && d.dirty.Swap(false) {
+				err := d.save()
+				if err != nil {
+					log.Printf("Failed to save webhook store: %v", err)
+					d.dirty.Store(true)
+				}
+				d.saveFailed.Store(err != nil)
+			}
+		}
+	}()
+
+	registerHealthCheck(HealthCheck{
+		Name:     "webhook_scheduler",
+		Liveness: true,
+		Check:    d.checkScheduler,
+	})
+	registerHealthCheck(HealthCheck{
+		Name:      "webhook_queue",
+		Readiness: true,
+		Check:     d.checkQueue,
+	})
+}
+
+// checkScheduler fails when the loop that hands due deliveries to workers
+// and saves the store has stopped ticking
+func (d *WebhookDispatcher) checkScheduler(ctx context.Context) (gin.H, error) {
+	last := d.lastTick.Load()
+	if last == 0 {
+		return gin.H{"last_tick": nil}, nil
+	}
+	since := time.Since(time.Unix(0, last))
+	details := gin.H{"last_tick": time.Unix(0, last)}
+	if since > 30*time.Second {
+		return details, fmt.Errorf("scheduler has not run for %s", since.Round(time.Second))
+	}
+	return details, nil
+}
+
+// checkQueue reports the delivery backlog. Webhooks are delivered
+// asynchronously, so a backlog degrades the gateway without making it
+// unready.
+func (d *WebhookDispatcher) checkQueue(ctx context.Context) (gin.H, error) {
+	now := time.Now()
+	var pending, overdue int
+	d.mu.Lock()
+	for _, delivery := range d.deliveries {
+		if delivery.NextAttempt == nil {
+			continue
+		}
+		pending++
+		if now.Sub(*delivery.NextAttempt) > time.Minute {
+			overdue++
+		}
+	}
+	d.mu.Unlock()
+
+	details := gin.H{
+		"pending":        pending,
+		"overdue":        overdue,
+		"queued":         len(d.work),
+		"queue_capacity": cap(d.work),
+	}
+	switch {
+	case d.saveFailed.Load():
+		return details, healthWarning("saving the webhook store to %s is failing", d.path)
+	case overdue > 0:
+		return details, healthWarning("%d deliveries are more than a minute overdue", overdue)
+	}
+	return details, nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Webhook payload formats
+const (
+	WebhookFormatGeneric   = "generic"
+	WebhookFormatSlack     = "slack"
+	WebhookFormatTeams     = "teams"
+	WebhookFormatPagerDuty = "pagerduty"
+	WebhookFormatTemplate  = "template"
+)
+
+var webhookSeverities = map[string]bool{"low": true, "medium": true, "high": true, "critical": true}
+
+// webhookTemplateData is the value custom templates are executed against
+type webhookTemplateData struct {
+	Event
+	Summary   string
+	WebhookID string
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"time": func(t time.Time, layout string) string {
+		return t.Format(layout)
+	},
+}
+
+// validateWebhookFormat checks a format and, for custom templates, that the
+// template parses and renders valid JSON for a sample event. It returns the
+// parsed template for the webhook to keep.
+func validateWebhookFormat(format, tmpl, routingKey string) (*template.Template, error) {
+	switch format {
+	case "", WebhookFormatGeneric, WebhookFormatSlack, WebhookFormatTeams:
+		return nil, nil
+	case WebhookFormatPagerDuty:
+		if routingKey == "" {
+			return nil, errors.New("pagerduty webhooks require a routing_key")
+		}
+		return nil, nil
+	case WebhookFormatTemplate:
+		if tmpl == "" {
+			return nil, errors.New("template webhooks require a template")
+		}
+		compiled, err := parseWebhookTemplate(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := renderWebhookPayload(&Webhook{Format: format, Template: tmpl, compiled: compiled}, sampleWebhookEvent(EventAlertCreated)); err != nil {
+			return nil, err
+		}
+		return compiled, nil
+	}
+	return nil, fmt.Errorf("unknown webhook format %q", format)
+}
+
+// parseWebhookTemplate parses a custom payload template
+func parseWebhookTemplate(src string) (*template.Template, error) {
+	tmpl, err := template.New("webhook").Funcs(webhookTemplateFuncs).Option("missingkey=zero").Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// validateWebhookSeverities rejects unknown severity names
+func validateWebhookSeverities(severities []string) error {
+	for _, severity := range severities {
+		if !webhookSeverities[severity] {
+			return fmt.Errorf("unknown severity %q", severity)
+		}
+	}
+	return nil
+}
+
+// webhookAcceptsSeverity applies a webhook's severity filter. When a filter is
+// set, events that carry no severity are not delivered.
+func webhookAcceptsSeverity(webhook *Webhook, event Event) bool {
+	if len(webhook.Severities) == 0 || event.Type == "test" {
+		return true
+	}
+	for _, severity := range webhook.Severities {
+		if severity == event.Severity {
+			return true
+		}
+	}
+	return false
+}
+
+// renderWebhookPayload renders the JSON body delivered for an event in the
+// webhook's format
+func renderWebhookPayload(webhook *Webhook, event Event) ([]byte, error) {
+	switch webhook.Format {
+	case WebhookFormatSlack:
+		return json.Marshal(slackPayload(event))
+	case WebhookFormatTeams:
+		return json.Marshal(teamsPayload(event))
+	case WebhookFormatPagerDuty:
+		return json.Marshal(pagerDutyPayload(webhook, event))
+	case WebhookFormatTemplate:
+		return templatePayload(webhook, event)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"id":         event.ID,
+		"event":      event.Type,
+		"data":       event.Data,
+		"timestamp":  event.Timestamp.Format(time.RFC3339),
+		"webhook_id": webhook.ID,
+	})
+}
+
+// eventSummary returns a one-line human readable description of an event
+func eventSummary(event Event) string {
+	switch data := event.Data.(type) {
+	case *Alert:
+		return fmt.Sprintf("[%s] %s: %s", strings.ToUpper(data.Severity), event.Type, data.Title)
+	case *Threat:
+		summary := fmt.Sprintf("[%s] %s: %s", strings.ToUpper(data.Severity), event.Type, data.Name)
+		if data.SourceIP != "" {
+			summary += " from " + data.SourceIP
+		}
+		return summary
+	}
+
+	if event.Type == "test" {
+		return "NetGuard test webhook"
+	}
+	if event.ResourceID != "" {
+		return fmt.Sprintf("%s: %s %s", event.Type, event.Resource, event.ResourceID)
+	}
+	return event.Type
+}
+
+// eventFacts returns labelled fields shown in chat cards
+func eventFacts(event Event) [][2]string {
+	facts := [][2]string{{"Event", event.Type}}
+	if event.Severity != "" {
+		facts = append(facts, [2]string{"Severity", event.Severity})
+	}
+
+	switch data := event.Data.(type) {
+	case *Alert:
+		facts = append(facts, [2]string{"Status", data.Status}, [2]string{"Source", data.Source})
+		if data.SourceIP != "" {
+			facts = append(facts, [2]string{"Source IP", data.SourceIP})
+		}
+	case *Threat:
+		facts = append(facts, [2]string{"Type", data.Type}, [2]string{"Status", data.Status})
+		if data.SourceIP != "" {
+			facts = append(facts, [2]string{"Source IP", data.SourceIP})
+		}
+		if data.TargetIP != "" {
+			facts = append(facts, [2]string{"Target IP", data.TargetIP})
+		}
+	default:
+		if event.ResourceID != "" {
+			facts = append(facts, [2]string{"Resource", event.Resource + " " + event.ResourceID})
+		}
+	}
+
+	return append(facts, [2]string{"Time", event.Timestamp.Format(time.RFC3339)})
+}
+
+// slackPayload renders an event as a Slack incoming webhook message
+func slackPayload(event Event) gin.H {
+	fields := make([]gin.H, 0)
+	for _, fact := range eventFacts(event) {
+		fields = append(fields, gin.H{"type": "mrkdwn", "text": "*" + fact[0] + "*\n" + fact[1]})
+	}
+
+	summary := eventSummary(event)
+	return gin.H{
+		"text": summary,
+		"blocks": []gin.H{
+			{"type": "header", "text": gin.H{"type": "plain_text", "text": truncate(summary, 150)}},
+			{"type": "section", "fields": fields},
+			{"type": "context", "elements": []gin.H{{"type": "mrkdwn", "text": "NetGuard event " + event.ID}}},
+		},
+	}
+}
+
+// teamsPayload renders an event as a Microsoft Teams adaptive card message
+func teamsPayload(event Event) gin.H {
+	facts := make([]gin.H, 0)
+	for _, fact := range eventFacts(event) {
+		facts = append(facts, gin.H{"title": fact[0], "value": fact[1]})
+	}
+
+	color := "Default"
+	switch event.Severity {
+	case "critical", "high":
+		color = "Attention"
+	case "medium":
+		color = "Warning"
+	}
+
+	return gin.H{
+		"type": "message",
+		"attachments": []gin.H{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": gin.H{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body": []gin.H{
+					{"type": "TextBlock", "text": eventSummary(event), "weight": "Bolder", "size": "Medium", "wrap": true, "color": color},
+					{"type": "FactSet", "facts": facts},
+				},
+			},
+		}},
+	}
+}
+
+// pagerDutyPayload renders an event as a PagerDuty Events API v2 request.
+// Resolved alerts and threats resolve the incident with the same dedup key.
+func pagerDutyPayload(webhook *Webhook, event Event) gin.H {
+	action := "trigger"
+	switch data := event.Data.(type) {
+	case *Alert:
+		if data.Status == "resolved" {
+			action = "resolve"
+		}
+	case *Threat:
+		if data.Status == "resolved" || data.Status == "mitigated" || data.Status == "benign" {
+			action = "resolve"
+		}
+	}
+	if strings.HasSuffix(event.Type, ".deleted") {
+		action = "resolve"
+	}
+
+	severity := "info"
+	switch event.Severity {
+	case "critical":
+		severity = "critical"
+	case "high":
+		severity = "error"
+	case "medium":
+		severity = "warning"
+	}
+
+	dedupKey := event.ID
+	if event.ResourceID != "" {
+		dedupKey = "netguard/" + event.Resource + "/" + event.ResourceID
+	}
+
+	return gin.H{
+		"routing_key":  webhook.RoutingKey,
+		"event_action": action,
+		"dedup_key":    dedupKey,
+		"payload": gin.H{
+			"summary":        truncate(eventSummary(event), 1024),
+			"source":         "netguard",
+			"severity":       severity,
+			"timestamp":      event.Timestamp.Format(time.RFC3339),
+			"component":      event.Resource,
+			"class":          event.Type,
+			"custom_details": event.Data,
+		},
+	}
+}
+
+// templatePayload executes a user-defined template, which must produce JSON.
+// The template is parsed when the webhook is saved or loaded, not per event.
+func templatePayload(webhook *Webhook, event Event) ([]byte, error) {
+	tmpl := webhook.compiled
+	if tmpl == nil {
+		return nil, errors.New("template webhook has no parsed template")
+	}
+
+	var buf bytes.Buffer
+	data := webhookTemplateData{Event: event, Summary: eventSummary(event), WebhookID: webhook.ID}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("template execution failed: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("template did not produce valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// truncate shortens s to at most n characters, never splitting a multi-byte
+// character
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:n-3]) + "..."
+}
+
+// sampleWebhookEvent builds a representative event used for previews
+func sampleWebhookEvent(eventType string) Event {
+	event := Event{
+		ID:        "evt_preview",
+		Type:      eventType,
+		Timestamp: time.Now(),
+		Actor:     "system",
+	}
+
+	switch {
+	case strings.HasPrefix(eventType, "alert."):
+		alert := &Alert{
+			ID:          "alert_sample",
+			Title:       "Suspicious outbound connection",
+			Description: "Host contacted a known command-and-control address",
+			Severity:    "high",
+			Status:      "active",
+			Timestamp:   event.Timestamp,
+			Source:      "detection",
+			SourceIP:    "10.0.0.15",
+		}
+		event.Resource, event.ResourceID, event.Severity, event.Data = "alert", alert.ID, alert.Severity, alert
+	case strings.HasPrefix(eventType, "threat."):
+		threat := &Threat{
+			ID:         "threat_sample",
+			Name:       "Port scan",
+			Type:       "port_scan",
+			Severity:   "critical",
+			Status:     "detected",
+			SourceIP:   "203.0.113.42",
+			TargetIP:   "10.0.0.15",
+			Port:       22,
+			Timestamp:  event.Timestamp,
+			Detections: 1,
+		}
+		event.Resource, event.ResourceID, event.Severity, event.Data = "threat", threat.ID, threat.Severity, threat
+	default:
+		event.Resource = strings.SplitN(eventType, ".", 2)[0]
+		event.ResourceID = event.Resource + "_sample"
+		event.Data = gin.H{"message": "Sample " + eventType + " event"}
+	}
+	return event
+}
+
+// previewWebhook renders a sample event in the webhook's format without
+// sending it. The body may override the format to try out changes.
+func previewWebhook(c *gin.Context) {
+	webhook, ok := ownedWebhook(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		EventType  string `json:"event_type"`
+		Format     string `json:"format"`
+		Template   string `json:"template"`
+		RoutingKey string `json:"routing_key"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	webhooksMux.RLock()
+	preview := *webhook
+	webhooksMux.RUnlock()
+
+	if req.Format != "" {
+		preview.Format = req.Format
+		preview.Template = req.Template
+	}
+	if req.RoutingKey != "" {
+		preview.RoutingKey = req.RoutingKey
+	}
+	if req.EventType == "" {
+		req.EventType = EventAlertCreated
+		if len(preview.Events) > 0 && !strings.Contains(preview.Events[0], "*") {
+			req.EventType = preview.Events[0]
+		}
+	}
+
+	compiled, err := validateWebhookFormat(preview.Format, preview.Template, preview.RoutingKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	preview.compiled = compiled
+
+	event := sampleWebhookEvent(req.EventType)
+	payload, err := renderWebhookPayload(&preview, event)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"format":    formatOrDefault(preview.Format),
+		"event":     event.Type,
+		"delivered": webhookAcceptsSeverity(&preview, event),
+		"payload":   json.RawMessage(payload),
+	})
+}
+
+// formatOrDefault returns the effective format name
+func formatOrDefault(format string) string {
+	if format == "" {
+		return WebhookFormatGeneric
+	}
+	return format
+}
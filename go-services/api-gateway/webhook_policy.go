@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OutboundPolicy decides which destinations webhooks may reach. Hostnames are
+// resolved and every address must be public unless an admin has allowlisted
+// the host or network. The check runs again at dial time, so DNS rebinding
+// and redirects cannot reach blocked addresses.
+type OutboundPolicy struct {
+	allowedNetworks  []*net.IPNet
+	allowedHosts     []string
+	maxResponseBytes int64
+	maxRedirects     int
+	mu               sync.RWMutex
+}
+
+var webhookPolicy = &OutboundPolicy{maxResponseBytes: 1 << 20, maxRedirects: 3}
+
+// parseAllowedNetworks parses CIDRs or bare addresses
+func parseAllowedNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// normalizeAllowedHosts lower-cases host patterns ("example.com" or "*.example.com")
+func normalizeAllowedHosts(values []string) []string {
+	hosts := make([]string, 0, len(values))
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value != "" {
+			hosts = append(hosts, value)
+		}
+	}
+	return hosts
+}
+
+// Configure replaces the allowlists and limits
+func (p *OutboundPolicy) Configure(networks []*net.IPNet, hosts []string, maxResponseBytes int64, maxRedirects int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.allowedNetworks = networks
+	p.allowedHosts = hosts
+	if maxResponseBytes > 0 {
+		p.maxResponseBytes = maxResponseBytes
+	}
+	if maxRedirects >= 0 {
+		p.maxRedirects = maxRedirects
+	}
+}
+
+// MaxResponseBytes returns how much of a response body is read
+func (p *OutboundPolicy) MaxResponseBytes() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.maxResponseBytes
+}
+
+// hostAllowed reports whether a hostname is on the admin allowlist
+func (p *OutboundPolicy) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, pattern := range p.allowedHosts {
+		if pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIP rejects non-public addresses that are not allowlisted
+func (p *OutboundPolicy) checkIP(ip net.IP) error {
+	class := classifyIP(ip)
+	if class == "public" {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, network := range p.allowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination %s is a %s address", ip, strings.ReplaceAll(class, "_", "-"))
+}
+
+// resolve returns the permitted addresses for a host
+func (p *OutboundPolicy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if err := p.checkIP(ip); err != nil {
+			return nil, err
+		}
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s did not resolve to any address", host)
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if err := p.checkIP(addr.IP); err != nil {
+			return nil, fmt.Errorf("%s resolves to a blocked address: %w", host, err)
+		}
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// CheckURL validates a webhook URL's scheme and destination
+func (p *OutboundPolicy) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("credentials in the URL are not allowed")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("URL has no host")
+	}
+	if p.hostAllowed(host) {
+		return nil
+	}
+
+	_, err = p.resolve(ctx, host)
+	return err
+}
+
+// dialContext connects only to permitted addresses, pinning the connection to
+// the address that was checked
+func (p *OutboundPolicy) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if p.hostAllowed(host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		ips, err := p.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// Client returns an HTTP client that enforces the policy on every
+// connection and redirect. Proxies from the environment are ignored.
+func (p *OutboundPolicy) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           p.dialContext(dialer),
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          50,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			p.mu.RLock()
+			maxRedirects := p.maxRedirects
+			p.mu.RUnlock()
+
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if err := p.CheckURL(req.Context(), req.URL.String()); err != nil {
+				return fmt.Errorf("redirect to %s blocked: %w", req.URL.Host, err)
+			}
+			return nil
+		},
+	}
+}
+
+// Snapshot returns the policy for display
+func (p *OutboundPolicy) Snapshot() gin.H {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	networks := make([]string, 0, len(p.allowedNetworks))
+	for _, network := range p.allowedNetworks {
+		networks = append(networks, network.String())
+	}
+
+	return gin.H{
+		"allowed_networks":   networks,
+		"allowed_hosts":      append([]string{}, p.allowedHosts...),
+		"max_response_bytes": p.maxResponseBytes,
+		"max_redirects":      p.maxRedirects,
+		"blocked_classes":    []string{"private", "loopback", "link-local", "cgnat", "reserved", "multicast", "documentation", "unspecified", "broadcast"},
+	}
+}
+
+// checkWebhookURL validates a webhook destination against the policy
+func checkWebhookURL(c *gin.Context, rawURL string) bool {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := webhookPolicy.CheckURL(ctx, rawURL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook URL not allowed: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// getWebhookPolicy returns the outbound webhook policy (admin only)
+func getWebhookPolicy(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	c.JSON(http.StatusOK, webhookPolicy.Snapshot())
+}
+
+// updateWebhookPolicy replaces the webhook allowlists (admin only)
+func updateWebhookPolicy(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	var req struct {
+		AllowedNetworks  []string `json:"allowed_networks"`
+		AllowedHosts     []string `json:"allowed_hosts"`
+		MaxResponseBytes int64    `json:"max_response_bytes"`
+		MaxRedirects     *int     `json:"max_redirects"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	networks, err := parseAllowedNetworks(req.AllowedNetworks)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	maxRedirects := -1
+	if req.MaxRedirects != nil {
+		maxRedirects = *req.MaxRedirects
+	}
+	webhookPolicy.Configure(networks, normalizeAllowedHosts(req.AllowedHosts), req.MaxResponseBytes, maxRedirects)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Webhook policy updated",
+		"policy":  webhookPolicy.Snapshot(),
+	})
+}
+
+// configureWebhookPolicy loads the policy from the environment
+func configureWebhookPolicy() {
+	networks, err := parseAllowedNetworks(getEnvList("WEBHOOK_ALLOWED_NETWORKS", nil))
+	if err != nil {
+		log.Printf("Ignoring WEBHOOK_ALLOWED_NETWORKS: %v", err)
+	}
+	webhookPolicy.Configure(
+		networks,
+		normalizeAllowedHosts(getEnvList("WEBHOOK_ALLOWED_HOSTS", nil)),
+		int64(getEnvInt("WEBHOOK_MAX_RESPONSE_BYTES", 1<<20)),
+		getEnvInt("WEBHOOK_MAX_REDIRECTS", 3),
+	)
+}
@@ -1,25 +1,37 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"sort"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// Webhook represents a webhook configuration
+// Webhook represents a webhook configuration. The signing secret is only
+// returned when the webhook is created.
 type Webhook struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	URL       string    `json:"url"`
-	Events    []string  `json:"events"`
-	Secret    string    `json:"secret"`
-	Enabled   bool      `json:"enabled"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             string     `json:"id"`
+	UserID         string     `json:"user_id"`
+	URL            string     `json:"url"`
+	Events         []string   `json:"events"`
+	Secret         string     `json:"-"`
+	Enabled        bool       `json:"enabled"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Format         string     `json:"format"`
+	Template       string     `json:"template,omitempty"`
+	Severities     []string   `json:"severities,omitempty"`
+	RoutingKey     string     `json:"-"`
+	FailureCount   int        `json:"failure_count"`
+	LastDeliveryAt *time.Time `json:"last_delivery_at,omitempty"`
+	DisabledReason string     `json:"disabled_reason,omitempty"`
+
+	// compiled is Template parsed once when the webhook is saved or loaded
+	compiled *template.Template
 }
 
 var (
@@ -27,41 +39,131 @@ var (
 	webhooksMux sync.RWMutex
 )
 
+// webhookEventTypes are the events webhooks can subscribe to. Backups concern
+// the whole installation and are not delivered.
+var webhookEventTypes = []string{
+	EventAlertCreated, EventAlertUpdated, EventAlertDeleted,
+	EventThreatCreated, EventThreatDetected, EventThreatUpdated, EventThreatAnalyzed, EventThreatDeleted,
+	EventFirewallRuleChanged,
+	EventUserCreated, EventUserUpdated, EventUserDeleted,
+	EventAPIKeyCreated, EventAPIKeyUpdated, EventAPIKeyRevoked,
+	EventWebhookCreated, EventWebhookUpdated, EventWebhookDeleted, EventWebhookDisabled,
+	EventMonitoringStarted, EventMonitoringStopped,
+	EventDetectionRulesReloaded, EventIntelFeedRefreshed,
+}
+
+// validateWebhookEvents rejects subscription patterns that match no event a
+// webhook can receive
+func validateWebhookEvents(patterns []string) error {
+	if len(patterns) == 0 {
+		return fmt.Errorf("events must not be empty")
+	}
+	for _, pattern := range patterns {
+		matched := false
+		for _, eventType := range webhookEventTypes {
+			if matchEventType(pattern, eventType) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("events: %q matches no webhook event", pattern)
+		}
+	}
+	return nil
+}
+
+// webhookMayReceive reports whether an event may be sent to a webhook.
+// Security events go to every subscriber, like on the websocket topics; user,
+// API key and webhook events only to the account they belong to.
+func webhookMayReceive(webhook *Webhook, event Event) bool {
+	switch event.Resource {
+	case "alert", "threat", "firewall_rule", "network", "detection_rules", "intel_feed":
+		return true
+	case "user":
+		return event.ResourceID == webhook.UserID
+	case "api_key":
+		key, ok := event.Data.(*APIKey)
+		return ok && key.UserID == webhook.UserID
+	case "webhook":
+		owned, ok := event.Data.(*Webhook)
+		return ok && owned.UserID == webhook.UserID
+	}
+	return false
+}
+
 // createWebhook creates a new webhook
 func createWebhook(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 
 	var req struct {
-		URL    string   `json:"url" binding:"required,url"`
-		Events []string `json:"events" binding:"required"`
-		Secret string   `json:"secret"`
+		URL        string   `json:"url" binding:"required,url"`
+		Events     []string `json:"events" binding:"required"`
+		Secret     string   `json:"secret"`
+		Format     string   `json:"format"`
+		Template   string   `json:"template"`
+		Severities []string `json:"severities"`
+		RoutingKey string   `json:"routing_key"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := validateWebhookEvents(req.Events); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkWebhookURL(c, req.URL) {
+		return
+	}
+	if req.Format == "" {
+		req.Format = WebhookFormatGeneric
+	}
+	compiled, err := validateWebhookFormat(req.Format, req.Template, req.RoutingKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateWebhookSeverities(req.Severities); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	id := fmt.Sprintf("wh_%d", time.Now().Unix())
+	id := generateWebhookID()
+	if req.Secret == "" {
+		req.Secret = generateWebhookSecret()
+	}
 
 	webhook := &Webhook{
-		ID:        id,
-		UserID:    userID.(string),
-		URL:       req.URL,
-		Events:    req.Events,
-		Secret:    req.Secret,
-		Enabled:   true,
-		CreatedAt: time.Now(),
+		ID:         id,
+		UserID:     userID.(string),
+		URL:        req.URL,
+		Events:     req.Events,
+		Secret:     req.Secret,
+		Enabled:    true,
+		CreatedAt:  time.Now(),
+		Format:     req.Format,
+		Template:   req.Template,
+		Severities: req.Severities,
+		RoutingKey: req.RoutingKey,
+		compiled:   compiled,
 	}
 
 	webhooksMux.Lock()
 	webhooks[id] = webhook
+	// Updates and delivery results change the stored webhook from here on
+	snapshot := *webhook
 	webhooksMux.Unlock()
 
+	markWebhooksChanged()
+	publishEvent(c, EventWebhookCreated, "webhook", id, &snapshot)
+
 	c.JSON(http.StatusCreated, gin.H{
 		"id":      id,
-		"message": "Webhook created successfully",
-		"webhook": webhook,
+		"message": "Webhook created successfully. Save the secret securely, it won't be shown again.",
+		"webhook": snapshot,
+		"secret":  req.Secret,
 	})
 }
 
@@ -69,20 +171,42 @@ func createWebhook(c *gin.Context) {
 func listWebhooks(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 
+	defer traceData(c.Request.Context(), "webhooks.list")()
 	webhooksMux.RLock()
 	defer webhooksMux.RUnlock()
 
 	var userWebhooks []*Webhook
+	var newest time.Time
 	for _, webhook := range webhooks {
 		if webhook.UserID == userID.(string) {
 			userWebhooks = append(userWebhooks, webhook)
+			newest = latest(newest, resourceModified("webhook", webhook.ID, webhook.CreatedAt))
 		}
 	}
+	sort.Slice(userWebhooks, func(i, j int) bool { return userWebhooks[i].ID < userWebhooks[j].ID })
 
-	c.JSON(http.StatusOK, gin.H{
+	writeConditionalJSON(c, gin.H{
 		"webhooks": userWebhooks,
 		"total":    len(userWebhooks),
-	})
+	}, collectionModified("webhook", newest))
+}
+
+// getWebhook returns one of the user's webhooks
+func getWebhook(c *gin.Context) {
+	webhookID := c.Param("id")
+	userID, _ := c.Get("user_id")
+
+	defer traceData(c.Request.Context(), "webhooks.get")()
+	webhooksMux.RLock()
+	defer webhooksMux.RUnlock()
+
+	webhook, exists := webhooks[webhookID]
+	if !exists || webhook.UserID != userID.(string) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	writeConditionalJSON(c, webhook, resourceModified("webhook", webhookID, webhook.CreatedAt))
 }
 
 // deleteWebhook deletes a webhook
@@ -90,12 +214,19 @@ func deleteWebhook(c *gin.Context) {
 	webhookID := c.Param("id")
 	userID, _ := c.Get("user_id")
 
+	defer traceData(c.Request.Context(), "webhooks.delete")()
 	webhooksMux.Lock()
 	defer webhooksMux.Unlock()
 
 	if webhook, exists := webhooks[webhookID]; exists {
 		if webhook.UserID == userID.(string) {
+			if !ifMatch(c, webhook) {
+				preconditionFailed(c, resourceETag(webhook))
+				return
+			}
 			delete(webhooks, webhookID)
+			markWebhooksChanged()
+			publishEvent(c, EventWebhookDeleted, "webhook", webhookID, webhook)
 			c.JSON(http.StatusOK, gin.H{
 				"message": "Webhook deleted successfully",
 				"id":      webhookID,
@@ -113,21 +244,70 @@ func updateWebhook(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 
 	var req struct {
-		URL     string   `json:"url"`
-		Events  []string `json:"events"`
-		Enabled *bool    `json:"enabled"`
+		URL        string    `json:"url"`
+		Events     []string  `json:"events"`
+		Enabled    *bool     `json:"enabled"`
+		Secret     string    `json:"secret"`
+		Format     string    `json:"format"`
+		Template   *string   `json:"template"`
+		Severities *[]string `json:"severities"`
+		RoutingKey string    `json:"routing_key"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if len(req.Events) > 0 {
+		if err := validateWebhookEvents(req.Events); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.URL != "" && !checkWebhookURL(c, req.URL) {
+		return
+	}
+	if req.Severities != nil {
+		if err := validateWebhookSeverities(*req.Severities); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
+	defer traceData(c.Request.Context(), "webhooks.update")()
 	webhooksMux.Lock()
 	defer webhooksMux.Unlock()
 
 	if webhook, exists := webhooks[webhookID]; exists {
 		if webhook.UserID == userID.(string) {
+			if !ifMatch(c, webhook) {
+				preconditionFailed(c, resourceETag(webhook))
+				return
+			}
+
+			// Validate the resulting format against the webhook's current
+			// settings before changing anything, so a rejected update
+			// leaves the webhook as it was
+			formatChanged := req.Format != "" || req.Template != nil || req.RoutingKey != ""
+			format, tmpl, routingKey := webhook.Format, webhook.Template, webhook.RoutingKey
+			compiled := webhook.compiled
+			if formatChanged {
+				if req.Format != "" {
+					format = req.Format
+				}
+				if req.Template != nil {
+					tmpl = *req.Template
+				}
+				if req.RoutingKey != "" {
+					routingKey = req.RoutingKey
+				}
+				var err error
+				if compiled, err = validateWebhookFormat(format, tmpl, routingKey); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+
 			if req.URL != "" {
 				webhook.URL = req.URL
 			}
@@ -136,7 +316,23 @@ func updateWebhook(c *gin.Context) {
 			}
 			if req.Enabled != nil {
 				webhook.Enabled = *req.Enabled
+				if webhook.Enabled {
+					webhook.FailureCount = 0
+					webhook.DisabledReason = ""
+				}
 			}
+			if req.Secret != "" {
+				webhook.Secret = req.Secret
+			}
+			if formatChanged {
+				webhook.Format, webhook.Template, webhook.RoutingKey = format, tmpl, routingKey
+				webhook.compiled = compiled
+			}
+			if req.Severities != nil {
+				webhook.Severities = *req.Severities
+			}
+			markWebhooksChanged()
+			publishEvent(c, EventWebhookUpdated, "webhook", webhookID, webhook)
 
 			c.JSON(http.StatusOK, gin.H{
 				"message": "Webhook updated successfully",
@@ -149,8 +345,8 @@ func updateWebhook(c *gin.Context) {
 	c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
 }
 
-// triggerWebhook sends webhook notification
-func triggerWebhook(event string, data interface{}) {
+// triggerWebhook queues an event for every enabled webhook subscribed to it
+func triggerWebhook(event Event) {
 	webhooksMux.RLock()
 	defer webhooksMux.RUnlock()
 
@@ -162,75 +358,139 @@ func triggerWebhook(event string, data interface{}) {
 		// Check if webhook subscribes to this event
 		subscribed := false
 		for _, e := range webhook.Events {
-			if e == event || e == "*" {
+			if matchEventType(e, event.Type) {
 				subscribed = true
 				break
 			}
 		}
 
-		if !subscribed {
+		if !subscribed || !webhookMayReceive(webhook, event) || !webhookAcceptsSeverity(webhook, event) {
 			continue
 		}
 
-		// Send webhook in goroutine
-		go sendWebhook(webhook, event, data)
+		payload, err := renderWebhookPayload(webhook, event)
+		if err != nil {
+			log.Printf("Failed to render %s payload for webhook %s: %v", event.Type, webhook.ID, err)
+			continue
+		}
+		webhookDispatcher.Enqueue(webhook.ID, event, payload)
 	}
 }
 
-// sendWebhook sends HTTP POST to webhook URL
-func sendWebhook(webhook *Webhook, event string, data interface{}) {
-	payload := map[string]interface{}{
-		"event":     event,
-		"data":      data,
-		"timestamp": time.Now().Format(time.RFC3339),
-		"webhook_id": webhook.ID,
-	}
+// testWebhook sends a test webhook
+func testWebhook(c *gin.Context) {
+	webhookID := c.Param("id")
+	userID, _ := c.Get("user_id")
 
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return
-	}
+	webhooksMux.RLock()
+	webhook, exists := webhooks[webhookID]
+	webhooksMux.RUnlock()
 
-	req, err := http.NewRequest("POST", webhook.URL, bytes.NewBuffer(jsonData))
-	if err != nil {
+	if !exists || webhook.UserID != userID.(string) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
 		return
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "NetGuard-Webhook/1.0")
-	if webhook.Secret != "" {
-		req.Header.Set("X-Webhook-Secret", webhook.Secret)
+	// Send test event
+	event := Event{
+		ID:        fmt.Sprintf("evt_test_%d", time.Now().Unix()),
+		Type:      "test",
+		Timestamp: time.Now(),
+		Actor:     userID.(string),
+		Resource:  "webhook",
+		RequestID: c.GetString("request_id"),
+		Data:      gin.H{"message": "This is a test webhook"},
 	}
+	webhooksMux.RLock()
+	payload, err := renderWebhookPayload(webhook, event)
+	url := webhook.URL
+	webhooksMux.RUnlock()
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer resp.Body.Close()
+
+	delivery := webhookDispatcher.Enqueue(webhook.ID, event, payload)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Test webhook queued",
+		"url":         url,
+		"delivery_id": delivery.ID,
+	})
 }
 
-// testWebhook sends a test webhook
-func testWebhook(c *gin.Context) {
-	webhookID := c.Param("id")
+// ownedWebhook returns the webhook if it belongs to the requesting user
+func ownedWebhook(c *gin.Context) (*Webhook, bool) {
 	userID, _ := c.Get("user_id")
 
 	webhooksMux.RLock()
-	webhook, exists := webhooks[webhookID]
+	webhook, exists := webhooks[c.Param("id")]
 	webhooksMux.RUnlock()
 
 	if !exists || webhook.UserID != userID.(string) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return nil, false
+	}
+	return webhook, true
+}
+
+// listWebhookDeliveries lists a webhook's recent deliveries and attempts
+func listWebhookDeliveries(c *gin.Context) {
+	webhook, ok := ownedWebhook(c)
+	if !ok {
 		return
 	}
 
-	// Send test event
-	go sendWebhook(webhook, "test", gin.H{
-		"message": "This is a test webhook",
-	})
+	status := c.Query("status")
+	deliveries := webhookDispatcher.Deliveries(webhook.ID)
+
+	result := make([]WebhookDelivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		if status != "" && delivery.Status != status {
+			continue
+		}
+		delivery.Payload = nil
+		result = append(result, delivery)
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Test webhook sent",
-		"url":     webhook.URL,
+		"deliveries": result,
+		"total":      len(result),
+	})
+}
+
+// getWebhookDelivery returns one delivery including its payload
+func getWebhookDelivery(c *gin.Context) {
+	webhook, ok := ownedWebhook(c)
+	if !ok {
+		return
+	}
+
+	delivery, exists := webhookDispatcher.Delivery(webhook.ID, c.Param("delivery_id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, delivery)
+}
+
+// redeliverWebhook queues a fresh copy of an earlier delivery
+func redeliverWebhook(c *gin.Context) {
+	webhook, ok := ownedWebhook(c)
+	if !ok {
+		return
+	}
+
+	delivery, exists := webhookDispatcher.Redeliver(webhook.ID, c.Param("delivery_id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":     "Delivery queued",
+		"delivery_id": delivery.ID,
 	})
 }
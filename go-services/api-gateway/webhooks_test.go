@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// useTestWebhooks gives the test its own webhooks and a dispatcher without
+// workers, so queued deliveries stay put until the test attempts them.
+// Loopback destinations are allowed for httptest receivers.
+func useTestWebhooks(t *testing.T) *WebhookDispatcher {
+	t.Helper()
+
+	savedWebhooks, savedDispatcher, savedPolicy := webhooks, webhookDispatcher, webhookPolicy
+	t.Cleanup(func() {
+		webhooksMux.Lock()
+		webhooks = savedWebhooks
+		webhooksMux.Unlock()
+		webhookDispatcher, webhookPolicy = savedDispatcher, savedPolicy
+	})
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	webhookPolicy = &OutboundPolicy{allowedNetworks: []*net.IPNet{loopback}, maxResponseBytes: 1 << 20, maxRedirects: 3}
+
+	webhooksMux.Lock()
+	webhooks = make(map[string]*Webhook)
+	webhooksMux.Unlock()
+
+	webhookDispatcher = &WebhookDispatcher{
+		deliveries:   make(map[string]*WebhookDelivery),
+		work:         make(chan string, 100),
+		client:       webhookPolicy.Client(5 * time.Second),
+		maxAttempts:  3,
+		backoff:      time.Minute,
+		maxBackoff:   time.Hour,
+		disableAfter: 20,
+		retention:    100,
+	}
+	return webhookDispatcher
+}
+
+// captureEvents subscribes to the event bus for the rest of the test
+func captureEvents(t *testing.T, patterns ...string) <-chan Event {
+	t.Helper()
+
+	events := make(chan Event, 100)
+	t.Cleanup(eventBus.Subscribe("test", 100, func(event Event) { events <- event }, patterns...))
+	return events
+}
+
+// nextEvent waits for the next captured event
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event published")
+		return Event{}
+	}
+}
+
+// deliveredTypes returns the event types queued for a webhook
+func deliveredTypes(d *WebhookDispatcher, webhookID string) map[string]bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	types := make(map[string]bool)
+	for _, delivery := range d.deliveries {
+		if delivery.WebhookID == webhookID {
+			types[delivery.EventType] = true
+		}
+	}
+	return types
+}
+
+func TestWebhooksOnlyReceiveTheirOwnersAccountEvents(t *testing.T) {
+	router := newRouter()
+	alice, aliceToken := testUser(t, "analyst")
+	bob, _ := testUser(t, "analyst")
+	d := useTestWebhooks(t)
+
+	webhooksMux.Lock()
+	webhooks["wh_bob"] = &Webhook{ID: "wh_bob", UserID: bob.ID, URL: "http://127.0.0.1:9/bob", Events: []string{"*"}, Enabled: true, Format: WebhookFormatGeneric}
+	webhooksMux.Unlock()
+
+	events := captureEvents(t, "user.*", "webhook.*", "alert.*")
+
+	if w := doRequest(t, router, http.MethodPut, "/api/v1/users/"+alice.ID, map[string]string{"name": "Alice"}, bearer(aliceToken)...); w.Code != http.StatusOK {
+		t.Fatalf("update user = %d: %s", w.Code, w.Body)
+	}
+	w := doRequest(t, router, http.MethodPost, "/api/v1/webhooks", map[string]interface{}{
+		"url":    "http://127.0.0.1:9/alice",
+		"events": []string{"user.*", "webhook.*"},
+	}, bearer(aliceToken)...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create webhook = %d: %s", w.Code, w.Body)
+	}
+	aliceWebhook := decodeBody(t, w)["id"].(string)
+	createResource(t, router, aliceToken, "/api/v1/alerts", map[string]string{"title": "shared", "description": "test", "severity": "low"})
+
+	for i := 0; i < 3; i++ {
+		triggerWebhook(nextEvent(t, events))
+	}
+
+	if got := deliveredTypes(d, "wh_bob"); len(got) != 1 || !got[EventAlertCreated] {
+		t.Errorf("bob's webhook received %v, want only %s", got, EventAlertCreated)
+	}
+	if got := deliveredTypes(d, aliceWebhook); !got[EventUserUpdated] || !got[EventWebhookCreated] {
+		t.Errorf("alice's webhook received %v, want her own %s and %s", got, EventUserUpdated, EventWebhookCreated)
+	}
+}
+
+func TestWebhookEventValidation(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+	useTestWebhooks(t)
+
+	tests := []struct {
+		events []string
+		status int
+	}{
+		{[]string{"*"}, http.StatusCreated},
+		{[]string{"alert.*", "user.updated"}, http.StatusCreated},
+		{[]string{"backup.*"}, http.StatusBadRequest},
+		{[]string{"backup.created"}, http.StatusBadRequest},
+		{[]string{"alert.*", "alerts.created"}, http.StatusBadRequest},
+		{[]string{}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := map[string]interface{}{"url": "http://127.0.0.1:9/hook", "events": tt.events}
+		if w := doRequest(t, router, http.MethodPost, "/api/v1/webhooks", body, bearer(token)...); w.Code != tt.status {
+			t.Errorf("create with events %v = %d, want %d: %s", tt.events, w.Code, tt.status, w.Body)
+		}
+	}
+
+	webhooksMux.RLock()
+	var id string
+	for id = range webhooks {
+		break
+	}
+	webhooksMux.RUnlock()
+	if w := doRequest(t, router, http.MethodPut, "/api/v1/webhooks/"+id, map[string]interface{}{"events": []string{"backup.*"}}, bearer(token)...); w.Code != http.StatusBadRequest {
+		t.Errorf("update to backup.* = %d, want 400", w.Code)
+	}
+}
+
+func TestWebhookIDsAreUnique(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+	useTestWebhooks(t)
+
+	// All within the same second, which used to hand out one ID
+	for i := 0; i < 5; i++ {
+		body := map[string]interface{}{"url": "http://127.0.0.1:9/hook", "events": []string{"*"}}
+		if w := doRequest(t, router, http.MethodPost, "/api/v1/webhooks", body, bearer(token)...); w.Code != http.StatusCreated {
+			t.Fatalf("create = %d: %s", w.Code, w.Body)
+		}
+	}
+
+	webhooksMux.RLock()
+	defer webhooksMux.RUnlock()
+	if len(webhooks) != 5 {
+		t.Errorf("stored %d webhooks after 5 creates", len(webhooks))
+	}
+}
+
+func TestWebhookTemplateParsedOnSave(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+	useTestWebhooks(t)
+
+	w := doRequest(t, router, http.MethodPost, "/api/v1/webhooks", map[string]interface{}{
+		"url":      "http://127.0.0.1:9/hook",
+		"events":   []string{"alert.*"},
+		"format":   WebhookFormatTemplate,
+		"template": `{"text": {{json .Summary}}}`,
+	}, bearer(token)...)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", w.Code, w.Body)
+	}
+	id := decodeBody(t, w)["id"].(string)
+
+	webhooksMux.Lock()
+	webhook := webhooks[id]
+	// Rendering must use the template parsed on save rather than parse the
+	// source again for every event
+	webhook.Template = "{{"
+	payload, err := renderWebhookPayload(webhook, sampleWebhookEvent(EventAlertCreated))
+	webhooksMux.Unlock()
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if string(payload) != `{"text": "[HIGH] alert.created: Suspicious outbound connection"}` {
+		t.Errorf("payload = %s", payload)
+	}
+
+	w = doRequest(t, router, http.MethodPut, "/api/v1/webhooks/"+id, map[string]interface{}{"template": `{"event": {{json .Type}}}`}, bearer(token)...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update = %d: %s", w.Code, w.Body)
+	}
+	webhooksMux.RLock()
+	payload, err = renderWebhookPayload(webhooks[id], sampleWebhookEvent(EventAlertCreated))
+	webhooksMux.RUnlock()
+	if err != nil || string(payload) != `{"event": "alert.created"}` {
+		t.Errorf("payload after update = %s, %v", payload, err)
+	}
+
+	// Webhooks loaded from the store get their template parsed too
+	d := webhookDispatcher
+	d.path = filepath.Join(t.TempDir(), "webhooks.json")
+	if err := d.save(); err != nil {
+		t.Fatal(err)
+	}
+	webhooksMux.Lock()
+	webhooks = make(map[string]*Webhook)
+	webhooksMux.Unlock()
+	if err := d.load(); err != nil {
+		t.Fatal(err)
+	}
+	webhooksMux.RLock()
+	payload, err = renderWebhookPayload(webhooks[id], sampleWebhookEvent(EventAlertCreated))
+	webhooksMux.RUnlock()
+	if err != nil || string(payload) != `{"event": "alert.created"}` {
+		t.Errorf("payload after reload = %s, %v", payload, err)
+	}
+}
+
+func TestRejectedWebhookUpdateChangesNothing(t *testing.T) {
+	router := newRouter()
+	_, token := testUser(t, "analyst")
+	useTestWebhooks(t)
+
+	id := createResource(t, router, token, "/api/v1/webhooks", map[string]interface{}{
+		"url":    "http://127.0.0.1:9/hook",
+		"events": []string{"alert.*"},
+	})
+
+	// PagerDuty needs a routing key, so the whole update is refused
+	w := doRequest(t, router, http.MethodPut, "/api/v1/webhooks/"+id, map[string]interface{}{
+		"url":     "http://127.0.0.1:9/new",
+		"events":  []string{"threat.*"},
+		"enabled": false,
+		"format":  WebhookFormatPagerDuty,
+	}, bearer(token)...)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("update = %d, want 400: %s", w.Code, w.Body)
+	}
+
+	webhooksMux.RLock()
+	defer webhooksMux.RUnlock()
+	webhook := webhooks[id]
+	if webhook.URL != "http://127.0.0.1:9/hook" || webhook.Events[0] != "alert.*" || !webhook.Enabled || webhook.Format != WebhookFormatGeneric {
+		t.Errorf("rejected update changed the webhook: %+v", webhook)
+	}
+}
+
+func TestTruncateKeepsCharactersWhole(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"a longer summary", 10, "a longe..."},
+		{"Überwachung läuft", 8, "Überw..."},
+		{"攻撃を検知しました", 6, "攻撃を..."},
+	}
+	for _, tt := range tests {
+		got := truncate(tt.in, tt.n)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
@@ -1,80 +1,250 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = 54 * time.Second
+	wsMaxMessageSize = 4096
+)
+
+// defaultAllowedOrigins are the dashboard origins accepted for CORS and websockets
+var defaultAllowedOrigins = []string{"http://localhost:3000", "http://localhost:3001", "http://localhost:4200"}
+
+var wsAllowedOrigins = getEnvList("WS_ALLOWED_ORIGINS", defaultAllowedOrigins)
+
+// wsStatsInterval is how often live network statistics are pushed
+var wsStatsInterval = getEnvDuration("WS_STATS_INTERVAL", 2*time.Second)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins in development
-	},
+	CheckOrigin:     checkWebsocketOrigin,
 }
 
-// WebSocket handler for real-time updates
-func websocketHandler(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
-		return
+// checkWebsocketOrigin accepts non-browser clients, same-host pages and the
+// configured dashboard origins
+func checkWebsocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
 	}
-	defer conn.Close()
 
-	// Create client
-	client := &Client{
-		conn: conn,
-		send: make(chan []byte, 256),
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
 	}
 
-	// Start goroutines for reading and writing
-	go client.writePump()
-	go client.readPump()
-
-	// Send initial connection message
-	client.send <- []byte(`{"type":"connected","message":"WebSocket connection established"}`)
+	for _, allowed := range wsAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Simulate real-time updates
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+// Websocket topics. Alerts and threats can also be followed individually
+// with "alert:<id>" and "threat:<id>".
+var wsTopics = map[string]bool{
+	"alerts":        true,
+	"threats":       true,
+	"stats":         true,
+	"notifications": true,
+	"firewall":      true,
+	"network":       true,
+	"detection":     true,
+	"intel":         true,
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			// Send periodic updates
-			update := `{
-				"type": "stats_update",
-				"data": {
-					"packets_captured": 15234,
-					"alerts_count": 42,
-					"timestamp": "` + time.Now().Format(time.RFC3339) + `"
-				}
-			}`
-			client.send <- []byte(update)
+// validTopic reports whether clients may subscribe to a topic
+func validTopic(topic string) bool {
+	if wsTopics[topic] {
+		return true
+	}
+	for _, prefix := range []string{"alert:", "threat:"} {
+		if strings.HasPrefix(topic, prefix) && len(topic) > len(prefix) {
+			return true
 		}
 	}
+	return false
+}
+
+// eventTopics returns the websocket topics an event is published on. Events
+// about users, API keys, webhooks and backups are not pushed to websockets.
+func eventTopics(event Event) []string {
+	switch event.Resource {
+	case "alert":
+		return []string{"alerts", "alert:" + event.ResourceID}
+	case "threat":
+		return []string{"threats", "threat:" + event.ResourceID}
+	case "firewall_rule":
+		return []string{"firewall"}
+	case "network":
+		return []string{"network"}
+	case "detection_rules":
+		return []string{"detection"}
+	case "intel_feed":
+		return []string{"intel"}
+	}
+	return nil
 }
 
 // Client represents a WebSocket client
 type Client struct {
-	conn *websocket.Conn
-	send chan []byte
+	conn        *websocket.Conn
+	send        chan []byte
+	userID      string
+	topics      map[string]bool
+	resumeEpoch string
+	resumeFrom  int64
+	closed      bool
+	mu          sync.Mutex
+}
+
+// enqueue queues a message without blocking; it reports false when the
+// client is closed or its buffer is full
+func (c *Client) enqueue(message []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the write pump; it is safe to call more than once
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// resuming reports whether the client asked to resume a previous stream
+func (c *Client) resuming() bool {
+	return c.resumeEpoch != "" || c.resumeFrom > 0
 }
 
-// readPump pumps messages from the websocket connection to the hub
+// subscribed reports whether the client follows any of the topics
+func (c *Client) subscribed(topics []string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, topic := range topics {
+		if c.topics[topic] {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptions returns the client's topics in order
+func (c *Client) subscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// wsControl is a control message sent by a client
+type wsControl struct {
+	Action string   `json:"action"`
+	Topics []string `json:"topics"`
+}
+
+// reply sends a JSON control response to the client
+func (c *Client) reply(message gin.H) {
+	data, err := json.Marshal(message)
+	if err == nil {
+		c.enqueue(data)
+	}
+}
+
+// handleControl applies a subscribe/unsubscribe/ping/list message
+func (c *Client) handleControl(raw []byte) {
+	var msg wsControl
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		c.reply(gin.H{"type": "error", "error": "invalid message: " + err.Error()})
+		return
+	}
+
+	switch msg.Action {
+	case "subscribe":
+		var invalid []string
+		c.mu.Lock()
+		for _, topic := range msg.Topics {
+			if validTopic(topic) {
+				c.topics[topic] = true
+			} else {
+				invalid = append(invalid, topic)
+			}
+		}
+		c.mu.Unlock()
+		if len(invalid) > 0 {
+			c.reply(gin.H{"type": "error", "error": "unknown topics", "topics": invalid})
+		}
+		c.reply(gin.H{"type": "subscribed", "topics": c.subscriptions()})
+	case "unsubscribe":
+		c.mu.Lock()
+		for _, topic := range msg.Topics {
+			delete(c.topics, topic)
+		}
+		c.mu.Unlock()
+		c.reply(gin.H{"type": "unsubscribed", "topics": c.subscriptions()})
+	case "list":
+		c.reply(gin.H{"type": "subscriptions", "topics": c.subscriptions()})
+	case "ping":
+		c.reply(gin.H{"type": "pong", "timestamp": time.Now().Unix()})
+	default:
+		c.reply(gin.H{"type": "error", "error": "unknown action " + msg.Action})
+	}
+}
+
+// readPump reads control messages until the connection closes
 func (c *Client) readPump() {
 	defer func() {
+		hub.unregister <- c
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
 		return nil
 	})
 
@@ -87,16 +257,13 @@ func (c *Client) readPump() {
 			break
 		}
 
-		log.Printf("Received message: %s", message)
-
-		// Echo back for now
-		c.send <- message
+		c.handleControl(message)
 	}
 }
 
 // writePump pumps messages from the hub to the websocket connection
 func (c *Client) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
+	ticker := time.NewTicker(wsPingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -105,31 +272,18 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued messages to the current websocket message
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -137,151 +291,312 @@ func (c *Client) writePump() {
 	}
 }
 
-// Hub maintains the set of active clients and broadcasts messages to the clients
+// hubMessage is a message for every client subscribed to one of its topics.
+// When userID is set only that user's clients receive it. Ephemeral messages
+// are not kept for replay.
+type hubMessage struct {
+	topics    []string
+	userID    string
+	payload   gin.H
+	ephemeral bool
+}
+
+// Hub maintains the set of active clients and routes messages to them by
+// topic. Every message gets the next sequence number and is kept in a
+// per-topic replay buffer so reconnecting clients can resume. Sequence
+// numbers restart with the process and differ between replicas, so they are
+// only meaningful together with the hub's epoch.
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	broadcast  chan hubMessage
 	register   chan *Client
 	unregister chan *Client
+	epoch      string
+	seq        int64
+	buffers    map[string]*replayBuffer
+	replaySize int
+	lastSeq    atomic.Int64
+	connected  atomic.Int64
+	sent       atomic.Int64
+	dropped    atomic.Int64
 }
 
+// hub is the single websocket hub shared by all endpoints
+var hub = newHub()
+
 func newHub() *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		broadcast:  make(chan hubMessage, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
+		epoch:      generateHubEpoch(),
+		buffers:    make(map[string]*replayBuffer),
+		replaySize: getEnvInt("WS_REPLAY_BUFFER", 500),
 	}
 }
 
+// generateHubEpoch creates the random ID that scopes a hub's sequence numbers
+func generateHubEpoch() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			if client.resuming() && !h.resume(client) {
+				h.dropped.Add(1)
+				client.close()
+				delete(h.clients, client)
+			}
+			h.connected.Store(int64(len(h.clients)))
+			websocketConnections.WithLabelValues("events").Set(float64(len(h.clients)))
 
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				close(client.send)
+				client.close()
 			}
+			h.connected.Store(int64(len(h.clients)))
+			websocketConnections.WithLabelValues("events").Set(float64(len(h.clients)))
 
 		case message := <-h.broadcast:
+			h.seq++
+			h.lastSeq.Store(h.seq)
+			message.payload["seq"] = h.seq
+			data, err := json.Marshal(message.payload)
+			if err != nil {
+				log.Printf("Failed to encode websocket message: %v", err)
+				continue
+			}
+			if !message.ephemeral {
+				h.record(replayEntry{seq: h.seq, topics: message.topics, userID: message.userID, data: data})
+			}
+
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				if message.userID != "" && client.userID != message.userID {
+					continue
+				}
+				if !client.subscribed(message.topics) {
+					continue
 				}
+				if client.enqueue(data) {
+					h.sent.Add(1)
+					continue
+				}
+				// Slow client: drop it rather than stall everyone else
+				h.dropped.Add(1)
+				client.close()
+				delete(h.clients, client)
 			}
+			h.connected.Store(int64(len(h.clients)))
+			websocketConnections.WithLabelValues("events").Set(float64(len(h.clients)))
 		}
 	}
 }
 
-// Stats WebSocket handler - sends real-time statistics
-func statsWebSocketHandler(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
+// publish queues a message for routing without blocking the caller
+func (h *Hub) publish(message hubMessage) {
+	select {
+	case h.broadcast <- message:
+	default:
+		h.dropped.Add(1)
+	}
+}
+
+// Stats returns connection and delivery counters
+func (h *Hub) Stats() gin.H {
+	return gin.H{
+		"connected": h.connected.Load(),
+		"epoch":     h.epoch,
+		"seq":       h.lastSeq.Load(),
+		"sent":      h.sent.Load(),
+		"dropped":   h.dropped.Load(),
+	}
+}
+
+// broadcastEvent forwards a bus event to clients subscribed to its topics
+func broadcastEvent(event Event) {
+	topics := eventTopics(event)
+	if len(topics) == 0 {
 		return
 	}
-	defer conn.Close()
+	hub.publish(hubMessage{topics: topics, payload: gin.H{"type": "event", "topic": topics[0], "event": event}})
+}
 
-	log.Println("Stats WebSocket client connected")
+// broadcastNotification pushes a notification to its recipient's clients
+func broadcastNotification(notif *Notification) {
+	hub.publish(hubMessage{
+		topics:  []string{"notifications"},
+		userID:  notif.UserID,
+		payload: gin.H{"type": "notification", "topic": "notifications", "notification": notif},
+	})
+}
 
-	// Send stats updates every 2 seconds
-	ticker := time.NewTicker(2 * time.Second)
+// publishStats pushes live network statistics while anyone is connected
+func publishStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	// Channel to signal when to stop
-	done := make(chan struct{})
-
-	// Read pump to detect client disconnect
-	go func() {
-		for {
-			if _, _, err := conn.ReadMessage(); err != nil {
-				close(done)
-				return
-			}
+	for range ticker.C {
+		if hub.connected.Load() == 0 {
+			continue
 		}
-	}()
 
-	for {
-		select {
-		case <-done:
-			log.Println("Stats WebSocket client disconnected")
-			return
-		case <-ticker.C:
-			stats := map[string]interface{}{
-				"packets_per_second": 1234.5 + float64(time.Now().Second()%100),
-				"bytes_per_second":   5242880 + (time.Now().Unix() % 1000000),
-				"active_connections": 42 + (time.Now().Second() % 20),
-				"threats_detected":   7 + (time.Now().Second() % 10),
-				"timestamp":          time.Now().Unix(),
-			}
+		inbound, outbound, bytesPerSecond, packetsPerSecond := flowStats.Rates()
+
+		dataMux.RLock()
+		threatCount := len(threats)
+		dataMux.RUnlock()
+
+		hub.publish(hubMessage{topics: []string{"stats"}, ephemeral: true, payload: gin.H{
+			"type":  "stats",
+			"topic": "stats",
+			"data": gin.H{
+				"packets_per_second":  packetsPerSecond,
+				"bytes_per_second":    bytesPerSecond,
+				"inbound_per_second":  inbound,
+				"outbound_per_second": outbound,
+				"active_connections":  flowStats.ActiveFlows(),
+				"threats_detected":    threatCount,
+				"timestamp":           time.Now().Unix(),
+			},
+		}})
+	}
+}
 
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := conn.WriteJSON(stats); err != nil {
-				log.Printf("Error sending stats: %v", err)
-				return
-			}
+// websocketCredentials returns the API key and token of a websocket request.
+// Browsers cannot set headers on websocket requests, so they may also be
+// passed as the "api_key" or "token" query parameter.
+func websocketCredentials(c *gin.Context) (apiKey, token string) {
+	apiKey = c.GetHeader("X-API-Key")
+	if apiKey == "" {
+		apiKey = c.Query("api_key")
+	}
+	token = bearerToken(c.GetHeader("Authorization"))
+	if token == "" {
+		token = c.Query("token")
+	}
+	return apiKey, token
+}
+
+// websocketUser authenticates a websocket request
+func websocketUser(c *gin.Context) (*User, bool) {
+	user, _, ok := authenticateCredentials(websocketCredentials(c))
+	return user, ok
+}
+
+// requestedTopics returns the "topics" query parameter or the defaults,
+// answering 400 for unknown topics
+func requestedTopics(c *gin.Context, defaults []string) (map[string]bool, bool) {
+	requested := defaults
+	if q := c.Query("topics"); q != "" {
+		requested = strings.Split(q, ",")
+	}
+
+	topics := map[string]bool{}
+	for _, topic := range requested {
+		topic = strings.TrimSpace(topic)
+		if !validTopic(topic) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown topic " + topic})
+			return nil, false
 		}
+		topics[topic] = true
 	}
+	return topics, true
 }
 
-// Threats WebSocket handler - sends real-time threat alerts
-func threatsWebSocketHandler(c *gin.Context) {
+// parseResumeFrom parses the "<epoch>:<seq>" position a client last
+// received. A bare sequence number is accepted but has no epoch, so it can
+// never be resumed from and is answered with a gap.
+func parseResumeFrom(value string) (string, int64, error) {
+	if value == "" {
+		return "", 0, nil
+	}
+	epoch, number, found := strings.Cut(value, ":")
+	if !found {
+		epoch, number = "", value
+	}
+	seq, err := strconv.ParseInt(number, 10, 64)
+	if err == nil && seq < 0 {
+		err = strconv.ErrRange
+	}
+	return epoch, seq, err
+}
+
+// resumePosition formats a hub position as accepted by parseResumeFrom
+func resumePosition(epoch string, seq int64) string {
+	return epoch + ":" + strconv.FormatInt(seq, 10)
+}
+
+// serveWebsocket authenticates and upgrades a connection, subscribing it to
+// the "topics" query parameter or the endpoint's default topics. A client
+// that reconnects with "resume_from=<epoch>:<last seq>" is sent what it
+// missed.
+func serveWebsocket(c *gin.Context, defaultTopics []string) {
+	user, ok := websocketUser(c)
+	if !ok {
+		authFailuresTotal.WithLabelValues(credentialFailure(websocketCredentials(c))).Inc()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required. Provide valid token or API key"})
+		return
+	}
+
+	topics, ok := requestedTopics(c, defaultTopics)
+	if !ok {
+		return
+	}
+
+	resumeEpoch, resumeFrom, err := parseResumeFrom(c.Query("resume_from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "resume_from must be <epoch>:<sequence number>"})
+		return
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v", err)
 		return
 	}
-	defer conn.Close()
 
-	log.Println("Threats WebSocket client connected")
+	client := &Client{
+		conn:        conn,
+		send:        make(chan []byte, 1024),
+		userID:      user.ID,
+		topics:      topics,
+		resumeEpoch: resumeEpoch,
+		resumeFrom:  resumeFrom,
+	}
 
-	// Send threat updates every 10 seconds
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	client.reply(gin.H{
+		"type":    "connected",
+		"message": "WebSocket connection established",
+		"topics":  client.subscriptions(),
+		"epoch":   hub.epoch,
+		"seq":     hub.lastSeq.Load(),
+	})
 
-	// Channel to signal when to stop
-	done := make(chan struct{})
+	hub.register <- client
+	websocketConnectionsTotal.WithLabelValues("events").Inc()
 
-	// Read pump to detect client disconnect
-	go func() {
-		for {
-			if _, _, err := conn.ReadMessage(); err != nil {
-				close(done)
-				return
-			}
-		}
-	}()
+	go client.writePump()
+	go client.readPump()
+}
 
-	threatTypes := []string{"Port Scan", "Brute Force", "DDoS Attack", "SQL Injection", "XSS Attack"}
-	severities := []string{"low", "medium", "high", "critical"}
-	sourceIPs := []string{"192.168.1.100", "10.0.0.50", "172.16.0.25", "203.0.113.42"}
+// WebSocket handler for real-time updates
+func websocketHandler(c *gin.Context) {
+	serveWebsocket(c, []string{"alerts", "threats", "notifications"})
+}
 
-	for {
-		select {
-		case <-done:
-			log.Println("Threats WebSocket client disconnected")
-			return
-		case <-ticker.C:
-			threat := map[string]interface{}{
-				"threat_type":    threatTypes[time.Now().Second()%len(threatTypes)],
-				"severity":       severities[time.Now().Second()%len(severities)],
-				"source_ip":      sourceIPs[time.Now().Second()%len(sourceIPs)],
-				"destination_ip": "192.168.1.1",
-				"port":           22 + (time.Now().Second() % 100),
-				"timestamp":      time.Now().Format(time.RFC3339),
-			}
+// Stats WebSocket handler - subscribes to real-time statistics
+func statsWebSocketHandler(c *gin.Context) {
+	serveWebsocket(c, []string{"stats"})
+}
 
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := conn.WriteJSON(threat); err != nil {
-				log.Printf("Error sending threat: %v", err)
-				return
-			}
-		}
-	}
+// Threats WebSocket handler - subscribes to threat events
+func threatsWebSocketHandler(c *gin.Context) {
+	serveWebsocket(c, []string{"threats"})
 }
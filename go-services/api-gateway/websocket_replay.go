@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// replayEntry is a delivered websocket message kept for clients that reconnect
+type replayEntry struct {
+	seq    int64
+	topics []string
+	userID string
+	data   []byte
+}
+
+// replayBuffer is a fixed-size ring of the most recent messages on one topic
+type replayBuffer struct {
+	entries []replayEntry
+	start   int
+	size    int
+	evicted int64 // highest sequence number pushed out of the ring
+}
+
+func newReplayBuffer(capacity int) *replayBuffer {
+	return &replayBuffer{entries: make([]replayEntry, capacity)}
+}
+
+func (b *replayBuffer) add(entry replayEntry) {
+	if len(b.entries) == 0 {
+		b.evicted = entry.seq
+		return
+	}
+	if b.size == len(b.entries) {
+		b.evicted = b.entries[b.start].seq
+		b.entries[b.start] = entry
+		b.start = (b.start + 1) % len(b.entries)
+		return
+	}
+	b.entries[(b.start+b.size)%len(b.entries)] = entry
+	b.size++
+}
+
+// since calls fn for every buffered entry newer than seq, oldest first
+func (b *replayBuffer) since(seq int64, fn func(replayEntry)) {
+	for i := 0; i < b.size; i++ {
+		entry := b.entries[(b.start+i)%len(b.entries)]
+		if entry.seq > seq {
+			fn(entry)
+		}
+	}
+}
+
+// replayTopic maps a subscription to the buffer that stores its messages;
+// per-resource topics share the buffer of their collection
+func replayTopic(topic string) string {
+	switch {
+	case strings.HasPrefix(topic, "alert:"):
+		return "alerts"
+	case strings.HasPrefix(topic, "threat:"):
+		return "threats"
+	}
+	return topic
+}
+
+// record stores a message in its primary topic's replay buffer. Must be
+// called from the hub's run loop.
+func (h *Hub) record(entry replayEntry) {
+	topic := replayTopic(entry.topics[0])
+	buffer, ok := h.buffers[topic]
+	if !ok {
+		buffer = newReplayBuffer(h.replaySize)
+		h.buffers[topic] = buffer
+	}
+	buffer.add(entry)
+}
+
+// resume replays the messages a reconnecting client missed, or tells it to
+// refetch when they are no longer buffered. Must be called from the hub's
+// run loop so no live message is delivered twice or skipped.
+func (h *Hub) resume(client *Client) bool {
+	from := client.resumeFrom
+	seen := map[string]bool{}
+	var gaps []string
+	var missed []replayEntry
+
+	for _, topic := range client.subscriptions() {
+		topic = replayTopic(topic)
+		if seen[topic] || topic == "stats" {
+			continue
+		}
+		seen[topic] = true
+
+		buffer, ok := h.buffers[topic]
+		if !ok {
+			continue
+		}
+		if buffer.evicted > from {
+			gaps = append(gaps, topic)
+		}
+		buffer.since(from, func(entry replayEntry) {
+			if entry.userID != "" && entry.userID != client.userID {
+				return
+			}
+			if client.subscribed(entry.topics) {
+				missed = append(missed, entry)
+			}
+		})
+	}
+
+	// Sequence numbers from another process or replica say nothing about
+	// what this hub sent
+	if client.resumeEpoch != h.epoch || from > h.seq {
+		gaps = []string{"*"}
+		missed = nil
+	}
+
+	if len(missed) > cap(client.send)/2 {
+		gaps = append(gaps, "*")
+		missed = nil
+	}
+
+	if len(gaps) > 0 {
+		sort.Strings(gaps)
+		client.reply(gin.H{
+			"type":        "gap",
+			"epoch":       h.epoch,
+			"seq":         h.seq,
+			"resume_from": from,
+			"topics":      gaps,
+			"message":     "Missed events are no longer available, refetch current state",
+		})
+		if missed == nil {
+			return true
+		}
+	}
+
+	sort.Slice(missed, func(i, j int) bool { return missed[i].seq < missed[j].seq })
+	for _, entry := range missed {
+		if !client.enqueue(entry.data) {
+			return false
+		}
+	}
+
+	client.reply(gin.H{
+		"type":        "resumed",
+		"epoch":       h.epoch,
+		"seq":         h.seq,
+		"resume_from": from,
+		"replayed":    len(missed),
+	})
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// testReplayHub returns a hub, not running, whose buffers hold capacity
+// messages per topic
+func testReplayHub(capacity int) *Hub {
+	h := newHub()
+	h.replaySize = capacity
+	return h
+}
+
+// recordMessage stores a message as the hub's run loop would
+func recordMessage(h *Hub, topic, userID string) {
+	h.seq++
+	data := fmt.Sprintf(`{"type":"event","topic":%q,"seq":%d}`, topic, h.seq)
+	h.record(replayEntry{seq: h.seq, topics: []string{topic}, userID: userID, data: []byte(data)})
+}
+
+// resumingClient is a client reconnecting from position epoch:from
+func resumingClient(userID, epoch string, from int64, topics ...string) *Client {
+	client := &Client{send: make(chan []byte, 100), userID: userID, topics: map[string]bool{}, resumeEpoch: epoch, resumeFrom: from}
+	for _, topic := range topics {
+		client.topics[topic] = true
+	}
+	return client
+}
+
+// sentMessages drains and decodes everything queued for a client
+func sentMessages(t *testing.T, client *Client) []map[string]interface{} {
+	t.Helper()
+
+	var messages []map[string]interface{}
+	for {
+		select {
+		case data := <-client.send:
+			var message map[string]interface{}
+			if err := json.Unmarshal(data, &message); err != nil {
+				t.Fatalf("decoding %s: %v", data, err)
+			}
+			messages = append(messages, message)
+		default:
+			return messages
+		}
+	}
+}
+
+// replayedSeqs returns the sequence numbers of replayed events
+func replayedSeqs(messages []map[string]interface{}) []int64 {
+	var seqs []int64
+	for _, message := range messages {
+		if message["type"] == "event" {
+			seqs = append(seqs, int64(message["seq"].(float64)))
+		}
+	}
+	return seqs
+}
+
+func TestReplayBufferEviction(t *testing.T) {
+	buffer := newReplayBuffer(3)
+	for seq := int64(1); seq <= 5; seq++ {
+		buffer.add(replayEntry{seq: seq})
+	}
+
+	if buffer.evicted != 2 {
+		t.Errorf("evicted = %d, want 2", buffer.evicted)
+	}
+	var seqs []int64
+	buffer.since(0, func(entry replayEntry) { seqs = append(seqs, entry.seq) })
+	if fmt.Sprint(seqs) != "[3 4 5]" {
+		t.Errorf("buffered %v, want [3 4 5]", seqs)
+	}
+	seqs = nil
+	buffer.since(4, func(entry replayEntry) { seqs = append(seqs, entry.seq) })
+	if fmt.Sprint(seqs) != "[5]" {
+		t.Errorf("since(4) = %v, want [5]", seqs)
+	}
+}
+
+func TestResumeReplaysMissedMessages(t *testing.T) {
+	h := testReplayHub(10)
+	for i := 0; i < 4; i++ {
+		recordMessage(h, "alerts", "")
+	}
+	recordMessage(h, "threats", "")
+
+	client := resumingClient("user_1", h.epoch, 2, "alerts")
+	if !h.resume(client) {
+		t.Fatal("resume failed")
+	}
+	messages := sentMessages(t, client)
+	if got := replayedSeqs(messages); fmt.Sprint(got) != "[3 4]" {
+		t.Errorf("replayed %v, want [3 4]", got)
+	}
+	if last := messages[len(messages)-1]; last["type"] != "resumed" || last["epoch"] != h.epoch {
+		t.Errorf("last message = %v, want resumed in epoch %s", last, h.epoch)
+	}
+}
+
+func TestResumeGapWhenEvicted(t *testing.T) {
+	h := testReplayHub(2)
+	for i := 0; i < 5; i++ {
+		recordMessage(h, "alerts", "")
+	}
+
+	client := resumingClient("user_1", h.epoch, 1, "alerts")
+	if !h.resume(client) {
+		t.Fatal("resume failed")
+	}
+	messages := sentMessages(t, client)
+	if messages[0]["type"] != "gap" || fmt.Sprint(messages[0]["topics"]) != "[alerts]" {
+		t.Errorf("first message = %v, want a gap on alerts", messages[0])
+	}
+	// What is still buffered is replayed after the gap
+	if got := replayedSeqs(messages); fmt.Sprint(got) != "[4 5]" {
+		t.Errorf("replayed %v, want [4 5]", got)
+	}
+}
+
+func TestResumeGapFromAnotherEpoch(t *testing.T) {
+	h := testReplayHub(10)
+	for i := 0; i < 5; i++ {
+		recordMessage(h, "alerts", "")
+	}
+
+	// A restarted gateway or another replica has its own sequence numbers,
+	// even when they have already passed the client's
+	positions := map[string]*Client{
+		"other epoch": resumingClient("user_1", "0123456789abcdef", 2, "alerts"),
+		"no epoch":    resumingClient("user_1", "", 2, "alerts"),
+	}
+	for name, client := range positions {
+		if !h.resume(client) {
+			t.Fatalf("%s: resume failed", name)
+		}
+		messages := sentMessages(t, client)
+		if len(messages) != 1 || messages[0]["type"] != "gap" || fmt.Sprint(messages[0]["topics"]) != "[*]" {
+			t.Errorf("%s: sent %v, want only a gap on every topic", name, messages)
+		}
+	}
+}
+
+func TestResumeFiltersNotificationsByUser(t *testing.T) {
+	h := testReplayHub(10)
+	recordMessage(h, "notifications", "user_alice")
+	recordMessage(h, "notifications", "user_bob")
+	recordMessage(h, "notifications", "user_alice")
+
+	client := resumingClient("user_alice", h.epoch, 0, "notifications")
+	if !h.resume(client) {
+		t.Fatal("resume failed")
+	}
+	if got := replayedSeqs(sentMessages(t, client)); fmt.Sprint(got) != "[1 3]" {
+		t.Errorf("alice was replayed %v, want [1 3]", got)
+	}
+}
+
+func TestParseResumeFrom(t *testing.T) {
+	tests := []struct {
+		value string
+		epoch string
+		seq   int64
+		err   bool
+	}{
+		{"", "", 0, false},
+		{"abc:42", "abc", 42, false},
+		{"42", "", 42, false},
+		{"abc:-1", "", 0, true},
+		{"abc:x", "", 0, true},
+	}
+	for _, tt := range tests {
+		epoch, seq, err := parseResumeFrom(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("parseResumeFrom(%q) error = %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if err == nil && (epoch != tt.epoch || seq != tt.seq) {
+			t.Errorf("parseResumeFrom(%q) = %q, %d; want %q, %d", tt.value, epoch, seq, tt.epoch, tt.seq)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
@@ -13,8 +14,8 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -26,7 +27,11 @@ var (
 	firewallServiceURL = getEnv("FIREWALL_SERVICE_URL", "http://localhost:8084")
 )
 
+const requestIDHeader = "X-Request-ID"
+
 func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)).With("service", "api-gateway"))
+
 	app := fiber.New(fiber.Config{
 		AppName:      "NetGuard API Gateway v2.0",
 		ErrorHandler: customErrorHandler,
@@ -34,12 +39,12 @@ func main() {
 
 	// Middleware
 	app.Use(recover.New())
-	app.Use(logger.New(logger.Config{
-		Format: "[${time}] ${status} - ${method} ${path} (${latency})\n",
-	}))
+	app.Use(requestid.New(requestid.Config{Header: requestIDHeader}))
+	app.Use(requestLogger)
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     getEnv("CORS_ORIGINS", "http://localhost:3000,http://localhost:3001"),
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-Request-ID",
+		ExposeHeaders:    "X-Request-ID",
 		AllowMethods:     "GET, POST, PUT, PATCH, DELETE, OPTIONS",
 		AllowCredentials: true,
 	}))
@@ -104,7 +109,7 @@ func main() {
 	protected.Delete("/users/:id", deleteUser)
 
 	port := getEnv("PORT", "8080")
-	log.Printf("🚀 API Gateway starting on port %s", port)
+	slog.Info("API gateway starting", "port", port)
 	log.Fatal(app.Listen(":" + port))
 }
 
@@ -135,6 +140,49 @@ func authMiddleware(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// requestLogger writes one JSON line per request with its request ID
+func requestLogger(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+	if err != nil {
+		// Let the error handler set the status so it is logged correctly
+		if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+			_ = c.SendStatus(fiber.StatusInternalServerError)
+		}
+		err = nil
+	}
+
+	status := c.Response().StatusCode()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("request_id", requestID(c)),
+		slog.String("method", c.Method()),
+		slog.String("route", c.Route().Path),
+		slog.String("path", c.Path()),
+		slog.Int("status", status),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("client_ip", c.IP()),
+	}
+	if userID, ok := c.Locals("user_id").(string); ok {
+		attrs = append(attrs, slog.String("user_id", userID))
+	}
+	slog.LogAttrs(c.UserContext(), level, "request", attrs...)
+	return err
+}
+
+// requestID returns the ID assigned by the requestid middleware
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("requestid").(string)
+	return id
+}
+
 func proxyRequest(targetURL string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Replace path params
@@ -154,10 +202,12 @@ func proxyRequest(targetURL string) fiber.Handler {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to create request"})
 		}
 
-		// Copy headers
+		// Copy headers, forwarding the request ID so the upstream service's
+		// logs can be matched to this request
 		c.Request().Header.VisitAll(func(key, value []byte) {
 			req.Header.Set(string(key), string(value))
 		})
+		req.Header.Set(requestIDHeader, requestID(c))
 
 		// Send request
 		client := &http.Client{Timeout: 30 * time.Second}